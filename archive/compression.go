@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip", "gz":
+		return CompressionGzip, nil
+	case "zstd", "zst":
+		return CompressionZstd, nil
+	default:
+		return CompressionNone, fmt.Errorf("Unknown compression \"%s\"", s)
+	}
+}
+
+// CompressionFromFilename guesses the compression from the extension of the archive filename.
+func CompressionFromFilename(filename string) Compression {
+	switch {
+	case strings.HasSuffix(filename, ".gz"), strings.HasSuffix(filename, ".tgz"):
+		return CompressionGzip
+	case strings.HasSuffix(filename, ".zst"):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+func (comp Compression) String() string {
+	switch comp {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(comp))
+	}
+}
+
+// Ext returns the filename extension of tar archives with the compression.
+func (comp Compression) Ext() string {
+	switch comp {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionZstd:
+		return ".tar.zst"
+	default:
+		return ".tar"
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer compressing to w. Closing it flushes the compressed stream, but doesn't close w.
+func compressWriter(comp Compression, w io.Writer) (io.WriteCloser, error) {
+	switch comp {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %v", comp)
+	}
+}
+
+type zstdReadCloser struct{ *zstd.Decoder }
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+func decompressReader(comp Compression, r io.Reader) (io.ReadCloser, error) {
+	switch comp {
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %v", comp)
+	}
+}
@@ -0,0 +1,289 @@
+// Package archive streams otaru directories as tar archives, and extracts tar archives into otaru.
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nyaxt/otaru"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+// PAXInodeID is the PAX record of the inode ID the entry had in otaru.
+const PAXInodeID = "OTARU.inode_id"
+
+// extractTmpPrefix is prepended to the name of the directory an archive is extracted into, before it is renamed to the destination.
+const extractTmpPrefix = ".otaru-extract."
+
+var epoch = time.Unix(0, 0)
+
+type tarWriter struct {
+	fs *otaru.FileSystem
+	tw *tar.Writer
+}
+
+func (w *tarWriter) writeHeader(name string, a otaru.Attr) error {
+	hdr := &tar.Header{
+		Name:       name,
+		ModTime:    epoch,
+		PAXRecords: map[string]string{PAXInodeID: strconv.FormatUint(uint64(a.ID), 10)},
+		Format:     tar.FormatPAX,
+	}
+	if a.Type == inodedb.DirNodeT {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		hdr.Mode = 0755
+	} else {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Mode = 0644
+		hdr.Size = a.Size
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Failed to write tar header of \"%s\": %v", name, err)
+	}
+	return nil
+}
+
+func (w *tarWriter) writeFile(fullpath, name string, a otaru.Attr) error {
+	fh, err := w.fs.OpenFile(a.ID, fl.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	// The header is written from the size on open, so that the entry is consistent even if the file is written meanwhile.
+	a.Size = fh.Size()
+	if err := w.writeHeader(name, a); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w.tw, otaru.NewFileHandleIO(fh), a.Size); err != nil {
+		return fmt.Errorf("Failed to archive \"%s\": %v", fullpath, err)
+	}
+	return nil
+}
+
+func (w *tarWriter) writeTree(fullpath, name string, id inodedb.ID) error {
+	a, err := w.fs.Attr(id)
+	if err != nil {
+		return err
+	}
+	if a.Type != inodedb.DirNodeT {
+		return w.writeFile(fullpath, name, a)
+	}
+
+	if name != "" {
+		if err := w.writeHeader(name, a); err != nil {
+			return err
+		}
+	}
+	entries, err := w.fs.DirEntries(id)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for childname := range entries {
+		names = append(names, childname)
+	}
+	sort.Strings(names)
+	for _, childname := range names {
+		if id == inodedb.RootDirID && childname == otaru.TrashDirName {
+			continue
+		}
+		if err := w.writeTree(path.Join(fullpath, childname), path.Join(name, childname), entries[childname]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteTar streams the file or the directory tree at fullpath to w as a tar archive.
+func WriteTar(fs *otaru.FileSystem, fullpath string, w io.Writer, comp Compression) error {
+	id, err := fs.FindNodeFullPath(fullpath)
+	if err != nil {
+		return err
+	}
+
+	cw, err := compressWriter(comp, w)
+	if err != nil {
+		return err
+	}
+	tw := &tarWriter{fs: fs, tw: tar.NewWriter(cw)}
+	name := path.Base(fullpath)
+	if fullpath == "/" {
+		name = ""
+	}
+	if err := tw.writeTree(fullpath, name, id); err != nil {
+		return err
+	}
+	if err := tw.tw.Close(); err != nil {
+		return fmt.Errorf("Failed to close tar writer: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		return fmt.Errorf("Failed to close compressor: %v", err)
+	}
+	return nil
+}
+
+type ExtractStats struct {
+	NumDirs    int   `json:"num_dirs"`
+	NumFiles   int   `json:"num_files"`
+	NumBytes   int64 `json:"num_bytes"`
+	NumSkipped int   `json:"num_skipped"`
+}
+
+type extractor struct {
+	fs    *otaru.FileSystem
+	dirs  map[string]inodedb.ID
+	stats ExtractStats
+}
+
+func (e *extractor) ensureDir(name string) (inodedb.ID, error) {
+	if id, ok := e.dirs[name]; ok {
+		return id, nil
+	}
+	parentID, err := e.ensureDir(path.Dir(name))
+	if err != nil {
+		return 0, err
+	}
+
+	base := path.Base(name)
+	entries, err := e.fs.DirEntries(parentID)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := entries[base]
+	if ok {
+		if isdir, err := e.fs.IsDir(id); err != nil {
+			return 0, err
+		} else if !isdir {
+			return 0, fmt.Errorf("\"%s\" is both a file and a directory in the archive: %v", name, syscall.ENOTDIR)
+		}
+	} else {
+		if id, err = e.fs.CreateDir(parentID, base); err != nil {
+			return 0, err
+		}
+		e.stats.NumDirs++
+	}
+	e.dirs[name] = id
+	return id, nil
+}
+
+func (e *extractor) extractFile(name string, r io.Reader) error {
+	dirID, err := e.ensureDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	entries, err := e.fs.DirEntries(dirID)
+	if err != nil {
+		return err
+	}
+	// Later entries of the same name replace earlier ones, as tar does.
+	id, ok := entries[base]
+	if !ok {
+		if id, err = e.fs.CreateFile(dirID, base); err != nil {
+			return err
+		}
+	}
+
+	fh, err := e.fs.OpenFile(id, fl.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	if err := fh.Truncate(0); err != nil {
+		return err
+	}
+	n, err := io.Copy(otaru.NewFileHandleIO(fh), r)
+	if err != nil {
+		return fmt.Errorf("Failed to extract \"%s\": %v", name, err)
+	}
+	if err := fh.Sync(); err != nil {
+		return err
+	}
+	e.stats.NumFiles++
+	e.stats.NumBytes += n
+	return nil
+}
+
+func (e *extractor) extract(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read tar header: %v", err)
+		}
+
+		// Clean the name against the root, so that entries never escape the destination.
+		name := path.Clean("/" + hdr.Name)[1:]
+		if name == "" {
+			name = "."
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if _, err := e.ensureDir(name); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if name == "." {
+				return fmt.Errorf("Invalid file entry name \"%s\"", hdr.Name)
+			}
+			if err := e.extractFile(name, tr); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping \"%s\" of unsupported type %c in the archive.", hdr.Name, hdr.Typeflag)
+			e.stats.NumSkipped++
+		}
+	}
+}
+
+// ExtractTar extracts the tar archive read from r into a new directory at fullpath, which appears only once the extraction succeeds.
+func ExtractTar(fs *otaru.FileSystem, fullpath string, r io.Reader, comp Compression) (ExtractStats, error) {
+	parentID, base, err := fs.SplitFullPath(fullpath)
+	if err != nil {
+		return ExtractStats{}, err
+	}
+	entries, err := fs.DirEntries(parentID)
+	if err != nil {
+		return ExtractStats{}, err
+	}
+	if _, ok := entries[base]; ok {
+		return ExtractStats{}, otaru.EEXIST
+	}
+
+	dr, err := decompressReader(comp, r)
+	if err != nil {
+		return ExtractStats{}, fmt.Errorf("Failed to init decompressor: %v", err)
+	}
+	defer dr.Close()
+
+	tmpname := fmt.Sprintf("%s%s.%d", extractTmpPrefix, base, time.Now().UnixNano())
+	tmpID, err := fs.CreateDir(parentID, tmpname)
+	if err != nil {
+		return ExtractStats{}, err
+	}
+
+	e := &extractor{fs: fs, dirs: map[string]inodedb.ID{".": tmpID}}
+	err = e.extract(tar.NewReader(dr))
+	if err == nil {
+		err = fs.Rename(parentID, tmpname, parentID, base)
+	}
+	if err != nil {
+		if rerr := fs.RemoveAllNow(parentID, tmpname); rerr != nil {
+			log.Printf("Failed to remove \"%s\" after failed extraction: %v", tmpname, rerr)
+		}
+		return e.stats, err
+	}
+	return e.stats, nil
+}
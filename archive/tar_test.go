@@ -0,0 +1,141 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/archive"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func writeFile(t *testing.T, fs *otaru.FileSystem, p, content string) {
+	fh, err := fs.OpenFileFullPath(p, fl.O_RDWRCREATE, 0666)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath(%s) failed: %v", p, err)
+	}
+	defer fh.Close()
+	if err := fh.PWrite(0, []byte(content)); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+}
+
+func readFile(t *testing.T, fs *otaru.FileSystem, p string) string {
+	fh, err := fs.OpenFileFullPath(p, fl.O_RDONLY, 0666)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath(%s) failed: %v", p, err)
+	}
+	defer fh.Close()
+	b, err := ioutil.ReadAll(otaru.NewFileHandleIO(fh))
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return string(b)
+}
+
+func TestTar_RoundTrip(t *testing.T) {
+	for _, comp := range []archive.Compression{archive.CompressionNone, archive.CompressionGzip, archive.CompressionZstd} {
+		fs := TestFileSystem()
+		for _, p := range []string{"/data", "/data/sub", "/data/empty"} {
+			if _, err := fs.CreateDirFullPath(p); err != nil {
+				t.Fatalf("CreateDirFullPath failed: %v", err)
+			}
+		}
+		writeFile(t, fs, "/data/a.txt", "hello")
+		writeFile(t, fs, "/data/sub/b.txt", "world!")
+
+		var b bytes.Buffer
+		if err := archive.WriteTar(fs, "/data", &b, comp); err != nil {
+			t.Fatalf("[%v] WriteTar failed: %v", comp, err)
+		}
+
+		stats, err := archive.ExtractTar(fs, "/copy", bytes.NewReader(b.Bytes()), comp)
+		if err != nil {
+			t.Fatalf("[%v] ExtractTar failed: %v", comp, err)
+		}
+		if stats.NumDirs != 3 || stats.NumFiles != 2 || stats.NumBytes != 11 {
+			t.Errorf("[%v] Unexpected stats: %+v", comp, stats)
+		}
+		if s := readFile(t, fs, "/copy/data/sub/b.txt"); s != "world!" {
+			t.Errorf("[%v] Unexpected content: %q", comp, s)
+		}
+		if _, err := fs.FindDirFullPath("/copy/data/empty"); err != nil {
+			t.Errorf("[%v] Empty dir not extracted: %v", comp, err)
+		}
+
+		if _, err := archive.ExtractTar(fs, "/copy", bytes.NewReader(b.Bytes()), comp); err != otaru.EEXIST {
+			t.Errorf("[%v] ExtractTar to existing path should fail with EEXIST: %v", comp, err)
+		}
+	}
+}
+
+func TestTar_InodeIDRecord(t *testing.T) {
+	fs := TestFileSystem()
+	fs.EnableTrash(time.Hour)
+	writeFile(t, fs, "/a.txt", "hello")
+	writeFile(t, fs, "/removed.txt", "bye")
+	if err := fs.RemoveAllFullPath("/removed.txt"); err != nil {
+		t.Fatalf("RemoveAllFullPath failed: %v", err)
+	}
+	id, err := fs.FindNodeFullPath("/a.txt")
+	if err != nil {
+		t.Fatalf("FindNodeFullPath failed: %v", err)
+	}
+
+	var b bytes.Buffer
+	if err := archive.WriteTar(fs, "/", &b, archive.CompressionNone); err != nil {
+		t.Fatalf("WriteTar failed: %v", err)
+	}
+	tr := tar.NewReader(&b)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	if hdr.Name != "a.txt" || hdr.Size != 5 {
+		t.Errorf("Unexpected header: %+v", hdr)
+	}
+	if v := hdr.PAXRecords[archive.PAXInodeID]; v != "2" || id != 2 {
+		t.Errorf("Unexpected inode ID record: %q, id: %d", v, id)
+	}
+	// The trash isn't archived.
+	if hdr, err := tr.Next(); err != io.EOF {
+		t.Errorf("Unexpected entry: %+v, %v", hdr, err)
+	}
+}
+
+func TestExtractTar_Failure(t *testing.T) {
+	fs := TestFileSystem()
+	fs.EnableTrash(time.Hour)
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	// Entries escaping the destination are kept inside.
+	tw.WriteHeader(&tar.Header{Name: "../../evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+
+	if _, err := archive.ExtractTar(fs, "/x", bytes.NewReader(b.Bytes()), archive.CompressionNone); err != nil {
+		t.Fatalf("ExtractTar failed: %v", err)
+	}
+	if s := readFile(t, fs, "/x/evil.txt"); s != "evil" {
+		t.Errorf("Unexpected content: %q", s)
+	}
+
+	// A truncated archive leaves nothing behind, not even in the trash.
+	if _, err := archive.ExtractTar(fs, "/y", bytes.NewReader(b.Bytes()[:514]), archive.CompressionNone); err == nil {
+		t.Errorf("ExtractTar of truncated archive should fail")
+	}
+	entries, err := fs.DirEntries(inodedb.RootDirID)
+	if err != nil {
+		t.Fatalf("DirEntries failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Unexpected entries after failed extraction: %v", entries)
+	}
+}
@@ -45,6 +45,11 @@ func (cbv *CachedBackendVersion) Query(blobpath string) (BlobVersion, error) {
 	}
 
 	r, err := cbv.backendbs.OpenReader(blobpath)
+	if err == ENOENT {
+		countBackendRequest(cbv.backendbs, "open_reader", nil)
+	} else {
+		countBackendRequest(cbv.backendbs, "open_reader", err)
+	}
 	if err != nil {
 		if err == ENOENT {
 			cbv.cache[blobpath] = 0
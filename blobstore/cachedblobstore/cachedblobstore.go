@@ -51,6 +51,11 @@ type RemoveBlobRequest struct {
 	resultC  chan error
 }
 
+type FindEntryRequest struct {
+	blobpath string
+	resultC  chan *CachedBlobEntry
+}
+
 type OpenEntryRequest struct {
 	blobpath string
 	resultC  chan interface{}
@@ -81,6 +86,9 @@ func (mgr *CachedBlobEntriesManager) Run() {
 		case *RemoveBlobRequest:
 			req := req.(*RemoveBlobRequest)
 			req.resultC <- mgr.doRemoveBlob(req.blobpath)
+		case *FindEntryRequest:
+			req := req.(*FindEntryRequest)
+			req.resultC <- mgr.entries[req.blobpath]
 		case *OpenEntryRequest:
 			req := req.(*OpenEntryRequest)
 			be, err := mgr.doOpenEntry(req.blobpath)
@@ -150,6 +158,13 @@ func (mgr *CachedBlobEntriesManager) ChooseSyncEntry() *CachedBlobEntry {
 	return <-req.resultC
 }
 
+// FindEntry returns the cache entry of blobpath, or nil if it isn't cached.
+func (mgr *CachedBlobEntriesManager) FindEntry(blobpath string) *CachedBlobEntry {
+	req := &FindEntryRequest{blobpath: blobpath, resultC: make(chan *CachedBlobEntry)}
+	mgr.reqC <- req
+	return <-req.resultC
+}
+
 func (mgr *CachedBlobEntriesManager) doDumpEntriesInfo() []*CachedBlobEntryInfo {
 	infos := make([]*CachedBlobEntryInfo, 0, len(mgr.entries))
 	for _, be := range mgr.entries {
@@ -290,6 +305,9 @@ type CachedBlobStore struct {
 
 	flags int
 
+	muFence  sync.Mutex
+	fenceErr error
+
 	queryVersion QueryVersionFunc
 	bever        *CachedBackendVersion
 
@@ -359,6 +377,7 @@ func (be *CachedBlobEntry) invalidateCache(cbs *CachedBlobStore) error {
 	blobpath := be.blobpath
 
 	backendr, err := cbs.backendbs.OpenReader(blobpath)
+	countBackendRequest(cbs.backendbs, "open_reader", err)
 	if err != nil {
 		return fmt.Errorf("Failed to open backend blob for cache invalidation: %v", err)
 	}
@@ -436,6 +455,11 @@ func (be *CachedBlobEntry) initializeWithLock(cbs *CachedBlobStore) error {
 	be.cachebh = cachebh
 	be.handles = make(map[*CachedBlobHandle]struct{})
 
+	if cachever >= backendver {
+		cacheHits.Inc()
+	} else {
+		cacheMisses.Inc()
+	}
 	if cachever > backendver {
 		log.Printf("FIXME: cache is newer than backend when open")
 		be.state = cacheEntryDirty
@@ -448,6 +472,7 @@ func (be *CachedBlobEntry) initializeWithLock(cbs *CachedBlobStore) error {
 	} else {
 		blobsizer := cbs.backendbs.(blobstore.BlobSizer)
 		be.bloblen, err = blobsizer.BlobSize(be.blobpath)
+		countBackendRequest(cbs.backendbs, "blob_size", err)
 		if err != nil {
 			be.closeWithLock(abandonAndClose)
 			return fmt.Errorf("Failed to query backend blobsize: %v", err)
@@ -483,6 +508,8 @@ func (be *CachedBlobEntry) OpenHandle(cbs *CachedBlobStore, flags int) (*CachedB
 		if err := be.initializeWithLock(cbs); err != nil {
 			return nil, err
 		}
+	} else {
+		cacheHits.Inc()
 	}
 
 	be.lastUsed = time.Now()
@@ -551,6 +578,9 @@ func (be *CachedBlobEntry) PWrite(offset int64, p []byte) error {
 	if len(p) == 0 {
 		return nil
 	}
+	if err := be.cbs.fenced(); err != nil {
+		return err
+	}
 	be.markDirtyWithLock()
 	if err := be.cachebh.PWrite(offset, p); err != nil {
 		return err
@@ -582,6 +612,9 @@ func (be *CachedBlobEntry) Truncate(newsize int64) error {
 	if be.bloblen == newsize {
 		return nil
 	}
+	if err := be.cbs.fenced(); err != nil {
+		return err
+	}
 	be.markDirtyWithLock()
 	if err := be.cachebh.Truncate(newsize); err != nil {
 		return err
@@ -598,13 +631,18 @@ func (be *CachedBlobEntry) writeBackWithLock() error {
 	if be.state != cacheEntryDirty {
 		return nil
 	}
+	if err := be.cbs.fenced(); err != nil {
+		return err
+	}
 
 	cachever, err := be.cbs.queryVersion(&blobstore.OffsetReader{be.cachebh, 0})
 	if err != nil {
 		return fmt.Errorf("Failed to query cached blob ver: %v", err)
 	}
 
+	defer observeWriteback(time.Now())
 	w, err := be.cbs.backendbs.OpenWriter(be.blobpath)
+	countBackendRequest(be.cbs.backendbs, "open_writer", err)
 	if err != nil {
 		return fmt.Errorf("Failed to open backend blob writer: %v", err)
 	}
@@ -770,6 +808,15 @@ func (cbs *CachedBlobStore) Sync() error {
 	return cbs.entriesmgr.SyncAll()
 }
 
+// SyncBlob writes back the cache of blobpath, so that backendbs has its latest content.
+func (cbs *CachedBlobStore) SyncBlob(blobpath string) error {
+	be := cbs.entriesmgr.FindEntry(blobpath)
+	if be == nil {
+		return nil
+	}
+	return be.Sync()
+}
+
 const (
 	syncTimeoutDuration  = 300 * time.Second
 	writeTimeoutDuration = 3 * time.Second
@@ -824,10 +871,28 @@ func (cbs *CachedBlobStore) Flags() int {
 	return cbs.flags
 }
 
+// Fence makes cbs fail all following writes, including writebacks of the dirty cache, with err.
+func (cbs *CachedBlobStore) Fence(err error) {
+	cbs.muFence.Lock()
+	cbs.fenceErr = err
+	cbs.muFence.Unlock()
+}
+
+func (cbs *CachedBlobStore) fenced() error {
+	cbs.muFence.Lock()
+	defer cbs.muFence.Unlock()
+	return cbs.fenceErr
+}
+
 func (cbs *CachedBlobStore) Open(blobpath string, flags int) (blobstore.BlobHandle, error) {
 	if !fl.IsWriteAllowed(cbs.flags) && fl.IsWriteAllowed(flags) {
 		return nil, EPERM
 	}
+	if fl.IsWriteAllowed(flags) {
+		if err := cbs.fenced(); err != nil {
+			return nil, err
+		}
+	}
 
 	be, err := cbs.entriesmgr.OpenEntry(blobpath)
 	if err != nil {
@@ -851,6 +916,7 @@ func (cbs *CachedBlobStore) ListBlobs() ([]string, error) {
 	}
 
 	belist, err := belister.ListBlobs()
+	countBackendRequest(cbs.backendbs, "list_blobs", err)
 	if err != nil {
 		return nil, fmt.Errorf("Backendbs failed to ListBlobs: %v", err)
 	}
@@ -873,9 +939,25 @@ func (cbs *CachedBlobStore) ListBlobs() ([]string, error) {
 	return list, nil
 }
 
+var _ = blobstore.BlobSizer(&CachedBlobStore{})
+
+// BlobSize returns the size of the blob stored on backendbs, which is what removing the blob reclaims.
+func (cbs *CachedBlobStore) BlobSize(blobpath string) (int64, error) {
+	besizer, ok := cbs.backendbs.(blobstore.BlobSizer)
+	if !ok {
+		return -1, fmt.Errorf("Backendbs \"%v\" doesn't support BlobSize().", util.TryGetImplName(cbs.backendbs))
+	}
+	size, err := besizer.BlobSize(blobpath)
+	countBackendRequest(cbs.backendbs, "blob_size", err)
+	return size, err
+}
+
 var _ = blobstore.BlobRemover(&CachedBlobStore{})
 
 func (cbs *CachedBlobStore) RemoveBlob(blobpath string) error {
+	if err := cbs.fenced(); err != nil {
+		return err
+	}
 	backendrm, ok := cbs.backendbs.(blobstore.BlobRemover)
 	if !ok {
 		return fmt.Errorf("Backendbs \"%v\" doesn't support removing blobs.", util.TryGetImplName(cbs.backendbs))
@@ -889,7 +971,9 @@ func (cbs *CachedBlobStore) RemoveBlob(blobpath string) error {
 		return err
 	}
 	cbs.bever.Delete(blobpath)
-	if err := backendrm.RemoveBlob(blobpath); err != nil && !os.IsNotExist(err) {
+	err := backendrm.RemoveBlob(blobpath)
+	countBackendRequest(cbs.backendbs, "remove_blob", err)
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("Backendbs RemoveBlob failed: %v", err)
 	}
 	if err := cacherm.RemoveBlob(blobpath); err != nil && !os.IsNotExist(err) {
@@ -0,0 +1,42 @@
+package cachedblobstore
+
+import (
+	"time"
+
+	"github.com/nyaxt/otaru/metrics"
+	"github.com/nyaxt/otaru/util"
+)
+
+var (
+	cacheHits         = metrics.NewCounter("otaru_cache_hits_total", "Number of blob opens served by an up-to-date cache entry.")
+	cacheMisses       = metrics.NewCounter("otaru_cache_misses_total", "Number of blob opens which required fetching the blob from the backend.")
+	writebackDuration = metrics.NewHistogram("otaru_cache_writeback_duration_seconds", "Latency of writing back dirty cache entries to the backend.", nil)
+	backendRequests   = metrics.NewCounter("otaru_backend_requests_total", "Number of requests issued to the backend blobstore.", "impl", "op")
+	backendErrors     = metrics.NewCounter("otaru_backend_errors_total", "Number of failed requests to the backend blobstore.", "impl", "op")
+)
+
+func init() {
+	metrics.Register(cacheHits, cacheMisses, writebackDuration, backendRequests, backendErrors)
+}
+
+// countBackendRequest counts a request to the backend blobstore, and whether it failed.
+func countBackendRequest(backendbs interface{}, op string, err error) {
+	impl := util.TryGetImplName(backendbs)
+	backendRequests.Inc(impl, op)
+	if err != nil {
+		backendErrors.Inc(impl, op)
+	}
+}
+
+// DirtyBytes returns the total size of the cache entries yet to be written back.
+func (cbs *CachedBlobStore) DirtyBytes() int64 {
+	var n int64
+	for _, info := range cbs.DumpEntriesInfo() {
+		if info.State == cacheEntryDirty.String() {
+			n += info.BlobLen
+		}
+	}
+	return n
+}
+
+func observeWriteback(start time.Time) { writebackDuration.ObserveSince(start) }
@@ -18,8 +18,9 @@ import (
 )
 
 type BlobStoreDBStateSnapshotIO struct {
-	bs blobstore.RandomAccessBlobStore
-	c  btncrypt.Cipher
+	bs       blobstore.RandomAccessBlobStore
+	c        btncrypt.Cipher
+	blobpath string
 
 	snapshotVer inodedb.TxID
 }
@@ -27,7 +28,11 @@ type BlobStoreDBStateSnapshotIO struct {
 var _ = inodedb.DBStateSnapshotIO(&BlobStoreDBStateSnapshotIO{})
 
 func NewBlobStoreDBStateSnapshotIO(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher) *BlobStoreDBStateSnapshotIO {
-	return &BlobStoreDBStateSnapshotIO{bs: bs, c: c, snapshotVer: -1}
+	return NewBlobStoreDBStateSnapshotIOForVolume(bs, c, metadata.DefaultVolume)
+}
+
+func NewBlobStoreDBStateSnapshotIOForVolume(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, volume string) *BlobStoreDBStateSnapshotIO {
+	return &BlobStoreDBStateSnapshotIO{bs: bs, c: c, blobpath: metadata.INodeDBSnapshotBlobpathOf(volume), snapshotVer: -1}
 }
 
 func (sio *BlobStoreDBStateSnapshotIO) SaveSnapshot(s *inodedb.DBState) error {
@@ -39,7 +44,7 @@ func (sio *BlobStoreDBStateSnapshotIO) SaveSnapshot(s *inodedb.DBState) error {
 		return nil
 	}
 
-	raw, err := sio.bs.Open(metadata.INodeDBSnapshotBlobpath, fl.O_RDWR|fl.O_CREATE)
+	raw, err := sio.bs.Open(sio.blobpath, fl.O_RDWR|fl.O_CREATE)
 	if err != nil {
 		return err
 	}
@@ -48,8 +53,9 @@ func (sio *BlobStoreDBStateSnapshotIO) SaveSnapshot(s *inodedb.DBState) error {
 	}
 
 	cio := chunkstore.NewChunkIOWithMetadata(raw, sio.c, chunkstore.ChunkHeader{
-		OrigFilename: metadata.INodeDBSnapshotBlobpath,
+		OrigFilename: sio.blobpath,
 		OrigOffset:   0,
+		BlobPath:     sio.blobpath,
 	})
 	bufio := bufio.NewWriter(&blobstore.OffsetWriter{cio, 0})
 	zw := zlib.NewWriter(bufio)
@@ -80,12 +86,12 @@ func (sio *BlobStoreDBStateSnapshotIO) SaveSnapshot(s *inodedb.DBState) error {
 }
 
 func (sio *BlobStoreDBStateSnapshotIO) RestoreSnapshot() (*inodedb.DBState, error) {
-	raw, err := sio.bs.Open(metadata.INodeDBSnapshotBlobpath, fl.O_RDONLY)
+	raw, err := sio.bs.Open(sio.blobpath, fl.O_RDONLY)
 	if err != nil {
 		return nil, err
 	}
 
-	cio := chunkstore.NewChunkIO(raw, sio.c)
+	cio := chunkstore.NewChunkIOWithMetadata(raw, sio.c, chunkstore.ChunkHeader{BlobPath: sio.blobpath})
 	log.Printf("serialized blob size: %d", cio.Size())
 	zr, err := zlib.NewReader(&io.LimitedReader{&blobstore.OffsetReader{cio, 0}, cio.Size()})
 	if err != nil {
@@ -0,0 +1,88 @@
+package otaru
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/gc"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/util"
+)
+
+// BlobStoreGCCandidateStore persists GC candidates to an encrypted metadata blob.
+type BlobStoreGCCandidateStore struct {
+	bs       blobstore.RandomAccessBlobStore
+	c        btncrypt.Cipher
+	blobpath string
+}
+
+var _ = gc.CandidateStore(&BlobStoreGCCandidateStore{})
+
+func NewBlobStoreGCCandidateStoreForVolume(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, volume string) *BlobStoreGCCandidateStore {
+	return &BlobStoreGCCandidateStore{bs: bs, c: c, blobpath: metadata.GCCandidatesBlobpathOf(volume)}
+}
+
+func (cs *BlobStoreGCCandidateStore) SaveCandidates(firstSeen map[string]time.Time) error {
+	raw, err := cs.bs.Open(cs.blobpath, fl.O_RDWR|fl.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if err := raw.Truncate(0); err != nil {
+		raw.Close()
+		return err
+	}
+
+	cio := chunkstore.NewChunkIOWithMetadata(raw, cs.c, chunkstore.ChunkHeader{
+		OrigFilename: cs.blobpath,
+		OrigOffset:   0,
+		BlobPath:     cs.blobpath,
+	})
+	bufio := bufio.NewWriter(&blobstore.OffsetWriter{cio, 0})
+	enc := gob.NewEncoder(bufio)
+
+	es := []error{}
+	if err := enc.Encode(firstSeen); err != nil {
+		es = append(es, fmt.Errorf("Failed to encode GC candidates: %v", err))
+	}
+	if err := bufio.Flush(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close bufio: %v", err))
+	}
+	if err := cio.Close(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close ChunkIO: %v", err))
+	}
+	if err := raw.Close(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close blobhandle: %v", err))
+	}
+	return util.ToErrors(es)
+}
+
+func (cs *BlobStoreGCCandidateStore) LoadCandidates() (map[string]time.Time, error) {
+	raw, err := cs.bs.Open(cs.blobpath, fl.O_RDONLY)
+	if err == blobstore.ENOENT {
+		return map[string]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	cio := chunkstore.NewChunkIOWithMetadata(raw, cs.c, chunkstore.ChunkHeader{BlobPath: cs.blobpath})
+	defer cio.Close()
+	if cio.Size() == 0 {
+		return map[string]time.Time{}, nil
+	}
+
+	firstSeen := make(map[string]time.Time)
+	dec := gob.NewDecoder(&io.LimitedReader{&blobstore.OffsetReader{cio, 0}, cio.Size()})
+	if err := dec.Decode(&firstSeen); err != nil {
+		return nil, fmt.Errorf("Failed to decode GC candidates: %v", err)
+	}
+	return firstSeen, nil
+}
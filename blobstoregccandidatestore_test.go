@@ -0,0 +1,39 @@
+package otaru_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/metadata"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func TestBlobStoreGCCandidateStore(t *testing.T) {
+	cs := otaru.NewBlobStoreGCCandidateStoreForVolume(TestFileBlobStore(), TestCipher(), metadata.DefaultVolume)
+
+	firstSeen, err := cs.LoadCandidates()
+	if err != nil || len(firstSeen) != 0 {
+		t.Fatalf("Unexpected load result on empty store: %v, %v", firstSeen, err)
+	}
+
+	now := time.Now().UTC()
+	firstSeen = map[string]time.Time{"a": now, "b": now.Add(-time.Hour)}
+	if err := cs.SaveCandidates(firstSeen); err != nil {
+		t.Fatalf("SaveCandidates failed: %v", err)
+	}
+	firstSeen2, err := cs.LoadCandidates()
+	if err != nil {
+		t.Fatalf("LoadCandidates failed: %v", err)
+	}
+	if len(firstSeen2) != 2 || !firstSeen2["a"].Equal(now) || !firstSeen2["b"].Equal(now.Add(-time.Hour)) {
+		t.Errorf("Unexpected candidates: %+v", firstSeen2)
+	}
+
+	if err := cs.SaveCandidates(map[string]time.Time{}); err != nil {
+		t.Fatalf("SaveCandidates failed: %v", err)
+	}
+	if firstSeen2, err := cs.LoadCandidates(); err != nil || len(firstSeen2) != 0 {
+		t.Errorf("Unexpected candidates: %+v, %v", firstSeen2, err)
+	}
+}
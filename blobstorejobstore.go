@@ -0,0 +1,91 @@
+package otaru
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/scheduler"
+	"github.com/nyaxt/otaru/util"
+)
+
+// BlobStoreJobStore persists scheduler job records to an encrypted metadata blob.
+type BlobStoreJobStore struct {
+	bs       blobstore.RandomAccessBlobStore
+	c        btncrypt.Cipher
+	blobpath string
+}
+
+var _ = scheduler.JobStore(&BlobStoreJobStore{})
+
+func NewBlobStoreJobStore(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher) *BlobStoreJobStore {
+	return NewBlobStoreJobStoreForVolume(bs, c, metadata.DefaultVolume)
+}
+
+func NewBlobStoreJobStoreForVolume(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, volume string) *BlobStoreJobStore {
+	return &BlobStoreJobStore{bs: bs, c: c, blobpath: metadata.JobHistoryBlobpathOf(volume)}
+}
+
+func (js *BlobStoreJobStore) SaveJobRecords(rs []scheduler.JobRecord) error {
+	raw, err := js.bs.Open(js.blobpath, fl.O_RDWR|fl.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if err := raw.Truncate(0); err != nil {
+		raw.Close()
+		return err
+	}
+
+	cio := chunkstore.NewChunkIOWithMetadata(raw, js.c, chunkstore.ChunkHeader{
+		OrigFilename: js.blobpath,
+		OrigOffset:   0,
+		BlobPath:     js.blobpath,
+	})
+	bufio := bufio.NewWriter(&blobstore.OffsetWriter{cio, 0})
+	enc := gob.NewEncoder(bufio)
+
+	es := []error{}
+	if err := enc.Encode(rs); err != nil {
+		es = append(es, fmt.Errorf("Failed to encode job records: %v", err))
+	}
+	if err := bufio.Flush(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close bufio: %v", err))
+	}
+	if err := cio.Close(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close ChunkIO: %v", err))
+	}
+	if err := raw.Close(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close blobhandle: %v", err))
+	}
+	return util.ToErrors(es)
+}
+
+func (js *BlobStoreJobStore) LoadJobRecords() ([]scheduler.JobRecord, error) {
+	raw, err := js.bs.Open(js.blobpath, fl.O_RDONLY)
+	if err == blobstore.ENOENT {
+		return []scheduler.JobRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	cio := chunkstore.NewChunkIOWithMetadata(raw, js.c, chunkstore.ChunkHeader{BlobPath: js.blobpath})
+	defer cio.Close()
+	if cio.Size() == 0 {
+		return []scheduler.JobRecord{}, nil
+	}
+
+	var rs []scheduler.JobRecord
+	dec := gob.NewDecoder(&io.LimitedReader{&blobstore.OffsetReader{cio, 0}, cio.Size()})
+	if err := dec.Decode(&rs); err != nil {
+		return nil, fmt.Errorf("Failed to decode job records: %v", err)
+	}
+	return rs, nil
+}
@@ -0,0 +1,42 @@
+package otaru_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/scheduler"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func TestBlobStoreJobStore(t *testing.T) {
+	js := otaru.NewBlobStoreJobStore(TestFileBlobStore(), TestCipher())
+
+	rs, err := js.LoadJobRecords()
+	if err != nil || len(rs) != 0 {
+		t.Fatalf("Unexpected load result on empty store: %v, %v", rs, err)
+	}
+
+	rs = []scheduler.JobRecord{
+		{ID: 1, TaskType: "gc", State: scheduler.JobFinished},
+		{ID: 2, TaskType: "scrub", State: scheduler.JobStarted, Checkpoint: HelloWorld},
+	}
+	if err := js.SaveJobRecords(rs); err != nil {
+		t.Fatalf("SaveJobRecords failed: %v", err)
+	}
+	rs2, err := js.LoadJobRecords()
+	if err != nil {
+		t.Fatalf("LoadJobRecords failed: %v", err)
+	}
+	if len(rs2) != 2 || rs2[0].TaskType != "gc" || rs2[1].State != scheduler.JobStarted || !bytes.Equal(rs2[1].Checkpoint, HelloWorld) {
+		t.Errorf("Unexpected records: %+v", rs2)
+	}
+
+	// Saving fewer records must not leave stale data behind.
+	if err := js.SaveJobRecords(rs[:1]); err != nil {
+		t.Fatalf("SaveJobRecords failed: %v", err)
+	}
+	if rs2, err := js.LoadJobRecords(); err != nil || len(rs2) != 1 {
+		t.Errorf("Unexpected records: %+v, %v", rs2, err)
+	}
+}
@@ -0,0 +1,188 @@
+package otaru
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/util"
+)
+
+type VolumeInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// OldestKeyID is the oldest data key the blobs of the volume may be encrypted with. 0 if unknown.
+	OldestKeyID uint32 `json:"oldest_key_id"`
+}
+
+// BlobStoreVolumeRegistry records the volumes in the bucket to an encrypted metadata blob.
+type BlobStoreVolumeRegistry struct {
+	bs blobstore.RandomAccessBlobStore
+	c  btncrypt.Cipher
+
+	mu sync.Mutex
+}
+
+func NewBlobStoreVolumeRegistry(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher) *BlobStoreVolumeRegistry {
+	return &BlobStoreVolumeRegistry{bs: bs, c: c}
+}
+
+func (r *BlobStoreVolumeRegistry) save(vs []VolumeInfo) error {
+	raw, err := r.bs.Open(metadata.VolumesBlobpath, fl.O_RDWR|fl.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if err := raw.Truncate(0); err != nil {
+		raw.Close()
+		return err
+	}
+
+	cio := chunkstore.NewChunkIOWithMetadata(raw, r.c, chunkstore.ChunkHeader{
+		OrigFilename: metadata.VolumesBlobpath,
+		OrigOffset:   0,
+		BlobPath:     metadata.VolumesBlobpath,
+	})
+	bufio := bufio.NewWriter(&blobstore.OffsetWriter{cio, 0})
+	enc := gob.NewEncoder(bufio)
+
+	es := []error{}
+	if err := enc.Encode(vs); err != nil {
+		es = append(es, fmt.Errorf("Failed to encode volumes: %v", err))
+	}
+	if err := bufio.Flush(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close bufio: %v", err))
+	}
+	if err := cio.Close(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close ChunkIO: %v", err))
+	}
+	if err := raw.Close(); err != nil {
+		es = append(es, fmt.Errorf("Failed to close blobhandle: %v", err))
+	}
+	return util.ToErrors(es)
+}
+
+// load returns the volumes recorded. The default volume is recorded only once its OldestKeyID is set.
+func (r *BlobStoreVolumeRegistry) load() ([]VolumeInfo, error) {
+	raw, err := r.bs.Open(metadata.VolumesBlobpath, fl.O_RDONLY)
+	if err == blobstore.ENOENT {
+		return []VolumeInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer raw.Close()
+
+	cio := chunkstore.NewChunkIOWithMetadata(raw, r.c, chunkstore.ChunkHeader{BlobPath: metadata.VolumesBlobpath})
+	defer cio.Close()
+	if cio.Size() == 0 {
+		return []VolumeInfo{}, nil
+	}
+
+	var vs []VolumeInfo
+	dec := gob.NewDecoder(&io.LimitedReader{&blobstore.OffsetReader{cio, 0}, cio.Size()})
+	if err := dec.Decode(&vs); err != nil {
+		return nil, fmt.Errorf("Failed to decode volumes: %v", err)
+	}
+	return vs, nil
+}
+
+func (r *BlobStoreVolumeRegistry) ListVolumes() ([]VolumeInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	vs, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vs {
+		if v.Name == metadata.DefaultVolume {
+			return vs, nil
+		}
+	}
+	return append([]VolumeInfo{{Name: metadata.DefaultVolume}}, vs...), nil
+}
+
+func (r *BlobStoreVolumeRegistry) HasVolume(name string) (bool, error) {
+	vs, err := r.ListVolumes()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range vs {
+		if v.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *BlobStoreVolumeRegistry) AddVolume(name string) error {
+	if err := metadata.ValidateVolumeName(name); err != nil {
+		return err
+	}
+	if name == metadata.DefaultVolume {
+		return EEXIST
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	vs, err := r.load()
+	if err != nil {
+		return err
+	}
+	for _, v := range vs {
+		if v.Name == name {
+			return EEXIST
+		}
+	}
+	return r.save(append(vs, VolumeInfo{Name: name, CreatedAt: time.Now(), OldestKeyID: r.c.KeyID()}))
+}
+
+// SetOldestKeyID records that the blobs of the volume are encrypted with key id or newer ones.
+func (r *BlobStoreVolumeRegistry) SetOldestKeyID(name string, id uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	vs, err := r.load()
+	if err != nil {
+		return err
+	}
+	for i := range vs {
+		if vs[i].Name == name {
+			vs[i].OldestKeyID = id
+			return r.save(vs)
+		}
+	}
+	if name != metadata.DefaultVolume {
+		return ENOENT
+	}
+	return r.save(append([]VolumeInfo{{Name: name, OldestKeyID: id}}, vs...))
+}
+
+func (r *BlobStoreVolumeRegistry) RemoveVolume(name string) error {
+	if name == metadata.DefaultVolume {
+		return EPERM
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	vs, err := r.load()
+	if err != nil {
+		return err
+	}
+	for i, v := range vs {
+		if v.Name == name {
+			return r.save(append(vs[:i], vs[i+1:]...))
+		}
+	}
+	return ENOENT
+}
@@ -0,0 +1,118 @@
+package otaru_test
+
+import (
+	"testing"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/metadata"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func volumeNames(t *testing.T, r *otaru.BlobStoreVolumeRegistry) []string {
+	vs, err := r.ListVolumes()
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	names := []string{}
+	for _, v := range vs {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func TestBlobStoreVolumeRegistry(t *testing.T) {
+	r := otaru.NewBlobStoreVolumeRegistry(TestFileBlobStore(), TestCipher())
+
+	if names := volumeNames(t, r); len(names) != 1 || names[0] != metadata.DefaultVolume {
+		t.Errorf("Unexpected volumes on empty registry: %v", names)
+	}
+	if err := r.AddVolume("photos"); err != nil {
+		t.Errorf("AddVolume failed: %v", err)
+	}
+	if err := r.AddVolume("work"); err != nil {
+		t.Errorf("AddVolume failed: %v", err)
+	}
+	if err := r.AddVolume("photos"); err != otaru.EEXIST {
+		t.Errorf("AddVolume of existing volume should fail with EEXIST: %v", err)
+	}
+	if err := r.AddVolume("../bad"); err == nil {
+		t.Errorf("AddVolume of invalid name should fail")
+	}
+	if names := volumeNames(t, r); len(names) != 3 || names[1] != "photos" || names[2] != "work" {
+		t.Errorf("Unexpected volumes: %v", names)
+	}
+
+	if err := r.RemoveVolume(metadata.DefaultVolume); err != otaru.EPERM {
+		t.Errorf("RemoveVolume of default volume should fail with EPERM: %v", err)
+	}
+	if err := r.RemoveVolume("photos"); err != nil {
+		t.Errorf("RemoveVolume failed: %v", err)
+	}
+	if err := r.RemoveVolume("photos"); err != otaru.ENOENT {
+		t.Errorf("RemoveVolume of removed volume should fail with ENOENT: %v", err)
+	}
+	if ok, err := r.HasVolume("work"); err != nil || !ok {
+		t.Errorf("HasVolume(work): %t, %v", ok, err)
+	}
+}
+
+func TestBlobStoreVolumeRegistry_OldestKeyID(t *testing.T) {
+	r := otaru.NewBlobStoreVolumeRegistry(TestFileBlobStore(), TestCipher())
+
+	if err := r.AddVolume("photos"); err != nil {
+		t.Fatalf("AddVolume failed: %v", err)
+	}
+	if err := r.SetOldestKeyID(metadata.DefaultVolume, 3); err != nil {
+		t.Errorf("SetOldestKeyID failed: %v", err)
+	}
+	if err := r.SetOldestKeyID("nonexistent", 3); err != otaru.ENOENT {
+		t.Errorf("SetOldestKeyID of unknown volume should fail with ENOENT: %v", err)
+	}
+
+	vs, err := r.ListVolumes()
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(vs) != 2 || vs[0].Name != metadata.DefaultVolume || vs[0].OldestKeyID != 3 || vs[1].Name != "photos" || vs[1].OldestKeyID != TestCipher().KeyID() {
+		t.Errorf("Unexpected volumes: %+v", vs)
+	}
+	if err := r.RemoveVolume(metadata.DefaultVolume); err != otaru.EPERM {
+		t.Errorf("RemoveVolume of default volume should fail with EPERM: %v", err)
+	}
+}
+
+func TestBlobStoreDBStateSnapshotIO_Volumes(t *testing.T) {
+	bs := TestFileBlobStore()
+
+	for _, vol := range []string{metadata.DefaultVolume, "photos"} {
+		sio := otaru.NewBlobStoreDBStateSnapshotIOForVolume(bs, TestCipher(), vol)
+		db, err := inodedb.NewEmptyDB(sio, inodedb.NewSimpleDBTransactionLogIO())
+		if err != nil {
+			t.Fatalf("NewEmptyDB failed: %v", err)
+		}
+		fs := otaru.NewFileSystem(db, bs, TestCipher())
+		if _, err := fs.CreateDirFullPath("/" + vol); err != nil {
+			t.Fatalf("CreateDirFullPath failed: %v", err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+	}
+
+	for _, vol := range []string{metadata.DefaultVolume, "photos"} {
+		sio := otaru.NewBlobStoreDBStateSnapshotIOForVolume(bs, TestCipher(), vol)
+		db, err := inodedb.NewDB(sio, inodedb.NewSimpleDBTransactionLogIO())
+		if err != nil {
+			t.Fatalf("NewDB failed: %v", err)
+		}
+		fs := otaru.NewFileSystem(db, bs, TestCipher())
+		entries, err := fs.DirEntries(inodedb.RootDirID)
+		if err != nil {
+			t.Fatalf("DirEntries failed: %v", err)
+		}
+		if _, ok := entries[vol]; !ok || len(entries) != 1 {
+			t.Errorf("Volume %s has unexpected entries: %v", vol, entries)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package otaru
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/util"
+)
+
+const (
+	// WriterLockTTL is how long a writer lock stays valid without being renewed.
+	WriterLockTTL = 5 * time.Minute
+
+	writerLockRenewInterval = WriterLockTTL / 5
+	defaultWriterLockSettle = time.Second
+)
+
+// WriterLockHeldError is returned if the volume is already opened for write by another process.
+type WriterLockHeldError struct {
+	Holder    string
+	ExpiresAt time.Time
+}
+
+func (e *WriterLockHeldError) Error() string {
+	return fmt.Sprintf("Volume is opened for write by %s. The lock expires at %v unless renewed.", e.Holder, e.ExpiresAt.Local().Format(time.RFC3339))
+}
+
+func (e *WriterLockHeldError) Errno() syscall.Errno { return syscall.EBUSY }
+
+// writerLease is the content of the writer lock blob.
+type writerLease struct {
+	Hostname  string
+	PID       int
+	Holder    string
+	ExpiresAt time.Time
+}
+
+// BlobStoreWriterLock is a lease on a volume held while it is opened for write, so that a second writer fails instead of diverging the inodedb.
+type BlobStoreWriterLock struct {
+	bs       blobstore.BlobStore
+	c        btncrypt.Cipher
+	blobpath string
+	settle   time.Duration
+
+	hostname string
+	holder   string
+
+	mu         sync.Mutex
+	renewer    *util.PeriodicRunner
+	validUntil time.Time
+	lost       bool
+	onLost     func()
+}
+
+func NewBlobStoreWriterLockForVolume(bs blobstore.BlobStore, c btncrypt.Cipher, volume string) *BlobStoreWriterLock {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "<unknown>"
+	}
+	return &BlobStoreWriterLock{
+		bs:       bs,
+		c:        c,
+		blobpath: metadata.WriterLockBlobpathOf(volume),
+		settle:   defaultWriterLockSettle,
+		hostname: hostname,
+		holder:   fmt.Sprintf("%s[%d] at %s", hostname, os.Getpid(), time.Now().Format(time.RFC3339Nano)),
+	}
+}
+
+func (l *BlobStoreWriterLock) SetSettleDelayForTesting(d time.Duration) { l.settle = d }
+
+// SetOnLost sets the func called once when the lock is taken over by another writer, or is about to expire as renewals keep failing.
+func (l *BlobStoreWriterLock) SetOnLost(f func()) {
+	l.mu.Lock()
+	l.onLost = f
+	lost := l.lost
+	l.mu.Unlock()
+	if lost {
+		f()
+	}
+}
+
+// Lost tells if the lock was lost while held.
+func (l *BlobStoreWriterLock) Lost() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+func (l *BlobStoreWriterLock) RenewForTesting() { l.renew() }
+
+func (l *BlobStoreWriterLock) readLease() (*writerLease, error) {
+	r, err := l.bs.OpenReader(l.blobpath)
+	if err == blobstore.ENOENT {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open writer lock blob: %v", err)
+	}
+	defer r.Close()
+
+	env, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read writer lock blob: %v", err)
+	}
+	if len(env) == 0 {
+		return nil, nil
+	}
+	b, err := btncrypt.Decrypt(l.c, env, len(env)-l.c.FrameOverhead())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt writer lock: %v", err)
+	}
+	var lease writerLease
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&lease); err != nil {
+		return nil, fmt.Errorf("Failed to decode writer lock: %v", err)
+	}
+	return &lease, nil
+}
+
+func (l *BlobStoreWriterLock) writeLease(expiresAt time.Time) error {
+	var b bytes.Buffer
+	lease := writerLease{Hostname: l.hostname, PID: os.Getpid(), Holder: l.holder, ExpiresAt: expiresAt}
+	if err := gob.NewEncoder(&b).Encode(lease); err != nil {
+		return fmt.Errorf("Failed to encode writer lock: %v", err)
+	}
+	env, err := btncrypt.Encrypt(l.c, b.Bytes())
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt writer lock: %v", err)
+	}
+
+	w, err := l.bs.OpenWriter(l.blobpath)
+	if err != nil {
+		return fmt.Errorf("Failed to open writer lock blob for writing: %v", err)
+	}
+	if _, err := w.Write(env); err != nil {
+		w.Close()
+		return fmt.Errorf("Failed to write writer lock blob: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed to close writer lock blob: %v", err)
+	}
+	return nil
+}
+
+// isAbandoned tells if the lease of another holder no longer needs to be respected.
+func (l *BlobStoreWriterLock) isAbandoned(lease *writerLease, now time.Time) bool {
+	if lease == nil || !now.Before(lease.ExpiresAt) {
+		return true
+	}
+	if lease.Hostname == l.hostname && lease.PID != os.Getpid() {
+		// Signal 0 only checks that the process exists.
+		if err := syscall.Kill(lease.PID, 0); err == syscall.ESRCH {
+			return true
+		}
+	}
+	return false
+}
+
+// IsHeld tells if the writer lock is currently held by anyone, including this process.
+func (l *BlobStoreWriterLock) IsHeld() (bool, error) {
+	lease, err := l.readLease()
+	if err != nil {
+		return false, err
+	}
+	return !l.isAbandoned(lease, time.Now()), nil
+}
+
+// Lock acquires the writer lock, and keeps renewing it until Unlock. If force is set, the lock is taken over even if another writer holds it.
+func (l *BlobStoreWriterLock) Lock(force bool) error {
+	lease, err := l.readLease()
+	if err != nil {
+		return err
+	}
+	if !l.isAbandoned(lease, time.Now()) {
+		if !force {
+			return &WriterLockHeldError{Holder: lease.Holder, ExpiresAt: lease.ExpiresAt}
+		}
+		log.Printf("Forcibly taking over the writer lock held by %s.", lease.Holder)
+	}
+
+	expiresAt := time.Now().Add(WriterLockTTL)
+	if err := l.writeLease(expiresAt); err != nil {
+		return err
+	}
+	// Another writer which read the lease before the write above would have overwritten it by now.
+	time.Sleep(l.settle)
+	lease, err = l.readLease()
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return fmt.Errorf("Writer lock blob disappeared while acquiring it")
+	}
+	if lease.Holder != l.holder {
+		return &WriterLockHeldError{Holder: lease.Holder, ExpiresAt: lease.ExpiresAt}
+	}
+	log.Printf("Acquired writer lock \"%s\" as %s.", l.blobpath, l.holder)
+
+	l.mu.Lock()
+	l.validUntil = expiresAt
+	l.lost = false
+	l.renewer = util.NewPeriodicRunner(l.renew, writerLockRenewInterval)
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *BlobStoreWriterLock) markLost() {
+	l.mu.Lock()
+	if l.lost {
+		l.mu.Unlock()
+		return
+	}
+	l.lost = true
+	onLost := l.onLost
+	l.mu.Unlock()
+
+	if onLost != nil {
+		onLost()
+	}
+}
+
+// renewFailed marks the lock lost if it may expire before the next renewal.
+func (l *BlobStoreWriterLock) renewFailed(err error) {
+	log.Printf("Failed to renew writer lock: %v", err)
+
+	l.mu.Lock()
+	validUntil := l.validUntil
+	l.mu.Unlock()
+	if time.Now().Add(writerLockRenewInterval).After(validUntil) {
+		log.Printf("WARNING: Writer lock expires at %v before it can be renewed. Stop writing.", validUntil.Local().Format(time.RFC3339))
+		l.markLost()
+	}
+}
+
+func (l *BlobStoreWriterLock) renew() {
+	if l.Lost() {
+		return
+	}
+
+	lease, err := l.readLease()
+	if err != nil {
+		l.renewFailed(err)
+		return
+	}
+	if lease == nil || lease.Holder != l.holder {
+		log.Printf("WARNING: Writer lock was taken over by another writer. Stop writing.")
+		l.markLost()
+		return
+	}
+	expiresAt := time.Now().Add(WriterLockTTL)
+	if err := l.writeLease(expiresAt); err != nil {
+		l.renewFailed(err)
+		return
+	}
+	l.mu.Lock()
+	l.validUntil = expiresAt
+	l.mu.Unlock()
+}
+
+// Unlock stops renewing the writer lock, and releases it unless it was taken over.
+func (l *BlobStoreWriterLock) Unlock() error {
+	l.mu.Lock()
+	renewer := l.renewer
+	l.renewer = nil
+	l.mu.Unlock()
+	if renewer == nil {
+		return nil
+	}
+	renewer.Stop()
+
+	lease, err := l.readLease()
+	if err != nil {
+		return err
+	}
+	if lease == nil || lease.Holder != l.holder {
+		return nil
+	}
+	// Blobstores may not support removal, so release by expiring the lease.
+	return l.writeLease(time.Time{})
+}
@@ -0,0 +1,137 @@
+package otaru_test
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/blobstore/cachedblobstore"
+	"github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/metadata"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func TestBlobStoreWriterLock(t *testing.T) {
+	bs := TestFileBlobStore()
+	newLock := func() *otaru.BlobStoreWriterLock {
+		l := otaru.NewBlobStoreWriterLockForVolume(bs, TestCipher(), metadata.DefaultVolume)
+		l.SetSettleDelayForTesting(0)
+		return l
+	}
+
+	l1 := newLock()
+	if err := l1.Lock(false); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	if held, err := newLock().IsHeld(); err != nil || !held {
+		t.Errorf("Unexpected IsHeld result while locked: %t, %v", held, err)
+	}
+
+	l2 := newLock()
+	err := l2.Lock(false)
+	if err == nil {
+		t.Fatalf("Lock succeeded while another writer holds it")
+	}
+	herr, ok := err.(*otaru.WriterLockHeldError)
+	if !ok {
+		t.Fatalf("Unexpected error type: %v", err)
+	}
+	if herr.Errno() != syscall.EBUSY {
+		t.Errorf("Unexpected errno: %v", herr.Errno())
+	}
+
+	if err := l1.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := l2.Lock(false); err != nil {
+		t.Fatalf("Lock after Unlock failed: %v", err)
+	}
+
+	l3 := newLock()
+	if err := l3.Lock(true); err != nil {
+		t.Fatalf("Forced Lock failed: %v", err)
+	}
+	// l2 was taken over, so its Unlock must not release the lock of l3.
+	if err := l2.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := newLock().Lock(false); err == nil {
+		t.Errorf("Lock succeeded while the forced writer holds it")
+	}
+	if err := l3.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if held, err := newLock().IsHeld(); err != nil || held {
+		t.Errorf("Unexpected IsHeld result after Unlock: %t, %v", held, err)
+	}
+}
+
+func TestBlobStoreWriterLock_TakenOver(t *testing.T) {
+	backendbs := TestFileBlobStoreOfName("backend")
+	cbs, err := cachedblobstore.New(backendbs, TestFileBlobStoreOfName("cache"), flags.O_RDWRCREATE, TestQueryVersion)
+	if err != nil {
+		t.Fatalf("Failed to create CachedBlobStore: %v", err)
+	}
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	idbs := inodedb.NewDBService(idb)
+	defer idbs.Quit()
+	fs := otaru.NewFileSystem(idbs, cbs, TestCipher())
+
+	newLock := func() *otaru.BlobStoreWriterLock {
+		l := otaru.NewBlobStoreWriterLockForVolume(backendbs, TestCipher(), metadata.DefaultVolume)
+		l.SetSettleDelayForTesting(0)
+		return l
+	}
+	l1 := newLock()
+	if err := l1.Lock(false); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	defer l1.Unlock()
+	numLost := 0
+	l1.SetOnLost(func() {
+		numLost++
+		cbs.Fence(otaru.EBUSY)
+		idbs.Fence(otaru.EBUSY)
+	})
+
+	if _, err := fs.WriteFileFullPath("/before.txt", strings.NewReader("hello")); err != nil {
+		t.Fatalf("WriteFileFullPath failed: %v", err)
+	}
+	l1.RenewForTesting()
+	if numLost != 0 || l1.Lost() {
+		t.Fatalf("Lock lost while still held")
+	}
+
+	l2 := newLock()
+	if err := l2.Lock(true); err != nil {
+		t.Fatalf("Forced Lock failed: %v", err)
+	}
+	defer l2.Unlock()
+	l1.RenewForTesting()
+	l1.RenewForTesting()
+	if numLost != 1 || !l1.Lost() {
+		t.Fatalf("Unexpected lost state after takeover: called %d times, Lost() %t", numLost, l1.Lost())
+	}
+
+	if _, err := fs.WriteFileFullPath("/after.txt", strings.NewReader("hello")); err == nil {
+		t.Errorf("WriteFileFullPath succeeded after the lock was lost")
+	}
+	if _, err := fs.CreateDirFullPath("/dir"); err != otaru.EBUSY {
+		t.Errorf("Unexpected CreateDirFullPath err after the lock was lost: %v", err)
+	}
+	if _, err := cbs.Open("foo", flags.O_RDWRCREATE); err != otaru.EBUSY {
+		t.Errorf("Unexpected Open err after the lock was lost: %v", err)
+	}
+
+	// l1 must not have overwritten the lease of l2.
+	err = newLock().Lock(false)
+	if _, ok := err.(*otaru.WriterLockHeldError); !ok {
+		t.Errorf("Unexpected Lock err while l2 holds it: %v", err)
+	}
+}
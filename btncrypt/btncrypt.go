@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,6 +19,9 @@ const (
 	BtnFrameMaxPayload = 256 * 1024
 )
 
+// ErrAuthenticationFailed is returned when a frame fails to authenticate with any of the keys, or with the expected additional data.
+var ErrAuthenticationFailed = errors.New("btncrypt: frame authentication failed")
+
 func gcmFromKey(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -34,6 +38,11 @@ func gcmFromKey(key []byte) (cipher.AEAD, error) {
 
 type Cipher struct {
 	gcm cipher.AEAD
+
+	// keyID identifies the key encrypting new frames. 0 for the password-derived key.
+	keyID uint32
+	// fallbacks are tried in order when gcm fails to authenticate a frame, so that frames encrypted with older keys stay readable.
+	fallbacks []cipher.AEAD
 }
 
 func NewCipher(key []byte) (Cipher, error) {
@@ -45,6 +54,39 @@ func NewCipher(key []byte) (Cipher, error) {
 	return Cipher{gcm: gcm}, nil
 }
 
+// NewCipherWithKeyID returns a Cipher which encrypts with key, and decrypts frames encrypted with either key or one of decryptKeys.
+func NewCipherWithKeyID(key []byte, keyID uint32, decryptKeys [][]byte) (Cipher, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return Cipher{}, err
+	}
+	c.keyID = keyID
+	for _, k := range decryptKeys {
+		gcm, err := gcmFromKey(k)
+		if err != nil {
+			return Cipher{}, err
+		}
+		c.fallbacks = append(c.fallbacks, gcm)
+	}
+	return c, nil
+}
+
+// KeyID returns the ID of the key used for encryption.
+func (c Cipher) KeyID() uint32 { return c.keyID }
+
+func (c Cipher) open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+	plain, err := c.gcm.Open(dst, nonce, ciphertext, aad)
+	if err == nil {
+		return plain, nil
+	}
+	for _, gcm := range c.fallbacks {
+		if plain, ferr := gcm.Open(dst, nonce, ciphertext, aad); ferr == nil {
+			return plain, nil
+		}
+	}
+	return nil, err
+}
+
 func (c Cipher) FrameOverhead() int {
 	return c.gcm.NonceSize() + c.gcm.Overhead()
 }
@@ -53,16 +95,29 @@ func (c Cipher) EncryptedFrameSize(payloadLen int) int {
 	return payloadLen + c.FrameOverhead()
 }
 
+// AADFunc returns additional authenticated data for i-th frame of a stream. nil AADFunc authenticates frames without any additional data.
+type AADFunc func(i int) []byte
+
+func (f AADFunc) aad(i int) []byte {
+	if f == nil {
+		return nil
+	}
+	return f(i)
+}
+
 type frameEncryptor struct {
 	c         Cipher
+	aadf      AADFunc
+	i         int
 	b         bytes.Buffer
 	encrypted []byte
 }
 
-func newFrameEncryptor(c Cipher) *frameEncryptor {
+func newFrameEncryptor(c Cipher, aadf AADFunc) *frameEncryptor {
 	lenEncrypted := c.EncryptedFrameSize(BtnFrameMaxPayload)
 	return &frameEncryptor{
 		c:         c,
+		aadf:      aadf,
 		encrypted: make([]byte, 0, lenEncrypted),
 	}
 }
@@ -93,7 +148,8 @@ func (f *frameEncryptor) Sync() ([]byte, error) {
 	f.encrypted = f.encrypted[:len(nonce)]
 	copy(f.encrypted, nonce)
 
-	f.encrypted = f.c.gcm.Seal(f.encrypted, nonce, f.b.Bytes(), nil)
+	f.encrypted = f.c.gcm.Seal(f.encrypted, nonce, f.b.Bytes(), f.aadf.aad(f.i))
+	f.i++
 	if len(f.encrypted) != f.c.EncryptedFrameSize(f.Written()) {
 		log.Panicf("EncryptedFrameSize mismatch. expected: %d, actual: %v", f.c.EncryptedFrameSize(f.Written()), len(f.encrypted))
 	}
@@ -109,11 +165,16 @@ type WriteCloser struct {
 }
 
 func NewWriteCloser(dst io.Writer, c Cipher, lenTotal int) (*WriteCloser, error) {
+	return NewWriteCloserWithAAD(dst, c, lenTotal, nil)
+}
+
+// NewWriteCloserWithAAD returns a WriteCloser which authenticates i-th frame with aadf(i) in addition to its content.
+func NewWriteCloserWithAAD(dst io.Writer, c Cipher, lenTotal int, aadf AADFunc) (*WriteCloser, error) {
 	bew := &WriteCloser{
 		dst:            dst,
 		lenTotal:       lenTotal,
 		lenWritten:     0,
-		frameEncryptor: newFrameEncryptor(c),
+		frameEncryptor: newFrameEncryptor(c, aadf),
 	}
 	return bew, nil
 }
@@ -176,8 +237,12 @@ func (bew *WriteCloser) Close() error {
 }
 
 func Encrypt(c Cipher, plain []byte) ([]byte, error) {
+	return EncryptWithAAD(c, plain, nil)
+}
+
+func EncryptWithAAD(c Cipher, plain []byte, aadf AADFunc) ([]byte, error) {
 	var b bytes.Buffer
-	bew, err := NewWriteCloser(&b, c, len(plain))
+	bew, err := NewWriteCloserWithAAD(&b, c, len(plain), aadf)
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +258,8 @@ func Encrypt(c Cipher, plain []byte) ([]byte, error) {
 type Reader struct {
 	src       io.Reader
 	c         Cipher
+	aadf      AADFunc
+	i         int
 	lenTotal  int
 	lenRead   int
 	decrypted []byte
@@ -201,9 +268,15 @@ type Reader struct {
 }
 
 func NewReader(src io.Reader, c Cipher, lenTotal int) (*Reader, error) {
+	return NewReaderWithAAD(src, c, lenTotal, nil)
+}
+
+// NewReaderWithAAD returns a Reader which requires i-th frame to be authenticated with aadf(i).
+func NewReaderWithAAD(src io.Reader, c Cipher, lenTotal int, aadf AADFunc) (*Reader, error) {
 	bdr := &Reader{
 		src:       src,
 		c:         c,
+		aadf:      aadf,
 		lenTotal:  lenTotal,
 		lenRead:   0,
 		decrypted: make([]byte, 0, BtnFrameMaxPayload),
@@ -228,9 +301,10 @@ func (bdr *Reader) decryptNextFrame() error {
 
 	var err error
 	bdr.decrypted = bdr.decrypted[:0]
-	if bdr.decrypted, err = bdr.c.gcm.Open(bdr.decrypted, nonce, ciphertext, nil); err != nil {
-		return err
+	if bdr.decrypted, err = bdr.c.open(bdr.decrypted, nonce, ciphertext, bdr.aadf.aad(bdr.i)); err != nil {
+		return ErrAuthenticationFailed
 	}
+	bdr.i++
 	bdr.unread = bdr.decrypted
 
 	return nil
@@ -271,7 +345,11 @@ func (bdr *Reader) HasReadAll() bool {
 }
 
 func Decrypt(c Cipher, envelope []byte, lenTotal int) ([]byte, error) {
-	bdr, err := NewReader(bytes.NewReader(envelope), c, lenTotal)
+	return DecryptWithAAD(c, envelope, lenTotal, nil)
+}
+
+func DecryptWithAAD(c Cipher, envelope []byte, lenTotal int, aadf AADFunc) ([]byte, error) {
+	bdr, err := NewReaderWithAAD(bytes.NewReader(envelope), c, lenTotal, aadf)
 	if err != nil {
 		return nil, err
 	}
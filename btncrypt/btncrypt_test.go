@@ -107,3 +107,38 @@ func TestBtnEncryptWriter_PartialWrite(t *testing.T) {
 		t.Errorf("Failed to restore original payload")
 	}
 }
+
+func TestCipherWithKeyID_DecryptsOldKey(t *testing.T) {
+	payload := util.RandomBytes(1024 * 1024)
+	envelope, err := btncrypt.Encrypt(tu.TestCipher(), payload)
+	if err != nil {
+		t.Errorf("Failed to encrypt: %v", err)
+	}
+
+	newkey := util.RandomBytes(len(tu.Key))
+	c, err := btncrypt.NewCipherWithKeyID(newkey, 1, [][]byte{tu.Key})
+	if err != nil {
+		t.Errorf("Failed to create cipher: %v", err)
+		return
+	}
+	if c.KeyID() != 1 {
+		t.Errorf("Unexpected KeyID: %d", c.KeyID())
+	}
+
+	plain, err := btncrypt.Decrypt(c, envelope, len(payload))
+	if err != nil {
+		t.Errorf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(plain, payload) {
+		t.Errorf("Failed to restore original payload")
+	}
+
+	// The new key is used for encryption, so the old key can't decrypt.
+	envelope, err = btncrypt.Encrypt(c, payload)
+	if err != nil {
+		t.Errorf("Failed to encrypt: %v", err)
+	}
+	if _, err := btncrypt.Decrypt(tu.TestCipher(), envelope, len(payload)); err == nil {
+		t.Errorf("Decrypt with the old key should fail")
+	}
+}
@@ -0,0 +1,113 @@
+package btncrypt
+
+import (
+	"crypto/sha1"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+
+	. "github.com/nyaxt/otaru/util" // FIXME
+)
+
+const (
+	KDFPBKDF2SHA1 = "pbkdf2-sha1"
+	KDFScrypt     = "scrypt"
+	KDFArgon2id   = "argon2id"
+
+	DefaultKDF = KDFArgon2id
+
+	kdfSaltLength = 16
+)
+
+// KDFParams specifies how to derive a key from a password.
+type KDFParams struct {
+	Algorithm string
+	Salt      []byte
+
+	// Iterations is the cost parameter of pbkdf2-sha1.
+	Iterations int `json:",omitempty"`
+
+	// N, R, P are the cost parameters of scrypt.
+	N int `json:",omitempty"`
+	R int `json:",omitempty"`
+	P int `json:",omitempty"`
+
+	// Time, MemoryKiB, Threads are the cost parameters of argon2id.
+	Time      uint32 `json:",omitempty"`
+	MemoryKiB uint32 `json:",omitempty"`
+	Threads   uint8  `json:",omitempty"`
+}
+
+// LegacyKDFParams returns the parameters KeyFromPassword uses, with a fixed salt.
+func LegacyKDFParams() KDFParams {
+	return KDFParams{Algorithm: KDFPBKDF2SHA1, Salt: []byte("otaru"), Iterations: 4096}
+}
+
+// NewKDFParams returns parameters for algorithm with a random salt and the recommended cost.
+func NewKDFParams(algorithm string) (KDFParams, error) {
+	p := KDFParams{Algorithm: algorithm, Salt: RandomBytes(kdfSaltLength)}
+	switch algorithm {
+	case KDFPBKDF2SHA1:
+		p.Iterations = 100000
+	case KDFScrypt:
+		p.N, p.R, p.P = 1<<15, 8, 1
+	case KDFArgon2id:
+		p.Time, p.MemoryKiB, p.Threads = 3, 64*1024, 4
+	default:
+		return KDFParams{}, fmt.Errorf("Unknown KDF algorithm \"%s\"", algorithm)
+	}
+	return p, nil
+}
+
+// IsLegacy reports whether p is the zero value, which stands for the parameters predating configurable KDF, or equals LegacyKDFParams.
+func (p KDFParams) IsLegacy() bool {
+	if p.Algorithm == "" {
+		return true
+	}
+	l := LegacyKDFParams()
+	return p.Algorithm == l.Algorithm && string(p.Salt) == string(l.Salt) && p.Iterations == l.Iterations
+}
+
+func (p KDFParams) String() string {
+	switch p.Algorithm {
+	case "":
+		return LegacyKDFParams().String()
+	case KDFPBKDF2SHA1:
+		return fmt.Sprintf("%s(iter=%d)", p.Algorithm, p.Iterations)
+	case KDFScrypt:
+		return fmt.Sprintf("%s(N=%d, r=%d, p=%d)", p.Algorithm, p.N, p.R, p.P)
+	case KDFArgon2id:
+		return fmt.Sprintf("%s(t=%d, m=%dKiB, p=%d)", p.Algorithm, p.Time, p.MemoryKiB, p.Threads)
+	default:
+		return fmt.Sprintf("unknown(%s)", p.Algorithm)
+	}
+}
+
+// DeriveKey derives a key of KeyLength from password.
+func (p KDFParams) DeriveKey(password string) ([]byte, error) {
+	if p.Algorithm == "" {
+		p = LegacyKDFParams()
+	}
+	if len(p.Salt) == 0 {
+		return nil, fmt.Errorf("KDF salt is empty")
+	}
+
+	switch p.Algorithm {
+	case KDFPBKDF2SHA1:
+		if p.Iterations <= 0 {
+			return nil, fmt.Errorf("Invalid pbkdf2 iterations: %d", p.Iterations)
+		}
+		return pbkdf2.Key([]byte(password), p.Salt, p.Iterations, KeyLength, sha1.New), nil
+	case KDFScrypt:
+		return scrypt.Key([]byte(password), p.Salt, p.N, p.R, p.P, KeyLength)
+	case KDFArgon2id:
+		if p.Time == 0 || p.MemoryKiB == 0 || p.Threads == 0 {
+			return nil, fmt.Errorf("Invalid argon2id params: %v", p)
+		}
+		return argon2.IDKey([]byte(password), p.Salt, p.Time, p.MemoryKiB, p.Threads, KeyLength), nil
+	default:
+		return nil, fmt.Errorf("Unknown KDF algorithm \"%s\"", p.Algorithm)
+	}
+}
@@ -0,0 +1,68 @@
+package btncrypt_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nyaxt/otaru/btncrypt"
+)
+
+func TestKDFParams_Legacy(t *testing.T) {
+	for _, p := range []btncrypt.KDFParams{{}, btncrypt.LegacyKDFParams()} {
+		if !p.IsLegacy() {
+			t.Errorf("%v should be legacy", p)
+		}
+		key, err := p.DeriveKey("hogefuga")
+		if err != nil {
+			t.Errorf("DeriveKey failed: %v", err)
+			continue
+		}
+		if !bytes.Equal(key, btncrypt.KeyFromPassword("hogefuga")) {
+			t.Errorf("Legacy KDF should match KeyFromPassword")
+		}
+	}
+}
+
+func TestKDFParams_DeriveKey(t *testing.T) {
+	for _, alg := range []string{btncrypt.KDFPBKDF2SHA1, btncrypt.KDFScrypt, btncrypt.KDFArgon2id} {
+		p, err := btncrypt.NewKDFParams(alg)
+		if err != nil {
+			t.Errorf("NewKDFParams(%s) failed: %v", alg, err)
+			continue
+		}
+		// keep the test fast
+		switch alg {
+		case btncrypt.KDFPBKDF2SHA1:
+			p.Iterations = 16
+		case btncrypt.KDFScrypt:
+			p.N = 1024
+		case btncrypt.KDFArgon2id:
+			p.Time, p.MemoryKiB = 1, 1024
+		}
+		if p.IsLegacy() {
+			t.Errorf("%v shouldn't be legacy", p)
+		}
+
+		a, err := p.DeriveKey("hogefuga")
+		if err != nil {
+			t.Errorf("DeriveKey(%v) failed: %v", p, err)
+			continue
+		}
+		if len(a) != btncrypt.KeyLength {
+			t.Errorf("invalid key length: %d", len(a))
+		}
+		if b, _ := p.DeriveKey("hogefuga"); !bytes.Equal(a, b) {
+			t.Errorf("DeriveKey(%v) should be deterministic", p)
+		}
+
+		p2, _ := btncrypt.NewKDFParams(alg)
+		p2.Salt, p.Salt = p.Salt, p2.Salt
+		if b, _ := p.DeriveKey("hogefuga"); bytes.Equal(a, b) {
+			t.Errorf("DeriveKey(%v) should depend on salt", p)
+		}
+	}
+
+	if _, err := btncrypt.NewKDFParams("rot13"); err == nil {
+		t.Errorf("NewKDFParams should fail on unknown algorithm")
+	}
+}
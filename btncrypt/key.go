@@ -1,11 +1,25 @@
 package btncrypt
 
 import (
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// KeyLength is the length of keys used by Cipher in bytes.
+const KeyLength = 32
+
+// KeyFromPassword derives a key with LegacyKDFParams.
 func KeyFromPassword(password string) []byte {
-	return pbkdf2.Key([]byte(password), []byte("otaru"), 4096, 32, sha1.New)
+	l := LegacyKDFParams()
+	return pbkdf2.Key([]byte(password), l.Salt, l.Iterations, KeyLength, sha1.New)
+}
+
+// DeriveKey derives a subkey for a specific purpose from key.
+func DeriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
 }
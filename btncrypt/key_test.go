@@ -1,6 +1,7 @@
 package btncrypt_test
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/nyaxt/otaru/btncrypt"
@@ -13,3 +14,18 @@ func TestKeyFromPassword(t *testing.T) {
 	}
 	// t.Errorf("gen key: %v", key)
 }
+
+func TestDeriveKey(t *testing.T) {
+	key := btncrypt.KeyFromPassword("hogefuga")
+	a := btncrypt.DeriveKey(key, "a")
+	b := btncrypt.DeriveKey(key, "b")
+	if len(a) != 32 {
+		t.Errorf("invalid key length: %d", len(a))
+	}
+	if bytes.Equal(a, b) {
+		t.Errorf("keys derived for different purposes should differ")
+	}
+	if !bytes.Equal(a, btncrypt.DeriveKey(key, "a")) {
+		t.Errorf("DeriveKey should be deterministic")
+	}
+}
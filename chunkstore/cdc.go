@@ -0,0 +1,65 @@
+package chunkstore
+
+// Content-defined chunking using a gear-based rolling hash.
+// Chunk boundaries are placed where the hash of the last 64 bytes matches a mask.
+
+const (
+	CDCMinChunkLen = 256 * 1024
+	CDCAvgChunkLen = 1024 * 1024
+	CDCMaxChunkLen = 4 * 1024 * 1024
+
+	// Use top bits of the hash, which depend on the whole 64 byte window.
+	cdcMaskBits = 20 // log2(CDCAvgChunkLen)
+	cdcMask     = ((uint64(1) << cdcMaskBits) - 1) << (64 - cdcMaskBits)
+)
+
+var gearTable [256]uint64
+
+func init() {
+	// The table must never change, as it determines chunk boundaries and thus dedup blobpaths.
+	// splitmix64 w/ a fixed seed.
+	x := uint64(0x6f74617275636463) // "otarucdc"
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// NextCutPoint returns the length of the first content-defined chunk in p.
+// If no boundary is found, it returns min(len(p), CDCMaxChunkLen).
+func NextCutPoint(p []byte) int {
+	n := len(p)
+	if n <= CDCMinChunkLen {
+		return n
+	}
+	if n > CDCMaxChunkLen {
+		n = CDCMaxChunkLen
+	}
+
+	var h uint64
+	// Warm up the hash window just before the min chunk len.
+	for i := CDCMinChunkLen - 64; i < CDCMinChunkLen; i++ {
+		h = (h << 1) + gearTable[p[i]]
+	}
+	for i := CDCMinChunkLen; i < n; i++ {
+		h = (h << 1) + gearTable[p[i]]
+		if h&cdcMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// SplitContentDefined splits p into content-defined chunks. The returned slices share the backing array with p.
+func SplitContentDefined(p []byte) [][]byte {
+	ret := make([][]byte, 0, len(p)/CDCAvgChunkLen+1)
+	for len(p) > 0 {
+		n := NextCutPoint(p)
+		ret = append(ret, p[:n])
+		p = p[n:]
+	}
+	return ret
+}
@@ -0,0 +1,62 @@
+package chunkstore_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/nyaxt/otaru/chunkstore"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(r.Intn(256))
+	}
+	return p
+}
+
+func TestSplitContentDefined_Bounds(t *testing.T) {
+	p := randomBytes(1, 20*1024*1024)
+	pieces := chunkstore.SplitContentDefined(p)
+	total := 0
+	for i, piece := range pieces {
+		if len(piece) > chunkstore.CDCMaxChunkLen {
+			t.Errorf("piece %d too long: %d", i, len(piece))
+		}
+		if i != len(pieces)-1 && len(piece) < chunkstore.CDCMinChunkLen {
+			t.Errorf("piece %d too short: %d", i, len(piece))
+		}
+		total += len(piece)
+	}
+	if total != len(p) {
+		t.Errorf("pieces total len %d != %d", total, len(p))
+	}
+	if len(pieces) < 2 {
+		t.Errorf("Expected multiple pieces, got %d", len(pieces))
+	}
+}
+
+func TestSplitContentDefined_ShiftResilience(t *testing.T) {
+	p := randomBytes(2, 16*1024*1024)
+	shifted := append([]byte("inserted prefix"), p...)
+
+	seen := make(map[string]struct{})
+	for _, piece := range chunkstore.SplitContentDefined(p) {
+		seen[string(piece)] = struct{}{}
+	}
+	pieces := chunkstore.SplitContentDefined(shifted)
+	shared := 0
+	for _, piece := range pieces {
+		if _, ok := seen[string(piece)]; ok {
+			shared++
+		}
+	}
+	if shared < len(pieces)-2 {
+		t.Errorf("Expected most pieces to be shared after insertion, but only %d/%d were", shared, len(pieces))
+	}
+	if !bytes.Equal(bytes.Join(pieces, nil), shifted) {
+		t.Errorf("pieces don't reconstruct the original")
+	}
+}
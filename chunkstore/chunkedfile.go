@@ -26,14 +26,23 @@ type ChunksArrayIO interface {
 	Write(cs []inodedb.FileChunk) error
 }
 
+// SharedChunkQuerier is optionally implemented by ChunksArrayIO to tell if the blob of a chunk is shared with other files, e.g. by a clone.
+// Shared chunks are copy-on-write: they are detached before writes, as immutable chunks are.
+type SharedChunkQuerier interface {
+	IsSharedChunk(c inodedb.FileChunk) bool
+}
+
 type ChunkedFileIO struct {
 	bs blobstore.RandomAccessBlobStore
 	c  btncrypt.Cipher
 
 	caio       ChunksArrayIO
-	newChunkIO func(blobstore.BlobHandle, btncrypt.Cipher, int64) blobstore.BlobHandle
+	newChunkIO func(bh blobstore.BlobHandle, c btncrypt.Cipher, blobpath string, offset int64) blobstore.BlobHandle
 
 	origFilename string
+
+	// immutableBlobs caches whether the chunk blobs are sealed or compressed per their headers, so that the header isn't read on every write. It doesn't change once the blob is written.
+	immutableBlobs map[string]bool
 }
 
 func NewChunkedFileIO(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, caio ChunksArrayIO) *ChunkedFileIO {
@@ -44,18 +53,22 @@ func NewChunkedFileIO(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, cai
 		caio: caio,
 
 		origFilename: "<unknown>",
+
+		immutableBlobs: make(map[string]bool),
 	}
-	cio.newChunkIO = func(bh blobstore.BlobHandle, c btncrypt.Cipher, offset int64) blobstore.BlobHandle {
+	cio.newChunkIO = func(bh blobstore.BlobHandle, c btncrypt.Cipher, blobpath string, offset int64) blobstore.BlobHandle {
 		return NewChunkIOWithMetadata(
 			bh, c,
-			ChunkHeader{OrigFilename: cio.origFilename, OrigOffset: offset},
+			ChunkHeader{OrigFilename: cio.origFilename, OrigOffset: offset, BlobPath: blobpath},
 		)
 	}
 	return cio
 }
 
 func (cfio *ChunkedFileIO) OverrideNewChunkIOForTesting(newChunkIO func(blobstore.BlobHandle, btncrypt.Cipher, int64) blobstore.BlobHandle) {
-	cfio.newChunkIO = newChunkIO
+	cfio.newChunkIO = func(bh blobstore.BlobHandle, c btncrypt.Cipher, _ string, offset int64) blobstore.BlobHandle {
+		return newChunkIO(bh, c, offset)
+	}
 }
 
 func (cfio *ChunkedFileIO) SetOrigFilename(name string) { cfio.origFilename = name }
@@ -66,10 +79,85 @@ func (cfio *ChunkedFileIO) newFileChunk(newo int64) (inodedb.FileChunk, error) {
 		return inodedb.FileChunk{}, fmt.Errorf("Failed to generate new blobpath: %v", err)
 	}
 	fc := inodedb.FileChunk{Offset: newo, Length: 0, BlobPath: bpath}
+	cfio.immutableBlobs[bpath] = false
 	log.Printf("new chunk %+v", fc)
 	return fc, nil
 }
 
+// isImmutableChunk returns true if the chunk c can't be modified in place, and needs to be detached before writes.
+func (cfio *ChunkedFileIO) isImmutableChunk(c inodedb.FileChunk) (bool, error) {
+	if IsDedupBlobPath(c.BlobPath) {
+		return true, nil
+	}
+	if q, ok := cfio.caio.(SharedChunkQuerier); ok && q.IsSharedChunk(c) {
+		return true, nil
+	}
+	if immutable, ok := cfio.immutableBlobs[c.BlobPath]; ok {
+		return immutable, nil
+	}
+
+	bh, err := cfio.bs.Open(c.BlobPath, fl.O_RDONLY)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open path \"%s\" to read its header: %v", c.BlobPath, err)
+	}
+	defer bh.Close()
+
+	immutable := false
+	if cio, ok := cfio.newChunkIO(bh, cfio.c, c.BlobPath, c.Offset).(*ChunkIO); ok {
+		if err := cio.ensureHeader(); err != nil {
+			return false, err
+		}
+		immutable = cio.header.Sealed || cio.header.Compression != CompressionNone
+	}
+	cfio.immutableBlobs[c.BlobPath] = immutable
+	return immutable, nil
+}
+
+// detachChunk copies the first length bytes of the immutable chunk c to a newly allocated blob, and points c to the new blob.
+func (cfio *ChunkedFileIO) detachChunk(c *inodedb.FileChunk, length int64) error {
+	buf := make([]byte, length)
+	if err := func() error {
+		bh, err := cfio.bs.Open(c.BlobPath, fl.O_RDONLY)
+		if err != nil {
+			return fmt.Errorf("Failed to open path \"%s\" for reading: %v", c.BlobPath, err)
+		}
+		defer bh.Close()
+
+		cio := cfio.newChunkIO(bh, cfio.c, c.BlobPath, c.Offset)
+		defer cio.Close()
+		return cio.PRead(0, buf)
+	}(); err != nil {
+		return err
+	}
+
+	newc, err := cfio.newFileChunk(c.Offset)
+	if err != nil {
+		return err
+	}
+	bh, err := cfio.bs.Open(newc.BlobPath, fl.O_RDWR|fl.O_CREATE|fl.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("Failed to open path \"%s\" for writing: %v", newc.BlobPath, err)
+	}
+	defer func() {
+		if err := bh.Close(); err != nil {
+			log.Printf("blobhandle Close failed: %v", err)
+		}
+	}()
+	cio := cfio.newChunkIO(bh, cfio.c, newc.BlobPath, c.Offset)
+	if err := cio.PWrite(0, buf); err != nil {
+		cio.Close()
+		return err
+	}
+	if err := cio.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Detached chunk %+v to %s", *c, newc.BlobPath)
+	newc.Length = length
+	*c = newc
+	return nil
+}
+
 func (cfio *ChunkedFileIO) PWrite(offset int64, p []byte) error {
 	log.Printf("PWrite: offset=%d, len=%d", offset, len(p))
 	// log.Printf("PWrite: p=%v", p)
@@ -89,6 +177,21 @@ func (cfio *ChunkedFileIO) PWrite(offset int64, p []byte) error {
 			return EPERM
 		}
 
+		if !isNewChunk {
+			immutable, err := cfio.isImmutableChunk(*c)
+			if err != nil {
+				return err
+			}
+			if immutable {
+				if err := cfio.detachChunk(c, c.Length); err != nil {
+					return err
+				}
+				if err := cfio.caio.Write(cs); err != nil {
+					return fmt.Errorf("Failed to write updated cs array: %v", err)
+				}
+			}
+		}
+
 		flags := fl.O_RDWR
 		if isNewChunk {
 			flags |= fl.O_CREATE | fl.O_EXCL
@@ -103,7 +206,7 @@ func (cfio *ChunkedFileIO) PWrite(offset int64, p []byte) error {
 			}
 		}()
 
-		cio := cfio.newChunkIO(bh, cfio.c, c.Offset)
+		cio := cfio.newChunkIO(bh, cfio.c, c.BlobPath, c.Offset)
 		defer func() {
 			if err := cio.Close(); err != nil {
 				log.Printf("cio Close failed: %v", err)
@@ -272,14 +375,14 @@ func (cfio *ChunkedFileIO) PRead(offset int64, p []byte) error {
 			}
 		}()
 
-		cio := cfio.newChunkIO(bh, cfio.c, c.Offset)
+		cio := cfio.newChunkIO(bh, cfio.c, c.BlobPath, c.Offset)
 		defer func() {
 			if err := cio.Close(); err != nil {
 				log.Printf("cio Close failed: %v", err)
 			}
 		}()
 
-		n := Int64Min(int64(len(p)), c.Length-coff)
+		n := Int64Min(int64(len(remp)), c.Length-coff)
 		if err := cio.PRead(coff, remp[:n]); err != nil {
 			return err
 		}
@@ -334,11 +437,26 @@ func (cfio *ChunkedFileIO) Truncate(size int64) error {
 			// trim the chunk
 			chunksize := size - c.Left()
 
+			immutable, err := cfio.isImmutableChunk(*c)
+			if err != nil {
+				return err
+			}
+			if immutable {
+				if err := cfio.detachChunk(c, chunksize); err != nil {
+					return err
+				}
+				cs = cs[:i+1]
+				if err := cfio.caio.Write(cs); err != nil {
+					return fmt.Errorf("Failed to write updated cs array: %v", err)
+				}
+				return nil
+			}
+
 			bh, err := cfio.bs.Open(c.BlobPath, fl.O_RDWR)
 			if err != nil {
 				return err
 			}
-			cio := cfio.newChunkIO(bh, cfio.c, c.Offset)
+			cio := cfio.newChunkIO(bh, cfio.c, c.BlobPath, c.Offset)
 			if err := cio.Truncate(chunksize); err != nil {
 				return err
 			}
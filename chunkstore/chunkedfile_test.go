@@ -4,6 +4,7 @@ import (
 	"github.com/nyaxt/otaru/blobstore"
 	"github.com/nyaxt/otaru/btncrypt"
 	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
 	"github.com/nyaxt/otaru/inodedb"
 	. "github.com/nyaxt/otaru/testutils"
 
@@ -135,3 +136,42 @@ func TestChunkedFileIO_MultiChunk(t *testing.T) {
 		fmt.Printf("? %+v\n", bh.Log[1])
 	}
 }
+
+type readOpenCountingBlobStore struct {
+	*blobstore.FileBlobStore
+	numReadOpens int
+}
+
+func (bs *readOpenCountingBlobStore) Open(blobpath string, flags int) (blobstore.BlobHandle, error) {
+	if !fl.IsWriteAllowed(flags) {
+		bs.numReadOpens++
+	}
+	return bs.FileBlobStore.Open(blobpath, flags)
+}
+
+func TestChunkedFileIO_ImmutableCheckCached(t *testing.T) {
+	caio := NewSimpleDBChunksArrayIO()
+	bs := &readOpenCountingBlobStore{FileBlobStore: TestFileBlobStore()}
+	if err := chunkstore.NewChunkedFileIO(bs, TestCipher(), caio).PWrite(0, HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+
+	bs.numReadOpens = 0
+	cfio := chunkstore.NewChunkedFileIO(bs, TestCipher(), caio)
+	for i := 0; i < 3; i++ {
+		if err := cfio.PWrite(0, []byte("HELLO")); err != nil {
+			t.Fatalf("PWrite failed: %v", err)
+		}
+	}
+	if bs.numReadOpens != 1 {
+		t.Errorf("Chunk header should be read once to tell if the chunk is mutable, but read %d times", bs.numReadOpens)
+	}
+
+	// A chunk of which header can't be read shouldn't be taken as mutable.
+	if err := bs.RemoveBlob(caio.cs[0].BlobPath); err != nil {
+		t.Fatalf("RemoveBlob failed: %v", err)
+	}
+	if err := chunkstore.NewChunkedFileIO(bs, TestCipher(), caio).PWrite(0, []byte("HELLO")); err == nil {
+		t.Errorf("PWrite to the chunk with missing blob should fail")
+	}
+}
@@ -2,6 +2,7 @@ package chunkstore
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -23,7 +24,18 @@ const (
 	MaxChunkPayloadLen = math.MaxInt32
 	MaxOrigFilenameLen = 1024
 
-	CurrentFormat             byte = 0x03
+	// frameVersionBits is the number of lower bits of PayloadVersion recorded in FrameVersions.
+	frameVersionBits = 16
+	// maxFrameVersionAge is the number of frame writes after which a frame is rewritten by ChunkIO, so that its version stays recoverable from the lower bits.
+	// Half of the range leaves room for frame writes by a single ChunkIO.PWrite.
+	maxFrameVersionAge = 1 << (frameVersionBits - 1)
+
+	// Format 0x03 chunks have fixed size content frames, and no compression.
+	LegacyFormat byte = 0x03
+	// Format 0x04 adds optional per-frame compression.
+	FrameCompressionFormat byte = 0x04
+	// Format 0x05 authenticates each content frame with its blobpath, frame index, and the PayloadVersion the frame was written at.
+	CurrentFormat             byte = 0x05
 	CurrentFrameEncapsulation byte = 0x02
 )
 
@@ -33,6 +45,40 @@ type ChunkHeader struct {
 	PayloadVersion     int64
 	OrigFilename       string
 	OrigOffset         int64
+
+	// Compression specifies the algorithm used to compress content frames.
+	Compression Compression
+	// FrameLens lists stored (compressed) length of each content frame. Only available if Compression != CompressionNone.
+	FrameLens []uint32
+
+	// KeyID identifies the data key the chunk was encrypted with. 0 for chunks encrypted with the password-derived key.
+	// Frames rewritten in place are encrypted with the current key, so a chunk with KeyID of a retired key may not be fully readable with it alone. Re-encryption rewrites such chunks as a whole.
+	KeyID uint32
+
+	// BlobPath is the blobpath the chunk is bound to. Content frames are authenticated with it, so frames moved from other blobs fail to decrypt.
+	// Empty if the chunk was written without knowing its blobpath. Such chunks fail VerifyBlobPath, so they are only readable by callers which don't know the blobpath either.
+	BlobPath string
+	// Sealed is set on chunks written as a whole. Content frames of sealed chunks are also bound to PayloadVersion, which detects frames rolled back to an older version of the chunk.
+	// Sealed chunks are immutable, since modifying a frame in place would require re-encrypting all the other frames.
+	Sealed bool
+	// FrameVersions lists the lower 16 bits of PayloadVersion each content frame of an unsealed chunk was last written at, as big endian uint16s. Frames are bound to the full version recovered from it, which detects frames rolled back in place.
+	// Frames not listed are of chunks written before FrameVersions was introduced, and are bound to version 0 until rewritten.
+	FrameVersions []byte
+	// PendingFrame is 1 + the index of the content frame being rewritten in place when the header was written, or 0. The header is written ahead of the frame, so the frame may still be the previous one, bound to PendingFrameVersion and of PendingFrameLen.
+	PendingFrame        int
+	PendingFrameVersion int64
+	PendingFrameLen     uint32
+
+	// format is the format byte the header was read with. Not serialized.
+	format byte
+}
+
+// Format returns the format version of the chunk the header was read from, or CurrentFormat.
+func (h ChunkHeader) Format() byte {
+	if h.format == 0 {
+		return CurrentFormat
+	}
+	return h.format
 }
 
 func (h ChunkHeader) WriteTo(w io.Writer, c btncrypt.Cipher) error {
@@ -42,6 +88,10 @@ func (h ChunkHeader) WriteTo(w io.Writer, c btncrypt.Cipher) error {
 		return fmt.Errorf("payload length too big: %d", h.PayloadLen)
 	}
 
+	if h.Compression != CompressionNone && len(h.FrameLens) > MaxCompressedChunkFrames {
+		return fmt.Errorf("too many frames for a compressed chunk: %d", len(h.FrameLens))
+	}
+
 	if len(h.OrigFilename) > MaxOrigFilenameLen {
 		h.OrigFilename = filepath.Base(h.OrigFilename)
 		if len(h.OrigFilename) > MaxOrigFilenameLen {
@@ -52,7 +102,7 @@ func (h ChunkHeader) WriteTo(w io.Writer, c btncrypt.Cipher) error {
 	if _, err := w.Write([]byte{ChunkSignatureMagic1, ChunkSignatureMagic2}); err != nil {
 		return fmt.Errorf("Failed to write signature magic: %v", err)
 	}
-	if _, err := w.Write([]byte{CurrentFormat}); err != nil {
+	if _, err := w.Write([]byte{h.Format()}); err != nil {
 		return fmt.Errorf("Failed to write format byte: %v", err)
 	}
 
@@ -84,6 +134,27 @@ func (h ChunkHeader) WriteTo(w io.Writer, c btncrypt.Cipher) error {
 	return nil
 }
 
+// chunkFormat describes how to decode chunks of a format, identified by the format byte following the signature magic.
+type chunkFormat struct {
+	// readHeaderFrame decodes the encrypted header frame, which follows the signature magic and the format byte.
+	readHeaderFrame func(h *ChunkHeader, r io.Reader, c btncrypt.Cipher) error
+	// authenticatesFrames is true if content frames are encrypted with additional data returned by ChunkHeader.contentFrameAAD.
+	authenticatesFrames bool
+}
+
+// chunkFormats lists all chunk formats readable. Add an entry here when introducing a new format, so existing chunks stay readable.
+// Chunks modified in place keep their format, so the formats listed here must stay writable by ChunkIO too.
+var chunkFormats = map[byte]chunkFormat{
+	LegacyFormat:           {readHeaderFrame: readGobHeaderFrame},
+	FrameCompressionFormat: {readHeaderFrame: readGobHeaderFrame},
+	CurrentFormat:          {readHeaderFrame: readGobHeaderFrame, authenticatesFrames: true},
+}
+
+func IsSupportedFormat(format byte) bool {
+	_, ok := chunkFormats[format]
+	return ok
+}
+
 func (h *ChunkHeader) ReadFrom(r io.Reader, c btncrypt.Cipher) error {
 	magic := make([]byte, SignatureLength+1)
 	if _, err := r.Read(magic); err != nil {
@@ -96,10 +167,18 @@ func (h *ChunkHeader) ReadFrom(r io.Reader, c btncrypt.Cipher) error {
 		magic[1] != ChunkSignatureMagic2 {
 		return errors.New("signature magic mismatch")
 	}
-	if magic[2] != CurrentFormat {
-		return fmt.Errorf("Expected format version %x but got %x", CurrentFormat, magic[2])
+	format, ok := chunkFormats[magic[2]]
+	if !ok {
+		return fmt.Errorf("Unknown chunk format version %x", magic[2])
+	}
+	if err := format.readHeaderFrame(h, r, c); err != nil {
+		return err
 	}
+	h.format = magic[2]
+	return nil
+}
 
+func readGobHeaderFrame(h *ChunkHeader, r io.Reader, c btncrypt.Cipher) error {
 	framelen := ChunkHeaderLength - c.FrameOverhead() - SignatureLength - 1
 	bdr, err := btncrypt.NewReader(r, c, framelen)
 	if err != nil {
@@ -114,10 +193,107 @@ func (h *ChunkHeader) ReadFrom(r io.Reader, c btncrypt.Cipher) error {
 		panic("Incomplete read in prologue frame !?!?")
 	}
 
+	// gob doesn't transmit zero valued fields. Clear fields whose defaults of h would be wrong for chunks written without them.
+	h.KeyID = 0
+	h.BlobPath = ""
+	h.Sealed = false
+	h.FrameVersions = nil
+	h.PendingFrame = 0
+	h.PendingFrameVersion = 0
+	h.PendingFrameLen = 0
 	dec := gob.NewDecoder(bytes.NewBuffer(encoded))
 	if err := dec.Decode(h); err != nil {
 		return err
 	}
+	if h.Compression != CompressionNone && len(h.FrameLens) != (int(h.PayloadLen)+ContentFramePayloadLength-1)/ContentFramePayloadLength {
+		return fmt.Errorf("FrameLens has %d entries, which doesn't match PayloadLen %d", len(h.FrameLens), h.PayloadLen)
+	}
+	if len(h.FrameVersions)%2 != 0 {
+		return fmt.Errorf("FrameVersions has odd length %d", len(h.FrameVersions))
+	}
+
+	return nil
+}
+
+const contentFrameAADPrefix = "otaru-content-frame"
 
+// contentFrameAAD returns the additional data authenticating i-th content frame. Returns nil for formats without frame authentication.
+func (h ChunkHeader) contentFrameAAD(i int) []byte {
+	if !chunkFormats[h.Format()].authenticatesFrames {
+		return nil
+	}
+
+	return h.frameAAD(i, h.frameVersion(i))
+}
+
+// pendingFrameAADFunc returns btncrypt.AADFunc for the previous version of the pending frame.
+func (h ChunkHeader) pendingFrameAADFunc() btncrypt.AADFunc {
+	return func(int) []byte { return h.frameAAD(h.PendingFrame-1, h.PendingFrameVersion) }
+}
+
+// isPendingFrame tells if the i-th content frame may still be the one before the rewrite recorded in the header.
+func (h ChunkHeader) isPendingFrame(i int) bool {
+	return chunkFormats[h.Format()].authenticatesFrames && h.PendingFrame == i+1
+}
+
+func (h ChunkHeader) frameAAD(i int, ver int64) []byte {
+	aad := make([]byte, len(contentFrameAADPrefix)+4+8, len(contentFrameAADPrefix)+4+8+len(h.BlobPath))
+	copy(aad, contentFrameAADPrefix)
+	binary.BigEndian.PutUint32(aad[len(contentFrameAADPrefix):], uint32(i))
+	binary.BigEndian.PutUint64(aad[len(contentFrameAADPrefix)+4:], uint64(ver))
+	return append(aad, h.BlobPath...)
+}
+
+// contentFrameAADFunc returns btncrypt.AADFunc for a stream of content frames starting from first-th frame.
+func (h ChunkHeader) contentFrameAADFunc(first int) btncrypt.AADFunc {
+	if !chunkFormats[h.Format()].authenticatesFrames {
+		return nil
+	}
+	return func(i int) []byte { return h.contentFrameAAD(first + i) }
+}
+
+// frameVersion returns the PayloadVersion the i-th content frame is bound to.
+func (h ChunkHeader) frameVersion(i int) int64 {
+	if h.Sealed {
+		return h.PayloadVersion
+	}
+	if 2*i+2 > len(h.FrameVersions) {
+		return 0
+	}
+	// The frame was written at the latest version not newer than PayloadVersion with the lower bits recorded.
+	lower := binary.BigEndian.Uint16(h.FrameVersions[2*i:])
+	return h.PayloadVersion - int64(uint16(h.PayloadVersion)-lower)
+}
+
+// setFrameVersion records that the i-th content frame is written at PayloadVersion. Frames must be recorded in order.
+func (h *ChunkHeader) setFrameVersion(i int) {
+	if 2*i > len(h.FrameVersions) {
+		panic(fmt.Sprintf("setFrameVersion: frame %d recorded before frame %d", i, len(h.FrameVersions)/2))
+	}
+	if 2*i == len(h.FrameVersions) {
+		h.FrameVersions = append(h.FrameVersions, 0, 0)
+	}
+	binary.BigEndian.PutUint16(h.FrameVersions[2*i:], uint16(h.PayloadVersion))
+}
+
+// isFrameVersionStale returns true if the i-th content frame of an unsealed chunk needs to be rewritten.
+func (h ChunkHeader) isFrameVersionStale(i int) bool {
+	if 2*i+2 > len(h.FrameVersions) {
+		return true
+	}
+	return h.PayloadVersion-h.frameVersion(i) >= maxFrameVersionAge
+}
+
+// VerifyBlobPath checks that the chunk is bound to blobpath. Chunks of older formats always pass.
+func (h ChunkHeader) VerifyBlobPath(blobpath string) error {
+	if !chunkFormats[h.Format()].authenticatesFrames {
+		return nil
+	}
+	if h.BlobPath == "" {
+		return &IntegrityError{BlobPath: blobpath, Frame: HeaderFrame, Reason: "chunk isn't bound to any blobpath"}
+	}
+	if h.BlobPath != blobpath {
+		return &IntegrityError{BlobPath: blobpath, Frame: HeaderFrame, Reason: fmt.Sprintf("chunk is bound to blobpath \"%s\"", h.BlobPath)}
+	}
 	return nil
 }
@@ -60,3 +60,28 @@ func TestChunkHeader_Read_BadMagic(t *testing.T) {
 		t.Errorf("UnmarshalBinary passed on bad magic!", err)
 	}
 }
+
+func TestChunkHeader_FitsFrameVersionsOfFullChunk(t *testing.T) {
+	numFrames := chunkstore.ChunkSplitSize / chunkstore.ContentFramePayloadLength
+	h := chunkstore.ChunkHeader{
+		PayloadLen:     chunkstore.ChunkSplitSize,
+		PayloadVersion: 0x7fffffffffffffff,
+		OrigFilename:   string(bytes.Repeat([]byte{'a'}, chunkstore.MaxOrigFilenameLen)),
+		OrigOffset:     0x0123456789abcdef,
+		KeyID:          0xffffffff,
+		BlobPath:       "dedup_0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		FrameVersions:  bytes.Repeat([]byte{0xff}, 2*numFrames),
+	}
+
+	var b bytes.Buffer
+	if err := h.WriteTo(&b, TestCipher()); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	var h2 chunkstore.ChunkHeader
+	if err := h2.ReadFrom(&b, TestCipher()); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if !bytes.Equal(h2.FrameVersions, h.FrameVersions) {
+		t.Errorf("Failed to unmarshal FrameVersions")
+	}
+}
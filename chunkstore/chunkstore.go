@@ -1,6 +1,8 @@
 package chunkstore
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,6 +20,9 @@ const (
 
 var (
 	ZeroContent = make([]byte, ContentFramePayloadLength)
+
+	ErrCompressedChunkIsImmutable = errors.New("Compressed chunks can't be modified in place")
+	ErrSealedChunkIsImmutable     = errors.New("Sealed chunks can't be modified in place")
 )
 
 func NewQueryChunkVersion(c btncrypt.Cipher) cachedblobstore.QueryVersionFunc {
@@ -34,12 +39,36 @@ func NewQueryChunkVersion(c btncrypt.Cipher) cachedblobstore.QueryVersionFunc {
 	}
 }
 
+// NewChunkWriter returns io.WriteCloser to write a new chunk of the current format. The chunk is sealed if h.Sealed is set.
 func NewChunkWriter(w io.Writer, c btncrypt.Cipher, h ChunkHeader) (io.WriteCloser, error) {
+	h.format = CurrentFormat
+	if h.PayloadVersion == 0 {
+		// ChunkIO reads PayloadVersion 0 as 1, since gob omits zero values.
+		h.PayloadVersion = 1
+	}
+	if !h.Sealed {
+		h.FrameVersions = nil
+		numFrames := (int(h.PayloadLen) + ContentFramePayloadLength - 1) / ContentFramePayloadLength
+		for i := 0; i < numFrames; i++ {
+			h.setFrameVersion(i)
+		}
+	}
+	return newChunkWriter(w, c, h)
+}
+
+// NewChunkWriterOfFormatForTesting returns io.WriteCloser to write a chunk of an older format.
+func NewChunkWriterOfFormatForTesting(w io.Writer, c btncrypt.Cipher, h ChunkHeader, format byte) (io.WriteCloser, error) {
+	h.format = format
+	return newChunkWriter(w, c, h)
+}
+
+func newChunkWriter(w io.Writer, c btncrypt.Cipher, h ChunkHeader) (io.WriteCloser, error) {
+	h.KeyID = c.KeyID()
 	if err := h.WriteTo(w, c); err != nil {
 		return nil, fmt.Errorf("Failed to write header: %v", err)
 	}
 
-	return btncrypt.NewWriteCloser(w, c, int(h.PayloadLen))
+	return btncrypt.NewWriteCloserWithAAD(w, c, int(h.PayloadLen), h.contentFrameAADFunc(0))
 }
 
 type ChunkReader struct {
@@ -48,7 +77,8 @@ type ChunkReader struct {
 
 	header ChunkHeader
 
-	bdr *btncrypt.Reader
+	bdr   io.Reader
+	nread int
 }
 
 func NewChunkReader(r io.Reader, c btncrypt.Cipher) (*ChunkReader, error) {
@@ -58,8 +88,17 @@ func NewChunkReader(r io.Reader, c btncrypt.Cipher) (*ChunkReader, error) {
 		return nil, fmt.Errorf("Failed to read header: %v", err)
 	}
 
+	if cr.header.Compression != CompressionNone {
+		cr.bdr = &compressedChunkReader{r: r, c: c, h: cr.header}
+		return cr, nil
+	}
+	if cr.header.PendingFrame != 0 {
+		cr.bdr = &pendingChunkReader{r: r, c: c, h: cr.header}
+		return cr, nil
+	}
+
 	var err error
-	cr.bdr, err = btncrypt.NewReader(cr.r, cr.c, cr.Length())
+	cr.bdr, err = btncrypt.NewReaderWithAAD(cr.r, cr.c, cr.Length(), cr.header.contentFrameAADFunc(0))
 	if err != nil {
 		return nil, err
 	}
@@ -77,9 +116,57 @@ func (cr *ChunkReader) Length() int {
 }
 
 func (cr *ChunkReader) Read(p []byte) (int, error) {
-	return cr.bdr.Read(p)
+	n, err := cr.bdr.Read(p)
+	if err == btncrypt.ErrAuthenticationFailed {
+		// Frames are read sequentially, so the failing frame is the one containing the end of content read so far.
+		return n, frameError(cr.header, cr.nread/ContentFramePayloadLength, err)
+	}
+	cr.nread += n
+	return n, err
+}
+
+// pendingChunkReader provides io.Reader of a chunk's content frame by frame, so that the pending frame can fall back to its previous version.
+type pendingChunkReader struct {
+	r      io.Reader
+	c      btncrypt.Cipher
+	h      ChunkHeader
+	i      int
+	unread []byte
+}
+
+func (cr *pendingChunkReader) Read(p []byte) (int, error) {
+	if len(cr.unread) == 0 {
+		payloadLen := contentFrameRawLen(int(cr.h.PayloadLen), cr.i)
+		if payloadLen <= 0 {
+			return 0, io.EOF
+		}
+
+		encrypted := make([]byte, cr.c.EncryptedFrameSize(payloadLen))
+		n, err := io.ReadFull(cr.r, encrypted)
+		if err != nil && !(err == io.ErrUnexpectedEOF && cr.h.isPendingFrame(cr.i)) {
+			return 0, err
+		}
+		f, err := btncrypt.DecryptWithAAD(cr.c, encrypted[:n], payloadLen, cr.h.contentFrameAADFunc(cr.i))
+		if err != nil && cr.h.isPendingFrame(cr.i) {
+			prevLen := int(cr.h.PendingFrameLen)
+			if prevEncLen := cr.c.EncryptedFrameSize(prevLen); prevEncLen <= n {
+				f, err = btncrypt.DecryptWithAAD(cr.c, encrypted[:prevEncLen], prevLen, cr.h.pendingFrameAADFunc())
+			}
+		}
+		if err != nil {
+			return 0, frameError(cr.h, cr.i, err)
+		}
+		cr.unread = f
+		cr.i++
+	}
+
+	n := copy(p, cr.unread)
+	cr.unread = cr.unread[n:]
+	return n, nil
 }
 
+var _ = io.Reader(&pendingChunkReader{})
+
 // ChunkIO provides RandomAccessIO for blobchunk
 type ChunkIO struct {
 	bh blobstore.BlobHandle
@@ -87,6 +174,13 @@ type ChunkIO struct {
 
 	didReadHeader bool
 	header        ChunkHeader
+	// expectedBlobPath is the blobpath bh was opened with, if known.
+	expectedBlobPath string
+	// persistedLen is the PayloadLen of the header last written to, or read from, bh.
+	persistedLen int
+	// pendingChecked is set once the pending frame is known to be of either version. pendingIsPrevious is set if it is still the previous one.
+	pendingChecked    bool
+	pendingIsPrevious bool
 
 	needsHeaderUpdate bool
 }
@@ -100,6 +194,7 @@ func NewChunkIO(bh blobstore.BlobHandle, c btncrypt.Cipher) *ChunkIO {
 			OrigFilename:   "<unknown>",
 			OrigOffset:     -1,
 			PayloadVersion: 1,
+			KeyID:          c.KeyID(),
 		},
 		needsHeaderUpdate: false,
 	}
@@ -109,6 +204,10 @@ func NewChunkIOWithMetadata(bh blobstore.BlobHandle, c btncrypt.Cipher, h ChunkH
 	ch := NewChunkIO(bh, c)
 	ch.header = h
 	ch.header.PayloadVersion = 1
+	ch.header.KeyID = c.KeyID()
+	ch.header.Sealed = false
+	ch.header.PendingFrame = 0
+	ch.expectedBlobPath = h.BlobPath
 	return ch
 }
 
@@ -125,6 +224,12 @@ func (ch *ChunkIO) ensureHeader() error {
 	if err := ch.header.ReadFrom(&blobstore.OffsetReader{ch.bh, 0}, ch.c); err != nil {
 		return fmt.Errorf("Failed to read header: %v", err)
 	}
+	ch.persistedLen = int(ch.header.PayloadLen)
+	if ch.expectedBlobPath != "" {
+		if err := ch.header.VerifyBlobPath(ch.expectedBlobPath); err != nil {
+			return err
+		}
+	}
 
 	ch.didReadHeader = true
 	return nil
@@ -175,7 +280,19 @@ func (ch *ChunkIO) expandLengthBy(by int) error {
 	return nil
 }
 
+func (ch *ChunkIO) isCompressed() bool {
+	return ch.header.Compression != CompressionNone
+}
+
 func (ch *ChunkIO) encryptedFrameOffset(i int) int {
+	if ch.isCompressed() {
+		offset := ChunkHeaderLength
+		for j := 0; j < i; j++ {
+			offset += ch.c.EncryptedFrameSize(int(ch.header.FrameLens[j]))
+		}
+		return offset
+	}
+
 	encryptedFrameSize := ch.c.EncryptedFrameSize(ContentFramePayloadLength)
 	return ChunkHeaderLength + encryptedFrameSize*i
 }
@@ -203,48 +320,192 @@ func (ch *ChunkIO) readContentFrame(i int) (*decryptedContentFrame, error) {
 	// the offset of the start of the frame in blob
 	blobOffset := ch.encryptedFrameOffset(i)
 
+	if ch.isCompressed() {
+		if i >= len(ch.header.FrameLens) {
+			return nil, fmt.Errorf("Frame idx %d out of range. Chunk has %d frames.", i, len(ch.header.FrameLens))
+		}
+		storedLen := int(ch.header.FrameLens[i])
+		encrypted := make([]byte, ch.c.EncryptedFrameSize(storedLen))
+		if err := ch.bh.PRead(int64(blobOffset), encrypted); err != nil {
+			return nil, fmt.Errorf("Failed to read frame idx: %d, err: %v", i, err)
+		}
+		p, err := decodeStoredFrame(ch.c, ch.header.Compression, encrypted, storedLen, framePayloadLen, ch.header.contentFrameAADFunc(i))
+		if err != nil {
+			if err == btncrypt.ErrAuthenticationFailed {
+				return nil, frameError(ch.header, i, err)
+			}
+			return nil, fmt.Errorf("Failed to decode frame idx: %d, err: %v", i, err)
+		}
+		log.Printf("ChunkIO: Read compressed content frame idx: %d", i)
+		return &decryptedContentFrame{
+			P: p, Offset: offset,
+			IsLastFrame: isLastFrame,
+		}, nil
+	}
+
+	p, err := ch.decryptFrameAt(blobOffset, framePayloadLen, ch.header.contentFrameAADFunc(i))
+	if ch.header.isPendingFrame(i) {
+		if err != nil {
+			// The rewrite of the frame didn't complete, so it still has the previous content.
+			var perr error
+			if p, perr = ch.decryptFrameAt(blobOffset, int(ch.header.PendingFrameLen), ch.header.pendingFrameAADFunc()); perr == nil {
+				log.Printf("ChunkIO: Read the previous version of pending content frame idx: %d", i)
+				ch.pendingIsPrevious = true
+				err = nil
+			}
+		}
+		ch.pendingChecked = err == nil
+	}
+	if err != nil {
+		return nil, frameError(ch.header, i, err)
+	}
+
+	log.Printf("ChunkIO: Read content frame idx: %d", i)
+	return &decryptedContentFrame{
+		P: p, Offset: offset,
+		IsLastFrame: isLastFrame,
+	}, nil
+}
+
+func (ch *ChunkIO) decryptFrameAt(blobOffset, payloadLen int, aadf btncrypt.AADFunc) ([]byte, error) {
 	rd := &blobstore.OffsetReader{ch.bh, int64(blobOffset)}
-	bdr, err := btncrypt.NewReader(rd, ch.c, framePayloadLen)
+	bdr, err := btncrypt.NewReaderWithAAD(rd, ch.c, payloadLen, aadf)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create BtnDecryptReader: %v", err)
 	}
 
-	p := make([]byte, framePayloadLen, ContentFramePayloadLength)
+	p := make([]byte, payloadLen, ContentFramePayloadLength)
 	if _, err := io.ReadFull(bdr, p); err != nil {
-		return nil, fmt.Errorf("Failed to decrypt frame idx: %d, err: %v", i, err)
+		return nil, err
 	}
 	if !bdr.HasReadAll() {
 		panic("Incomplete frame read")
 	}
+	return p, nil
+}
 
-	log.Printf("ChunkIO: Read content frame idx: %d", i)
-	return &decryptedContentFrame{
-		P: p, Offset: offset,
-		IsLastFrame: isLastFrame,
-	}, nil
+// writeHeader writes h in a single PWrite, so that the header on bh is never partially updated.
+func (ch *ChunkIO) writeHeader(h ChunkHeader) error {
+	var b bytes.Buffer
+	if err := h.WriteTo(&b, ch.c); err != nil {
+		return fmt.Errorf("Failed to encode header: %v", err)
+	}
+	if err := ch.bh.PWrite(0, b.Bytes()); err != nil {
+		return fmt.Errorf("Header write failed: %v", err)
+	}
+	ch.persistedLen = int(h.PayloadLen)
+	return nil
 }
 
+// writeContentFrame writes the i-th content frame along with the header, ordered so that the chunk is readable at any point in between.
 func (ch *ChunkIO) writeContentFrame(i int, f *decryptedContentFrame) error {
 	// the offset of the start of the frame in blob
 	blobOffset := ch.encryptedFrameOffset(i)
+	offset := i * ContentFramePayloadLength
+	isNewFrame := offset >= ch.persistedLen
+
+	if !isNewFrame && chunkFormats[ch.header.Format()].authenticatesFrames {
+		if err := ch.settlePendingFrame(i); err != nil {
+			return err
+		}
+		if !ch.pendingIsPrevious {
+			ch.header.PendingFrame = i + 1
+			ch.header.PendingFrameVersion = ch.header.frameVersion(i)
+			ch.header.PendingFrameLen = uint32(util.IntMin(ch.persistedLen-offset, ContentFramePayloadLength))
+		}
+		// Otherwise the frame i is the pending one at its previous version, which the pending fields already describe.
+	}
+	ch.header.PayloadVersion++
+	if chunkFormats[ch.header.Format()].authenticatesFrames {
+		ch.header.setFrameVersion(i)
+	}
+	ch.needsHeaderUpdate = true
+
+	if !isNewFrame {
+		if err := ch.writeHeader(ch.header); err != nil {
+			return err
+		}
+		ch.needsHeaderUpdate = false
+	} else if ch.bh.Size() == 0 {
+		// Write the header of the empty chunk first, so that the blob is a valid chunk at any point.
+		h := ch.header
+		h.PayloadLen = uint32(ch.persistedLen)
+		if err := ch.writeHeader(h); err != nil {
+			return err
+		}
+	}
 
 	wr := &blobstore.OffsetWriter{ch.bh, int64(blobOffset)}
-	bew, err := btncrypt.NewWriteCloser(wr, ch.c, len(f.P))
+	bew, err := btncrypt.NewWriteCloserWithAAD(wr, ch.c, len(f.P), ch.header.contentFrameAADFunc(i))
 	if err != nil {
 		return fmt.Errorf("Failed to create BtnEncryptWriteCloser: %v", err)
 	}
-	defer func() {
-		if err := bew.Close(); err != nil {
-			log.Printf("Failed to Close BtnEncryptWriteCloser: %v", err)
-		}
-	}()
 	if _, err := bew.Write(f.P); err != nil {
 		return fmt.Errorf("Failed to encrypt frame: %v", err)
 	}
-	ch.header.PayloadVersion++
-	ch.needsHeaderUpdate = true
-
+	if err := bew.Close(); err != nil {
+		return fmt.Errorf("Failed to Close BtnEncryptWriteCloser: %v", err)
+	}
 	log.Printf("ChunkIO: Wrote content frame idx: %d", i)
+
+	if isNewFrame {
+		if err := ch.writeHeader(ch.header); err != nil {
+			return err
+		}
+		ch.needsHeaderUpdate = false
+	} else {
+		// The frame is complete. Clear the pending frame on the next header write, so that the frame can't be rolled back to the previous version.
+		ch.header.PendingFrame = 0
+		ch.pendingIsPrevious = false
+		ch.needsHeaderUpdate = true
+	}
+	return nil
+}
+
+// settlePendingFrame resolves the pending frame of the header on the blob before the frame i is rewritten.
+func (ch *ChunkIO) settlePendingFrame(i int) error {
+	if ch.header.PendingFrame == 0 {
+		return nil
+	}
+	k := ch.header.PendingFrame - 1
+	if !ch.pendingChecked {
+		if _, err := ch.readContentFrame(k); err != nil {
+			return err
+		}
+	}
+	if !ch.pendingIsPrevious || k == i {
+		return nil
+	}
+
+	f, err := ch.readContentFrame(k)
+	if err != nil {
+		return err
+	}
+	if err := ch.writeContentFrame(k, f); err != nil {
+		return fmt.Errorf("Failed to rewrite pending frame idx: %d, err: %v", k, err)
+	}
+	return nil
+}
+
+// refreshStaleFrames rewrites the content frames whose versions would no longer be recoverable from FrameVersions.
+func (ch *ChunkIO) refreshStaleFrames() error {
+	if !chunkFormats[ch.header.Format()].authenticatesFrames {
+		return nil
+	}
+
+	numFrames := (ch.PayloadLen() + ContentFramePayloadLength - 1) / ContentFramePayloadLength
+	for i := 0; i < numFrames; i++ {
+		if !ch.header.isFrameVersionStale(i) {
+			continue
+		}
+		f, err := ch.readContentFrame(i)
+		if err != nil {
+			return err
+		}
+		if err := ch.writeContentFrame(i, f); err != nil {
+			return fmt.Errorf("Failed to rewrite stale frame idx: %d, err: %v", i, err)
+		}
+	}
 	return nil
 }
 
@@ -304,9 +565,18 @@ func (ch *ChunkIO) PWrite(offset int64, p []byte) error {
 	if len(p) == 0 {
 		return nil
 	}
+	if ch.isCompressed() {
+		return ErrCompressedChunkIsImmutable
+	}
+	if ch.header.Sealed {
+		return ErrSealedChunkIsImmutable
+	}
 	if offset < 0 || math.MaxInt32 < offset {
 		return fmt.Errorf("Offset out of range: %d", offset)
 	}
+	if err := ch.refreshStaleFrames(); err != nil {
+		return err
+	}
 
 	remo := int(offset)
 	remp := p
@@ -449,8 +719,8 @@ func (ch *ChunkIO) PWrite(offset int64, p []byte) error {
 
 func (ch *ChunkIO) Sync() error {
 	if ch.needsHeaderUpdate {
-		if err := ch.header.WriteTo(&blobstore.OffsetWriter{ch.bh, 0}, ch.c); err != nil {
-			return fmt.Errorf("Header write failed: %v", err)
+		if err := ch.writeHeader(ch.header); err != nil {
+			return err
 		}
 		log.Printf("Wrote chunk header: %+v", ch.header)
 		ch.needsHeaderUpdate = false
@@ -0,0 +1,235 @@
+package chunkstore
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/nyaxt/otaru/btncrypt"
+)
+
+// Compression is the algorithm content frames are compressed with. Only chunks written whole by WriteChunk are compressed, as ChunkIO can't rewrite compressed frames in place.
+type Compression byte
+
+const (
+	CompressionNone   Compression = 0
+	CompressionSnappy Compression = 1
+	CompressionZstd   Compression = 2
+)
+
+// MaxCompressedChunkFrames limits number of content frames in a compressed chunk, so that ChunkHeader.FrameLens always fits in the header frame.
+const MaxCompressedChunkFrames = 256
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return CompressionNone, fmt.Errorf("Unknown compression \"%s\"", s)
+	}
+}
+
+func (comp Compression) String() string {
+	switch comp {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(comp))
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	var err error
+	if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+		log.Fatalf("Failed to init zstd encoder: %v", err)
+	}
+	if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		log.Fatalf("Failed to init zstd decoder: %v", err)
+	}
+}
+
+func compressFrame(comp Compression, p []byte) ([]byte, error) {
+	switch comp {
+	case CompressionSnappy:
+		return snappy.Encode(nil, p), nil
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(p, nil), nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %v", comp)
+	}
+}
+
+func decompressFrame(comp Compression, p []byte, rawLen int) ([]byte, error) {
+	var ret []byte
+	var err error
+	switch comp {
+	case CompressionSnappy:
+		ret, err = snappy.Decode(nil, p)
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		ret, err = zstdDecoder.DecodeAll(p, make([]byte, 0, rawLen))
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %v", comp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) != rawLen {
+		return nil, fmt.Errorf("Decompressed frame length %d doesn't match expected %d", len(ret), rawLen)
+	}
+	return ret, nil
+}
+
+// contentFrameRawLen returns the uncompressed payload length of i-th content frame of a chunk with payloadLen.
+func contentFrameRawLen(payloadLen, i int) int {
+	n := payloadLen - i*ContentFramePayloadLength
+	if n > ContentFramePayloadLength {
+		n = ContentFramePayloadLength
+	}
+	return n
+}
+
+// decodeStoredFrame decrypts an encrypted content frame of a compressed chunk, and decompresses it if needed.
+// Frames which didn't shrink on compression are stored as is, which is detected by the stored length being equal to rawLen.
+func decodeStoredFrame(c btncrypt.Cipher, comp Compression, encrypted []byte, storedLen, rawLen int, aadf btncrypt.AADFunc) ([]byte, error) {
+	stored, err := btncrypt.DecryptWithAAD(c, encrypted, storedLen, aadf)
+	if err != nil {
+		return nil, err
+	}
+	if storedLen == rawLen {
+		return stored, nil
+	}
+	return decompressFrame(comp, stored, rawLen)
+}
+
+// worthCompressing is the heuristic to decide whether to compress a chunk, based on its first frame.
+func worthCompressing(raw, compressed []byte) bool {
+	// require at least 1/8 reduction
+	return len(compressed)*8 <= len(raw)*7
+}
+
+// WriteChunk writes p as a complete sealed chunk, compressing its frames if h.Compression is specified.
+func WriteChunk(w io.Writer, c btncrypt.Cipher, h ChunkHeader, p []byte) error {
+	if len(p) > MaxChunkPayloadLen {
+		return fmt.Errorf("payload length too big: %d", len(p))
+	}
+	h.PayloadLen = uint32(len(p))
+	h.FrameLens = nil
+	h.KeyID = c.KeyID()
+	h.format = CurrentFormat
+	h.Sealed = true
+	if h.PayloadVersion == 0 {
+		// ChunkIO reads PayloadVersion 0 as 1, since gob omits zero values.
+		h.PayloadVersion = 1
+	}
+
+	numFrames := (len(p) + ContentFramePayloadLength - 1) / ContentFramePayloadLength
+	if numFrames == 0 || numFrames > MaxCompressedChunkFrames {
+		h.Compression = CompressionNone
+	}
+
+	var encframes [][]byte
+	if h.Compression != CompressionNone {
+		h.FrameLens = make([]uint32, numFrames)
+		encframes = make([][]byte, numFrames)
+		for i := 0; i < numFrames; i++ {
+			offset := i * ContentFramePayloadLength
+			raw := p[offset : offset+contentFrameRawLen(len(p), i)]
+			stored, err := compressFrame(h.Compression, raw)
+			if err != nil {
+				return fmt.Errorf("Failed to compress frame %d: %v", i, err)
+			}
+			if i == 0 && !worthCompressing(raw, stored) {
+				log.Printf("WriteChunk: first frame didn't compress well (%d -> %d). Storing uncompressed.", len(raw), len(stored))
+				h.Compression = CompressionNone
+				h.FrameLens = nil
+				break
+			}
+			if len(stored) >= len(raw) {
+				stored = raw
+			}
+			h.FrameLens[i] = uint32(len(stored))
+			if encframes[i], err = btncrypt.EncryptWithAAD(c, stored, h.contentFrameAADFunc(i)); err != nil {
+				return fmt.Errorf("Failed to encrypt frame %d: %v", i, err)
+			}
+		}
+	}
+
+	if h.Compression == CompressionNone {
+		cw, err := NewChunkWriter(w, c, h)
+		if err != nil {
+			return err
+		}
+		if _, err := cw.Write(p); err != nil {
+			return err
+		}
+		return cw.Close()
+	}
+
+	if err := h.WriteTo(w, c); err != nil {
+		return fmt.Errorf("Failed to write header: %v", err)
+	}
+	for i, encframe := range encframes {
+		if _, err := w.Write(encframe); err != nil {
+			return fmt.Errorf("Failed to write frame %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// compressedChunkReader provides io.Reader of a compressed chunk's content, following its header.
+type compressedChunkReader struct {
+	r      io.Reader
+	c      btncrypt.Cipher
+	h      ChunkHeader
+	i      int
+	unread []byte
+}
+
+func (cr *compressedChunkReader) Read(p []byte) (int, error) {
+	if len(cr.unread) == 0 {
+		if cr.i >= len(cr.h.FrameLens) {
+			return 0, io.EOF
+		}
+
+		storedLen := int(cr.h.FrameLens[cr.i])
+		encrypted := make([]byte, cr.c.EncryptedFrameSize(storedLen))
+		if _, err := io.ReadFull(cr.r, encrypted); err != nil {
+			return 0, err
+		}
+		f, err := decodeStoredFrame(cr.c, cr.h.Compression, encrypted, storedLen, contentFrameRawLen(int(cr.h.PayloadLen), cr.i), cr.h.contentFrameAADFunc(cr.i))
+		if err != nil {
+			if err == btncrypt.ErrAuthenticationFailed {
+				return 0, frameError(cr.h, cr.i, err)
+			}
+			return 0, fmt.Errorf("Failed to decode frame idx: %d, err: %v", cr.i, err)
+		}
+		cr.unread = f
+		cr.i++
+	}
+
+	n := copy(p, cr.unread)
+	cr.unread = cr.unread[n:]
+	return n, nil
+}
+
+var _ = io.Reader(&compressedChunkReader{})
@@ -0,0 +1,122 @@
+package chunkstore_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/nyaxt/otaru/chunkstore"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func compressibleBytes(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i / 1000 % 7)
+	}
+	return p
+}
+
+func TestWriteChunk_Compressed(t *testing.T) {
+	for _, comp := range []chunkstore.Compression{chunkstore.CompressionSnappy, chunkstore.CompressionZstd} {
+		p := compressibleBytes(3*chunkstore.ContentFramePayloadLength + 1234)
+
+		var b bytes.Buffer
+		if err := chunkstore.WriteChunk(&b, TestCipher(), chunkstore.ChunkHeader{Compression: comp}, p); err != nil {
+			t.Errorf("WriteChunk failed: %v", err)
+			return
+		}
+		if b.Len() >= len(p) {
+			t.Errorf("%v: chunk not compressed. %d >= %d", comp, b.Len(), len(p))
+		}
+
+		testbh := &TestBlobHandle{Buf: b.Bytes()}
+		cio := chunkstore.NewChunkIO(testbh, TestCipher())
+		if h := cio.Header(); h.Compression != comp || len(h.FrameLens) != 4 {
+			t.Errorf("Unexpected header: %+v", h)
+		}
+		if cio.Size() != int64(len(p)) {
+			t.Errorf("Unexpected size: %d", cio.Size())
+		}
+
+		// random access across frames
+		readtgt := make([]byte, chunkstore.ContentFramePayloadLength)
+		if err := cio.PRead(1000, readtgt); err != nil {
+			t.Errorf("PRead failed: %v", err)
+			return
+		}
+		if !bytes.Equal(p[1000:1000+len(readtgt)], readtgt) {
+			t.Errorf("%v: PRead content mismatch", comp)
+		}
+		if err := cio.PWrite(0, HelloWorld); err != chunkstore.ErrCompressedChunkIsImmutable {
+			t.Errorf("PWrite on compressed chunk should fail, but got: %v", err)
+		}
+
+		cr, err := chunkstore.NewChunkReader(bytes.NewReader(b.Bytes()), TestCipher())
+		if err != nil {
+			t.Errorf("NewChunkReader failed: %v", err)
+			return
+		}
+		readall := make([]byte, len(p))
+		if _, err := io.ReadFull(cr, readall); err != nil {
+			t.Errorf("Read failed: %v", err)
+			return
+		}
+		if !bytes.Equal(p, readall) {
+			t.Errorf("%v: ChunkReader content mismatch", comp)
+		}
+	}
+}
+
+func TestWriteChunk_IncompressibleStoredRaw(t *testing.T) {
+	p := randomBytes(5, 100000)
+
+	var b bytes.Buffer
+	if err := chunkstore.WriteChunk(&b, TestCipher(), chunkstore.ChunkHeader{Compression: chunkstore.CompressionZstd}, p); err != nil {
+		t.Errorf("WriteChunk failed: %v", err)
+		return
+	}
+	cio := chunkstore.NewChunkIO(&TestBlobHandle{Buf: b.Bytes()}, TestCipher())
+	if h := cio.Header(); h.Compression != chunkstore.CompressionNone {
+		t.Errorf("Expected incompressible chunk to be stored uncompressed: %+v", h)
+	}
+	readtgt := make([]byte, len(p))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(p, readtgt) {
+		t.Errorf("PRead content mismatch")
+	}
+}
+
+func TestChunkIO_ReadsLegacyFormat(t *testing.T) {
+	var b bytes.Buffer
+	cw, err := chunkstore.NewChunkWriterOfFormatForTesting(&b, TestCipher(), chunkstore.ChunkHeader{PayloadLen: uint32(len(HelloWorld))}, chunkstore.LegacyFormat)
+	if err != nil {
+		t.Errorf("NewChunkWriter failed: %v", err)
+		return
+	}
+	if _, err := cw.Write(HelloWorld); err != nil {
+		t.Errorf("Write failed: %v", err)
+		return
+	}
+	if err := cw.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+		return
+	}
+	buf := b.Bytes()
+	if buf[2] != chunkstore.LegacyFormat {
+		t.Errorf("Unexpected format byte: %x", buf[2])
+	}
+
+	cio := chunkstore.NewChunkIO(&TestBlobHandle{Buf: buf}, TestCipher())
+	readtgt := make([]byte, len(HelloWorld))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(HelloWorld, readtgt) {
+		t.Errorf("PRead content mismatch")
+	}
+}
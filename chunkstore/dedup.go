@@ -0,0 +1,312 @@
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	. "github.com/nyaxt/otaru/util" // FIXME
+)
+
+// DedupBlobPathPrefix is prepended to blobpaths of content-addressed chunks.
+// Blobs under this prefix may be shared by multiple files, and must never be modified in place.
+const DedupBlobPathPrefix = "dedup_"
+
+func IsDedupBlobPath(blobpath string) bool {
+	return strings.HasPrefix(blobpath, DedupBlobPathPrefix)
+}
+
+// GenerateNewDedupBlobPath returns an unused dedup blobpath which isn't derived from the content.
+func GenerateNewDedupBlobPath(bs blobstore.RandomAccessBlobStore) (string, error) {
+	bp, err := blobstore.GenerateNewBlobPath(bs)
+	if err != nil {
+		return "", err
+	}
+	return DedupBlobPathPrefix + bp, nil
+}
+
+// BlobPinner keeps blobs from being removed by GC, e.g. while a reused dedup chunk isn't committed to a FileChunk yet.
+type BlobPinner interface {
+	// PinBlob keeps the blob until unpin is called. If the blob is being removed, it returns after the removal.
+	PinBlob(blobpath string) (unpin func())
+}
+
+// dedupPathLocks serializes storing chunks of the same blobpath.
+var dedupPathLocks [64]sync.Mutex
+
+func dedupPathLockOf(blobpath string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(blobpath))
+	return &dedupPathLocks[h.Sum32()%uint32(len(dedupPathLocks))]
+}
+
+// ContentNamer names chunks by keyed hash of their plaintext content.
+// The hash is keyed so that blobpaths don't leak which well-known contents are stored.
+type ContentNamer struct {
+	key []byte
+}
+
+func NewContentNamer(key []byte) *ContentNamer {
+	return &ContentNamer{key: key}
+}
+
+func (n *ContentNamer) BlobPath(p []byte) string {
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(p)
+	return DedupBlobPathPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// DedupChunkedFileIO is a ChunkedFileIO which stores content-defined chunks once under content-derived blobpaths.
+type DedupChunkedFileIO struct {
+	*ChunkedFileIO
+	namer       *ContentNamer
+	compression Compression
+	pinner      BlobPinner
+}
+
+var _ = blobstore.BlobHandle(&DedupChunkedFileIO{})
+
+func NewDedupChunkedFileIO(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, caio ChunksArrayIO, namer *ContentNamer) *DedupChunkedFileIO {
+	return &DedupChunkedFileIO{
+		ChunkedFileIO: NewChunkedFileIO(bs, c, caio),
+		namer:         namer,
+	}
+}
+
+// SetCompression specifies the compression applied to chunks newly stored.
+func (dfio *DedupChunkedFileIO) SetCompression(comp Compression) { dfio.compression = comp }
+
+// SetBlobPinner makes the chunks stored pinned by p until their FileChunks are committed.
+func (dfio *DedupChunkedFileIO) SetBlobPinner(p BlobPinner) { dfio.pinner = p }
+
+// verifyExistingChunk returns nil if the blob at bpath is a chunk of the content p, or blobstore.ENOENT if there is none.
+func (dfio *DedupChunkedFileIO) verifyExistingChunk(bpath string, p []byte) error {
+	bh, err := dfio.bs.Open(bpath, fl.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer bh.Close()
+	if bh.Size() == 0 {
+		return blobstore.ENOENT
+	}
+
+	cr, err := NewChunkReader(&blobstore.OffsetReader{bh, 0}, dfio.c)
+	if err != nil {
+		return err
+	}
+	if err := cr.Header().VerifyBlobPath(bpath); err != nil {
+		return err
+	}
+	if cr.Length() != len(p) {
+		return fmt.Errorf("Unexpected payload len %d, expected %d", cr.Length(), len(p))
+	}
+	existing, err := ioutil.ReadAll(cr)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(existing, p) {
+		return fmt.Errorf("Content mismatch")
+	}
+	return nil
+}
+
+func (dfio *DedupChunkedFileIO) writeChunk(bpath string, flags int, offset int64, p []byte) error {
+	bh, err := dfio.bs.Open(bpath, flags)
+	if err != nil {
+		return fmt.Errorf("Failed to open path \"%s\" for writing: %v", bpath, err)
+	}
+	defer func() {
+		if err := bh.Close(); err != nil {
+			log.Printf("blobhandle Close failed: %v", err)
+		}
+	}()
+
+	var b bytes.Buffer
+	h := ChunkHeader{
+		PayloadVersion: 1,
+		OrigFilename:   dfio.origFilename,
+		OrigOffset:     offset,
+		Compression:    dfio.compression,
+		BlobPath:       bpath,
+	}
+	if err := WriteChunk(&b, dfio.c, h, p); err != nil {
+		return fmt.Errorf("Failed to encode chunk: %v", err)
+	}
+	if err := bh.PWrite(0, b.Bytes()); err != nil {
+		return fmt.Errorf("Failed to write blob \"%s\": %v", bpath, err)
+	}
+	return nil
+}
+
+// storeChunk stores p at its content-derived blobpath. The blob is pinned until unpin is called after the FileChunk is committed.
+func (dfio *DedupChunkedFileIO) storeChunk(offset int64, p []byte) (inodedb.FileChunk, func(), error) {
+	bpath := dfio.namer.BlobPath(p)
+	fc := inodedb.FileChunk{Offset: offset, Length: int64(len(p)), BlobPath: bpath}
+
+	unpin := func() {}
+	if dfio.pinner != nil {
+		unpin = dfio.pinner.PinBlob(bpath)
+	}
+	mu := dedupPathLockOf(bpath)
+	mu.Lock()
+	defer mu.Unlock()
+
+	err := dfio.verifyExistingChunk(bpath, p)
+	if err == nil {
+		log.Printf("dedup: reusing existing chunk %+v", fc)
+		return fc, unpin, nil
+	}
+	flags := fl.O_RDWR | fl.O_CREATE
+	if err != blobstore.ENOENT {
+		// The blob may be referenced by other files, so it is never overwritten.
+		log.Printf("dedup: existing blob \"%s\" isn't a valid chunk of the content: %v. Storing the chunk to a new blob.", bpath, err)
+		unpin()
+		unpin = func() {}
+		if fc.BlobPath, err = GenerateNewDedupBlobPath(dfio.bs); err != nil {
+			return inodedb.FileChunk{}, nil, fmt.Errorf("Failed to generate new blobpath: %v", err)
+		}
+		flags |= fl.O_EXCL
+	}
+
+	if err := dfio.writeChunk(fc.BlobPath, flags, offset, p); err != nil {
+		unpin()
+		return inodedb.FileChunk{}, nil, err
+	}
+	log.Printf("dedup: new chunk %+v", fc)
+	return fc, unpin, nil
+}
+
+// storeContent splits p, which is to be placed at offset, into content-defined chunks and stores them. The chunks are pinned until unpin is called.
+func (dfio *DedupChunkedFileIO) storeContent(offset int64, p []byte) ([]inodedb.FileChunk, func(), error) {
+	newcs := []inodedb.FileChunk{}
+	unpins := []func(){}
+	unpin := func() {
+		for _, f := range unpins {
+			f()
+		}
+	}
+	for _, piece := range SplitContentDefined(p) {
+		fc, unpinChunk, err := dfio.storeChunk(offset, piece)
+		if err != nil {
+			unpin()
+			return nil, nil, err
+		}
+		newcs = append(newcs, fc)
+		unpins = append(unpins, unpinChunk)
+		offset += int64(len(piece))
+	}
+	return newcs, unpin, nil
+}
+
+func (dfio *DedupChunkedFileIO) PWrite(offset int64, p []byte) error {
+	log.Printf("dedup PWrite: offset=%d, len=%d", offset, len(p))
+	if len(p) == 0 {
+		return nil
+	}
+	if !fl.IsReadWriteAllowed(dfio.bs.Flags()) {
+		return EPERM
+	}
+
+	cs, err := dfio.caio.Read()
+	if err != nil {
+		return fmt.Errorf("Failed to read cs array: %v", err)
+	}
+
+	// Find chunks [first, last) overlapping the written region. The chunk ending exactly at offset is included too, so that appends re-chunk the file tail.
+	right := offset + int64(len(p))
+	first := len(cs)
+	for i, c := range cs {
+		if c.Right() >= offset {
+			first = i
+			break
+		}
+	}
+	last := first
+	for last < len(cs) && cs[last].Left() < right {
+		last++
+	}
+
+	left := offset
+	existingRight := offset
+	if first < last {
+		left = Int64Min(offset, cs[first].Left())
+		existingRight = cs[last-1].Right()
+	}
+	regionRight := right
+	if existingRight > regionRight {
+		regionRight = existingRight
+	}
+
+	buf := make([]byte, regionRight-left)
+	if existingRight > left {
+		if err := dfio.ChunkedFileIO.PRead(left, buf[:existingRight-left]); err != nil {
+			return fmt.Errorf("Failed to read existing content: %v", err)
+		}
+	}
+	copy(buf[offset-left:], p)
+
+	newcs, unpin, err := dfio.storeContent(left, buf)
+	if err != nil {
+		return err
+	}
+	defer unpin()
+
+	updated := make([]inodedb.FileChunk, 0, len(cs)-(last-first)+len(newcs))
+	updated = append(updated, cs[:first]...)
+	updated = append(updated, newcs...)
+	updated = append(updated, cs[last:]...)
+	if err := dfio.caio.Write(updated); err != nil {
+		return fmt.Errorf("Failed to write updated cs array: %v", err)
+	}
+	return nil
+}
+
+func (dfio *DedupChunkedFileIO) Truncate(size int64) error {
+	if !fl.IsReadWriteAllowed(dfio.bs.Flags()) {
+		return EPERM
+	}
+
+	cs, err := dfio.caio.Read()
+	if err != nil {
+		return fmt.Errorf("Failed to read cs array: %v", err)
+	}
+
+	i := 0
+	for i < len(cs) && cs[i].Right() <= size {
+		i++
+	}
+	if i == len(cs) {
+		return nil
+	}
+
+	updated := make([]inodedb.FileChunk, 0, i+1)
+	updated = append(updated, cs[:i]...)
+	if c := cs[i]; c.Left() < size {
+		// re-chunk the remaining part of the straddling chunk
+		buf := make([]byte, size-c.Left())
+		if err := dfio.ChunkedFileIO.PRead(c.Left(), buf); err != nil {
+			return fmt.Errorf("Failed to read existing content: %v", err)
+		}
+		newcs, unpin, err := dfio.storeContent(c.Left(), buf)
+		if err != nil {
+			return err
+		}
+		defer unpin()
+		updated = append(updated, newcs...)
+	}
+	if err := dfio.caio.Write(updated); err != nil {
+		return fmt.Errorf("Failed to write updated cs array: %v", err)
+	}
+	return nil
+}
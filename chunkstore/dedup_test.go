@@ -0,0 +1,238 @@
+package chunkstore_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nyaxt/otaru/chunkstore"
+	"github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func TestDedupChunkedFileIO_SharesChunks(t *testing.T) {
+	fbs := TestFileBlobStore()
+	namer := chunkstore.NewContentNamer([]byte("testkey"))
+	p := randomBytes(3, 6*1024*1024)
+
+	caioA := NewSimpleDBChunksArrayIO()
+	caioB := NewSimpleDBChunksArrayIO()
+	for _, caio := range []*SimpleDBChunksArrayIO{caioA, caioB} {
+		dfio := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caio, namer)
+		// write in pieces to exercise re-chunking of the tail
+		for o := 0; o < len(p); o += 1000 * 1000 {
+			r := o + 1000*1000
+			if r > len(p) {
+				r = len(p)
+			}
+			if err := dfio.PWrite(int64(o), p[o:r]); err != nil {
+				t.Errorf("PWrite failed: %v", err)
+				return
+			}
+		}
+	}
+
+	if len(caioA.cs) != len(caioB.cs) {
+		t.Errorf("Chunk count mismatch: %d vs %d", len(caioA.cs), len(caioB.cs))
+		return
+	}
+	for i := range caioA.cs {
+		if caioA.cs[i] != caioB.cs[i] {
+			t.Errorf("Chunk %d mismatch: %+v vs %+v", i, caioA.cs[i], caioB.cs[i])
+		}
+		if !chunkstore.IsDedupBlobPath(caioA.cs[i].BlobPath) {
+			t.Errorf("Chunk %d has non dedup blobpath: %s", i, caioA.cs[i].BlobPath)
+		}
+	}
+
+	dfio := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caioA, namer)
+	readtgt := make([]byte, len(p))
+	if err := dfio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(p, readtgt) {
+		t.Errorf("read content mismatch")
+	}
+}
+
+func TestDedupChunkedFileIO_OverwriteTruncate(t *testing.T) {
+	fbs := TestFileBlobStore()
+	namer := chunkstore.NewContentNamer([]byte("testkey"))
+	p := randomBytes(4, 3*1024*1024)
+	expected := make([]byte, len(p))
+	copy(expected, p)
+
+	caio := NewSimpleDBChunksArrayIO()
+	dfio := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caio, namer)
+	if err := dfio.PWrite(0, p); err != nil {
+		t.Errorf("PWrite failed: %v", err)
+		return
+	}
+	orig := append(caio.cs[:0:0], caio.cs...)
+
+	if err := dfio.PWrite(1234567, HelloWorld); err != nil {
+		t.Errorf("PWrite failed: %v", err)
+		return
+	}
+	copy(expected[1234567:], HelloWorld)
+
+	readtgt := make([]byte, len(expected))
+	if err := dfio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(expected, readtgt) {
+		t.Errorf("read content mismatch after overwrite")
+	}
+
+	// The original content must still be readable from the original chunks.
+	origcaio := NewSimpleDBChunksArrayIO()
+	origcaio.cs = orig
+	origtgt := make([]byte, len(p))
+	if err := chunkstore.NewChunkedFileIO(fbs, TestCipher(), origcaio).PRead(0, origtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(p, origtgt) {
+		t.Errorf("original chunks were modified in place")
+	}
+
+	if err := dfio.Truncate(1000000); err != nil {
+		t.Errorf("Truncate failed: %v", err)
+		return
+	}
+	if dfio.Size() != 1000000 {
+		t.Errorf("Unexpected size after truncate: %d", dfio.Size())
+	}
+	readtgt = make([]byte, 1000000)
+	if err := dfio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(expected[:1000000], readtgt) {
+		t.Errorf("read content mismatch after truncate")
+	}
+}
+
+func TestChunkedFileIO_DetachesDedupChunk(t *testing.T) {
+	fbs := TestFileBlobStore()
+	namer := chunkstore.NewContentNamer([]byte("testkey"))
+
+	caio := NewSimpleDBChunksArrayIO()
+	if err := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caio, namer).PWrite(0, HelloWorld); err != nil {
+		t.Errorf("PWrite failed: %v", err)
+		return
+	}
+	shared := caio.cs[0]
+
+	cfio := chunkstore.NewChunkedFileIO(fbs, TestCipher(), caio)
+	if err := cfio.PWrite(0, HogeFugaPiyo); err != nil {
+		t.Errorf("PWrite failed: %v", err)
+		return
+	}
+	if caio.cs[0].BlobPath == shared.BlobPath {
+		t.Errorf("ChunkedFileIO wrote to shared dedup chunk in place")
+	}
+
+	sharedcaio := NewSimpleDBChunksArrayIO()
+	sharedcaio.cs = []inodedb.FileChunk{shared}
+	readtgt := make([]byte, len(HelloWorld))
+	if err := chunkstore.NewChunkedFileIO(fbs, TestCipher(), sharedcaio).PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(HelloWorld, readtgt) {
+		t.Errorf("shared chunk content modified: %v", readtgt)
+	}
+}
+
+func TestDedupChunkedFileIO_DoesntReuseTornChunk(t *testing.T) {
+	fbs := TestFileBlobStore()
+	namer := chunkstore.NewContentNamer([]byte("testkey"))
+	p := randomBytes(5, 100*1024)
+
+	caioA := NewSimpleDBChunksArrayIO()
+	if err := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caioA, namer).PWrite(0, p); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if len(caioA.cs) != 1 {
+		t.Fatalf("Expected 1 chunk, got %+v", caioA.cs)
+	}
+	bpath := caioA.cs[0].BlobPath
+
+	// Tear the blob, leaving its header intact.
+	bh, err := fbs.Open(bpath, flags.O_RDWR)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	tornSize := bh.Size() - 1000
+	if err := bh.Truncate(tornSize); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	bh.Close()
+
+	caioB := NewSimpleDBChunksArrayIO()
+	dfio := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caioB, namer)
+	if err := dfio.PWrite(0, p); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if len(caioB.cs) != 1 || caioB.cs[0].BlobPath == bpath || !chunkstore.IsDedupBlobPath(caioB.cs[0].BlobPath) {
+		t.Errorf("Torn chunk shouldn't be reused: %+v", caioB.cs)
+	}
+	readtgt := make([]byte, len(p))
+	if err := dfio.PRead(0, readtgt); err != nil {
+		t.Fatalf("PRead failed: %v", err)
+	}
+	if !bytes.Equal(p, readtgt) {
+		t.Errorf("read content mismatch")
+	}
+	if size, err := fbs.BlobSize(bpath); err != nil || size != tornSize {
+		t.Errorf("Existing blob shouldn't be overwritten: %d, %v", size, err)
+	}
+}
+
+type recordingPinner struct {
+	caio   *SimpleDBChunksArrayIO
+	pinned map[string]int
+	// committedOnUnpin records if the blob was referenced from caio when unpinned.
+	committedOnUnpin map[string]bool
+}
+
+func (p *recordingPinner) PinBlob(bpath string) func() {
+	p.pinned[bpath]++
+	return func() {
+		p.pinned[bpath]--
+		for _, c := range p.caio.cs {
+			if c.BlobPath == bpath {
+				p.committedOnUnpin[bpath] = true
+			}
+		}
+	}
+}
+
+func TestDedupChunkedFileIO_PinsChunksUntilCommitted(t *testing.T) {
+	fbs := TestFileBlobStore()
+	namer := chunkstore.NewContentNamer([]byte("testkey"))
+
+	caio := NewSimpleDBChunksArrayIO()
+	pinner := &recordingPinner{caio: caio, pinned: make(map[string]int), committedOnUnpin: make(map[string]bool)}
+	dfio := chunkstore.NewDedupChunkedFileIO(fbs, TestCipher(), caio, namer)
+	dfio.SetBlobPinner(pinner)
+	if err := dfio.PWrite(0, HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	// Reuses the chunk stored above.
+	caio.cs = nil
+	if err := dfio.PWrite(0, HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+
+	bpath := namer.BlobPath(HelloWorld)
+	if n, ok := pinner.pinned[bpath]; !ok || n != 0 {
+		t.Errorf("Chunk should be pinned and unpinned: %+v", pinner.pinned)
+	}
+	if !pinner.committedOnUnpin[bpath] {
+		t.Errorf("Chunk was unpinned before committed")
+	}
+}
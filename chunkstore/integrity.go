@@ -0,0 +1,37 @@
+package chunkstore
+
+import (
+	"fmt"
+
+	"github.com/nyaxt/otaru/btncrypt"
+)
+
+// HeaderFrame is IntegrityError.Frame of errors on the chunk header.
+const HeaderFrame = -1
+
+// IntegrityError is returned when a chunk fails authentication against its blobpath or its frame order.
+type IntegrityError struct {
+	BlobPath string
+	Frame    int
+	Reason   string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Frame == HeaderFrame {
+		return fmt.Sprintf("Integrity check failed for chunk \"%s\": %s", e.BlobPath, e.Reason)
+	}
+	return fmt.Sprintf("Integrity check failed for chunk \"%s\" frame %d: %s", e.BlobPath, e.Frame, e.Reason)
+}
+
+func IsIntegrityError(err error) bool {
+	_, ok := err.(*IntegrityError)
+	return ok
+}
+
+// frameError converts a failure decoding i-th content frame of a chunk with header h to IntegrityError if the frame failed authentication.
+func frameError(h ChunkHeader, i int, err error) error {
+	if err == btncrypt.ErrAuthenticationFailed && chunkFormats[h.Format()].authenticatesFrames {
+		return &IntegrityError{BlobPath: h.BlobPath, Frame: i, Reason: err.Error()}
+	}
+	return fmt.Errorf("Failed to decrypt frame idx: %d, err: %v", i, err)
+}
@@ -0,0 +1,282 @@
+package chunkstore_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nyaxt/otaru/chunkstore"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func genSealedChunk(t *testing.T, blobpath string, ver int64, p []byte) []byte {
+	var b bytes.Buffer
+	cw, err := chunkstore.NewChunkWriter(&b, TestCipher(), chunkstore.ChunkHeader{PayloadLen: uint32(len(p)), PayloadVersion: ver, BlobPath: blobpath, Sealed: true})
+	if err != nil {
+		t.Fatalf("NewChunkWriter failed: %v", err)
+	}
+	if _, err := cw.Write(p); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return b.Bytes()
+}
+
+// frameRange returns the range of i-th content frame in an uncompressed chunk.
+func frameRange(i int) (int, int) {
+	size := TestCipher().EncryptedFrameSize(chunkstore.ContentFramePayloadLength)
+	return chunkstore.ChunkHeaderLength + size*i, chunkstore.ChunkHeaderLength + size*(i+1)
+}
+
+func expectIntegrityError(t *testing.T, buf []byte, blobpath string, frame int) {
+	cio := chunkstore.NewChunkIOWithMetadata(&TestBlobHandle{Buf: buf}, TestCipher(), chunkstore.ChunkHeader{BlobPath: blobpath})
+	readtgt := make([]byte, chunkstore.ContentFramePayloadLength)
+	off := int64(frame * chunkstore.ContentFramePayloadLength)
+	err := cio.PRead(off, readtgt)
+	if !chunkstore.IsIntegrityError(err) {
+		t.Errorf("PRead frame %d: expected IntegrityError, got: %v", frame, err)
+	} else if ie := err.(*chunkstore.IntegrityError); ie.Frame != frame {
+		t.Errorf("Unexpected IntegrityError frame: %+v", ie)
+	}
+
+	cr, err := chunkstore.NewChunkReader(bytes.NewReader(buf), TestCipher())
+	if err != nil {
+		t.Errorf("NewChunkReader failed: %v", err)
+		return
+	}
+	if _, err := ioutil.ReadAll(cr); !chunkstore.IsIntegrityError(err) {
+		t.Errorf("ChunkReader: expected IntegrityError, got: %v", err)
+	}
+}
+
+func TestIntegrity_SealedChunkRoundTrip(t *testing.T) {
+	td := genTestData(3 * chunkstore.ContentFramePayloadLength)
+	buf := genSealedChunk(t, "a", 1, td)
+
+	cio := chunkstore.NewChunkIOWithMetadata(&TestBlobHandle{Buf: buf}, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if h := cio.Header(); !h.Sealed || h.BlobPath != "a" || h.Format() != chunkstore.CurrentFormat {
+		t.Errorf("Unexpected header: %+v", h)
+	}
+	readtgt := make([]byte, len(td))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(td, readtgt) {
+		t.Errorf("PRead content mismatch")
+	}
+	if err := cio.PWrite(0, HelloWorld); err != chunkstore.ErrSealedChunkIsImmutable {
+		t.Errorf("PWrite on sealed chunk should fail, but got: %v", err)
+	}
+}
+
+func TestIntegrity_DetectsWrongBlobPath(t *testing.T) {
+	buf := genSealedChunk(t, "a", 1, HelloWorld)
+
+	cio := chunkstore.NewChunkIOWithMetadata(&TestBlobHandle{Buf: buf}, TestCipher(), chunkstore.ChunkHeader{BlobPath: "b"})
+	err := cio.PRead(0, make([]byte, len(HelloWorld)))
+	if !chunkstore.IsIntegrityError(err) {
+		t.Errorf("Expected IntegrityError, got: %v", err)
+	}
+}
+
+func TestIntegrity_DetectsTransplantedFrame(t *testing.T) {
+	td := genTestData(2 * chunkstore.ContentFramePayloadLength)
+	a := genSealedChunk(t, "a", 1, td)
+	b := genSealedChunk(t, "b", 1, td)
+
+	l, r := frameRange(1)
+	copy(a[l:r], b[l:r])
+	expectIntegrityError(t, a, "a", 1)
+}
+
+func TestIntegrity_DetectsReorderedFrames(t *testing.T) {
+	td := genTestData(2 * chunkstore.ContentFramePayloadLength)
+	a := genSealedChunk(t, "a", 1, td)
+
+	l0, r0 := frameRange(0)
+	l1, r1 := frameRange(1)
+	f0 := append([]byte{}, a[l0:r0]...)
+	copy(a[l0:r0], a[l1:r1])
+	copy(a[l1:r1], f0)
+	expectIntegrityError(t, a, "a", 0)
+}
+
+func TestIntegrity_DetectsRolledBackFrame(t *testing.T) {
+	td := genTestData(2 * chunkstore.ContentFramePayloadLength)
+	v1 := genSealedChunk(t, "a", 1, td)
+	v2 := genSealedChunk(t, "a", 2, td)
+
+	l, r := frameRange(1)
+	copy(v2[l:r], v1[l:r])
+	expectIntegrityError(t, v2, "a", 1)
+}
+
+func TestIntegrity_UnsealedChunk(t *testing.T) {
+	td := genTestData(2 * chunkstore.ContentFramePayloadLength)
+
+	genUnsealed := func(blobpath string) []byte {
+		testbh := &TestBlobHandle{}
+		cio := chunkstore.NewChunkIOWithMetadata(testbh, TestCipher(), chunkstore.ChunkHeader{BlobPath: blobpath})
+		if err := cio.PWrite(0, td); err != nil {
+			t.Fatalf("PWrite failed: %v", err)
+		}
+		if err := cio.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		return testbh.Buf
+	}
+	a := genUnsealed("a")
+	b := genUnsealed("b")
+
+	cio := chunkstore.NewChunkIOWithMetadata(&TestBlobHandle{Buf: a}, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if h := cio.Header(); h.Sealed || h.BlobPath != "a" {
+		t.Errorf("Unexpected header: %+v", h)
+	}
+	if err := cio.PWrite(10, HelloWorld); err != nil {
+		t.Errorf("PWrite on unsealed chunk failed: %v", err)
+	}
+
+	l, r := frameRange(1)
+	copy(a[l:r], b[l:r])
+	expectIntegrityError(t, a, "a", 1)
+}
+
+func TestIntegrity_DetectsRolledBackFrameInUnsealedChunk(t *testing.T) {
+	td := genTestData(2 * chunkstore.ContentFramePayloadLength)
+
+	testbh := &TestBlobHandle{}
+	cio := chunkstore.NewChunkIOWithMetadata(testbh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if err := cio.PWrite(0, td); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := cio.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	l, r := frameRange(1)
+	old := append([]byte{}, testbh.Buf[l:r]...)
+
+	cio = chunkstore.NewChunkIOWithMetadata(testbh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if err := cio.PWrite(int64(chunkstore.ContentFramePayloadLength+10), HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := cio.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	copy(testbh.Buf[l:r], old)
+	expectIntegrityError(t, testbh.Buf, "a", 1)
+}
+
+func TestIntegrity_UnsealedChunkKeepsRarelyWrittenFramesReadable(t *testing.T) {
+	td := genTestData(chunkstore.ContentFramePayloadLength + 1)
+
+	testbh := &TestBlobHandle{}
+	cio := chunkstore.NewChunkIOWithMetadata(testbh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if err := cio.PWrite(0, td); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	// Rewrite the last frame until the version of the first frame wraps around its lower 16 bits.
+	for i := 0; i < 1<<16+10; i++ {
+		if err := cio.PWrite(int64(chunkstore.ContentFramePayloadLength), []byte{byte(i)}); err != nil {
+			t.Fatalf("PWrite failed: %v", err)
+		}
+	}
+	if err := cio.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	cio = chunkstore.NewChunkIOWithMetadata(testbh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	readtgt := make([]byte, chunkstore.ContentFramePayloadLength)
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Fatalf("PRead failed: %v", err)
+	}
+	if !bytes.Equal(td[:chunkstore.ContentFramePayloadLength], readtgt) {
+		t.Errorf("PRead content mismatch")
+	}
+}
+
+func TestIntegrity_RejectsUnboundChunk(t *testing.T) {
+	testbh := &TestBlobHandle{}
+	cio := chunkstore.NewChunkIO(testbh, TestCipher())
+	if err := cio.PWrite(0, HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := cio.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	cio = chunkstore.NewChunkIOWithMetadata(testbh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if err := cio.PRead(0, make([]byte, len(HelloWorld))); !chunkstore.IsIntegrityError(err) {
+		t.Errorf("Expected IntegrityError, got: %v", err)
+	}
+}
+
+// snapshottingBlobHandle records the blob content after every write, which is what a crash or a concurrent writeback may leave.
+type snapshottingBlobHandle struct {
+	*TestBlobHandle
+	snapshots [][]byte
+}
+
+func (bh *snapshottingBlobHandle) PWrite(offset int64, p []byte) error {
+	err := bh.TestBlobHandle.PWrite(offset, p)
+	bh.snapshots = append(bh.snapshots, append([]byte{}, bh.Buf...))
+	return err
+}
+
+func TestIntegrity_UnsealedChunkReadableAfterEveryWrite(t *testing.T) {
+	td := genTestData(2 * chunkstore.ContentFramePayloadLength)
+	updated := append([]byte{}, td...)
+	copy(updated[chunkstore.ContentFramePayloadLength+10:], HelloWorld)
+	appended := append(append([]byte{}, updated...), HelloWorld...)
+	valid := [][]byte{{}, td[:chunkstore.ContentFramePayloadLength], td, updated, appended}
+
+	bh := &snapshottingBlobHandle{TestBlobHandle: &TestBlobHandle{}}
+	cio := chunkstore.NewChunkIOWithMetadata(bh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	if err := cio.PWrite(0, td); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := cio.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	cio = chunkstore.NewChunkIOWithMetadata(bh, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+	// Rewrites the frame 1 in place.
+	if err := cio.PWrite(int64(chunkstore.ContentFramePayloadLength+10), HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	// Appends the frame 2.
+	if err := cio.PWrite(int64(len(updated)), HelloWorld); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := cio.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for i, buf := range bh.snapshots {
+		cr, err := chunkstore.NewChunkReader(bytes.NewReader(buf), TestCipher())
+		if err != nil {
+			t.Errorf("Snapshot %d: NewChunkReader failed: %v", i, err)
+			continue
+		}
+		p, err := ioutil.ReadAll(cr)
+		if err != nil {
+			t.Errorf("Snapshot %d: ChunkReader failed: %v", i, err)
+			continue
+		}
+		ok := false
+		for _, v := range valid {
+			ok = ok || bytes.Equal(p, v)
+		}
+		if !ok {
+			t.Errorf("Snapshot %d: unexpected content of len %d", i, len(p))
+		}
+
+		cio := chunkstore.NewChunkIOWithMetadata(&TestBlobHandle{Buf: buf}, TestCipher(), chunkstore.ChunkHeader{BlobPath: "a"})
+		readtgt := make([]byte, cio.PayloadLen())
+		if err := cio.PRead(0, readtgt); err != nil || !bytes.Equal(readtgt, p) {
+			t.Errorf("Snapshot %d: ChunkIO read mismatch: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package chunkstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// PathPrivacy specifies how original paths are recorded in metadata, i.e. INodeCommon.OrigPath and ChunkHeader.OrigFilename.
+type PathPrivacy int
+
+const (
+	// PathPrivacyPlain records paths as is.
+	PathPrivacyPlain PathPrivacy = iota
+	// PathPrivacyHMAC records keyed hashes of paths. The same path always maps to the same hash, so a path can still be matched against the metadata given the key.
+	PathPrivacyHMAC
+	// PathPrivacyOmit records no path at all.
+	PathPrivacyOmit
+)
+
+const (
+	HashedPathPrefix = "hmac:"
+	OmittedPath      = "<omitted>"
+)
+
+func ParsePathPrivacy(s string) (PathPrivacy, error) {
+	switch s {
+	case "", "plain":
+		return PathPrivacyPlain, nil
+	case "hmac":
+		return PathPrivacyHMAC, nil
+	case "omit":
+		return PathPrivacyOmit, nil
+	default:
+		return PathPrivacyPlain, fmt.Errorf("Unknown path privacy \"%s\"", s)
+	}
+}
+
+func (pp PathPrivacy) String() string {
+	switch pp {
+	case PathPrivacyPlain:
+		return "plain"
+	case PathPrivacyHMAC:
+		return "hmac"
+	case PathPrivacyOmit:
+		return "omit"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(pp))
+	}
+}
+
+// IsScrubbedPath reports whether p is a hashed or omitted path, rather than a plain one.
+func IsScrubbedPath(p string) bool {
+	return p == OmittedPath || strings.HasPrefix(p, HashedPathPrefix)
+}
+
+// PathScrubber transforms paths before they are recorded in metadata. A nil *PathScrubber keeps paths plain.
+type PathScrubber struct {
+	privacy PathPrivacy
+	key     []byte
+}
+
+func NewPathScrubber(privacy PathPrivacy, key []byte) *PathScrubber {
+	return &PathScrubber{privacy: privacy, key: key}
+}
+
+func (s *PathScrubber) Privacy() PathPrivacy {
+	if s == nil {
+		return PathPrivacyPlain
+	}
+	return s.privacy
+}
+
+// HashPath returns the hashed form of p regardless of the privacy setting.
+func (s *PathScrubber) HashPath(p string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(p))
+	return HashedPathPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Scrub returns p in the form to be recorded. Already scrubbed paths are never hashed again.
+func (s *PathScrubber) Scrub(p string) string {
+	switch s.Privacy() {
+	case PathPrivacyHMAC:
+		if IsScrubbedPath(p) {
+			return p
+		}
+		return s.HashPath(p)
+	case PathPrivacyOmit:
+		return OmittedPath
+	default:
+		return p
+	}
+}
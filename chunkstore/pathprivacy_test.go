@@ -0,0 +1,51 @@
+package chunkstore_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nyaxt/otaru/chunkstore"
+)
+
+func TestPathScrubber(t *testing.T) {
+	var plain *chunkstore.PathScrubber
+	if s := plain.Scrub("/foo/bar.txt"); s != "/foo/bar.txt" {
+		t.Errorf("nil scrubber should keep paths plain: %s", s)
+	}
+
+	hs := chunkstore.NewPathScrubber(chunkstore.PathPrivacyHMAC, []byte("key"))
+	h := hs.Scrub("/foo/bar.txt")
+	if !strings.HasPrefix(h, chunkstore.HashedPathPrefix) || strings.Contains(h, "bar") {
+		t.Errorf("Unexpected hashed path: %s", h)
+	}
+	if h != hs.HashPath("/foo/bar.txt") {
+		t.Errorf("Scrub result should match HashPath")
+	}
+	if hs.Scrub(h) != h {
+		t.Errorf("Hashed path should not be hashed again")
+	}
+	if hs.Scrub("/foo/baz.txt") == h {
+		t.Errorf("Different paths should have different hashes")
+	}
+	other := chunkstore.NewPathScrubber(chunkstore.PathPrivacyHMAC, []byte("otherkey"))
+	if other.Scrub("/foo/bar.txt") == h {
+		t.Errorf("Hash should depend on the key")
+	}
+
+	omit := chunkstore.NewPathScrubber(chunkstore.PathPrivacyOmit, []byte("key"))
+	if s := omit.Scrub(h); s != chunkstore.OmittedPath {
+		t.Errorf("Unexpected omitted path: %s", s)
+	}
+}
+
+func TestParsePathPrivacy(t *testing.T) {
+	for _, pp := range []chunkstore.PathPrivacy{chunkstore.PathPrivacyPlain, chunkstore.PathPrivacyHMAC, chunkstore.PathPrivacyOmit} {
+		parsed, err := chunkstore.ParsePathPrivacy(pp.String())
+		if err != nil || parsed != pp {
+			t.Errorf("ParsePathPrivacy(%s) = %v, %v", pp, parsed, err)
+		}
+	}
+	if _, err := chunkstore.ParsePathPrivacy("rot13"); err == nil {
+		t.Errorf("ParsePathPrivacy should fail on unknown value")
+	}
+}
@@ -0,0 +1,533 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/nyaxt/otaru"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+const (
+	// importTmpPrefix and exportTmpPrefix are prepended to the names of files being copied. Files are renamed to their names only after the whole content is written, so an interrupted transfer never leaves a partial file under the final name.
+	importTmpPrefix = ".otaru-import."
+	exportTmpPrefix = ".otaru-export."
+
+	defaultBulkConcurrency = 4
+	defaultBulkBatchSize   = 256
+)
+
+type bulkStats struct {
+	numFiles   int64
+	numSkipped int64
+	numBytes   int64
+}
+
+func (s *bulkStats) String() string {
+	return fmt.Sprintf("%d files (%d bytes) copied, %d files already up to date", atomic.LoadInt64(&s.numFiles), atomic.LoadInt64(&s.numBytes), atomic.LoadInt64(&s.numSkipped))
+}
+
+// errorList collects errors from the workers. The transfer goes on for other files on errors, and the first error is reported.
+type errorList struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *errorList) add(err error) {
+	log.Printf("%v", err)
+	l.mu.Lock()
+	l.errs = append(l.errs, err)
+	l.mu.Unlock()
+}
+
+func (l *errorList) err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch len(l.errs) {
+	case 0:
+		return nil
+	case 1:
+		return l.errs[0]
+	}
+	return fmt.Errorf("%v, and %d more errors", l.errs[0], len(l.errs)-1)
+}
+
+// runWorkers runs f on the items sent to the returned channel with n goroutines. Close the channel and call wait to join them.
+func runWorkers(n int, f func(item interface{})) (chan<- interface{}, func()) {
+	c := make(chan interface{}, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range c {
+				f(item)
+			}
+		}()
+	}
+	return c, wg.Wait
+}
+
+type importFile struct {
+	localpath string
+	dirID     inodedb.ID
+	dirpath   string
+	name      string
+	tmpID     inodedb.ID
+}
+
+type importer struct {
+	fs        *otaru.FileSystem
+	batchSize int
+	stats     bulkStats
+	errs      errorList
+	fileC     chan<- interface{}
+}
+
+// createEntries creates the entries in batches of importer.batchSize, each applied in a single DBTransaction.
+func (im *importer) createEntries(dirID inodedb.ID, es []otaru.NewEntry) ([]inodedb.ID, error) {
+	ids := make([]inodedb.ID, 0, len(es))
+	for len(es) > 0 {
+		n := len(es)
+		if n > im.batchSize {
+			n = im.batchSize
+		}
+		batchids, err := im.fs.CreateEntries(dirID, es[:n])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, batchids...)
+		es = es[n:]
+	}
+	return ids, nil
+}
+
+func (im *importer) importDir(localdir, dirpath string, dirID inodedb.ID) error {
+	fis, err := ioutil.ReadDir(localdir)
+	if err != nil {
+		return err
+	}
+	entries, err := im.fs.DirEntries(dirID)
+	if err != nil {
+		return pathError(dirpath, err)
+	}
+
+	var newes []otaru.NewEntry
+	var files []*importFile
+	var newfiles []*importFile
+	subdirs := make(map[string]inodedb.ID)
+	for _, fi := range fis {
+		name := fi.Name()
+		p := path.Join(dirpath, name)
+		id, exists := entries[name]
+
+		switch {
+		case fi.IsDir():
+			if !exists {
+				newes = append(newes, otaru.NewEntry{Name: name, Type: inodedb.DirNodeT})
+				subdirs[name] = 0
+				continue
+			}
+			if dir, err := isDir(im.fs, id); err != nil {
+				return pathError(p, err)
+			} else if !dir {
+				return pathError(p, syscall.ENOTDIR)
+			}
+			subdirs[name] = id
+
+		case fi.Mode().IsRegular():
+			f := &importFile{localpath: path.Join(localdir, name), dirID: dirID, dirpath: dirpath, name: name}
+			if exists {
+				a, err := im.fs.Attr(id)
+				if err != nil {
+					return pathError(p, err)
+				}
+				if a.Type != inodedb.FileNodeT {
+					return pathError(p, syscall.EISDIR)
+				}
+				if a.Size == fi.Size() {
+					atomic.AddInt64(&im.stats.numSkipped, 1)
+					continue
+				}
+			}
+			// Reuse the temporary file left by an interrupted import.
+			if tmpID, ok := entries[importTmpPrefix+name]; ok {
+				f.tmpID = tmpID
+				files = append(files, f)
+			} else {
+				newes = append(newes, otaru.NewEntry{Name: importTmpPrefix + name, Type: inodedb.FileNodeT})
+				newfiles = append(newfiles, f)
+			}
+
+		default:
+			log.Printf("Skipping \"%s\", which is neither a regular file nor a directory.", path.Join(localdir, name))
+		}
+	}
+
+	if len(newes) > 0 {
+		ids, err := im.createEntries(dirID, newes)
+		if err != nil {
+			return pathError(dirpath, err)
+		}
+		for i, e := range newes {
+			if e.Type == inodedb.DirNodeT {
+				subdirs[e.Name] = ids[i]
+			}
+		}
+		i := 0
+		for j, e := range newes {
+			if e.Type == inodedb.FileNodeT {
+				newfiles[i].tmpID = ids[j]
+				i++
+			}
+		}
+		files = append(files, newfiles...)
+	}
+
+	for _, f := range files {
+		im.fileC <- f
+	}
+	for _, fi := range fis {
+		if id, ok := subdirs[fi.Name()]; ok {
+			if err := im.importDir(path.Join(localdir, fi.Name()), path.Join(dirpath, fi.Name()), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (im *importer) importFile(f *importFile) error {
+	p := path.Join(f.dirpath, f.name)
+
+	lf, err := os.Open(f.localpath)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	fh, err := im.fs.OpenFile(f.tmpID, fl.O_RDWR)
+	if err != nil {
+		return pathError(p, err)
+	}
+	if err := fh.Truncate(0); err != nil {
+		fh.Close()
+		return pathError(p, err)
+	}
+	n, err := io.Copy(otaru.NewFileHandleIO(fh), lf)
+	if err != nil {
+		fh.Close()
+		return pathError(p, err)
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return pathError(p, err)
+	}
+	fh.Close()
+
+	if err := im.fs.ReplaceFile(f.dirID, importTmpPrefix+f.name, f.name); err != nil {
+		return pathError(p, err)
+	}
+	atomic.AddInt64(&im.stats.numFiles, 1)
+	atomic.AddInt64(&im.stats.numBytes, n)
+	return nil
+}
+
+// Import copies a local directory tree into PATH, skipping files of the same size.
+func Import(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("import", flag.ContinueOnError)
+	concurrency := fset.Int("j", defaultBulkConcurrency, "Number of files copied in parallel")
+	batchSize := fset.Int("batch", defaultBulkBatchSize, "Max number of nodes created in a single DBTransaction")
+	verify := fset.Bool("verify", false, "Compare the checksums of all files after the import")
+	args, err := parseFlags(fset, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 || *batchSize < 1 {
+		return UsageError{"import: -j and -batch must be positive"}
+	}
+	localdir, dst := args[0], cleanPath(args[1])
+
+	if fi, err := os.Stat(localdir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return &PathError{Path: localdir, Err: syscall.ENOTDIR}
+	}
+	if err := mkdirAll(fs, dst); err != nil {
+		return err
+	}
+	dstID, err := fs.FindDirFullPath(dst)
+	if err != nil {
+		return pathError(dst, err)
+	}
+
+	im := &importer{fs: fs, batchSize: *batchSize}
+	fileC, wait := runWorkers(*concurrency, func(item interface{}) {
+		if err := im.importFile(item.(*importFile)); err != nil {
+			im.errs.add(err)
+		}
+	})
+	im.fileC = fileC
+	if err := im.importDir(localdir, dst, dstID); err != nil {
+		im.errs.add(err)
+	}
+	close(fileC)
+	wait()
+
+	fmt.Fprintf(w, "import: %v\n", &im.stats)
+	if err := im.errs.err(); err != nil {
+		return err
+	}
+	if *verify {
+		return verifyTree(fs, localdir, dst, *concurrency, w)
+	}
+	return nil
+}
+
+type exportFile struct {
+	id        inodedb.ID
+	path      string
+	localpath string
+	size      int64
+}
+
+type exporter struct {
+	fs    *otaru.FileSystem
+	stats bulkStats
+	errs  errorList
+	fileC chan<- interface{}
+}
+
+func (ex *exporter) exportDir(dirpath string, dirID inodedb.ID, localdir string) error {
+	if err := os.MkdirAll(localdir, 0755); err != nil {
+		return err
+	}
+	entries, err := ex.fs.DirEntries(dirID)
+	if err != nil {
+		return pathError(dirpath, err)
+	}
+	for _, name := range sortedNames(entries) {
+		if strings.HasPrefix(name, importTmpPrefix) || (dirID == inodedb.RootDirID && name == otaru.TrashDirName) {
+			continue
+		}
+		p := path.Join(dirpath, name)
+		a, err := ex.fs.Attr(entries[name])
+		if err != nil {
+			return pathError(p, err)
+		}
+		lp := path.Join(localdir, name)
+		if a.Type == inodedb.DirNodeT {
+			if err := ex.exportDir(p, a.ID, lp); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi, err := os.Stat(lp); err == nil && fi.Mode().IsRegular() && fi.Size() == a.Size {
+			atomic.AddInt64(&ex.stats.numSkipped, 1)
+			continue
+		}
+		ex.fileC <- &exportFile{id: a.ID, path: p, localpath: lp, size: a.Size}
+	}
+	return nil
+}
+
+func (ex *exporter) exportFile(f *exportFile) error {
+	tmppath := path.Join(path.Dir(f.localpath), exportTmpPrefix+path.Base(f.localpath))
+	lf, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+	if err := copyOut(ex.fs, f.path, lf); err != nil {
+		lf.Close()
+		return err
+	}
+	if err := lf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmppath, f.localpath); err != nil {
+		return err
+	}
+	atomic.AddInt64(&ex.stats.numFiles, 1)
+	atomic.AddInt64(&ex.stats.numBytes, f.size)
+	return nil
+}
+
+// Export copies the tree under PATH to a local directory, skipping local files of the same size.
+func Export(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("export", flag.ContinueOnError)
+	concurrency := fset.Int("j", defaultBulkConcurrency, "Number of files copied in parallel")
+	verify := fset.Bool("verify", false, "Compare the checksums of all files after the export")
+	args, err := parseFlags(fset, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return UsageError{"export: -j must be positive"}
+	}
+	src, localdir := cleanPath(args[0]), args[1]
+
+	srcID, err := fs.FindDirFullPath(src)
+	if err != nil {
+		return pathError(src, err)
+	}
+
+	ex := &exporter{fs: fs}
+	fileC, wait := runWorkers(*concurrency, func(item interface{}) {
+		if err := ex.exportFile(item.(*exportFile)); err != nil {
+			ex.errs.add(err)
+		}
+	})
+	ex.fileC = fileC
+	if err := ex.exportDir(src, srcID, localdir); err != nil {
+		ex.errs.add(err)
+	}
+	close(fileC)
+	wait()
+
+	fmt.Fprintf(w, "export: %v\n", &ex.stats)
+	if err := ex.errs.err(); err != nil {
+		return err
+	}
+	if *verify {
+		return verifyTree(fs, localdir, src, *concurrency, w)
+	}
+	return nil
+}
+
+type verifyFile struct {
+	localpath string
+	path      string
+}
+
+func localChecksum(localpath string) ([]byte, error) {
+	f, err := os.Open(localpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func checksum(fs *otaru.FileSystem, p string) ([]byte, error) {
+	h := sha256.New()
+	if err := copyOut(fs, p, h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verifyOne returns a description of the mismatch, or "" if the files match.
+func verifyOne(fs *otaru.FileSystem, f *verifyFile) (string, error) {
+	fi, err := os.Stat(f.localpath)
+	if err != nil {
+		return "", err
+	}
+	id, err := fs.FindNodeFullPath(f.path)
+	if err != nil {
+		if Errno(err) == syscall.ENOENT {
+			return "missing", nil
+		}
+		return "", pathError(f.path, err)
+	}
+	a, err := fs.Attr(id)
+	if err != nil {
+		return "", pathError(f.path, err)
+	}
+	if a.Type != inodedb.FileNodeT {
+		return "not a file", nil
+	}
+	if a.Size != fi.Size() {
+		return fmt.Sprintf("size differs: local %d, otaru %d", fi.Size(), a.Size), nil
+	}
+
+	lsum, err := localChecksum(f.localpath)
+	if err != nil {
+		return "", err
+	}
+	osum, err := checksum(fs, f.path)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(lsum, osum) {
+		return fmt.Sprintf("checksum differs: local %x, otaru %x", lsum, osum), nil
+	}
+	return "", nil
+}
+
+func walkLocal(localdir, dirpath string, f func(localpath, p string)) error {
+	fis, err := ioutil.ReadDir(localdir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if strings.HasPrefix(name, exportTmpPrefix) {
+			continue
+		}
+		lp, p := path.Join(localdir, name), path.Join(dirpath, name)
+		if fi.IsDir() {
+			if err := walkLocal(lp, p, f); err != nil {
+				return err
+			}
+		} else if fi.Mode().IsRegular() {
+			f(lp, p)
+		}
+	}
+	return nil
+}
+
+// verifyTree compares the SHA-256 checksums of the regular files under localdir with the files under dirpath.
+func verifyTree(fs *otaru.FileSystem, localdir, dirpath string, concurrency int, w io.Writer) error {
+	var numFiles, numMismatches int64
+	var mu sync.Mutex
+	var errs errorList
+
+	fileC, wait := runWorkers(concurrency, func(item interface{}) {
+		f := item.(*verifyFile)
+		mismatch, err := verifyOne(fs, f)
+		if err != nil {
+			errs.add(err)
+			return
+		}
+		atomic.AddInt64(&numFiles, 1)
+		if mismatch != "" {
+			atomic.AddInt64(&numMismatches, 1)
+			mu.Lock()
+			fmt.Fprintf(w, "verify: %s: %s\n", f.path, mismatch)
+			mu.Unlock()
+		}
+	})
+	if err := walkLocal(localdir, dirpath, func(localpath, p string) {
+		fileC <- &verifyFile{localpath: localpath, path: p}
+	}); err != nil {
+		errs.add(err)
+	}
+	close(fileC)
+	wait()
+
+	fmt.Fprintf(w, "verify: %d files verified, %d mismatches\n", numFiles, numMismatches)
+	if err := errs.err(); err != nil {
+		return err
+	}
+	if numMismatches > 0 {
+		return &PathError{Path: dirpath, Err: syscall.EIO}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package cli_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func writeLocalTree(t *testing.T, root string, files map[string]string) {
+	for p, content := range files {
+		lp := path.Join(root, p)
+		if err := os.MkdirAll(path.Dir(lp), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := ioutil.WriteFile(lp, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	fs := TestFileSystem()
+
+	tmpdir, err := ioutil.TempDir("", "otarubulk")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	src := path.Join(tmpdir, "src")
+	files := map[string]string{
+		"a.txt":       "aaa",
+		"b.txt":       "bbbbbb",
+		"sub/c.txt":   "ccccccccc",
+		"sub/d.txt":   "",
+		"sub/e/f.txt": "ffff",
+	}
+	writeLocalTree(t, src, files)
+
+	out := mustRun(t, fs, "import", "-batch", "2", "-verify", src, "/archive")
+	if !strings.Contains(out, "5 files (22 bytes) copied, 0 files already up to date") || !strings.Contains(out, "5 files verified, 0 mismatches") {
+		t.Errorf("Unexpected import output: %q", out)
+	}
+	if out := mustRun(t, fs, "cat", "/archive/sub/e/f.txt"); out != "ffff" {
+		t.Errorf("Unexpected content: %q", out)
+	}
+
+	// Resume: only the changed file is copied again, replacing the old one in place.
+	fs.EnableTrash(time.Hour)
+	writeLocalTree(t, src, map[string]string{"b.txt": "bb"})
+	out = mustRun(t, fs, "import", src, "/archive")
+	if !strings.Contains(out, "1 files (2 bytes) copied, 4 files already up to date") {
+		t.Errorf("Unexpected import output on resume: %q", out)
+	}
+	if out := mustRun(t, fs, "ls", "/archive"); out != "a.txt\nb.txt\nsub\n" {
+		t.Errorf("Unexpected ls output: %q", out)
+	}
+	if out := mustRun(t, fs, "trash", "list"); out != "" {
+		t.Errorf("The replaced file shouldn't go to the trash: %q", out)
+	}
+
+	dst := path.Join(tmpdir, "dst")
+	out = mustRun(t, fs, "export", "-verify", "/archive", dst)
+	if !strings.Contains(out, "5 files (18 bytes) copied") || !strings.Contains(out, "5 files verified, 0 mismatches") {
+		t.Errorf("Unexpected export output: %q", out)
+	}
+	files["b.txt"] = "bb"
+	for p, content := range files {
+		b, err := ioutil.ReadFile(path.Join(dst, p))
+		if err != nil || string(b) != content {
+			t.Errorf("Exported %s: %q, %v", p, b, err)
+		}
+	}
+
+	// Same size, different content is caught by the verification pass.
+	writeLocalTree(t, dst, map[string]string{"a.txt": "xxx"})
+	out, err = run(t, fs, "export", "-verify", "/archive", dst)
+	if err == nil {
+		t.Errorf("export -verify should fail on mismatch")
+	}
+	if !strings.Contains(out, "/archive/a.txt: checksum differs") {
+		t.Errorf("Unexpected export output: %q", out)
+	}
+
+	// The trash isn't exported.
+	mustRun(t, fs, "rm", "/archive/a.txt")
+	root := path.Join(tmpdir, "root")
+	mustRun(t, fs, "export", "/", root)
+	if _, err := os.Stat(path.Join(root, otaru.TrashDirName)); !os.IsNotExist(err) {
+		t.Errorf("The trash shouldn't be exported: %v", err)
+	}
+	if _, err := os.Stat(path.Join(root, "archive/b.txt")); err != nil {
+		t.Errorf("Stat failed: %v", err)
+	}
+}
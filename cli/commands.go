@@ -0,0 +1,422 @@
+// Package cli implements the commands of the otaru CLI, which operates on otaru.FileSystem directly without FUSE.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+
+	"github.com/nyaxt/otaru"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+// Command is a subcommand of the otaru CLI.
+type Command struct {
+	Name  string
+	Usage string
+	// Write tells if the command modifies the filesystem. Other commands open the filesystem read-only.
+	Write bool
+	Run   func(fs *otaru.FileSystem, args []string, w io.Writer) error
+}
+
+var Commands = []Command{
+	{"ls", "ls [-l] PATH...", false, Ls},
+	{"cat", "cat PATH...", false, Cat},
+	{"get", "get PATH LOCALPATH", false, Get},
+	{"put", "put LOCALPATH PATH", true, Put},
+	{"mkdir", "mkdir [-p] PATH...", true, Mkdir},
+	{"mv", "mv SRC DST", true, Mv},
+	{"cp", "cp [-r] SRC DST", true, Cp},
+	{"rm", "rm [-r] PATH...", true, Rm},
+	{"stat", "stat PATH...", false, Stat},
+	{"du", "du [-s] PATH...", false, Du},
+	{"import", "import [-j N] [-batch N] [-verify] LOCALDIR PATH", true, Import},
+	{"export", "export [-j N] [-verify] PATH LOCALDIR", false, Export},
+	{"tar", "tar [-z COMPRESSION] PATH [LOCALFILE]", false, Tar},
+	{"untar", "untar [-z COMPRESSION] LOCALFILE PATH", true, Untar},
+	{"trash", "trash list | trash restore [-dst PATH] NAME... | trash purge [-all]", true, Trash},
+}
+
+func FindCommand(name string) (Command, bool) {
+	for _, c := range Commands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Command{}, false
+}
+
+// parseFlags parses the command flags, and checks the number of the args left.
+func parseFlags(fset *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	fset.SetOutput(ioutil.Discard)
+	if err := fset.Parse(args); err != nil {
+		return nil, UsageError{fmt.Sprintf("%s: %v", fset.Name(), err)}
+	}
+	rest := fset.Args()
+	if len(rest) < minArgs || (maxArgs >= 0 && len(rest) > maxArgs) {
+		return nil, UsageError{fmt.Sprintf("%s: wrong number of arguments", fset.Name())}
+	}
+	return rest, nil
+}
+
+// cleanPath makes the path given on the command line absolute. Paths are always relative to the root of the filesystem.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func isDir(fs *otaru.FileSystem, id inodedb.ID) (bool, error) {
+	a, err := fs.Attr(id)
+	if err != nil {
+		return false, err
+	}
+	return a.Type == inodedb.DirNodeT, nil
+}
+
+func sortedNames(entries map[string]inodedb.ID) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func formatAttr(a otaru.Attr, name string) string {
+	return fmt.Sprintf("%-4s %12d %8d %s", a.Type, a.Size, a.ID, name)
+}
+
+func Ls(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := fset.Bool("l", false, "List type, size and inode ID")
+	paths, err := parseFlags(fset, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+
+	printEntry := func(fullpath, name string, id inodedb.ID) error {
+		if !*long {
+			fmt.Fprintln(w, name)
+			return nil
+		}
+		a, err := fs.Attr(id)
+		if err != nil {
+			return pathError(fullpath, err)
+		}
+		fmt.Fprintln(w, formatAttr(a, name))
+		return nil
+	}
+
+	for i, p := range paths {
+		p = cleanPath(p)
+		id, err := fs.FindNodeFullPath(p)
+		if err != nil {
+			return pathError(p, err)
+		}
+		dir, err := isDir(fs, id)
+		if err != nil {
+			return pathError(p, err)
+		}
+		if !dir {
+			if err := printEntry(p, p, id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s:\n", p)
+		}
+		entries, err := fs.DirEntries(id)
+		if err != nil {
+			return pathError(p, err)
+		}
+		for _, name := range sortedNames(entries) {
+			if err := printEntry(path.Join(p, name), name, entries[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyOut(fs *otaru.FileSystem, p string, w io.Writer) error {
+	p = cleanPath(p)
+	id, err := fs.FindNodeFullPath(p)
+	if err != nil {
+		return pathError(p, err)
+	}
+	fh, err := fs.OpenFile(id, fl.O_RDONLY)
+	if err != nil {
+		return pathError(p, err)
+	}
+	defer fh.Close()
+
+	if _, err := io.Copy(w, otaru.NewFileHandleIO(fh)); err != nil {
+		return pathError(p, err)
+	}
+	return nil
+}
+
+func Cat(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	paths, err := parseFlags(flag.NewFlagSet("cat", flag.ContinueOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := copyOut(fs, p, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get copies a file to the local filesystem. If LOCALPATH is a directory, the file is copied into it.
+func Get(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	args, err := parseFlags(flag.NewFlagSet("get", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	src, dst := args[0], args[1]
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = path.Join(dst, path.Base(cleanPath(src)))
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := copyOut(fs, src, f); err != nil {
+		f.Close()
+		os.Remove(dst)
+		return err
+	}
+	return f.Close()
+}
+
+// Put copies a local file to the filesystem, replacing the existing content. If PATH is a directory, the file is copied into it.
+func Put(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	args, err := parseFlags(flag.NewFlagSet("put", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	src, dst := args[0], cleanPath(args[1])
+	if id, err := fs.FindNodeFullPath(dst); err == nil {
+		if dir, err := isDir(fs, id); err != nil {
+			return pathError(dst, err)
+		} else if dir {
+			dst = path.Join(dst, path.Base(src))
+		}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fh, err := fs.OpenFileFullPath(dst, fl.O_RDWRCREATE, 0666)
+	if err != nil {
+		return pathError(dst, err)
+	}
+	defer fh.Close()
+	if err := fh.Truncate(0); err != nil {
+		return pathError(dst, err)
+	}
+	if _, err := io.Copy(otaru.NewFileHandleIO(fh), f); err != nil {
+		return pathError(dst, err)
+	}
+	return pathError(dst, fh.Sync())
+}
+
+func mkdirAll(fs *otaru.FileSystem, p string) error {
+	id, err := fs.FindNodeFullPath(p)
+	if err == nil {
+		if dir, err := isDir(fs, id); err != nil {
+			return pathError(p, err)
+		} else if !dir {
+			return pathError(p, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if err := mkdirAll(fs, path.Dir(p)); err != nil {
+		return err
+	}
+	_, err = fs.CreateDirFullPath(p)
+	return pathError(p, err)
+}
+
+func Mkdir(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("mkdir", flag.ContinueOnError)
+	parents := fset.Bool("p", false, "Create parent directories as needed, and don't fail if the directory exists")
+	paths, err := parseFlags(fset, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		if *parents {
+			err = mkdirAll(fs, p)
+		} else {
+			_, err = fs.CreateDirFullPath(p)
+			err = pathError(p, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mv renames SRC to DST. If DST is a directory, SRC is moved into it.
+func Mv(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	args, err := parseFlags(flag.NewFlagSet("mv", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	src, dst := cleanPath(args[0]), cleanPath(args[1])
+	if id, err := fs.FindNodeFullPath(dst); err == nil {
+		if dir, err := isDir(fs, id); err != nil {
+			return pathError(dst, err)
+		} else if dir {
+			dst = path.Join(dst, path.Base(src))
+		}
+	}
+	return pathError(src, fs.RenameFullPath(src, dst))
+}
+
+// Cp copies the file, or the directory with -r, by cloning, which shares the chunk blobs copy-on-write instead of copying the contents.
+func Cp(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("cp", flag.ContinueOnError)
+	recursive := fset.Bool("r", false, "Copy directories recursively")
+	args, err := parseFlags(fset, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	src, dst := cleanPath(args[0]), cleanPath(args[1])
+	if id, err := fs.FindNodeFullPath(dst); err == nil {
+		if dir, err := isDir(fs, id); err != nil {
+			return pathError(dst, err)
+		} else if dir {
+			dst = path.Join(dst, path.Base(src))
+		}
+	}
+	if *recursive {
+		_, err = fs.CloneTreeFullPath(src, dst)
+	} else {
+		_, err = fs.CloneFileFullPath(src, dst)
+	}
+	return pathError(src, err)
+}
+
+func Rm(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("rm", flag.ContinueOnError)
+	recursive := fset.Bool("r", false, "Remove directories and their contents recursively")
+	paths, err := parseFlags(fset, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		if *recursive {
+			err = fs.RemoveAllFullPath(p)
+		} else {
+			err = fs.RemoveFullPath(p)
+		}
+		if err != nil {
+			return pathError(p, err)
+		}
+	}
+	return nil
+}
+
+func Stat(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	paths, err := parseFlags(flag.NewFlagSet("stat", flag.ContinueOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		id, err := fs.FindNodeFullPath(p)
+		if err != nil {
+			return pathError(p, err)
+		}
+		a, err := fs.Attr(id)
+		if err != nil {
+			return pathError(p, err)
+		}
+		fmt.Fprintf(w, "Path: %s\nID: %d\nType: %s\nSize: %d\n", p, a.ID, a.Type, a.Size)
+	}
+	return nil
+}
+
+// diskUsage sums up the sizes of the files under the node. Directories are listed as they are summed up unless summarize.
+func diskUsage(fs *otaru.FileSystem, p string, id inodedb.ID, summarize bool, w io.Writer) (int64, error) {
+	a, err := fs.Attr(id)
+	if err != nil {
+		return 0, pathError(p, err)
+	}
+	if a.Type != inodedb.DirNodeT {
+		return a.Size, nil
+	}
+
+	entries, err := fs.DirEntries(id)
+	if err != nil {
+		return 0, pathError(p, err)
+	}
+	total := int64(0)
+	for _, name := range sortedNames(entries) {
+		size, err := diskUsage(fs, path.Join(p, name), entries[name], summarize, w)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	if !summarize {
+		fmt.Fprintf(w, "%d\t%s\n", total, p)
+	}
+	return total, nil
+}
+
+// Du reports the total size of the files under each PATH in bytes. The sizes are the file sizes, not the size of blobs stored in the backend.
+func Du(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("du", flag.ContinueOnError)
+	summarize := fset.Bool("s", false, "Display only the total of each argument")
+	paths, err := parseFlags(fset, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		id, err := fs.FindNodeFullPath(p)
+		if err != nil {
+			return pathError(p, err)
+		}
+		dir, err := isDir(fs, id)
+		if err != nil {
+			return pathError(p, err)
+		}
+		total, err := diskUsage(fs, p, id, *summarize, w)
+		if err != nil {
+			return err
+		}
+		if *summarize || !dir {
+			fmt.Fprintf(w, "%d\t%s\n", total, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package cli_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/cli"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func run(t *testing.T, fs *otaru.FileSystem, args ...string) (string, error) {
+	cmd, ok := cli.FindCommand(args[0])
+	if !ok {
+		t.Fatalf("Command %s not found", args[0])
+	}
+	var b bytes.Buffer
+	err := cmd.Run(fs, args[1:], &b)
+	return b.String(), err
+}
+
+func mustRun(t *testing.T, fs *otaru.FileSystem, args ...string) string {
+	out, err := run(t, fs, args...)
+	if err != nil {
+		t.Fatalf("%v failed: %v", args, err)
+	}
+	return out
+}
+
+func TestCommands(t *testing.T) {
+	fs := TestFileSystem()
+
+	tmpdir, err := ioutil.TempDir("", "otarucli")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	local := path.Join(tmpdir, "hello.txt")
+	if err := ioutil.WriteFile(local, []byte("hello world!\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	mustRun(t, fs, "mkdir", "-p", "/a/b")
+	mustRun(t, fs, "put", local, "/a/b")
+	if out := mustRun(t, fs, "cat", "/a/b/hello.txt"); out != "hello world!\n" {
+		t.Errorf("Unexpected cat output: %q", out)
+	}
+	if out := mustRun(t, fs, "ls", "/a"); out != "b\n" {
+		t.Errorf("Unexpected ls output: %q", out)
+	}
+	if out := mustRun(t, fs, "du", "-s", "/a"); out != "13\t/a\n" {
+		t.Errorf("Unexpected du output: %q", out)
+	}
+	if out := mustRun(t, fs, "du", "/"); out != "13\t/a/b\n13\t/a\n13\t/\n" {
+		t.Errorf("Unexpected du output: %q", out)
+	}
+
+	mustRun(t, fs, "mv", "/a/b/hello.txt", "/")
+	mustRun(t, fs, "get", "/hello.txt", path.Join(tmpdir, "got.txt"))
+	if b, err := ioutil.ReadFile(path.Join(tmpdir, "got.txt")); err != nil || string(b) != "hello world!\n" {
+		t.Errorf("Unexpected get result: %q, %v", b, err)
+	}
+	if out := mustRun(t, fs, "stat", "/hello.txt"); !bytes.Contains([]byte(out), []byte("Type: file\nSize: 13\n")) {
+		t.Errorf("Unexpected stat output: %q", out)
+	}
+
+	mustRun(t, fs, "cp", "/hello.txt", "/a")
+	if out := mustRun(t, fs, "cat", "/a/hello.txt"); out != "hello world!\n" {
+		t.Errorf("Unexpected cat output of copy: %q", out)
+	}
+	if _, err := run(t, fs, "cp", "/a", "/a2"); cli.Errno(err) != syscall.EISDIR {
+		t.Errorf("cp of dir without -r: %v", err)
+	}
+	mustRun(t, fs, "cp", "-r", "/a", "/a2")
+	if out := mustRun(t, fs, "ls", "/a2"); out != "b\nhello.txt\n" {
+		t.Errorf("Unexpected ls output of copied dir: %q", out)
+	}
+
+	_, err = run(t, fs, "rm", "/a")
+	if cli.Errno(err) != syscall.ENOTEMPTY {
+		t.Errorf("rm of non-empty dir: %v", err)
+	}
+	mustRun(t, fs, "rm", "-r", "/a")
+
+	_, err = run(t, fs, "cat", "/a/b/hello.txt")
+	if cli.Errno(err) != syscall.ENOENT {
+		t.Errorf("cat of removed file: %v", err)
+	}
+	if msg := cli.ErrorString(err); msg != "/a/b/hello.txt: no such file or directory (ENOENT)" {
+		t.Errorf("Unexpected error message: %q", msg)
+	}
+
+	if _, err := run(t, fs, "mv", "/hello.txt"); err == nil {
+		t.Errorf("mv with one arg should fail")
+	} else if _, ok := err.(cli.UsageError); !ok {
+		t.Errorf("Expected UsageError, got: %v", err)
+	}
+}
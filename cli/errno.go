@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+var errnoNames = map[syscall.Errno]string{
+	syscall.EACCES:    "EACCES",
+	syscall.EBADF:     "EBADF",
+	syscall.EBUSY:     "EBUSY",
+	syscall.EEXIST:    "EEXIST",
+	syscall.EINVAL:    "EINVAL",
+	syscall.EIO:       "EIO",
+	syscall.EISDIR:    "EISDIR",
+	syscall.ENOENT:    "ENOENT",
+	syscall.ENOTDIR:   "ENOTDIR",
+	syscall.ENOTEMPTY: "ENOTEMPTY",
+	syscall.EPERM:     "EPERM",
+}
+
+// Errno returns the errno of err. Errors without one are reported as EIO.
+func Errno(err error) syscall.Errno {
+	switch e := err.(type) {
+	case *PathError:
+		return Errno(e.Err)
+	case *os.PathError:
+		return Errno(e.Err)
+	case syscall.Errno:
+		return e
+	case inodedb.Errno:
+		return syscall.Errno(e)
+	case *otaru.WriterLockHeldError:
+		return e.Errno()
+	}
+	return syscall.EIO
+}
+
+func errnoName(errno syscall.Errno) string {
+	if name, ok := errnoNames[errno]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno %d", int(errno))
+}
+
+// PathError records the path of a failed operation, and formats the error in errno style, e.g. "/foo: no such file or directory (ENOENT)".
+type PathError struct {
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s: %v (%s)", e.Path, e.Err, errnoName(Errno(e.Err)))
+}
+
+// ErrorString formats err in errno style.
+func ErrorString(err error) string {
+	if _, ok := err.(*PathError); ok {
+		return err.Error()
+	}
+	return fmt.Sprintf("%v (%s)", err, errnoName(Errno(err)))
+}
+
+func pathError(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PathError{Path: path, Err: err}
+}
+
+// UsageError is returned for invalid arguments. The CLI exits with status 2 on it.
+type UsageError struct {
+	Msg string
+}
+
+func (e UsageError) Error() string { return e.Msg }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/cli"
+	"github.com/nyaxt/otaru/facade"
+)
+
+var Usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] COMMAND [ARGS...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, c := range cli.Commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", c.Usage)
+	}
+	fmt.Fprintf(os.Stderr, "  %s\n", cli.VolumeUsage)
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+var (
+	flagConfigFile = flag.String("config", path.Join(os.Getenv("HOME"), ".otaru", "config.toml"), "Config filepath")
+	flagForce      = flag.Bool("force", false, "Run write commands even if the volume is opened for write by another process, e.g. mounted")
+	flagVerbose    = flag.Bool("v", false, "Show logs of otaru")
+	flagVolume     = flag.String("volume", "", "Volume to operate on. Overrides Volume of the config")
+)
+
+func fail(cmd string, err error) {
+	fmt.Fprintf(os.Stderr, "otaru: %s: %s\n", cmd, cli.ErrorString(err))
+	if _, ok := err.(cli.UsageError); ok {
+		os.Exit(2)
+	}
+	os.Exit(1)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	flag.Usage = Usage
+	flag.Parse()
+	if !*flagVerbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if flag.NArg() < 1 {
+		Usage()
+		os.Exit(2)
+	}
+	cmd, ok := cli.FindCommand(flag.Arg(0))
+	switch flag.Arg(0) {
+	case "volume":
+		cmd, ok = cli.Command{Name: "volume", Write: cli.IsVolumeWrite(flag.Args()[1:])}, true
+	case "trash":
+		cmd.Write = cli.IsTrashWrite(flag.Args()[1:])
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "otaru: unknown command \"%s\"\n", flag.Arg(0))
+		Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := facade.NewConfigFromTomlFile(*flagConfigFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "otaru: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Writes from here and from a running mount would conflict, as each holds the inodedb state and node locks on its own. Opening for write takes the writer lock of the volume, which fails with EBUSY while it is mounted.
+	o, err := facade.NewOtaru(cfg, &facade.OneshotConfig{Volume: *flagVolume, ReadOnly: !cmd.Write, ForceWriterLock: *flagForce, NoServices: true, VolumesOnly: cmd.Run == nil})
+	if err != nil {
+		if _, ok := err.(*otaru.WriterLockHeldError); ok {
+			fmt.Fprintf(os.Stderr, "otaru: Unmount otaru first, or use -force.\n")
+		}
+		fail(cmd.Name, err)
+	}
+
+	if cmd.Run == nil {
+		err = cli.Volume(o, flag.Args()[1:], os.Stdout)
+	} else {
+		err = cmd.Run(o.FS, flag.Args()[1:], os.Stdout)
+	}
+	if cerr := o.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("Failed to close: %v", cerr)
+	}
+	if err != nil {
+		fail(cmd.Name, err)
+	}
+}
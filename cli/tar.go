@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/archive"
+)
+
+// compressionFlag returns the compression given by -z, or guessed from the archive filename.
+func compressionFlag(z, filename string) (archive.Compression, error) {
+	if z == "" {
+		return archive.CompressionFromFilename(filename), nil
+	}
+	comp, err := archive.ParseCompression(z)
+	if err != nil {
+		return comp, UsageError{err.Error()}
+	}
+	return comp, nil
+}
+
+// Tar writes the tree at PATH as a tar archive to LOCALFILE, or to stdout if LOCALFILE is "-" or omitted.
+func Tar(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("tar", flag.ContinueOnError)
+	z := fset.String("z", "", "Compression: \"none\", \"gzip\" or \"zstd\". Guessed from LOCALFILE if omitted")
+	args, err := parseFlags(fset, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	p, localpath := cleanPath(args[0]), "-"
+	if len(args) > 1 {
+		localpath = args[1]
+	}
+	comp, err := compressionFlag(*z, localpath)
+	if err != nil {
+		return err
+	}
+
+	if localpath == "-" {
+		return pathError(p, archive.WriteTar(fs, p, w, comp))
+	}
+	f, err := os.Create(localpath)
+	if err != nil {
+		return err
+	}
+	if err := archive.WriteTar(fs, p, f, comp); err != nil {
+		f.Close()
+		os.Remove(localpath)
+		return pathError(p, err)
+	}
+	return f.Close()
+}
+
+// Untar extracts the tar archive LOCALFILE, or stdin if "-", into a new directory PATH.
+func Untar(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	fset := flag.NewFlagSet("untar", flag.ContinueOnError)
+	z := fset.String("z", "", "Compression: \"none\", \"gzip\" or \"zstd\". Guessed from LOCALFILE if omitted")
+	args, err := parseFlags(fset, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	localpath, p := args[0], cleanPath(args[1])
+	comp, err := compressionFlag(*z, localpath)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if localpath != "-" {
+		f, err := os.Open(localpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	stats, err := archive.ExtractTar(fs, p, r, comp)
+	if err != nil {
+		return pathError(p, err)
+	}
+	fmt.Fprintf(w, "untar: %d dirs, %d files (%d bytes) extracted, %d entries skipped\n", stats.NumDirs, stats.NumFiles, stats.NumBytes, stats.NumSkipped)
+	return nil
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru"
+)
+
+// IsTrashWrite tells if the trash subcommand modifies the filesystem.
+func IsTrashWrite(args []string) bool {
+	return len(args) > 0 && args[0] != "list"
+}
+
+// Trash runs the trash subcommand: "list", "restore [-dst PATH] NAME...", or "purge [-all]".
+func Trash(fs *otaru.FileSystem, args []string, w io.Writer) error {
+	if len(args) < 1 {
+		return UsageError{"trash: subcommand required"}
+	}
+	switch sub := args[0]; sub {
+	case "list":
+		if _, err := parseFlags(flag.NewFlagSet("trash list", flag.ContinueOnError), args[1:], 0, 0); err != nil {
+			return err
+		}
+		tes, err := fs.ListTrash()
+		if err != nil {
+			return err
+		}
+		for _, te := range tes {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", te.Name, te.DeletedAt.Local().Format("2006-01-02 15:04:05"), formatAttr(te.Attr, te.OrigPath))
+		}
+		return nil
+	case "restore":
+		fset := flag.NewFlagSet("trash restore", flag.ContinueOnError)
+		dst := fset.String("dst", "", "Restore to the path instead of the path removed from. Only one NAME can be given")
+		names, err := parseFlags(fset, args[1:], 1, -1)
+		if err != nil {
+			return err
+		}
+		if *dst != "" {
+			if len(names) != 1 {
+				return UsageError{"trash restore: -dst takes only one NAME"}
+			}
+			*dst = cleanPath(*dst)
+		}
+		for _, name := range names {
+			p, err := fs.RestoreTrash(name, *dst)
+			if err != nil {
+				return pathError(name, err)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", name, p)
+		}
+		return nil
+	case "purge":
+		fset := flag.NewFlagSet("trash purge", flag.ContinueOnError)
+		all := fset.Bool("all", false, "Purge all entries, not only the ones older than TrashRetention")
+		if _, err := parseFlags(fset, args[1:], 0, 0); err != nil {
+			return err
+		}
+		var n int
+		var err error
+		if *all {
+			n, err = fs.PurgeTrash(context.Background(), time.Now())
+		} else {
+			n, err = fs.PurgeExpiredTrash(context.Background())
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Purged %d entries.\n", n)
+		return nil
+	default:
+		return UsageError{fmt.Sprintf("trash: unknown subcommand \"%s\"", sub)}
+	}
+}
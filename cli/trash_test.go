@@ -0,0 +1,50 @@
+package cli_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru/cli"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func TestTrash(t *testing.T) {
+	fs := TestFileSystem()
+	fs.EnableTrash(time.Hour)
+
+	mustRun(t, fs, "mkdir", "-p", "/a/b")
+	mustRun(t, fs, "rm", "-r", "/a")
+
+	out := mustRun(t, fs, "trash", "list")
+	fields := strings.Split(strings.TrimSuffix(out, "\n"), "\t")
+	if len(fields) != 3 || !strings.HasSuffix(fields[2], " /a") {
+		t.Fatalf("Unexpected trash list output: %q", out)
+	}
+	name := fields[0]
+
+	if _, err := run(t, fs, "trash", "restore", "-dst", "/x", name, name); err == nil {
+		t.Errorf("trash restore -dst with multiple names should fail")
+	} else if _, ok := err.(cli.UsageError); !ok {
+		t.Errorf("trash restore -dst with multiple names should fail with UsageError: %v", err)
+	}
+	if out := mustRun(t, fs, "trash", "restore", name); out != name+"\t/a\n" {
+		t.Errorf("Unexpected trash restore output: %q", out)
+	}
+	mustRun(t, fs, "stat", "/a/b")
+
+	mustRun(t, fs, "rm", "/a/b")
+	if out := mustRun(t, fs, "trash", "purge"); out != "Purged 0 entries.\n" {
+		t.Errorf("Unexpected trash purge output: %q", out)
+	}
+	if out := mustRun(t, fs, "trash", "purge", "-all"); out != "Purged 1 entries.\n" {
+		t.Errorf("Unexpected trash purge -all output: %q", out)
+	}
+	if out := mustRun(t, fs, "trash", "list"); out != "" {
+		t.Errorf("Unexpected trash list output after purge: %q", out)
+	}
+
+	if cli.IsTrashWrite([]string{"list"}) || !cli.IsTrashWrite([]string{"purge"}) {
+		t.Errorf("Unexpected IsTrashWrite")
+	}
+}
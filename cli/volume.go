@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nyaxt/otaru"
+)
+
+// VolumeManager manages the volumes in the bucket. It is implemented by facade.Otaru.
+type VolumeManager interface {
+	ListVolumes() ([]otaru.VolumeInfo, error)
+	CreateVolume(name string) error
+	DeleteVolume(name string) error
+}
+
+const VolumeUsage = "volume list | volume create NAME | volume delete NAME"
+
+// IsVolumeWrite tells if the volume subcommand modifies the bucket.
+func IsVolumeWrite(args []string) bool {
+	return len(args) > 0 && args[0] != "list"
+}
+
+// Volume runs the volume subcommand. It isn't in Commands, as it operates on the bucket instead of a filesystem.
+func Volume(vm VolumeManager, args []string, w io.Writer) error {
+	if len(args) < 1 {
+		return UsageError{"volume: subcommand required"}
+	}
+	switch sub := args[0]; sub {
+	case "list":
+		if len(args) != 1 {
+			return UsageError{"volume list: no args expected"}
+		}
+		vs, err := vm.ListVolumes()
+		if err != nil {
+			return err
+		}
+		for _, v := range vs {
+			if v.CreatedAt.IsZero() {
+				fmt.Fprintln(w, v.Name)
+			} else {
+				fmt.Fprintf(w, "%s\t%s\n", v.Name, v.CreatedAt.Format("2006-01-02 15:04:05"))
+			}
+		}
+		return nil
+	case "create", "delete":
+		if len(args) != 2 {
+			return UsageError{fmt.Sprintf("volume %s: NAME required", sub)}
+		}
+		name := args[1]
+		if sub == "create" {
+			return pathError(name, vm.CreateVolume(name))
+		}
+		return pathError(name, vm.DeleteVolume(name))
+	default:
+		return UsageError{fmt.Sprintf("volume: unknown subcommand \"%s\"", sub)}
+	}
+}
@@ -0,0 +1,55 @@
+package cli_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/cli"
+	"github.com/nyaxt/otaru/metadata"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+type testVolumeManager struct {
+	*otaru.BlobStoreVolumeRegistry
+}
+
+func (vm testVolumeManager) CreateVolume(name string) error { return vm.AddVolume(name) }
+func (vm testVolumeManager) DeleteVolume(name string) error { return vm.RemoveVolume(name) }
+
+func TestVolume(t *testing.T) {
+	vm := testVolumeManager{otaru.NewBlobStoreVolumeRegistry(TestFileBlobStore(), TestCipher())}
+	runVolume := func(args ...string) (string, error) {
+		var b bytes.Buffer
+		err := cli.Volume(vm, args, &b)
+		return b.String(), err
+	}
+
+	if _, err := runVolume("create", "photos"); err != nil {
+		t.Errorf("volume create failed: %v", err)
+	}
+	if _, err := runVolume("create", "photos"); cli.Errno(err) != otaru.EEXIST {
+		t.Errorf("volume create of existing volume should fail with EEXIST: %v", err)
+	}
+	out, err := runVolume("list")
+	if err != nil {
+		t.Errorf("volume list failed: %v", err)
+	}
+	if exp := metadata.DefaultVolume + "\nphotos\t"; len(out) < len(exp) || out[:len(exp)] != exp {
+		t.Errorf("Unexpected volume list output: %q", out)
+	}
+	if _, err := runVolume("delete", metadata.DefaultVolume); cli.Errno(err) != otaru.EPERM {
+		t.Errorf("volume delete of default volume should fail with EPERM: %v", err)
+	}
+	if _, err := runVolume("delete", "photos"); err != nil {
+		t.Errorf("volume delete failed: %v", err)
+	}
+	if _, err := runVolume("rename", "photos"); err == nil {
+		t.Errorf("unknown subcommand should fail")
+	} else if _, ok := err.(cli.UsageError); !ok {
+		t.Errorf("unknown subcommand should fail with UsageError: %v", err)
+	}
+	if cli.IsVolumeWrite([]string{"list"}) || !cli.IsVolumeWrite([]string{"delete", "photos"}) {
+		t.Errorf("Unexpected IsVolumeWrite")
+	}
+}
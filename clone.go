@@ -0,0 +1,209 @@
+package otaru
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+// syncOpenFileForClone flushes the pending writes of the file if it is open, and locks it against writes until the returned func is called.
+// Otherwise chunks written in place after their blobs are shared would leak into the clone.
+func (fs *FileSystem) syncOpenFileForClone(id inodedb.ID) (func(), error) {
+	fs.muOpenFiles.Lock()
+	of, ok := fs.openFiles[id]
+	fs.muOpenFiles.Unlock()
+	if !ok {
+		return func() {}, nil
+	}
+
+	of.mu.Lock()
+	if of.cfio != nil && of.nlock.HasTicket() {
+		if err := of.wc.Sync(of.cfio); err != nil {
+			of.mu.Unlock()
+			return nil, fmt.Errorf("Failed to sync source file: %v", err)
+		}
+	}
+	return of.mu.Unlock, nil
+}
+
+// CloneFile creates a file dstName in the directory dstDirID sharing the chunks of the file srcID copy-on-write, and returns its ID.
+func (fs *FileSystem) CloneFile(srcID inodedb.ID, dstDirID inodedb.ID, dstName string) (inodedb.ID, error) {
+	unlock, err := fs.syncOpenFileForClone(srcID)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	v, _, err := fs.idb.QueryNode(srcID, false)
+	if err != nil {
+		return 0, err
+	}
+	fv, ok := v.(*inodedb.FileNodeView)
+	if !ok {
+		if v.GetType() == inodedb.DirNodeT {
+			return 0, EISDIR
+		}
+		return 0, fmt.Errorf("Specified node not file but has type %v", v.GetType())
+	}
+
+	nlock, err := fs.idb.LockNode(inodedb.AllocateNewNodeID)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := fs.idb.UnlockNode(nlock); err != nil {
+			log.Printf("Failed to unlock node when cloning file: %v", err)
+		}
+	}()
+
+	origpath := fmt.Sprintf("%s/%s", fs.tryGetOrigPath(dstDirID), dstName)
+	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
+		&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: fs.pathScrubber.Scrub(origpath), Type: inodedb.FileNodeT},
+		&inodedb.UpdateChunksOp{NodeLock: nlock, Chunks: fv.Chunks},
+		&inodedb.UpdateSizeOp{NodeLock: nlock, Size: fv.Size},
+		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{dstDirID, inodedb.NoTicket}, Name: dstName, TargetID: nlock.ID},
+	}}
+	if _, err := fs.idb.ApplyTransaction(tx); err != nil {
+		return 0, err
+	}
+	log.Printf("Cloned file %d to %d (%d chunks, %d bytes)", srcID, nlock.ID, len(fv.Chunks), fv.Size)
+
+	fs.setOrigPathForId(nlock.ID, origpath)
+	return nlock.ID, nil
+}
+
+func (fs *FileSystem) CloneFileFullPath(srcpath, dstpath string) (inodedb.ID, error) {
+	srcID, err := fs.FindNodeFullPath(srcpath)
+	if err != nil {
+		return 0, err
+	}
+	dstDirID, dstName, err := fs.SplitFullPath(dstpath)
+	if err != nil {
+		return 0, err
+	}
+	return fs.CloneFile(srcID, dstDirID, dstName)
+}
+
+// freezeOpenFiles flushes the pending writes of all files open for write, and blocks writes and new opens until the returned func is called.
+func (fs *FileSystem) freezeOpenFiles() (func(), error) {
+	fs.muOpenFiles.Lock()
+	ofs := make([]*OpenFile, 0, len(fs.openFiles))
+	unfreeze := func() {
+		for _, of := range ofs {
+			of.mu.Unlock()
+		}
+		fs.muOpenFiles.Unlock()
+	}
+	for _, of := range fs.openFiles {
+		of.mu.Lock()
+		ofs = append(ofs, of)
+		if of.cfio == nil || !of.nlock.HasTicket() {
+			continue
+		}
+		if err := of.wc.Sync(of.cfio); err != nil {
+			unfreeze()
+			return nil, fmt.Errorf("Failed to sync open file %d: %v", of.nlock.ID, err)
+		}
+	}
+	return unfreeze, nil
+}
+
+// CloneTree creates dstName in the directory dstDirID as a copy of the file or the directory subtree srcID, and returns its ID.
+func (fs *FileSystem) CloneTree(srcID inodedb.ID, dstDirID inodedb.ID, dstName string) (inodedb.ID, error) {
+	q, ok := fs.idb.(inodedb.SubtreeQuerier)
+	if !ok {
+		return 0, fmt.Errorf("DBHandler doesn't support QuerySubtree")
+	}
+
+	unfreeze, err := fs.freezeOpenFiles()
+	if err != nil {
+		return 0, err
+	}
+	defer unfreeze()
+
+	views, err := q.QuerySubtree(srcID)
+	if err != nil {
+		return 0, err
+	}
+
+	nlocks := make(map[inodedb.ID]inodedb.NodeLock, len(views))
+	defer func() {
+		for _, nlock := range nlocks {
+			if err := fs.idb.UnlockNode(nlock); err != nil {
+				log.Printf("Failed to unlock node when cloning tree: %v", err)
+			}
+		}
+	}()
+	origpaths := make(map[inodedb.ID]string, len(views))
+
+	ops := make([]inodedb.DBOperation, 0, 4*len(views))
+	// Entries are linked to the new directories with their locks, as they are held until the tx is applied.
+	var clone func(id inodedb.ID, dirlock inodedb.NodeLock, name, origpath string) error
+	clone = func(id inodedb.ID, dirlock inodedb.NodeLock, name, origpath string) error {
+		if nlock, ok := nlocks[id]; ok {
+			ops = append(ops, &inodedb.HardLinkOp{NodeLock: dirlock, Name: name, TargetID: nlock.ID})
+			return nil
+		}
+
+		nlock, err := fs.idb.LockNode(inodedb.AllocateNewNodeID)
+		if err != nil {
+			return err
+		}
+		nlocks[id] = nlock
+		origpaths[nlock.ID] = origpath
+
+		v := views[id]
+		ops = append(ops, &inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: fs.pathScrubber.Scrub(origpath), Type: v.GetType()})
+		if fv, ok := v.(*inodedb.FileNodeView); ok {
+			ops = append(ops,
+				&inodedb.UpdateChunksOp{NodeLock: nlock, Chunks: fv.Chunks},
+				&inodedb.UpdateSizeOp{NodeLock: nlock, Size: fv.Size},
+			)
+		}
+		ops = append(ops, &inodedb.HardLinkOp{NodeLock: dirlock, Name: name, TargetID: nlock.ID})
+
+		dv, ok := v.(*inodedb.DirNodeView)
+		if !ok {
+			return nil
+		}
+		names := make([]string, 0, len(dv.Entries))
+		for name := range dv.Entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := clone(dv.Entries[name], nlock, name, fmt.Sprintf("%s/%s", origpath, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := clone(srcID, inodedb.NodeLock{dstDirID, inodedb.NoTicket}, dstName, fmt.Sprintf("%s/%s", fs.tryGetOrigPath(dstDirID), dstName)); err != nil {
+		return 0, err
+	}
+
+	if _, err := fs.idb.ApplyTransaction(inodedb.DBTransaction{Ops: ops}); err != nil {
+		return 0, err
+	}
+	log.Printf("Cloned tree %d to %d (%d nodes)", srcID, nlocks[srcID].ID, len(nlocks))
+
+	for id, origpath := range origpaths {
+		fs.setOrigPathForId(id, origpath)
+	}
+	fs.trackTrashDirs(dstDirID, nlocks[srcID].ID)
+	return nlocks[srcID].ID, nil
+}
+
+func (fs *FileSystem) CloneTreeFullPath(srcpath, dstpath string) (inodedb.ID, error) {
+	srcID, err := fs.FindNodeFullPath(srcpath)
+	if err != nil {
+		return 0, err
+	}
+	dstDirID, dstName, err := fs.SplitFullPath(dstpath)
+	if err != nil {
+		return 0, err
+	}
+	return fs.CloneTree(srcID, dstDirID, dstName)
+}
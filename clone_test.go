@@ -0,0 +1,251 @@
+package otaru_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func chunksOf(t *testing.T, idb inodedb.DBHandler, id inodedb.ID) []inodedb.FileChunk {
+	v, _, err := idb.QueryNode(id, false)
+	if err != nil {
+		t.Fatalf("QueryNode failed: %v", err)
+	}
+	return v.(*inodedb.FileNodeView).Chunks
+}
+
+func readAll(t *testing.T, fs *otaru.FileSystem, fullpath string) []byte {
+	h, err := fs.OpenFileFullPath(fullpath, flags.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath(%s) failed: %v", fullpath, err)
+	}
+	defer h.Close()
+	buf := make([]byte, h.Size())
+	if err := h.PRead(0, buf); err != nil {
+		t.Fatalf("PRead(%s) failed: %v", fullpath, err)
+	}
+	return buf
+}
+
+func writeAt(t *testing.T, fs *otaru.FileSystem, fullpath string, offset int64, p []byte) {
+	h, err := fs.OpenFileFullPath(fullpath, flags.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath(%s) failed: %v", fullpath, err)
+	}
+	defer h.Close()
+	if err := h.PWrite(offset, p); err != nil {
+		t.Fatalf("PWrite(%s) failed: %v", fullpath, err)
+	}
+	if err := h.Sync(); err != nil {
+		t.Fatalf("Sync(%s) failed: %v", fullpath, err)
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+
+	// Leave the write to the source unsynced in the write cache. The clone should still see it.
+	h, err := fs.OpenFileFullPath("/a.txt", flags.O_CREATE|flags.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath failed: %v", err)
+	}
+	if err := h.PWrite(0, []byte("hello world!\n")); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+
+	bid, err := fs.CloneFileFullPath("/a.txt", "/b.txt")
+	if err != nil {
+		t.Fatalf("CloneFileFullPath failed: %v", err)
+	}
+	h.Close()
+	if got := readAll(t, fs, "/b.txt"); !bytes.Equal(got, []byte("hello world!\n")) {
+		t.Errorf("Unexpected clone content: %q", got)
+	}
+	aid, _ := fs.FindNodeFullPath("/a.txt")
+	acs, bcs := chunksOf(t, idb, aid), chunksOf(t, idb, bid)
+	if len(bcs) != 1 || acs[0].BlobPath != bcs[0].BlobPath {
+		t.Errorf("Clone should share the chunk blobs: %+v %+v", acs, bcs)
+	}
+	if n := idb.BlobRefCount(bcs[0].BlobPath); n != 2 {
+		t.Errorf("Unexpected ref count of shared blob: %d", n)
+	}
+
+	// Write to the clone detaches the shared chunk.
+	writeAt(t, fs, "/b.txt", 0, []byte("HELLO"))
+	if got := readAll(t, fs, "/a.txt"); !bytes.Equal(got, []byte("hello world!\n")) {
+		t.Errorf("Write to the clone modified the source: %q", got)
+	}
+	if got := readAll(t, fs, "/b.txt"); !bytes.Equal(got, []byte("HELLO world!\n")) {
+		t.Errorf("Unexpected clone content after write: %q", got)
+	}
+	if bcs := chunksOf(t, idb, bid); bcs[0].BlobPath == acs[0].BlobPath {
+		t.Errorf("Write to the clone should have detached the shared chunk")
+	}
+	if n := idb.BlobRefCount(acs[0].BlobPath); n != 1 {
+		t.Errorf("Unexpected ref count after detach: %d", n)
+	}
+
+	// The source is the sole owner now, and is written in place.
+	writeAt(t, fs, "/a.txt", 6, []byte("otaru"))
+	if acs2 := chunksOf(t, idb, aid); acs2[0].BlobPath != acs[0].BlobPath {
+		t.Errorf("Unshared chunk shouldn't be detached")
+	}
+	if got := readAll(t, fs, "/b.txt"); !bytes.Equal(got, []byte("HELLO world!\n")) {
+		t.Errorf("Write to the source modified the clone: %q", got)
+	}
+
+	if _, err := fs.CloneFileFullPath("/a.txt", "/b.txt"); err != inodedb.EEXIST {
+		t.Errorf("Clone to existing path should fail with EEXIST: %v", err)
+	}
+	if _, err := fs.CloneFileFullPath("/", "/c"); err != otaru.EISDIR {
+		t.Errorf("Clone of dir should fail with EISDIR: %v", err)
+	}
+	if _, err := fs.CloneFileFullPath("/nonexistent", "/c"); err == nil {
+		t.Errorf("Clone of nonexistent file should fail")
+	}
+}
+
+func TestCloneFile_SourceRemovedWhileOpen(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+
+	createFile(t, fs, "/a.txt", []byte("hello world!\n"))
+	if _, err := fs.CloneFileFullPath("/a.txt", "/b.txt"); err != nil {
+		t.Fatalf("CloneFileFullPath failed: %v", err)
+	}
+
+	h, err := fs.OpenFileFullPath("/a.txt", flags.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath failed: %v", err)
+	}
+	if err := fs.RemoveFullPath("/a.txt"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	// The removed source no longer counts as a blob ref, but still shares the chunk with the clone.
+	if err := h.PWrite(0, []byte("HELLO")); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := h.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	h.Close()
+
+	if got := readAll(t, fs, "/b.txt"); !bytes.Equal(got, []byte("hello world!\n")) {
+		t.Errorf("Write to the removed source modified the clone: %q", got)
+	}
+}
+
+func TestCloneTree(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+
+	for _, p := range []string{"/projects", "/projects/v1", "/projects/v1/sub"} {
+		if _, err := fs.CreateDirFullPath(p); err != nil {
+			t.Fatalf("CreateDirFullPath failed: %v", err)
+		}
+	}
+	h, err := fs.OpenFileFullPath("/projects/v1/a.txt", flags.O_CREATE|flags.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath failed: %v", err)
+	}
+	if err := h.PWrite(0, []byte("aaa")); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	fh, err := fs.OpenFileFullPath("/projects/v1/sub/b.txt", flags.O_CREATE|flags.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath failed: %v", err)
+	}
+	if err := fh.PWrite(0, []byte("bbbb")); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := fh.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	fh.Close()
+	aid, _ := fs.FindNodeFullPath("/projects/v1/a.txt")
+	subid, _ := fs.FindNodeFullPath("/projects/v1/sub")
+	if _, err := idb.ApplyTransaction(inodedb.DBTransaction{Ops: []inodedb.DBOperation{
+		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{subid, inodedb.NoTicket}, Name: "a-link.txt", TargetID: aid},
+	}}); err != nil {
+		t.Fatalf("HardLinkOp failed: %v", err)
+	}
+
+	// The write to a.txt is still in the write cache.
+	if _, err := fs.CloneTreeFullPath("/projects/v1", "/projects/v1-backup"); err != nil {
+		t.Fatalf("CloneTreeFullPath failed: %v", err)
+	}
+	h.Close()
+	for p, exp := range map[string]string{
+		"/projects/v1-backup/a.txt":          "aaa",
+		"/projects/v1-backup/sub/b.txt":      "bbbb",
+		"/projects/v1-backup/sub/a-link.txt": "aaa",
+	} {
+		if got := readAll(t, fs, p); string(got) != exp {
+			t.Errorf("Unexpected content of %s: %q", p, got)
+		}
+	}
+	caid, _ := fs.FindNodeFullPath("/projects/v1-backup/a.txt")
+	clinkid, _ := fs.FindNodeFullPath("/projects/v1-backup/sub/a-link.txt")
+	if caid == aid || caid != clinkid {
+		t.Errorf("Hard link should be preserved in the clone: %d %d %d", aid, caid, clinkid)
+	}
+
+	// Cloning is a single tx.
+	ver := idb.GetStats().Version
+	if _, err := fs.CloneTreeFullPath("/projects/v1", "/projects/v1-backup2"); err != nil {
+		t.Fatalf("CloneTreeFullPath failed: %v", err)
+	}
+	if v := idb.GetStats().Version; v != ver+1 {
+		t.Errorf("Clone took %d txs", v-ver)
+	}
+	if _, err := fs.CloneTreeFullPath("/projects/v1", "/projects/v1-backup2"); err != inodedb.EEXIST {
+		t.Errorf("Clone to existing path should fail with EEXIST: %v", err)
+	}
+	if v := idb.GetStats().Version; v != ver+1 {
+		t.Errorf("Failed clone shouldn't apply any tx")
+	}
+
+	// Copy-on-write
+	writeAt(t, fs, "/projects/v1-backup/sub/b.txt", 0, []byte("B"))
+	if got := readAll(t, fs, "/projects/v1/sub/b.txt"); string(got) != "bbbb" {
+		t.Errorf("Write to the clone modified the source: %q", got)
+	}
+	if got := readAll(t, fs, "/projects/v1-backup2/sub/b.txt"); string(got) != "bbbb" {
+		t.Errorf("Write to the clone modified the other clone: %q", got)
+	}
+
+	// Blobs stay referenced after the source is removed.
+	if err := fs.RemoveAllFullPath("/projects/v1"); err != nil {
+		t.Fatalf("RemoveAllFullPath failed: %v", err)
+	}
+	for _, c := range chunksOf(t, idb, caid) {
+		if n := idb.BlobRefCount(c.BlobPath); n != 2 {
+			t.Errorf("Unexpected ref count of blob shared by the clones: %d", n)
+		}
+	}
+	r, err := idb.Check(false)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if len(r.Issues) != 0 {
+		t.Errorf("Unexpected fsck issues: %+v", r.Issues)
+	}
+	// b.txt of v1-backup was detached by the write above, so only a.txt is shared.
+	if r.NumSharedBlobs != 1 {
+		t.Errorf("Unexpected number of shared blobs: %+v", r)
+	}
+}
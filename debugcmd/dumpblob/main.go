@@ -10,12 +10,15 @@ import (
 
 	"github.com/nyaxt/otaru/btncrypt"
 	"github.com/nyaxt/otaru/chunkstore"
+	"github.com/nyaxt/otaru/keyring"
 	"github.com/nyaxt/otaru/util"
 )
 
 var (
 	flagPasswordFile = flag.String("passwordFile", path.Join(os.Getenv("HOME"), ".otaru", "password.txt"), "Path of a text file storing password")
 	flagHeader       = flag.Bool("header", false, "Show header")
+	flagKeyringFile  = flag.String("keyring", "", "Path of a local copy of the keyring blob. Password-derived key is used if not specified.")
+	flagHashPath     = flag.String("hashpath", "", "Show the hashed form of the path, and whether the header OrigFilename matches it")
 )
 
 func Usage() {
@@ -43,8 +46,26 @@ func main() {
 	defer f.Close()
 
 	password := util.StringFromFileOrDie(*flagPasswordFile, "password")
-	key := btncrypt.KeyFromPassword(password)
-	c, err := btncrypt.NewCipher(key)
+	var c btncrypt.Cipher
+	var namingKey []byte
+	if *flagKeyringFile != "" {
+		kf, err := os.Open(*flagKeyringFile)
+		if err != nil {
+			log.Printf("Failed to open keyring file: %v", err)
+			return
+		}
+		kr, err := keyring.Decode(kf, password)
+		kf.Close()
+		if err != nil {
+			log.Printf("Failed to load keyring: %v", err)
+			return
+		}
+		c, err = kr.Cipher()
+		namingKey = kr.NamingKey()
+	} else {
+		namingKey = btncrypt.KeyFromPassword(password)
+		c, err = btncrypt.NewCipher(namingKey)
+	}
 	if err != nil {
 		log.Printf("Failed to init Cipher: %v", err)
 		return
@@ -59,5 +80,11 @@ func main() {
 	if *flagHeader {
 		log.Printf("Header: %+v", cr.Header())
 	}
+	if *flagHashPath != "" {
+		s := chunkstore.NewPathScrubber(chunkstore.PathPrivacyHMAC, btncrypt.DeriveKey(namingKey, "origpath"))
+		hashed := s.HashPath(*flagHashPath)
+		log.Printf("Hashed path: %s", hashed)
+		log.Printf("OrigFilename matches: %t", cr.Header().OrigFilename == hashed)
+	}
 	io.Copy(os.Stdout, cr)
 }
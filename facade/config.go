@@ -9,6 +9,10 @@ import (
 
 	"github.com/naoina/toml"
 
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/gc"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/mgmt"
 	"github.com/nyaxt/otaru/util"
 )
 
@@ -20,7 +24,135 @@ type Config struct {
 	CacheDir                     string
 	LocalDebug                   bool
 
+	// Volume is the name of the volume to mount. A bucket can hold multiple independent filesystems as volumes, which share the keyring and the blobs.
+	// Defaults to "default", which is the filesystem created before volume support.
+	Volume string
+	// Volumes overrides Dedup, Compression and PathPrivacy per volume.
+	Volumes []VolumeConfig
+
+	// Dedup enables content-defined chunking and deduplication of file contents written.
+	Dedup bool
+	// Compression specifies compression of the chunks written with Dedup: "none", "snappy", or "zstd".
+	// Chunks written without Dedup are rewritten in place, which compressed frames of varying length don't allow, so they are never compressed.
+	Compression string
+
+	// KDF specifies the algorithm to derive the key encryption key from the password on -mkfs: "argon2id", "scrypt", or "pbkdf2-sha1".
+	// Existing filesystems keep the KDF they were created with. Use keyringcli to migrate.
+	KDF string
+
+	// PathPrivacy specifies how original paths of files are recorded in the inodedb and chunk headers: "plain", "hmac", or "omit".
+	// Only affects metadata written afterwards. Trigger /api/migrate/scrub to scrub OrigFilename of existing chunk headers.
+	PathPrivacy string
+
+	// ScrubberRateLimit limits the read rate of the integrity scrubber in bytes per second. 0 means unlimited.
+	ScrubberRateLimit int64
+
+	// GCGracePeriod is how long a blob needs to stay unreferenced before GC removes it, e.g. "1h".
+	GCGracePeriod string
+	// GCConcurrency is the number of blobs GC removes in parallel.
+	GCConcurrency int
+
+	// Trash makes removed files and directories moved to the hidden directory "/.otaru-trash" of the volume, so that they can be restored via /api/fs/trash or "otaru trash".
+	Trash bool
+	// TrashRetention is how long removed entries are kept in the trash, e.g. "720h". They are purged by the "trash-purge" task. "0" keeps them until purged explicitly.
+	TrashRetention string
+
+	// Schedules are recurring maintenance jobs to register to the scheduler.
+	Schedules []ScheduleConfig
+
+	// MgmtListenAddr is the address the mgmt server listens on, e.g. "127.0.0.1:10246" or ":10246" for all interfaces.
+	MgmtListenAddr string
+	// MgmtTLSCertFile and MgmtTLSKeyFile enable TLS on the mgmt server with the certificate.
+	MgmtTLSCertFile string
+	MgmtTLSKeyFile  string
+	// MgmtTLSSelfSigned enables TLS on the mgmt server with a self-signed certificate. If MgmtTLSCertFile and MgmtTLSKeyFile are given, the certificate is generated into them on first start.
+	MgmtTLSSelfSigned bool
+	// MgmtUsers are the credentials required to access the mgmt API. The API is open to anyone who can connect if none is given.
+	MgmtUsers []MgmtUserConfig
+
+	// WebDAV serves the filesystem over WebDAV under /webdav of the mgmt server, with the same auth as the mgmt API.
+	WebDAV bool
+	// WebDAVListenAddr serves WebDAV on its own listener at the address instead, e.g. ":8080". TLS and auth still follow the mgmt server config.
+	WebDAVListenAddr string
+
+	// KeyringUser is the name of the keyring user to unlock the keyring as. All users are tried if empty.
+	KeyringUser string
+	// PrivateKeyFile is the path of a file storing the private key of a public key keyring user. If specified, the keyring is unlocked with the key instead of the password.
+	PrivateKeyFile string
+
+	Password string
+}
+
+// ScheduleConfig specifies a recurring maintenance job, e.g.
+//
+//	[[Schedules]]
+//	Task = "gc"
+//	Spec = "30 3 * * *"
+//	MissedRun = "once"
+type ScheduleConfig struct {
+	// Task is the name of the maintenance task to run: "gc", "gc-dryrun", "scrub", or "trash-purge".
+	Task string
+	// Spec is an interval ("@every 6h") or a cron-like spec ("30 3 * * *").
+	Spec string
+	// MissedRun specifies what to do with runs missed while paused or while the previous run is still running: "skip" or "once".
+	MissedRun string
+	// Paused registers the job paused. It can be resumed via /api/scheduler/recurring/{id}/resume.
+	Paused bool
+}
+
+// VolumeConfig overrides the config of the volume, e.g.
+//
+//	[[Volumes]]
+//	Name = "photos"
+//	Dedup = false
+//
+// Unspecified fields follow the global config.
+type VolumeConfig struct {
+	Name        string
+	Dedup       *bool
+	Compression string
+	PathPrivacy string
+}
+
+// ForVolume returns the config to open the volume with, with its VolumeConfig applied.
+func (cfg *Config) ForVolume(volume string) (*Config, error) {
+	if err := metadata.ValidateVolumeName(volume); err != nil {
+		return nil, err
+	}
+
+	vcfg := *cfg
+	vcfg.Volume = volume
+	for _, v := range cfg.Volumes {
+		if v.Name != volume {
+			continue
+		}
+		if v.Dedup != nil {
+			vcfg.Dedup = *v.Dedup
+		}
+		if v.Compression != "" {
+			vcfg.Compression = v.Compression
+		}
+		if v.PathPrivacy != "" {
+			vcfg.PathPrivacy = v.PathPrivacy
+		}
+	}
+	return &vcfg, nil
+}
+
+// MgmtUserConfig is a credential of the mgmt API, e.g.
+//
+//	[[MgmtUsers]]
+//	Name = "dashboard"
+//	Token = "..."
+//	Role = "readonly"
+type MgmtUserConfig struct {
+	// Name and Password authenticate the user with HTTP basic auth. Password is required for basic auth.
+	Name     string
 	Password string
+	// Token authenticates the user with "Authorization: Bearer <Token>" header.
+	Token string
+	// Role is "admin" (default), which can trigger jobs, "reader", which can also download files and browse WebDAV, or "readonly", which can only query.
+	Role string
 }
 
 func NewConfigFromTomlFile(configpath string) (*Config, error) {
@@ -33,6 +165,15 @@ func NewConfigFromTomlFile(configpath string) (*Config, error) {
 		PasswordFile:                 path.Join(os.Getenv("HOME"), ".otaru", "password.txt"),
 		UseSeparateBucketForMetadata: false,
 		CacheDir:                     "/var/cache/otaru",
+		Volume:                       metadata.DefaultVolume,
+		Compression:                  "zstd",
+		KDF:                          btncrypt.DefaultKDF,
+		PathPrivacy:                  "plain",
+		ScrubberRateLimit:            8 * 1024 * 1024,
+		TrashRetention:               "720h",
+		GCGracePeriod:                "1h",
+		GCConcurrency:                gc.DefaultConcurrency,
+		MgmtListenAddr:               mgmt.DefaultListenAddr,
 	}
 	if err := toml.Unmarshal(buf, &cfg); err != nil {
 		return nil, fmt.Errorf("Failed to parse config file: %v", err)
@@ -40,7 +181,7 @@ func NewConfigFromTomlFile(configpath string) (*Config, error) {
 
 	if cfg.Password != "" {
 		log.Printf("Storing password directly on config file is not recommended.")
-	} else {
+	} else if cfg.PrivateKeyFile == "" {
 		fi, err := os.Stat(cfg.PasswordFile)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to stat password file \"%s\": %v", cfg.PasswordFile, err)
@@ -66,5 +207,17 @@ func NewConfigFromTomlFile(configpath string) (*Config, error) {
 }
 
 type OneshotConfig struct {
+	// Mkfs creates a new filesystem. On a volume other than the default, the volume is registered too.
 	Mkfs bool
+	// Volume overrides Config.Volume if given.
+	Volume string
+
+	// ReadOnly opens the filesystem without write access. Files can't be opened for write, and the inodedb snapshot isn't saved on Close.
+	ReadOnly bool
+	// ForceWriterLock takes over the writer lock of the volume even if another process holds it. Otherwise opening the volume without ReadOnly fails with EBUSY.
+	ForceWriterLock bool
+	// NoServices skips job history, recurring jobs and the mgmt server, for short-lived clients like the otaru CLI which may run beside a mount.
+	NoServices bool
+	// VolumesOnly opens just the keyring and the volume registry to manage volumes, without opening any filesystem.
+	VolumesOnly bool
 }
@@ -0,0 +1,57 @@
+package facade
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/nyaxt/otaru/blobstore"
+	oflags "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/gcloud/auth"
+	"github.com/nyaxt/otaru/gcloud/gcs"
+	"github.com/nyaxt/otaru/keyring"
+	"github.com/nyaxt/otaru/util"
+)
+
+func newClientSource() (auth.ClientSource, error) {
+	return auth.GetGCloudClientSource(
+		path.Join(os.Getenv("HOME"), ".otaru", "credentials.json"),
+		path.Join(os.Getenv("HOME"), ".otaru", "tokencache.json"),
+		false)
+}
+
+func localDebugBackendDir() string {
+	return path.Join(os.Getenv("HOME"), ".otaru", "bbs")
+}
+
+// NewKeyringBlobStore returns the blobstore storing the keyring, for tools managing the keyring without mounting the filesystem.
+func NewKeyringBlobStore(cfg *Config) (blobstore.BlobStore, error) {
+	if cfg.LocalDebug {
+		return blobstore.NewFileBlobStore(localDebugBackendDir(), oflags.O_RDWRCREATE)
+	}
+
+	clisrc, err := newClientSource()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init GCloudClientSource: %v", err)
+	}
+	bucketname := cfg.BucketName
+	if cfg.UseSeparateBucketForMetadata {
+		bucketname = fmt.Sprintf("%s-meta", cfg.BucketName)
+	}
+	return gcs.NewGCSBlobStore(cfg.ProjectName, bucketname, clisrc, oflags.O_RDWRCREATE)
+}
+
+// KeyringCredential returns the credential to unlock the keyring with, as specified by cfg.
+func KeyringCredential(cfg *Config) (keyring.Credential, error) {
+	cred := keyring.Credential{User: cfg.KeyringUser, Password: cfg.Password}
+	if cfg.PrivateKeyFile != "" {
+		s, err := util.StringFromFile(cfg.PrivateKeyFile)
+		if err != nil {
+			return cred, fmt.Errorf("Failed to read private key file: %v", err)
+		}
+		if cred.PrivateKey, err = keyring.ParseUserKey(s); err != nil {
+			return cred, fmt.Errorf("Failed to parse private key file \"%s\": %v", cfg.PrivateKeyFile, err)
+		}
+	}
+	return cred, nil
+}
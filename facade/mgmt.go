@@ -1,27 +1,69 @@
 package facade
 
 import (
+	"fmt"
 	"log"
 
+	"github.com/nyaxt/otaru/metrics"
+	"github.com/nyaxt/otaru/mgmt"
 	"github.com/nyaxt/otaru/mgmt/mblobstore"
+	"github.com/nyaxt/otaru/mgmt/mfs"
 	"github.com/nyaxt/otaru/mgmt/mgc"
 	"github.com/nyaxt/otaru/mgmt/minodedb"
+	"github.com/nyaxt/otaru/mgmt/mmigrate"
 	"github.com/nyaxt/otaru/mgmt/mscheduler"
+	"github.com/nyaxt/otaru/mgmt/mscrubber"
 )
 
+func mgmtOptions(cfg *Config) (mgmt.Options, error) {
+	opts := mgmt.Options{
+		ListenAddr:    cfg.MgmtListenAddr,
+		TLSCertFile:   cfg.MgmtTLSCertFile,
+		TLSKeyFile:    cfg.MgmtTLSKeyFile,
+		TLSSelfSigned: cfg.MgmtTLSSelfSigned,
+	}
+	if !cfg.MgmtTLSSelfSigned && (cfg.MgmtTLSCertFile == "") != (cfg.MgmtTLSKeyFile == "") {
+		return opts, fmt.Errorf("Both MgmtTLSCertFile and MgmtTLSKeyFile must be given.")
+	}
+	for _, u := range cfg.MgmtUsers {
+		role, err := mgmt.ParseRole(u.Role)
+		if err != nil {
+			return opts, fmt.Errorf("Invalid role of mgmt user \"%s\": %v", u.Name, err)
+		}
+		if u.Token == "" && (u.Name == "" || u.Password == "") {
+			return opts, fmt.Errorf("Mgmt user \"%s\" needs either Token, or Name and Password.", u.Name)
+		}
+		opts.Credentials = append(opts.Credentials, mgmt.Credential{Token: u.Token, User: u.Name, Password: u.Password, Role: role})
+	}
+	return opts, nil
+}
+
 func (o *Otaru) setupMgmtAPIs() error {
 	mblobstore.Install(o.MGMT, o.BackendBS, o.CBS)
 	minodedb.Install(o.MGMT, o.IDBS)
 	mscheduler.Install(o.MGMT, o.S)
-	mgc.Install(o.MGMT, o.S, o.CBS, o.IDBS)
+	mgc.Install(o.MGMT, o.S, o.GC)
+	mmigrate.Install(o.MGMT, o.S, "format", o.FormatMigrator)
+	mmigrate.Install(o.MGMT, o.S, "reencrypt", o.ReencryptMigrator)
+	mmigrate.Install(o.MGMT, o.S, "scrub", o.ScrubMigrator)
+	mscrubber.Install(o.MGMT, o.S, o.Scrubber)
+	mfs.Install(o.MGMT, o.FS)
 
 	return nil
 }
 
+// setupMetrics registers the metrics bound to the instances. The metrics of the subsystems themselves are registered on package init.
+func (o *Otaru) setupMetrics() {
+	metrics.Register(o.S.Metrics()...)
+	metrics.Register(o.GC.Metrics()...)
+	metrics.Register(metrics.NewGaugeFunc("otaru_cache_dirty_bytes", "Total size of cache entries yet to be written back.", func() float64 { return float64(o.CBS.DirtyBytes()) }))
+}
+
 func (o *Otaru) runMgmtServer() error {
 	if err := o.setupMgmtAPIs(); err != nil {
 		return err
 	}
+	o.setupMetrics()
 
 	go func() {
 		if err := o.MGMT.Run(); err != nil {
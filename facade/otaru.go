@@ -2,8 +2,8 @@ package facade
 
 import (
 	"fmt"
-	"os"
-	"path"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/nyaxt/otaru"
@@ -12,18 +12,22 @@ import (
 	"github.com/nyaxt/otaru/btncrypt"
 	"github.com/nyaxt/otaru/chunkstore"
 	oflags "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/gc"
 	"github.com/nyaxt/otaru/gcloud/auth"
-	"github.com/nyaxt/otaru/gcloud/datastore"
 	"github.com/nyaxt/otaru/gcloud/gcs"
 	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/keyring"
 	"github.com/nyaxt/otaru/metadata"
 	"github.com/nyaxt/otaru/mgmt"
+	"github.com/nyaxt/otaru/migrate"
 	"github.com/nyaxt/otaru/scheduler"
+	"github.com/nyaxt/otaru/scrubber"
 	"github.com/nyaxt/otaru/util"
 )
 
 type Otaru struct {
-	C btncrypt.Cipher
+	Keyring *keyring.Keyring
+	C       btncrypt.Cipher
 
 	S *scheduler.Scheduler
 
@@ -38,6 +42,13 @@ type Otaru struct {
 	CBS        *cachedblobstore.CachedBlobStore
 	CSS        *util.PeriodicRunner
 
+	// Volume is the name of the volume opened.
+	Volume  string
+	Volumes *otaru.BlobStoreVolumeRegistry
+
+	// WriterLock is held while the volume is opened without ReadOnly.
+	WriterLock *otaru.BlobStoreWriterLock
+
 	SIO   *otaru.BlobStoreDBStateSnapshotIO
 	TxIO  inodedb.DBTransactionLogIO
 	IDBBE *inodedb.DB
@@ -46,27 +57,41 @@ type Otaru struct {
 
 	FS   *otaru.FileSystem
 	MGMT *mgmt.Server
-}
 
-func NewOtaru(cfg *Config, oneshotcfg *OneshotConfig) (*Otaru, error) {
-	o := &Otaru{}
+	FormatMigrator    *migrate.Migrator
+	ReencryptMigrator *migrate.Migrator
+	ScrubMigrator     *migrate.Migrator
+	Scrubber          *scrubber.Scrubber
+	GC                *gc.GC
 
-	var err error
+	muVolumeRefs sync.Mutex
+	volumeRefs   map[string]volumeBlobRefs
 
-	key := btncrypt.KeyFromPassword(cfg.Password)
-	o.C, err = btncrypt.NewCipher(key)
+	cfg      *Config
+	readOnly bool
+}
+
+func NewOtaru(cfg *Config, oneshotcfg *OneshotConfig) (*Otaru, error) {
+	if oneshotcfg.Mkfs && (oneshotcfg.ReadOnly || oneshotcfg.VolumesOnly) {
+		return nil, fmt.Errorf("Mkfs can't be done on read-only or volumes-only mode.")
+	}
+	volume := cfg.Volume
+	if oneshotcfg.Volume != "" {
+		volume = oneshotcfg.Volume
+	}
+	if volume == "" {
+		volume = metadata.DefaultVolume
+	}
+	cfg, err := cfg.ForVolume(volume)
 	if err != nil {
-		o.Close()
-		return nil, fmt.Errorf("Failed to init Cipher: %v", err)
+		return nil, fmt.Errorf("Config Error: %v", err)
 	}
+	o := &Otaru{Volume: volume, cfg: cfg, readOnly: oneshotcfg.ReadOnly}
 
 	o.S = scheduler.NewScheduler()
 
 	if !cfg.LocalDebug {
-		o.Clisrc, err = auth.GetGCloudClientSource(
-			path.Join(os.Getenv("HOME"), ".otaru", "credentials.json"),
-			path.Join(os.Getenv("HOME"), ".otaru", "tokencache.json"),
-			false)
+		o.Clisrc, err = newClientSource()
 		if err != nil {
 			o.Close()
 			return nil, fmt.Errorf("Failed to init GCloudClientSource: %v", err)
@@ -101,25 +126,98 @@ func NewOtaru(cfg *Config, oneshotcfg *OneshotConfig) (*Otaru, error) {
 			}
 		}
 	} else {
-		o.BackendBS, err = blobstore.NewFileBlobStore(path.Join(os.Getenv("HOME"), ".otaru", "bbs"), oflags.O_RDWRCREATE)
+		o.BackendBS, err = blobstore.NewFileBlobStore(localDebugBackendDir(), oflags.O_RDWRCREATE)
+	}
+
+	isNewKeyring := false
+	cred, err := KeyringCredential(cfg)
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	o.Keyring, err = keyring.LoadWithCredential(o.BackendBS, cred)
+	if err == blobstore.ENOENT {
+		if cfg.Password == "" {
+			o.Close()
+			return nil, fmt.Errorf("Keyring not found. Password is required to create one.")
+		}
+		if oneshotcfg.Mkfs {
+			kdf, err := btncrypt.NewKDFParams(cfg.KDF)
+			if err != nil {
+				o.Close()
+				return nil, fmt.Errorf("Config Error: %v", err)
+			}
+			o.Keyring, err = keyring.New(cfg.Password, kdf)
+			if err != nil {
+				o.Close()
+				return nil, fmt.Errorf("Failed to create keyring: %v", err)
+			}
+		} else {
+			log.Printf("Keyring not found. Assuming the filesystem was created before keyring support.")
+			o.Keyring = keyring.NewLegacy(cfg.Password)
+		}
+		isNewKeyring = true
+	} else if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Failed to load keyring: %v", err)
+	}
+	o.C, err = o.Keyring.Cipher()
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Failed to init Cipher: %v", err)
 	}
 
 	queryFn := chunkstore.NewQueryChunkVersion(o.C)
-	o.CBS, err = cachedblobstore.New(o.BackendBS, o.CacheTgtBS, oflags.O_RDWRCREATE /* FIXME */, queryFn)
+	cbsFlags := oflags.O_RDWRCREATE
+	if o.readOnly {
+		cbsFlags = oflags.O_RDONLY
+	}
+	o.CBS, err = cachedblobstore.New(o.BackendBS, o.CacheTgtBS, cbsFlags, queryFn)
 	if err != nil {
 		o.Close()
 		return nil, fmt.Errorf("Failed to init CachedBlobStore: %v", err)
 	}
 	o.CSS = cachedblobstore.NewCacheSyncScheduler(o.CBS)
 
-	o.SIO = otaru.NewBlobStoreDBStateSnapshotIO(o.CBS, o.C)
+	o.Volumes = otaru.NewBlobStoreVolumeRegistry(o.CBS, o.C)
+	if oneshotcfg.VolumesOnly {
+		// The password of a filesystem without keyring is verified only by opening it.
+		if isNewKeyring {
+			o.Close()
+			return nil, fmt.Errorf("Keyring not found. Mount the filesystem once to create one.")
+		}
+		o.Volume = ""
+		return o, nil
+	}
+	isNewVolume := false
+	if o.Volume != metadata.DefaultVolume {
+		ok, err := o.Volumes.HasVolume(o.Volume)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("Failed to query volumes: %v", err)
+		}
+		if !ok {
+			if !oneshotcfg.Mkfs {
+				o.Close()
+				return nil, fmt.Errorf("Volume \"%s\" not found. Create it first.", o.Volume)
+			}
+			isNewVolume = true
+		}
+	}
 
-	if !cfg.LocalDebug {
-		o.TxIO, err = datastore.NewDBTransactionLogIO(cfg.ProjectName, cfg.BucketName, o.C, o.Clisrc)
-	} else {
-		o.TxIO = inodedb.NewSimpleDBTransactionLogIO()
-		err = nil
+	if !o.readOnly {
+		// The lock goes to the backend directly, so that writers on other hosts see it.
+		wl := otaru.NewBlobStoreWriterLockForVolume(o.BackendBS, o.C, o.Volume)
+		if err := wl.Lock(oneshotcfg.ForceWriterLock); err != nil {
+			o.Close()
+			return nil, err
+		}
+		o.WriterLock = wl
 	}
+
+	o.SIO = otaru.NewBlobStoreDBStateSnapshotIOForVolume(o.CBS, o.C, o.Volume)
+
+	o.TxIO, err = o.newTxLogIO(o.Volume)
 	if err != nil {
 		o.Close()
 		return nil, fmt.Errorf("Failed to init gcloud DBTransactionLogIO: %v", err)
@@ -131,6 +229,15 @@ func NewOtaru(cfg *Config, oneshotcfg *OneshotConfig) (*Otaru, error) {
 			o.Close()
 			return nil, fmt.Errorf("NewEmptyDB failed: %v", err)
 		}
+		if isNewVolume {
+			if err := o.Volumes.AddVolume(o.Volume); err != nil {
+				o.Close()
+				return nil, fmt.Errorf("Failed to register volume: %v", err)
+			}
+		} else if err := o.Volumes.SetOldestKeyID(o.Volume, o.C.KeyID()); err != nil {
+			o.Close()
+			return nil, fmt.Errorf("Failed to register volume: %v", err)
+		}
 	} else {
 		o.IDBBE, err = inodedb.NewDB(o.SIO, o.TxIO)
 		if err != nil {
@@ -139,12 +246,103 @@ func NewOtaru(cfg *Config, oneshotcfg *OneshotConfig) (*Otaru, error) {
 		}
 	}
 
+	// Save the keyring only after the DB is successfully opened, which verifies the password for legacy filesystems.
+	if isNewKeyring || o.Keyring.Upgraded() {
+		if err := o.Keyring.Save(o.BackendBS); err != nil {
+			o.Close()
+			return nil, fmt.Errorf("Failed to save keyring: %v", err)
+		}
+	}
+
 	o.IDBS = inodedb.NewDBService(o.IDBBE)
-	o.IDBSS = util.NewSyncScheduler(o.IDBS, 30*time.Second)
+	if o.WriterLock != nil {
+		o.WriterLock.SetOnLost(o.fenceWrites)
+	}
+	if !o.readOnly {
+		o.IDBSS = util.NewSyncScheduler(o.IDBS, 30*time.Second)
+	}
 
 	o.FS = otaru.NewFileSystem(o.IDBS, o.CBS, o.C)
-	o.MGMT = mgmt.NewServer()
+	pathPrivacy, err := chunkstore.ParsePathPrivacy(cfg.PathPrivacy)
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	pathScrubber := chunkstore.NewPathScrubber(pathPrivacy, btncrypt.DeriveKey(o.Keyring.NamingKey(), "origpath"))
+	o.FS.SetPathScrubber(pathScrubber)
+	comp, err := chunkstore.ParseCompression(cfg.Compression)
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	if cfg.Dedup {
+		o.FS.EnableDedup(chunkstore.NewContentNamer(btncrypt.DeriveKey(o.Keyring.NamingKey(), "dedup-blobpath")), comp)
+	}
+	if cfg.Trash {
+		retention, err := time.ParseDuration(cfg.TrashRetention)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("Config Error: Failed to parse TrashRetention: %v", err)
+		}
+		o.FS.EnableTrash(retention)
+	}
+	o.FormatMigrator = migrate.New(o.CBS, o.C, o.IDBS, migrate.IsOldFormat)
+	o.ReencryptMigrator = migrate.New(o.CBS, o.C, o.IDBS, migrate.IsEncryptedWithOtherKey(o.C.KeyID()))
+	o.ReencryptMigrator.SetOnCompleted(o.completeReencrypt)
+	o.ScrubMigrator = migrate.New(o.CBS, o.C, o.IDBS, migrate.HasUnscrubbedOrigFilename(pathScrubber))
+	o.ScrubMigrator.SetHeaderTransform(migrate.ScrubOrigFilename(pathScrubber))
+	// Scrub what the backend stores rather than the cache, through a read-only handle of its own.
+	var scrubBS blobstore.BlobStore
+	if cfg.LocalDebug {
+		scrubBS, err = blobstore.NewFileBlobStore(localDebugBackendDir(), oflags.O_RDONLY)
+	} else {
+		scrubBS, err = gcs.NewGCSBlobStore(cfg.ProjectName, cfg.BucketName, o.Clisrc, oflags.O_RDONLY)
+	}
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Failed to init read-only backend blobstore: %v", err)
+	}
+	o.Scrubber = scrubber.New(scrubBS, o.C, o.IDBS)
+	o.Scrubber.SetSyncBlob(o.CBS.SyncBlob)
+	o.Scrubber.SetRateLimit(cfg.ScrubberRateLimit)
+	gcGracePeriod, err := time.ParseDuration(cfg.GCGracePeriod)
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Config Error: Failed to parse GCGracePeriod: %v", err)
+	}
+	o.GC = gc.New(o.CBS, o.IDBS)
+	o.GC.SetGracePeriod(gcGracePeriod)
+	o.GC.SetConcurrency(cfg.GCConcurrency)
+	o.GC.SetExternalRefs(o.otherVolumesBlobRefs)
+	o.GC.SetExternalPins(o.otherVolumesBlobPins)
+	o.FS.SetBlobPinner(o.GC)
+	for _, m := range []*migrate.Migrator{o.FormatMigrator, o.ReencryptMigrator, o.ScrubMigrator} {
+		m.SetBlobPinner(o.GC)
+	}
+	if oneshotcfg.NoServices {
+		return o, nil
+	}
+
+	o.setupJobHistory()
+	o.GC.SetCandidateStore(otaru.NewBlobStoreGCCandidateStoreForVolume(o.CBS, o.C, o.Volume))
+	if err := o.setupRecurringJobs(cfg); err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	o.S.ResumeInterruptedJobs()
+
+	mgmtOpts, err := mgmtOptions(cfg)
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Config Error: %v", err)
+	}
+	o.MGMT, err = mgmt.NewServer(mgmtOpts)
+	if err != nil {
+		o.Close()
+		return nil, fmt.Errorf("Failed to init mgmt server: %v", err)
+	}
 	o.setupMgmtAPIs()
+	o.setupWebDAV(cfg)
 	if err := o.runMgmtServer(); err != nil {
 		o.Close()
 		return nil, fmt.Errorf("Mgmt server run failed: %v", err)
@@ -153,6 +351,17 @@ func NewOtaru(cfg *Config, oneshotcfg *OneshotConfig) (*Otaru, error) {
 	return o, nil
 }
 
+// fenceWrites fails all writes to the volume with EBUSY, once the writer lock was lost to another writer.
+func (o *Otaru) fenceWrites() {
+	log.Printf("Writer lock lost. Failing all writes to volume \"%s\".", o.Volume)
+	o.CBS.Fence(otaru.EBUSY)
+	o.IDBS.Fence(otaru.EBUSY)
+}
+
+func (o *Otaru) writerLockLost() bool {
+	return o.WriterLock != nil && o.WriterLock.Lost()
+}
+
 func (o *Otaru) Close() error {
 	errs := []error{}
 
@@ -174,7 +383,7 @@ func (o *Otaru) Close() error {
 		o.IDBS.Quit()
 	}
 
-	if o.IDBBE != nil {
+	if o.IDBBE != nil && !o.readOnly && !o.writerLockLost() {
 		if err := o.IDBBE.Sync(); err != nil {
 			errs = append(errs, err)
 		}
@@ -184,5 +393,11 @@ func (o *Otaru) Close() error {
 		o.CSS.Stop()
 	}
 
+	if o.WriterLock != nil {
+		if err := o.WriterLock.Unlock(); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to release writer lock: %v", err))
+		}
+	}
+
 	return util.ToErrors(errs)
 }
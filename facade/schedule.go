@@ -0,0 +1,66 @@
+package facade
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/gc"
+	"github.com/nyaxt/otaru/migrate"
+	"github.com/nyaxt/otaru/scheduler"
+	"github.com/nyaxt/otaru/scrubber"
+)
+
+func (o *Otaru) recurringTask(name string) (scheduler.Task, error) {
+	switch name {
+	case "gc":
+		return &gc.GCTask{o.GC, false}, nil
+	case "gc-dryrun":
+		return &gc.GCTask{o.GC, true}, nil
+	case "scrub":
+		return &scrubber.Task{o.Scrubber}, nil
+	case "trash-purge":
+		return &otaru.TrashPurgeTask{o.FS}, nil
+	default:
+		return nil, fmt.Errorf("Unknown task \"%s\"", name)
+	}
+}
+
+func (o *Otaru) setupRecurringJobs(cfg *Config) error {
+	for _, sc := range cfg.Schedules {
+		task, err := o.recurringTask(sc.Task)
+		if err != nil {
+			return err
+		}
+		spec, err := scheduler.ParseSpec(sc.Spec)
+		if err != nil {
+			return fmt.Errorf("Invalid spec for task \"%s\": %v", sc.Task, err)
+		}
+		policy, err := scheduler.ParseMissedRunPolicy(sc.MissedRun)
+		if err != nil {
+			return fmt.Errorf("Invalid missed run policy for task \"%s\": %v", sc.Task, err)
+		}
+
+		id := o.S.RunRecurring(sc.Task, task, spec, policy)
+		if sc.Paused {
+			if err := o.S.PauseRecurring(id); err != nil {
+				return err
+			}
+		}
+		log.Printf("Registered recurring job %d: task \"%s\" on \"%v\", missed run policy: %v", id, sc.Task, spec, policy)
+	}
+	return nil
+}
+
+// setupJobHistory persists the job records, and registers the resumers of checkpointed tasks.
+func (o *Otaru) setupJobHistory() {
+	o.S.SetJobStore(otaru.NewBlobStoreJobStoreForVolume(o.CBS, o.C, o.Volume))
+	o.S.RegisterResumer(scrubber.TaskType, scrubber.Resumer(o.Scrubber))
+	for name, m := range map[string]*migrate.Migrator{
+		"format":    o.FormatMigrator,
+		"reencrypt": o.ReencryptMigrator,
+		"scrub":     o.ScrubMigrator,
+	} {
+		o.S.RegisterResumer(migrate.TaskTypePrefix+name, migrate.Resumer(m, name))
+	}
+}
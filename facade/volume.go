@@ -0,0 +1,231 @@
+package facade
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/chunkstore"
+	oflags "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/gcloud/datastore"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/util"
+)
+
+func (o *Otaru) newTxLogIO(volume string) (inodedb.DBTransactionLogIO, error) {
+	if o.cfg.LocalDebug {
+		return inodedb.NewSimpleDBTransactionLogIO(), nil
+	}
+	return datastore.NewDBTransactionLogIO(o.cfg.ProjectName, metadata.TxLogRootKeyOf(o.cfg.BucketName, volume), o.C, o.Clisrc)
+}
+
+// snapshotExists tells if the volume has its inodedb snapshot. The default volume is listed even if the bucket only has named volumes.
+func (o *Otaru) snapshotExists(volume string) (bool, error) {
+	h, err := o.CBS.Open(metadata.INodeDBSnapshotBlobpathOf(volume), oflags.O_RDONLY)
+	if err == blobstore.ENOENT {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	h.Close()
+	return true, nil
+}
+
+// volumeBlobRefs is the blob refs of another volume, at the latest txid of its txlog.
+type volumeBlobRefs struct {
+	version inodedb.TxID
+	refs    map[string]struct{}
+}
+
+// blobRefsOfVolume returns the blob refs of the volume, reloading the volume only if its txlog has new transactions since last call.
+func (o *Otaru) blobRefsOfVolume(name string) (map[string]struct{}, error) {
+	txio, err := o.newTxLogIO(name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to init DBTransactionLogIO of volume \"%s\": %v", name, err)
+	}
+
+	if cached, ok := o.volumeRefs[name]; ok {
+		txs, err := txio.QueryTransactions(cached.version + 1)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query txlog of volume \"%s\": %v", name, err)
+		}
+		if len(txs) == 0 {
+			return cached.refs, nil
+		}
+	}
+
+	db, err := inodedb.NewDB(otaru.NewBlobStoreDBStateSnapshotIOForVolume(o.CBS, o.C, name), txio)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open volume \"%s\": %v", name, err)
+	}
+	refs, version := db.BlobRefsSnapshot()
+	log.Printf("Volume \"%s\" at version %d: %d used blobs.", name, version, len(refs))
+	o.volumeRefs[name] = volumeBlobRefs{version: version, refs: refs}
+	return refs, nil
+}
+
+// otherVolumesBlobRefs returns the blobs referenced from the volumes other than the one opened, so that GC doesn't sweep them.
+func (o *Otaru) otherVolumesBlobRefs() (map[string]struct{}, error) {
+	vs, err := o.Volumes.ListVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list volumes: %v", err)
+	}
+
+	o.muVolumeRefs.Lock()
+	defer o.muVolumeRefs.Unlock()
+	if o.volumeRefs == nil {
+		o.volumeRefs = make(map[string]volumeBlobRefs)
+	}
+
+	refs := make(map[string]struct{})
+	for _, v := range vs {
+		if v.Name == o.Volume {
+			continue
+		}
+		if _, ok := o.volumeRefs[v.Name]; !ok && v.Name == metadata.DefaultVolume {
+			if ok, err := o.snapshotExists(v.Name); err != nil {
+				return nil, fmt.Errorf("Failed to check volume \"%s\": %v", v.Name, err)
+			} else if !ok {
+				continue
+			}
+		}
+
+		vrefs, err := o.blobRefsOfVolume(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		for bp := range vrefs {
+			refs[bp] = struct{}{}
+		}
+	}
+	return refs, nil
+}
+
+// otherVolumesBlobPins returns the prefix of dedup chunks while any other volume is opened for write.
+func (o *Otaru) otherVolumesBlobPins() ([]string, error) {
+	vs, err := o.Volumes.ListVolumes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list volumes: %v", err)
+	}
+
+	for _, v := range vs {
+		if v.Name == o.Volume {
+			continue
+		}
+		held, err := otaru.NewBlobStoreWriterLockForVolume(o.BackendBS, o.C, v.Name).IsHeld()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to check writer lock of volume \"%s\": %v", v.Name, err)
+		}
+		if held {
+			log.Printf("Volume \"%s\" is opened for write. Not sweeping dedup chunks.", v.Name)
+			return []string{chunkstore.DedupBlobPathPrefix}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (o *Otaru) ListVolumes() ([]otaru.VolumeInfo, error) {
+	return o.Volumes.ListVolumes()
+}
+
+// CreateVolume creates an empty filesystem as a new volume.
+func (o *Otaru) CreateVolume(name string) error {
+	if err := metadata.ValidateVolumeName(name); err != nil {
+		return err
+	}
+	if ok, err := o.Volumes.HasVolume(name); err != nil {
+		return err
+	} else if ok {
+		return otaru.EEXIST
+	}
+
+	txio, err := o.newTxLogIO(name)
+	if err != nil {
+		return fmt.Errorf("Failed to init DBTransactionLogIO: %v", err)
+	}
+	if _, err := inodedb.NewEmptyDB(otaru.NewBlobStoreDBStateSnapshotIOForVolume(o.CBS, o.C, name), txio); err != nil {
+		return fmt.Errorf("NewEmptyDB failed: %v", err)
+	}
+	return o.Volumes.AddVolume(name)
+}
+
+type txLogDeleter interface {
+	DeleteAllTransactions() error
+}
+
+// DeleteVolume removes the volume and its metadata. The blobs of its files are left to GC.
+func (o *Otaru) DeleteVolume(name string) error {
+	if name == o.Volume {
+		return fmt.Errorf("Can't delete the volume \"%s\" in use.", name)
+	}
+	held, err := otaru.NewBlobStoreWriterLockForVolume(o.BackendBS, o.C, name).IsHeld()
+	if err != nil {
+		return fmt.Errorf("Failed to check writer lock of volume \"%s\": %v", name, err)
+	}
+	if held {
+		return otaru.EBUSY
+	}
+	if err := o.Volumes.RemoveVolume(name); err != nil {
+		return err
+	}
+	o.muVolumeRefs.Lock()
+	delete(o.volumeRefs, name)
+	o.muVolumeRefs.Unlock()
+
+	errs := []error{}
+	for _, bp := range metadata.BlobpathsOfVolume(name) {
+		if err := o.CBS.RemoveBlob(bp); err != nil && err != blobstore.ENOENT {
+			errs = append(errs, fmt.Errorf("Failed to remove \"%s\": %v", bp, err))
+		}
+	}
+	txio, err := o.newTxLogIO(name)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed to init DBTransactionLogIO: %v", err))
+	} else if d, ok := txio.(txLogDeleter); ok {
+		if err := d.DeleteAllTransactions(); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to delete txlog: %v", err))
+		}
+	}
+	return util.ToErrors(errs)
+}
+
+// completeReencrypt rewrites the metadata blobs of the volume with the primary key once its chunks are re-encrypted.
+func (o *Otaru) completeReencrypt() error {
+	if err := o.IDBS.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync inodedb: %v", err)
+	}
+	if err := o.S.SaveHistory(); err != nil {
+		return fmt.Errorf("Failed to save job records: %v", err)
+	}
+	if err := o.GC.SaveCandidates(); err != nil {
+		return fmt.Errorf("Failed to save GC candidates: %v", err)
+	}
+	return o.Volumes.SetOldestKeyID(o.Volume, o.C.KeyID())
+}
+
+// OldestKeyIDInUse returns the oldest data key the blobs of any volume may be encrypted with. Older keys can be retired.
+func (o *Otaru) OldestKeyIDInUse() (uint32, error) {
+	vs, err := o.Volumes.ListVolumes()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list volumes: %v", err)
+	}
+
+	oldest := o.C.KeyID()
+	for _, v := range vs {
+		if v.OldestKeyID >= oldest {
+			continue
+		}
+		if v.Name == metadata.DefaultVolume && v.OldestKeyID == 0 {
+			if ok, err := o.snapshotExists(v.Name); err != nil {
+				return 0, fmt.Errorf("Failed to check volume \"%s\": %v", v.Name, err)
+			} else if !ok {
+				continue
+			}
+		}
+		oldest = v.OldestKeyID
+	}
+	return oldest, nil
+}
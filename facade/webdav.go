@@ -0,0 +1,27 @@
+package facade
+
+import (
+	"log"
+
+	"github.com/nyaxt/otaru/mgmt"
+	"github.com/nyaxt/otaru/webdav"
+)
+
+// setupWebDAV serves the filesystem over WebDAV.
+func (o *Otaru) setupWebDAV(cfg *Config) {
+	if !cfg.WebDAV {
+		return
+	}
+
+	if cfg.WebDAVListenAddr == "" {
+		o.MGMT.HandlePrefix(webdav.DefaultPrefix, o.MGMT.Authenticator().Require(mgmt.RoleReader, webdav.NewHandler(o.FS, webdav.DefaultPrefix)))
+		return
+	}
+
+	h := o.MGMT.Authenticator().Require(mgmt.RoleReader, webdav.NewHandler(o.FS, ""))
+	go func() {
+		if err := o.MGMT.RunListener(cfg.WebDAVListenAddr, h); err != nil {
+			log.Fatalf("webdav httpd died: %v", err)
+		}
+	}()
+}
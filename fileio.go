@@ -0,0 +1,58 @@
+package otaru
+
+import (
+	"fmt"
+	"io"
+)
+
+// FileHandleIO provides io.Reader, io.Writer and io.Seeker over a FileHandle. Reads stop at the file size with io.EOF.
+type FileHandleIO struct {
+	fh     *FileHandle
+	offset int64
+}
+
+func NewFileHandleIO(fh *FileHandle) *FileHandleIO {
+	return &FileHandleIO{fh: fh}
+}
+
+func (fio *FileHandleIO) Read(p []byte) (int, error) {
+	size := fio.fh.Size()
+	if fio.offset >= size {
+		return 0, io.EOF
+	}
+	if rest := size - fio.offset; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	if err := fio.fh.PRead(fio.offset, p); err != nil {
+		return 0, err
+	}
+	fio.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (fio *FileHandleIO) Write(p []byte) (int, error) {
+	if err := fio.fh.PWrite(fio.offset, p); err != nil {
+		return 0, err
+	}
+	fio.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (fio *FileHandleIO) Seek(offset int64, whence int) (int64, error) {
+	var newoffset int64
+	switch whence {
+	case io.SeekStart:
+		newoffset = offset
+	case io.SeekCurrent:
+		newoffset = fio.offset + offset
+	case io.SeekEnd:
+		newoffset = fio.fh.Size() + offset
+	default:
+		return fio.offset, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if newoffset < 0 {
+		return fio.offset, fmt.Errorf("Seek to negative offset: %d", newoffset)
+	}
+	fio.offset = newoffset
+	return newoffset, nil
+}
@@ -2,9 +2,11 @@ package otaru
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/nyaxt/otaru/blobstore"
 	"github.com/nyaxt/otaru/btncrypt"
@@ -17,6 +19,7 @@ import (
 const (
 	EACCES    = syscall.Errno(syscall.EACCES)
 	EBADF     = syscall.Errno(syscall.EBADF)
+	EBUSY     = syscall.Errno(syscall.EBUSY)
 	EEXIST    = syscall.Errno(syscall.EEXIST)
 	EISDIR    = syscall.Errno(syscall.EISDIR)
 	ENOENT    = syscall.Errno(syscall.ENOENT)
@@ -38,11 +41,28 @@ type FileSystem struct {
 
 	newChunkedFileIO func(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, caio chunkstore.ChunksArrayIO) blobstore.BlobHandle
 
+	// blobPinner keeps the dedup chunks stored from being removed by GC until committed. See SetBlobPinner.
+	blobPinner chunkstore.BlobPinner
+
+	// pathScrubber transforms orig paths before they are persisted. The origpath map below keeps them plain, as child paths are built from them.
+	pathScrubber *chunkstore.PathScrubber
+
 	muOpenFiles sync.Mutex
 	openFiles   map[inodedb.ID]*OpenFile
 
 	muOrigPath sync.Mutex
 	origpath   map[inodedb.ID]string
+
+	// trashEnabled makes removed entries moved to TrashDirName. See EnableTrash.
+	trashEnabled   bool
+	trashRetention time.Duration
+	// muTrash serializes the creation of the trash directory.
+	muTrash sync.Mutex
+
+	// trashIDs caches the IDs of the directories in the trash directory trashIDsRoot, including itself. nil until queried, or after an operation which may move directories out of the trash.
+	muTrashIDs   sync.Mutex
+	trashIDs     map[inodedb.ID]struct{}
+	trashIDsRoot inodedb.ID
 }
 
 func NewFileSystem(idb inodedb.DBHandler, bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher) *FileSystem {
@@ -99,6 +119,29 @@ func (fs *FileSystem) Sync() error {
 	return util.ToErrors(es)
 }
 
+// EnableDedup makes files opened afterwards store their contents as content-defined, deduplicated chunks named by namer.
+// Newly stored chunks are compressed with comp.
+func (fs *FileSystem) EnableDedup(namer *chunkstore.ContentNamer, comp chunkstore.Compression) {
+	fs.newChunkedFileIO = func(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, caio chunkstore.ChunksArrayIO) blobstore.BlobHandle {
+		dfio := chunkstore.NewDedupChunkedFileIO(bs, c, caio, namer)
+		dfio.SetCompression(comp)
+		if fs.blobPinner != nil {
+			dfio.SetBlobPinner(fs.blobPinner)
+		}
+		return dfio
+	}
+}
+
+// SetBlobPinner makes the dedup chunks stored by files opened afterwards pinned by p until their FileChunks are committed.
+func (fs *FileSystem) SetBlobPinner(p chunkstore.BlobPinner) {
+	fs.blobPinner = p
+}
+
+// SetPathScrubber makes OrigPath of nodes created and OrigFilename of chunks written afterwards recorded as s specifies.
+func (fs *FileSystem) SetPathScrubber(s *chunkstore.PathScrubber) {
+	fs.pathScrubber = s
+}
+
 func (fs *FileSystem) OverrideNewChunkedFileIOForTesting(newChunkedFileIO func(blobstore.RandomAccessBlobStore, btncrypt.Cipher, chunkstore.ChunksArrayIO) blobstore.BlobHandle) {
 	fs.newChunkedFileIO = newChunkedFileIO
 }
@@ -123,6 +166,11 @@ func (fs *FileSystem) DirEntries(id inodedb.ID) (map[string]inodedb.ID, error) {
 }
 
 func (fs *FileSystem) Rename(srcDirID inodedb.ID, srcName string, dstDirID inodedb.ID, dstName string) error {
+	// The trash directory is found by its name at the root.
+	if (srcDirID == inodedb.RootDirID && srcName == TrashDirName) || (dstDirID == inodedb.RootDirID && dstName == TrashDirName) {
+		return EPERM
+	}
+
 	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
 		&inodedb.RenameOp{
 			SrcDirID: srcDirID, SrcName: srcName,
@@ -132,13 +180,25 @@ func (fs *FileSystem) Rename(srcDirID inodedb.ID, srcName string, dstDirID inode
 	if _, err := fs.idb.ApplyTransaction(tx); err != nil {
 		return err
 	}
+	fs.untrackTrashDirsIfIn(srcDirID, dstDirID)
 
 	// FIXME: fs.setOrigPathForId
 
 	return nil
 }
 
+// Remove removes the entry. A non-empty directory can't be removed.
+// If the trash is enabled, the entry is moved to the trash instead, unless it is in the trash already.
 func (fs *FileSystem) Remove(dirID inodedb.ID, name string) error {
+	if bypass, err := fs.bypassesTrash(dirID, name); err != nil {
+		return err
+	} else if !bypass {
+		return fs.moveToTrash(dirID, name, false)
+	}
+	return fs.removeNow(dirID, name)
+}
+
+func (fs *FileSystem) removeNow(dirID inodedb.ID, name string) error {
 	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
 		&inodedb.RemoveOp{
 			NodeLock: inodedb.NodeLock{dirID, inodedb.NoTicket}, Name: name,
@@ -168,7 +228,7 @@ func (fs *FileSystem) createNode(dirID inodedb.ID, name string, typ inodedb.Type
 	origpath := fmt.Sprintf("%s/%s", dirorigpath, name)
 
 	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
-		&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: origpath, Type: typ},
+		&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: fs.pathScrubber.Scrub(origpath), Type: typ},
 		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{dirID, inodedb.NoTicket}, Name: name, TargetID: nlock.ID},
 	}}
 	if _, err := fs.idb.ApplyTransaction(tx); err != nil {
@@ -176,10 +236,60 @@ func (fs *FileSystem) createNode(dirID inodedb.ID, name string, typ inodedb.Type
 	}
 
 	fs.setOrigPathForId(nlock.ID, origpath)
+	if typ == inodedb.DirNodeT {
+		fs.trackTrashDirs(dirID, nlock.ID)
+	}
 
 	return nlock.ID, nil
 }
 
+// NewEntry is a node to be created by CreateEntries.
+type NewEntry struct {
+	Name string
+	Type inodedb.Type
+}
+
+// CreateEntries creates the nodes in the directory in a single DBTransaction, and returns their IDs in the order given.
+func (fs *FileSystem) CreateEntries(dirID inodedb.ID, es []NewEntry) ([]inodedb.ID, error) {
+	nlocks := make([]inodedb.NodeLock, 0, len(es))
+	defer func() {
+		for _, nlock := range nlocks {
+			if err := fs.idb.UnlockNode(nlock); err != nil {
+				log.Printf("Failed to unlock node when creating entries: %v", err)
+			}
+		}
+	}()
+
+	dirorigpath := fs.tryGetOrigPath(dirID)
+	ops := make([]inodedb.DBOperation, 0, 2*len(es))
+	for _, e := range es {
+		nlock, err := fs.idb.LockNode(inodedb.AllocateNewNodeID)
+		if err != nil {
+			return nil, err
+		}
+		nlocks = append(nlocks, nlock)
+
+		origpath := fmt.Sprintf("%s/%s", dirorigpath, e.Name)
+		ops = append(ops,
+			&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: fs.pathScrubber.Scrub(origpath), Type: e.Type},
+			&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{dirID, inodedb.NoTicket}, Name: e.Name, TargetID: nlock.ID},
+		)
+	}
+	if _, err := fs.idb.ApplyTransaction(inodedb.DBTransaction{Ops: ops}); err != nil {
+		return nil, err
+	}
+
+	ids := make([]inodedb.ID, 0, len(es))
+	for i, nlock := range nlocks {
+		fs.setOrigPathForId(nlock.ID, fmt.Sprintf("%s/%s", dirorigpath, es[i].Name))
+		if es[i].Type == inodedb.DirNodeT {
+			fs.trackTrashDirs(dirID, nlock.ID)
+		}
+		ids = append(ids, nlock.ID)
+	}
+	return ids, nil
+}
+
 func (fs *FileSystem) CreateFile(dirID inodedb.ID, name string) (inodedb.ID, error) {
 	return fs.createNode(dirID, name, inodedb.FileNodeT)
 }
@@ -213,6 +323,35 @@ func (fs *FileSystem) Attr(id inodedb.ID) (Attr, error) {
 	return a, nil
 }
 
+// ContentVersion returns a value which changes whenever the synced content of the file changes.
+func (fs *FileSystem) ContentVersion(id inodedb.ID) (uint64, error) {
+	v, _, err := fs.idb.QueryNode(id, false)
+	if err != nil {
+		return 0, err
+	}
+	fn, ok := v.(*inodedb.FileNodeView)
+	if !ok {
+		return 0, EISDIR
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%d", id, fn.Size)
+	for _, c := range fn.Chunks {
+		bh, err := fs.bs.Open(c.BlobPath, fl.O_RDONLY)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to open chunk \"%s\": %v", c.BlobPath, err)
+		}
+		var ch chunkstore.ChunkHeader
+		err = ch.ReadFrom(&blobstore.OffsetReader{bh, 0}, fs.c)
+		bh.Close()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to read header of chunk \"%s\": %v", c.BlobPath, err)
+		}
+		fmt.Fprintf(h, ",%s@%d+%d:%d", c.BlobPath, c.Offset, c.Length, ch.PayloadVersion)
+	}
+	return h.Sum64(), nil
+}
+
 func (fs *FileSystem) IsDir(id inodedb.ID) (bool, error) {
 	v, _, err := fs.idb.QueryNode(id, false)
 	if err != nil {
@@ -302,7 +441,7 @@ func (fs *FileSystem) OpenFile(id inodedb.ID, flags int) (*FileHandle, error) {
 	caio := NewINodeDBChunksArrayIO(fs.idb, nlock)
 	of.cfio = fs.newChunkedFileIO(fs.bs, fs.c, caio)
 	if setter, ok := of.cfio.(origFilenameSetter); ok {
-		setter.SetOrigFilename(fs.tryGetOrigPath(nlock.ID))
+		setter.SetOrigFilename(fs.pathScrubber.Scrub(fs.tryGetOrigPath(nlock.ID)))
 	}
 	return of.OpenHandleWithoutLock(flags), nil
 }
@@ -7,6 +7,10 @@ import (
 	. "github.com/nyaxt/otaru/testutils"
 
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -41,3 +45,150 @@ func TestFileWriteRead(t *testing.T) {
 		t.Errorf("PRead content != PWrite content")
 	}
 }
+
+func TestFullPathOps(t *testing.T) {
+	snapshotio := inodedb.NewSimpleDBStateSnapshotIO()
+	txio := inodedb.NewSimpleDBTransactionLogIO()
+	idb, err := inodedb.NewEmptyDB(snapshotio, txio)
+	if err != nil {
+		t.Errorf("NewEmptyDB failed: %v", err)
+		return
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+
+	if _, err := fs.CreateDirFullPath("/a"); err != nil {
+		t.Errorf("CreateDirFullPath failed: %v", err)
+	}
+	if _, err := fs.CreateDirFullPath("/a/b"); err != nil {
+		t.Errorf("CreateDirFullPath failed: %v", err)
+	}
+	h, err := fs.OpenFileFullPath("/a/b/c.txt", flags.O_RDWRCREATE, 0666)
+	if err != nil {
+		t.Errorf("OpenFileFullPath failed: %v", err)
+		return
+	}
+	w := otaru.NewFileHandleIO(h)
+	if _, err := w.Write([]byte("hello world!")); err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	h.Close()
+
+	if _, err := fs.OpenFileFullPath("/a/b/c.txt", flags.O_RDWRCREATE|flags.O_EXCL, 0666); err != otaru.EEXIST {
+		t.Errorf("Expected EEXIST on O_EXCL, got %v", err)
+	}
+	if _, err := fs.FindDirFullPath("/a/b/c.txt"); err != otaru.ENOTDIR {
+		t.Errorf("Expected ENOTDIR, got %v", err)
+	}
+	if _, err := fs.FindNodeFullPath("/a/x/c.txt"); err != otaru.ENOENT {
+		t.Errorf("Expected ENOENT, got %v", err)
+	}
+
+	if err := fs.RenameFullPath("/a/b/c.txt", "/a/d.txt"); err != nil {
+		t.Errorf("RenameFullPath failed: %v", err)
+	}
+	h, err = fs.OpenFileFullPath("/a/d.txt", flags.O_RDONLY, 0)
+	if err != nil {
+		t.Errorf("OpenFileFullPath failed: %v", err)
+		return
+	}
+	r := otaru.NewFileHandleIO(h)
+	if _, err := r.Seek(6, io.SeekStart); err != nil {
+		t.Errorf("Seek failed: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("ReadAll failed: %v", err)
+	}
+	if string(b) != "world!" {
+		t.Errorf("Unexpected content: %q", b)
+	}
+	h.Close()
+
+	if err := fs.RemoveFullPath("/a/d.txt"); err != nil {
+		t.Errorf("RemoveFullPath failed: %v", err)
+	}
+	if _, err := fs.FindNodeFullPath("/a/d.txt"); err != otaru.ENOENT {
+		t.Errorf("Expected ENOENT after remove, got %v", err)
+	}
+}
+
+func TestCreateEntries(t *testing.T) {
+	snapshotio := inodedb.NewSimpleDBStateSnapshotIO()
+	txio := inodedb.NewSimpleDBTransactionLogIO()
+	idb, err := inodedb.NewEmptyDB(snapshotio, txio)
+	if err != nil {
+		t.Errorf("NewEmptyDB failed: %v", err)
+		return
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+
+	ids, err := fs.CreateEntries(inodedb.RootDirID, []otaru.NewEntry{
+		{Name: "dir", Type: inodedb.DirNodeT},
+		{Name: "a.txt", Type: inodedb.FileNodeT},
+		{Name: "b.txt", Type: inodedb.FileNodeT},
+	})
+	if err != nil {
+		t.Fatalf("CreateEntries failed: %v", err)
+	}
+	entries, err := fs.DirEntries(inodedb.RootDirID)
+	if err != nil {
+		t.Fatalf("DirEntries failed: %v", err)
+	}
+	if len(entries) != 3 || entries["dir"] != ids[0] || entries["a.txt"] != ids[1] || entries["b.txt"] != ids[2] {
+		t.Errorf("Unexpected entries: %v, ids: %v", entries, ids)
+	}
+	if isdir, err := fs.IsDir(ids[0]); err != nil || !isdir {
+		t.Errorf("dir should be a directory: %v", err)
+	}
+
+	// The whole batch fails if any entry conflicts.
+	if _, err := fs.CreateEntries(inodedb.RootDirID, []otaru.NewEntry{
+		{Name: "c.txt", Type: inodedb.FileNodeT},
+		{Name: "a.txt", Type: inodedb.FileNodeT},
+	}); err == nil {
+		t.Errorf("CreateEntries should fail on existing entry")
+	}
+	if _, err := fs.FindNodeFullPath("/c.txt"); err != otaru.ENOENT {
+		t.Errorf("c.txt shouldn't be created: %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestWriteFileFullPath(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+
+	if n, err := fs.WriteFileFullPath("/a.txt", strings.NewReader("hello world!")); err != nil || n != 12 {
+		t.Fatalf("WriteFileFullPath failed: %v, %d", err, n)
+	}
+	if n, err := fs.WriteFileFullPath("/a.txt", strings.NewReader("hello otaru")); err != nil || n != 11 {
+		t.Fatalf("WriteFileFullPath replace failed: %v, %d", err, n)
+	}
+	if !bytes.Equal(readAll(t, fs, "/a.txt"), []byte("hello otaru")) {
+		t.Errorf("Unexpected content after replace")
+	}
+
+	// A failed write leaves the old content, and no temporary file.
+	if _, err := fs.WriteFileFullPath("/a.txt", io.MultiReader(strings.NewReader("partial"), failingReader{})); err == nil {
+		t.Errorf("WriteFileFullPath should fail on read error")
+	}
+	if !bytes.Equal(readAll(t, fs, "/a.txt"), []byte("hello otaru")) {
+		t.Errorf("Failed write should leave the old content")
+	}
+	if entries, err := fs.DirEntries(inodedb.RootDirID); err != nil || len(entries) != 1 {
+		t.Errorf("Unexpected entries after failed write: %v, %v", entries, err)
+	}
+
+	if _, err := fs.CreateDirFullPath("/dir"); err != nil {
+		t.Fatalf("CreateDirFullPath failed: %v", err)
+	}
+	if _, err := fs.WriteFileFullPath("/dir", strings.NewReader("hello")); err != otaru.EISDIR {
+		t.Errorf("WriteFileFullPath onto dir should fail with EISDIR: %v", err)
+	}
+}
@@ -2,35 +2,85 @@ package otaru
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"os"
-	"path/filepath"
+	"path"
+	"strings"
+	"time"
 
+	fl "github.com/nyaxt/otaru/flags"
 	"github.com/nyaxt/otaru/inodedb"
 )
 
-func (fs *FileSystem) FindDirFullPath(fullpath string) (inodedb.ID, error) {
+func checkFullPath(fullpath string) error {
 	if len(fullpath) < 1 || fullpath[0] != '/' {
-		return 0, fmt.Errorf("Path must start with /, but given: %v", fullpath)
+		return fmt.Errorf("Path must start with /, but given: %v", fullpath)
 	}
+	return nil
+}
 
-	if fullpath != "/" {
-		panic("FIXME: implement me!!!!")
+// FindNodeFullPath resolves fullpath to the ID of the node, walking the directories from the root.
+func (fs *FileSystem) FindNodeFullPath(fullpath string) (inodedb.ID, error) {
+	if err := checkFullPath(fullpath); err != nil {
+		return 0, err
 	}
 
-	return inodedb.ID(1), nil
+	id := inodedb.RootDirID
+	for _, name := range strings.Split(path.Clean(fullpath), "/") {
+		if name == "" {
+			continue
+		}
+
+		entries, err := fs.DirEntries(id)
+		if err != nil {
+			return 0, err
+		}
+		var ok bool
+		if id, ok = entries[name]; !ok {
+			return 0, ENOENT
+		}
+	}
+	return id, nil
 }
 
-func (fs *FileSystem) OpenFileFullPath(fullpath string, flags int, perm os.FileMode) (*FileHandle, error) {
-	perm &= os.ModePerm
+func (fs *FileSystem) FindDirFullPath(fullpath string) (inodedb.ID, error) {
+	id, err := fs.FindNodeFullPath(fullpath)
+	if err != nil {
+		return 0, err
+	}
 
-	if len(fullpath) < 1 || fullpath[0] != '/' {
-		return nil, fmt.Errorf("Path must start with /, but given: %v", fullpath)
+	isdir, err := fs.IsDir(id)
+	if err != nil {
+		return 0, err
 	}
+	if !isdir {
+		return 0, ENOTDIR
+	}
+	return id, nil
+}
 
-	dirname := filepath.Dir(fullpath)
-	basename := filepath.Base(fullpath)
+// SplitFullPath resolves the parent directory of fullpath, and returns its ID with the base name.
+func (fs *FileSystem) SplitFullPath(fullpath string) (inodedb.ID, string, error) {
+	if err := checkFullPath(fullpath); err != nil {
+		return 0, "", err
+	}
+	fullpath = path.Clean(fullpath)
+	if fullpath == "/" {
+		return 0, "", EPERM
+	}
 
-	dirID, err := fs.FindDirFullPath(dirname)
+	dirID, err := fs.FindDirFullPath(path.Dir(fullpath))
+	if err != nil {
+		return 0, "", err
+	}
+	return dirID, path.Base(fullpath), nil
+}
+
+func (fs *FileSystem) OpenFileFullPath(fullpath string, flags int, perm os.FileMode) (*FileHandle, error) {
+	perm &= os.ModePerm
+
+	dirID, basename, err := fs.SplitFullPath(fullpath)
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +93,7 @@ func (fs *FileSystem) OpenFileFullPath(fullpath string, flags int, perm os.FileM
 	var id inodedb.ID
 	id, ok := entries[basename]
 	if !ok {
-		if flags|os.O_CREATE != 0 {
+		if flags&fl.O_CREATE != 0 {
 			// FIXME: apply perm
 
 			id, err = fs.CreateFile(dirID, basename)
@@ -53,6 +103,8 @@ func (fs *FileSystem) OpenFileFullPath(fullpath string, flags int, perm os.FileM
 		} else {
 			return nil, ENOENT
 		}
+	} else if flags&fl.O_EXCL != 0 {
+		return nil, EEXIST
 	}
 
 	if id == 0 {
@@ -67,3 +119,188 @@ func (fs *FileSystem) OpenFileFullPath(fullpath string, flags int, perm os.FileM
 
 	return fh, nil
 }
+
+// WriteFileFullPath replaces the content of the file at fullpath with r, creating the file if it doesn't exist.
+func (fs *FileSystem) WriteFileFullPath(fullpath string, r io.Reader) (int64, error) {
+	rep, err := fs.BeginReplaceFullPath(fullpath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fs.writeNewFile(rep.ID(), r)
+	if err != nil {
+		rep.Abort()
+		return n, err
+	}
+	if err := rep.Commit(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// FileReplacement is a temporary file which replaces a file on Commit.
+type FileReplacement struct {
+	fs      *FileSystem
+	dirID   inodedb.ID
+	name    string
+	tmpname string
+	tmpID   inodedb.ID
+}
+
+// BeginReplaceFullPath creates a temporary file, which replaces the file at fullpath on Commit.
+func (fs *FileSystem) BeginReplaceFullPath(fullpath string) (*FileReplacement, error) {
+	dirID, name, err := fs.SplitFullPath(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	// Fail before writing anything if the entry can't be replaced.
+	if _, err := fs.replaceOps(dirID, name, ""); err != nil {
+		return nil, err
+	}
+
+	tmpname := fmt.Sprintf(".%s.otaru-write-%d", name, time.Now().UnixNano())
+	tmpID, err := fs.CreateFile(dirID, tmpname)
+	if err != nil {
+		return nil, err
+	}
+	return &FileReplacement{fs: fs, dirID: dirID, name: name, tmpname: tmpname, tmpID: tmpID}, nil
+}
+
+// ID returns the ID of the temporary file, which the replaced file has after Commit.
+func (rep *FileReplacement) ID() inodedb.ID { return rep.tmpID }
+
+func (rep *FileReplacement) Commit() error {
+	if err := rep.fs.ReplaceFile(rep.dirID, rep.tmpname, rep.name); err != nil {
+		rep.Abort()
+		return err
+	}
+	return nil
+}
+
+// Abort removes the temporary file, leaving the file to be replaced intact.
+func (rep *FileReplacement) Abort() {
+	if err := rep.fs.removeNow(rep.dirID, rep.tmpname); err != nil {
+		log.Printf("Failed to remove temporary file \"%s\": %v", rep.tmpname, err)
+	}
+}
+
+// ReplaceFile renames srcName to name in the directory, replacing the file without the trash.
+func (fs *FileSystem) ReplaceFile(dirID inodedb.ID, srcName, name string) error {
+	ops, err := fs.replaceOps(dirID, name, srcName)
+	if err != nil {
+		return err
+	}
+	_, err = fs.idb.ApplyTransaction(inodedb.DBTransaction{Ops: ops})
+	return err
+}
+
+// replaceOps returns the DBOperations to rename srcName to name in the directory, replacing the file name if it exists.
+func (fs *FileSystem) replaceOps(dirID inodedb.ID, name, srcName string) ([]inodedb.DBOperation, error) {
+	entries, err := fs.DirEntries(dirID)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []inodedb.DBOperation{}
+	if id, ok := entries[name]; ok {
+		isdir, err := fs.IsDir(id)
+		if err != nil {
+			return nil, err
+		}
+		if isdir {
+			return nil, EISDIR
+		}
+		ops = append(ops, &inodedb.RemoveOp{NodeLock: inodedb.NodeLock{dirID, inodedb.NoTicket}, Name: name})
+	}
+	return append(ops, &inodedb.RenameOp{SrcDirID: dirID, SrcName: srcName, DstDirID: dirID, DstName: name}), nil
+}
+
+func (fs *FileSystem) writeNewFile(id inodedb.ID, r io.Reader) (int64, error) {
+	fh, err := fs.OpenFile(id, fl.O_RDWR)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	n, err := io.Copy(NewFileHandleIO(fh), r)
+	if err != nil {
+		return n, fmt.Errorf("Failed to write content: %v", err)
+	}
+	if err := fh.Sync(); err != nil {
+		return n, fmt.Errorf("Failed to sync: %v", err)
+	}
+	return n, nil
+}
+
+func (fs *FileSystem) CreateDirFullPath(fullpath string) (inodedb.ID, error) {
+	dirID, basename, err := fs.SplitFullPath(fullpath)
+	if err != nil {
+		return 0, err
+	}
+	return fs.CreateDir(dirID, basename)
+}
+
+func (fs *FileSystem) RenameFullPath(srcpath, dstpath string) error {
+	srcDirID, srcName, err := fs.SplitFullPath(srcpath)
+	if err != nil {
+		return err
+	}
+	dstDirID, dstName, err := fs.SplitFullPath(dstpath)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(srcDirID, srcName, dstDirID, dstName)
+}
+
+func (fs *FileSystem) RemoveFullPath(fullpath string) error {
+	dirID, basename, err := fs.SplitFullPath(fullpath)
+	if err != nil {
+		return err
+	}
+	return fs.Remove(dirID, basename)
+}
+
+// RemoveAll removes the entry, and everything it contains if it is a directory, or moves it to the trash.
+func (fs *FileSystem) RemoveAll(dirID inodedb.ID, name string) error {
+	if bypass, err := fs.bypassesTrash(dirID, name); err != nil {
+		return err
+	} else if !bypass {
+		return fs.moveToTrash(dirID, name, true)
+	}
+	return fs.RemoveAllNow(dirID, name)
+}
+
+// RemoveAllNow removes the entry and its contents for good, bypassing the trash.
+func (fs *FileSystem) RemoveAllNow(dirID inodedb.ID, name string) error {
+	entries, err := fs.DirEntries(dirID)
+	if err != nil {
+		return err
+	}
+	id, ok := entries[name]
+	if !ok {
+		return ENOENT
+	}
+	isdir, err := fs.IsDir(id)
+	if err != nil {
+		return err
+	}
+	if isdir {
+		children, err := fs.DirEntries(id)
+		if err != nil {
+			return err
+		}
+		for childname := range children {
+			if err := fs.RemoveAllNow(id, childname); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.removeNow(dirID, name)
+}
+
+func (fs *FileSystem) RemoveAllFullPath(fullpath string) error {
+	dirID, basename, err := fs.SplitFullPath(fullpath)
+	if err != nil {
+		return err
+	}
+	return fs.RemoveAll(dirID, basename)
+}
@@ -25,6 +25,7 @@ var Usage = func() {
 var (
 	flagMkfs       = flag.Bool("mkfs", false, "Reset metadata if no existing metadata exists")
 	flagConfigFile = flag.String("config", path.Join(os.Getenv("HOME"), ".otaru", "config.toml"), "Config filepath")
+	flagVolume     = flag.String("volume", "", "Volume to mount. Overrides Volume of the config. Creates the volume with -mkfs")
 )
 
 func main() {
@@ -45,7 +46,7 @@ func main() {
 	}
 	mountpoint := flag.Arg(0)
 
-	o, err := facade.NewOtaru(cfg, &facade.OneshotConfig{Mkfs: *flagMkfs})
+	o, err := facade.NewOtaru(cfg, &facade.OneshotConfig{Mkfs: *flagMkfs, Volume: *flagVolume})
 	if err != nil {
 		log.Printf("NewOtaru failed: %v", err)
 		os.Exit(1)
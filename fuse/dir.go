@@ -20,6 +20,8 @@ type DirNode struct {
 }
 
 func (d DirNode) Attr(ctx context.Context, a *bfuse.Attr) error {
+	defer observeOp("attr", time.Now())
+
 	log.Printf("DirNode Attr id: %d", d.id)
 
 	attr, err := d.fs.Attr(d.id)
@@ -38,6 +40,8 @@ func (d DirNode) Attr(ctx context.Context, a *bfuse.Attr) error {
 }
 
 func (d DirNode) Lookup(ctx context.Context, name string) (bfs.Node, error) {
+	defer observeOp("lookup", time.Now())
+
 	entries, err := d.fs.DirEntries(d.id)
 	if err != nil {
 		return nil, err
@@ -59,6 +63,8 @@ func (d DirNode) Lookup(ctx context.Context, name string) (bfs.Node, error) {
 }
 
 func (d DirNode) Create(ctx context.Context, req *bfuse.CreateRequest, resp *bfuse.CreateResponse) (bfs.Node, bfs.Handle, error) {
+	defer observeOp("create", time.Now())
+
 	id, err := d.fs.CreateFile(d.id, req.Name) // req.Flags req.Mode
 	if err != nil {
 		return nil, nil, err
@@ -73,6 +79,8 @@ func (d DirNode) Create(ctx context.Context, req *bfuse.CreateRequest, resp *bfu
 }
 
 func (d DirNode) ReadDirAll(ctx context.Context) ([]bfuse.Dirent, error) {
+	defer observeOp("readdir", time.Now())
+
 	entries, err := d.fs.DirEntries(d.id)
 	if err != nil {
 		return nil, err
@@ -92,6 +100,8 @@ func (d DirNode) ReadDirAll(ctx context.Context) ([]bfuse.Dirent, error) {
 }
 
 func (d DirNode) Rename(ctx context.Context, req *bfuse.RenameRequest, newDir bfs.Node) error {
+	defer observeOp("rename", time.Now())
+
 	newdn, ok := newDir.(DirNode)
 	if !ok {
 		return fmt.Errorf("Node for provided target dir is not DirNode!")
@@ -105,6 +115,8 @@ func (d DirNode) Rename(ctx context.Context, req *bfuse.RenameRequest, newDir bf
 }
 
 func (d DirNode) Remove(ctx context.Context, req *bfuse.RemoveRequest) error {
+	defer observeOp("remove", time.Now())
+
 	if err := d.fs.Remove(d.id, req.Name); err != nil {
 		return err
 	}
@@ -113,6 +125,8 @@ func (d DirNode) Remove(ctx context.Context, req *bfuse.RemoveRequest) error {
 }
 
 func (d DirNode) Mkdir(ctx context.Context, req *bfuse.MkdirRequest) (bfs.Node, error) {
+	defer observeOp("mkdir", time.Now())
+
 	id, err := d.fs.CreateDir(d.id, req.Name)
 	if err != nil {
 		return nil, err
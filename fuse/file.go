@@ -26,6 +26,8 @@ type FileNode struct {
 }
 
 func (n FileNode) Attr(ctx context.Context, a *bfuse.Attr) error {
+	defer observeOp("attr", time.Now())
+
 	attr, err := n.fs.Attr(n.id)
 	if err != nil {
 		panic("fs.Attr failed for FileNode")
@@ -71,6 +73,8 @@ func Bazil2OtaruFlags(bf bfuse.OpenFlags) int {
 }
 
 func (n FileNode) Open(ctx context.Context, req *bfuse.OpenRequest, resp *bfuse.OpenResponse) (bfs.Handle, error) {
+	defer observeOp("open", time.Now())
+
 	log.Printf("Open flags: %s", req.Flags.String())
 
 	fh, err := n.fs.OpenFile(n.id, Bazil2OtaruFlags(req.Flags))
@@ -86,6 +90,8 @@ type FileHandle struct {
 }
 
 func (fh FileHandle) Read(ctx context.Context, req *bfuse.ReadRequest, resp *bfuse.ReadResponse) error {
+	defer observeOp("read", time.Now())
+
 	/*
 	     Header:
 	       Conn *Conn     `json:"-"` // connection this request was received on
@@ -114,6 +120,8 @@ func (fh FileHandle) Read(ctx context.Context, req *bfuse.ReadRequest, resp *bfu
 }
 
 func (fh FileHandle) Write(ctx context.Context, req *bfuse.WriteRequest, resp *bfuse.WriteResponse) error {
+	defer observeOp("write", time.Now())
+
 	log.Printf("Write offset %d size %d", req.Offset, len(req.Data))
 
 	if fh.h == nil {
@@ -130,6 +138,8 @@ func (fh FileHandle) Write(ctx context.Context, req *bfuse.WriteRequest, resp *b
 
 // FIXME: move this to FileNode
 func (fh FileHandle) Setattr(ctx context.Context, req *bfuse.SetattrRequest, resp *bfuse.SetattrResponse) error {
+	defer observeOp("setattr", time.Now())
+
 	if fh.h == nil {
 		return EBADF
 	}
@@ -148,6 +158,8 @@ func (fh FileHandle) Setattr(ctx context.Context, req *bfuse.SetattrRequest, res
 }
 
 func (fh FileHandle) Flush(ctx context.Context, req *bfuse.FlushRequest) error {
+	defer observeOp("flush", time.Now())
+
 	if fh.h == nil {
 		return EBADF
 	}
@@ -11,6 +11,8 @@ import (
 	bfs "bazil.org/fuse/fs"
 )
 
+// FileSystem serves otaru.FileSystem over FUSE.
+// FICLONE doesn't reach FUSE filesystems, so clone via /api/fs/clone or "otaru cp" instead.
 type FileSystem struct {
 	ofs *otaru.FileSystem
 }
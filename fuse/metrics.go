@@ -0,0 +1,18 @@
+package fuse
+
+import (
+	"time"
+
+	"github.com/nyaxt/otaru/metrics"
+)
+
+var opDuration = metrics.NewHistogram("otaru_fuse_op_duration_seconds", "Latency of FUSE operations.", nil, "op")
+
+func init() {
+	metrics.Register(opDuration)
+}
+
+// observeOp records the latency of the FUSE op started at start. It is meant to be deferred.
+func observeOp(op string, start time.Time) {
+	opDuration.ObserveSince(start, op)
+}
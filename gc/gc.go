@@ -3,6 +3,8 @@ package gc
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -10,7 +12,14 @@ import (
 	"github.com/nyaxt/otaru/blobstore"
 	"github.com/nyaxt/otaru/inodedb"
 	"github.com/nyaxt/otaru/metadata"
-	"github.com/nyaxt/otaru/util"
+	"github.com/nyaxt/otaru/metrics"
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+const (
+	DefaultGracePeriod = time.Hour
+	DefaultConcurrency = 8
+	DefaultBatchSize   = 64
 )
 
 type GCableBlobStore interface {
@@ -18,77 +27,503 @@ type GCableBlobStore interface {
 	blobstore.BlobRemover
 }
 
-func GC(ctx context.Context, bs GCableBlobStore, idb inodedb.DBFscker, dryrun bool) error {
-	start := time.Now()
+const (
+	PhaseIdle     = "idle"
+	PhaseSnapshot = "snapshot"
+	PhaseList     = "list"
+	PhaseSweep    = "sweep"
+	PhaseDone     = "done"
+)
+
+type Report struct {
+	Running     bool      `json:"running"`
+	DryRun      bool      `json:"dryrun"`
+	Phase       string    `json:"phase"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+
+	// SnapshotVersion is the inodedb version of the blob refs snapshot the run is based on.
+	SnapshotVersion inodedb.TxID `json:"snapshot_version"`
+
+	NumBlobs      int `json:"num_blobs"`
+	NumReferenced int `json:"num_referenced"`
+	// NumUnused is the number of unreferenced blobs found. NumDeferred of them are still in the grace period, and the rest are swept.
+	NumUnused   int `json:"num_unused"`
+	NumDeferred int `json:"num_deferred"`
+
+	NumSwept int `json:"num_swept"`
+	// NumRemoved is the number of blobs removed, or would have been removed on dry run.
+	NumRemoved int `json:"num_removed"`
+	// NumSkipped is the number of blobs which got referenced again after the snapshot, or are pinned.
+	NumSkipped     int   `json:"num_skipped"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+
+	LastError string `json:"last_error"`
+}
+
+// candidate is an unreferenced blob observed by a previous run.
+type candidate struct {
+	firstSeen time.Time
+}
+
+// CandidateStore persists when the unreferenced blobs were first observed, so that their grace periods survive restarts.
+type CandidateStore interface {
+	SaveCandidates(firstSeen map[string]time.Time) error
+	LoadCandidates() (map[string]time.Time, error)
+}
+
+// GC removes blobs which stayed unreferenced from inodedb for the grace period.
+type GC struct {
+	bs  GCableBlobStore
+	idb inodedb.BlobRefsSnapshotter
+
+	externalRefs func() (map[string]struct{}, error)
+	externalPins func() ([]string, error)
+
+	gracePeriod time.Duration
+	concurrency int
+	batchSize   int
 
-	log.Printf("GC start. Dryrun: %t. Listing blobs.", dryrun)
-	allbs, err := bs.ListBlobs()
+	mu         sync.Mutex
+	report     Report
+	candidates map[string]candidate
+	cstore     CandidateStore
+
+	// pins counts PinBlob callers per blob, and removing has the blobs being removed. pinsCond is signaled when a removal completes.
+	pins     map[string]int
+	removing map[string]struct{}
+	pinsCond *sync.Cond
+}
+
+func New(bs GCableBlobStore, idb inodedb.BlobRefsSnapshotter) *GC {
+	g := &GC{
+		bs:          bs,
+		idb:         idb,
+		gracePeriod: DefaultGracePeriod,
+		concurrency: DefaultConcurrency,
+		batchSize:   DefaultBatchSize,
+		report:      Report{Phase: PhaseIdle},
+		candidates:  make(map[string]candidate),
+		pins:        make(map[string]int),
+		removing:    make(map[string]struct{}),
+	}
+	g.pinsCond = sync.NewCond(&g.mu)
+	return g
+}
+
+// PinBlob keeps the blob from being removed until unpin is called, and restarts its grace period.
+func (g *GC) PinBlob(b string) (unpin func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for {
+		if _, ok := g.removing[b]; !ok {
+			break
+		}
+		g.pinsCond.Wait()
+	}
+	g.pins[b]++
+	delete(g.candidates, b)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.pins[b]--; g.pins[b] <= 0 {
+				delete(g.pins, b)
+			}
+		})
+	}
+}
+
+// beginRemoval marks the blob as being removed, unless it is pinned.
+func (g *GC) beginRemoval(b string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pins[b] > 0 {
+		return false
+	}
+	g.removing[b] = struct{}{}
+	return true
+}
+
+func (g *GC) endRemoval(b string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.removing, b)
+	g.pinsCond.Broadcast()
+}
+
+// SetGracePeriod sets how long a blob needs to stay unreferenced before it is removed. 0 removes unreferenced blobs immediately.
+func (g *GC) SetGracePeriod(d time.Duration) { g.gracePeriod = d }
+
+// SetConcurrency sets the number of blobs removed in parallel.
+func (g *GC) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	g.concurrency = n
+}
+
+// SetExternalRefs sets the function to query the blobs referenced from outside idb, e.g. other volumes.
+func (g *GC) SetExternalRefs(f func() (map[string]struct{}, error)) { g.externalRefs = f }
+
+// SetExternalPins sets the function to query the blobpath prefixes which must not be swept at the moment.
+func (g *GC) SetExternalPins(f func() ([]string, error)) { g.externalPins = f }
+
+// SetCandidateStore loads the candidates from cs, and persists the candidates to it after each trace. It must be called before running GC.
+func (g *GC) SetCandidateStore(cs CandidateStore) {
+	firstSeen, err := cs.LoadCandidates()
 	if err != nil {
-		return fmt.Errorf("ListBlobs failed: %v", err)
+		log.Printf("Failed to load GC candidates. Starting with none: %v", err)
+		firstSeen = nil
 	}
-	log.Printf("List blobs done. %d blobs found.", len(allbs))
-	if err := ctx.Err(); err != nil {
-		log.Printf("Detected cancel. Bailing out.")
-		return err
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cstore = cs
+	g.candidates = make(map[string]candidate, len(firstSeen))
+	for b, t := range firstSeen {
+		g.candidates[b] = candidate{firstSeen: t}
 	}
-	log.Printf("Starting INodeDB fsck.")
-	usedbs, errs := idb.Fsck()
-	if len(errs) != 0 {
-		return fmt.Errorf("Fsck returned err: %v", err)
+	log.Printf("Loaded %d GC candidates.", len(firstSeen))
+}
+
+// SaveCandidates persists the candidates found by the last trace to the CandidateStore, if set.
+func (g *GC) SaveCandidates() error {
+	g.mu.Lock()
+	cs := g.cstore
+	firstSeen := make(map[string]time.Time, len(g.candidates))
+	for b, c := range g.candidates {
+		firstSeen[b] = c.firstSeen
 	}
-	log.Printf("Fsck done. %d used blobs found.", len(usedbs))
+	g.mu.Unlock()
+
+	if cs == nil {
+		return nil
+	}
+	return cs.SaveCandidates(firstSeen)
+}
+
+func (g *GC) Report() Report {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.report
+}
+
+func (g *GC) updateReport(f func(r *Report)) {
+	g.mu.Lock()
+	f(&g.report)
+	g.mu.Unlock()
+}
+
+// reportProgress reports the progress of the run to the scheduler job running it, if any.
+func (g *GC) reportProgress(ctx context.Context) {
+	r := g.Report()
+	p := scheduler.Progress{
+		Fraction:       scheduler.UnknownFraction,
+		Message:        r.Phase,
+		BytesProcessed: r.ReclaimedBytes,
+	}
+	switch r.Phase {
+	case PhaseSweep:
+		if n := r.NumUnused - r.NumDeferred; n > 0 {
+			p.Fraction = float64(r.NumSwept) / float64(n)
+			p.Message = fmt.Sprintf("sweep: %d/%d blobs", r.NumSwept, n)
+		}
+	case PhaseDone:
+		p.Fraction = 1
+	}
+	scheduler.ReportProgress(ctx, p)
+}
+
+func (g *GC) fail(err error) error {
+	g.updateReport(func(r *Report) { r.LastError = err.Error() })
+	return err
+}
+
+func (g *GC) Run(ctx context.Context, dryrun bool) error {
+	g.mu.Lock()
+	if g.report.Running {
+		g.mu.Unlock()
+		return fmt.Errorf("GC is already running.")
+	}
+	start := time.Now()
+	g.report = Report{Running: true, DryRun: dryrun, Phase: PhaseSnapshot, StartedAt: start}
+	g.mu.Unlock()
+
+	defer g.updateReport(func(r *Report) { r.Running = false })
+
+	// The snapshot must be taken before listing, so that any blob listed but missing from the snapshot is either unreferenced or newer than the snapshot. The latter is protected by the grace period.
+	log.Printf("GC start. Dryrun: %t. Taking blob refs snapshot.", dryrun)
+	g.reportProgress(ctx)
+	usedbset, version := g.idb.BlobRefsSnapshot()
+	if usedbset == nil {
+		return g.fail(fmt.Errorf("Failed to take blob refs snapshot."))
+	}
+	log.Printf("Blob refs snapshot at version %d: %d used blobs.", version, len(usedbset))
+	if g.externalRefs != nil {
+		extbset, err := g.externalRefs()
+		if err != nil {
+			return g.fail(fmt.Errorf("Failed to query external blob refs: %v", err))
+		}
+		for bp := range extbset {
+			usedbset[bp] = struct{}{}
+		}
+		log.Printf("%d blobs referenced externally. %d used blobs in total.", len(extbset), len(usedbset))
+	}
+	g.updateReport(func(r *Report) {
+		r.Phase = PhaseList
+		r.SnapshotVersion = version
+	})
+	g.reportProgress(ctx)
 	if err := ctx.Err(); err != nil {
 		log.Printf("Detected cancel. Bailing out.")
 		return err
 	}
 
-	log.Printf("Converting used blob list to a hashset")
-	usedbset := make(map[string]struct{})
-	for _, b := range usedbs {
-		usedbset[b] = struct{}{}
+	allbs, err := g.bs.ListBlobs()
+	if err != nil {
+		return g.fail(fmt.Errorf("ListBlobs failed: %v", err))
 	}
-	log.Printf("Convert used blob list to a hashset: Done.")
-
+	log.Printf("List blobs done. %d blobs found.", len(allbs))
 	if err := ctx.Err(); err != nil {
 		log.Printf("Detected cancel. Bailing out.")
 		return err
 	}
 
-	log.Printf("Listing unused blobpaths.")
-	unusedbs := make([]string, 0, util.IntMax(len(allbs)-len(usedbs), 0))
+	now := time.Now()
+	unusedbs := make([]string, 0)
+	numReferenced := 0
+	numDeferred := 0
+
+	g.mu.Lock()
+	prevCandidates := g.candidates
+	g.candidates = make(map[string]candidate)
 	for _, b := range allbs {
 		if _, ok := usedbset[b]; ok {
+			numReferenced++
 			continue
 		}
-
 		if metadata.IsMetadataBlobpath(b) {
-			log.Printf("Marking metadata blobpath as used: %s", b)
 			continue
 		}
 
+		c, ok := prevCandidates[b]
+		if !ok {
+			c = candidate{firstSeen: now}
+		}
+		g.candidates[b] = c
+		if now.Sub(c.firstSeen) < g.gracePeriod {
+			numDeferred++
+			continue
+		}
 		unusedbs = append(unusedbs, b)
 	}
+	g.report.Phase = PhaseSweep
+	g.report.NumBlobs = len(allbs)
+	g.report.NumReferenced = numReferenced
+	g.report.NumUnused = len(unusedbs) + numDeferred
+	g.report.NumDeferred = numDeferred
+	g.mu.Unlock()
+	// A failure only makes the grace periods restart on the next restart, so it doesn't fail the run.
+	if err := g.SaveCandidates(); err != nil {
+		log.Printf("Failed to save GC candidates: %v", err)
+	}
+	g.reportProgress(ctx)
 
 	traceend := time.Now()
-	log.Printf("GC Found %d unused blobpaths. (Trace took %v)", len(unusedbs), traceend.Sub(start))
+	log.Printf("GC Found %d unused blobpaths, %d of them within the grace period. (Trace took %v)", len(unusedbs)+numDeferred, numDeferred, traceend.Sub(start))
 
-	for _, b := range unusedbs {
+	for len(unusedbs) > 0 {
 		if err := ctx.Err(); err != nil {
 			log.Printf("Detected cancel. Bailing out.")
 			return err
 		}
 
-		if dryrun {
-			log.Printf("Dryrun found unused blob: %s", b)
-		} else {
-			log.Printf("Removing unused blob: %s", b)
-			if err := bs.RemoveBlob(b); err != nil {
-				return fmt.Errorf("Removing unused blob \"%s\" failed: %v", b, err)
+		n := g.batchSize
+		if n > len(unusedbs) {
+			n = len(unusedbs)
+		}
+		if err := g.sweepBatch(ctx, unusedbs[:n], dryrun); err != nil {
+			if err == ctx.Err() {
+				log.Printf("Detected cancel. Bailing out.")
+				return err
 			}
+			return g.fail(err)
 		}
+		unusedbs = unusedbs[n:]
+		g.reportProgress(ctx)
 	}
+
 	sweepend := time.Now()
-	log.Printf("GC success. Dryrun: %t. (Sweep took %v. The whole GC took %v.)", dryrun, sweepend.Sub(traceend), sweepend.Sub(start))
+	g.updateReport(func(r *Report) {
+		r.Phase = PhaseDone
+		r.CompletedAt = sweepend
+	})
+	g.reportProgress(ctx)
+	rep := g.Report()
+	log.Printf("GC success. Dryrun: %t. %d blobs removed, %d bytes reclaimed. (Sweep took %v. The whole GC took %v.)", dryrun, rep.NumRemoved, rep.ReclaimedBytes, sweepend.Sub(traceend), sweepend.Sub(start))
+	return nil
+}
 
-	return err
+// sweepBatch removes the blobs in parallel, and returns the first error.
+func (g *GC) sweepBatch(ctx context.Context, bps []string, dryrun bool) error {
+	refcounter, hasRefCounter := g.idb.(inodedb.BlobRefCounter)
+	sizer, hasSizer := g.bs.(blobstore.BlobSizer)
+	isExternallyUsed, err := g.queryExternalUse()
+	if err != nil {
+		return err
+	}
+
+	bpC := make(chan string)
+	errC := make(chan error, len(bps))
+	var wg sync.WaitGroup
+	for i := 0; i < g.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range bpC {
+				if ctx.Err() != nil {
+					continue
+				}
+				errC <- g.sweepBlob(b, dryrun, refcounter, hasRefCounter, sizer, hasSizer, isExternallyUsed)
+			}
+		}()
+	}
+	for _, b := range bps {
+		bpC <- b
+	}
+	close(bpC)
+	wg.Wait()
+	close(errC)
+
+	for err := range errC {
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// queryExternalUse queries the external refs and pins anew, and returns a func which tells if the blob is in use outside idb.
+func (g *GC) queryExternalUse() (func(b string) bool, error) {
+	var extbset map[string]struct{}
+	if g.externalRefs != nil {
+		var err error
+		if extbset, err = g.externalRefs(); err != nil {
+			return nil, fmt.Errorf("Failed to query external blob refs: %v", err)
+		}
+	}
+	var pins []string
+	if g.externalPins != nil {
+		var err error
+		if pins, err = g.externalPins(); err != nil {
+			return nil, fmt.Errorf("Failed to query external blob pins: %v", err)
+		}
+	}
+	return func(b string) bool {
+		if _, ok := extbset[b]; ok {
+			return true
+		}
+		for _, prefix := range pins {
+			if strings.HasPrefix(b, prefix) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (g *GC) skipBlob(b string) {
+	g.mu.Lock()
+	delete(g.candidates, b)
+	g.report.NumSkipped++
+	g.mu.Unlock()
+}
+
+func (g *GC) sweepBlob(b string, dryrun bool, refcounter inodedb.BlobRefCounter, hasRefCounter bool, sizer blobstore.BlobSizer, hasSizer bool, isExternallyUsed func(b string) bool) error {
+	defer g.updateReport(func(r *Report) { r.NumSwept++ })
+
+	if !g.beginRemoval(b) {
+		log.Printf("Skipping blob \"%s\" which is pinned.", b)
+		g.skipBlob(b)
+		return nil
+	}
+	defer g.endRemoval(b)
+
+	// Dedup chunks may have been referenced again by a file written after the snapshot.
+	if hasRefCounter {
+		if n := refcounter.BlobRefCount(b); n > 0 {
+			log.Printf("Skipping blob \"%s\" which is now referenced by %d file chunks.", b, n)
+			g.skipBlob(b)
+			return nil
+		}
+	}
+	// ... or by another volume.
+	if isExternallyUsed(b) {
+		log.Printf("Skipping blob \"%s\" which is now used outside this volume.", b)
+		g.skipBlob(b)
+		return nil
+	}
+
+	var size int64
+	if hasSizer {
+		var err error
+		if size, err = sizer.BlobSize(b); err != nil {
+			log.Printf("Failed to query size of blob \"%s\": %v", b, err)
+			size = 0
+		}
+	}
+
+	if dryrun {
+		log.Printf("Dryrun found unused blob: %s", b)
+	} else {
+		log.Printf("Removing unused blob: %s", b)
+		if err := g.bs.RemoveBlob(b); err != nil {
+			return fmt.Errorf("Removing unused blob \"%s\" failed: %v", b, err)
+		}
+	}
+
+	g.mu.Lock()
+	if !dryrun {
+		delete(g.candidates, b)
+	}
+	g.report.NumRemoved++
+	g.report.ReclaimedBytes += size
+	g.mu.Unlock()
+	return nil
+}
+
+// Metrics returns gauges of the last GC run, to be registered by the owner of the GC.
+func (g *GC) Metrics() []metrics.Metric {
+	gauge := func(name, help string, f func(r Report) float64) metrics.Metric {
+		return metrics.NewGaugeFunc(name, help, func() float64 { return f(g.Report()) })
+	}
+	return []metrics.Metric{
+		gauge("otaru_gc_running", "1 if GC is running.", func(r Report) float64 {
+			if r.Running {
+				return 1
+			}
+			return 0
+		}),
+		gauge("otaru_gc_last_completion_timestamp_seconds", "Unix time the last successful GC run completed.", func(r Report) float64 {
+			if r.CompletedAt.IsZero() {
+				return 0
+			}
+			return float64(r.CompletedAt.Unix())
+		}),
+		gauge("otaru_gc_last_unused_blobs", "Number of unreferenced blobs found by the last GC run.", func(r Report) float64 { return float64(r.NumUnused) }),
+		gauge("otaru_gc_last_removed_blobs", "Number of blobs removed by the last GC run.", func(r Report) float64 { return float64(r.NumRemoved) }),
+		gauge("otaru_gc_last_reclaimed_bytes", "Bytes reclaimed by the last GC run.", func(r Report) float64 { return float64(r.ReclaimedBytes) }),
+		gauge("otaru_gc_last_failed", "1 if the last GC run failed.", func(r Report) float64 {
+			if r.LastError != "" {
+				return 1
+			}
+			return 0
+		}),
+	}
 }
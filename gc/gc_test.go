@@ -1,15 +1,21 @@
 package gc_test
 
 import (
+	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nyaxt/otaru/gc"
+	"github.com/nyaxt/otaru/inodedb"
 
 	"golang.org/x/net/context"
 )
 
 type MockGCBlobStore struct {
+	mu        sync.Mutex
 	bs        []string
 	removedbs []string
 }
@@ -18,31 +24,59 @@ var _ = gc.GCableBlobStore(&MockGCBlobStore{})
 
 func (bs *MockGCBlobStore) ListBlobs() ([]string, error) { return bs.bs, nil }
 func (bs *MockGCBlobStore) RemoveBlob(b string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
 	bs.removedbs = append(bs.removedbs, b)
 	return nil
 }
+func (bs *MockGCBlobStore) BlobSize(b string) (int64, error) { return int64(len(b)), nil }
 
-type MockFscker struct {
+func (bs *MockGCBlobStore) Removed() []string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	ret := append([]string{}, bs.removedbs...)
+	sort.Strings(ret)
+	return ret
+}
+
+type MockSnapshotter struct {
 	usedbs []string
 }
 
-func (idb *MockFscker) Fsck() ([]string, []error) { return idb.usedbs, nil }
+func (idb *MockSnapshotter) BlobRefsSnapshot() (map[string]struct{}, inodedb.TxID) {
+	refs := make(map[string]struct{})
+	for _, b := range idb.usedbs {
+		refs[b] = struct{}{}
+	}
+	return refs, 123
+}
+
+func newGC(bs gc.GCableBlobStore, idb inodedb.BlobRefsSnapshotter) *gc.GC {
+	g := gc.New(bs, idb)
+	g.SetGracePeriod(0)
+	return g
+}
 
 func TestGC_Basic(t *testing.T) {
 	bs := &MockGCBlobStore{
-		bs:        []string{"a", "b", "x", "y", "z", "META_INODEDB_SNAPSHOT"},
+		bs:        []string{"a", "bb", "x", "y", "z", "META_INODEDB_SNAPSHOT"},
 		removedbs: []string{},
 	}
-	idb := &MockFscker{
+	idb := &MockSnapshotter{
 		usedbs: []string{"x", "y", "z"},
 	}
 
-	if err := gc.GC(context.TODO(), bs, idb, false); err != nil {
+	g := newGC(bs, idb)
+	if err := g.Run(context.TODO(), false); err != nil {
 		t.Errorf("GC err: %v", err)
 	}
 
-	if !reflect.DeepEqual([]string{"a", "b"}, bs.removedbs) {
-		t.Errorf("GC removed unexpected blobs: %v", bs.removedbs)
+	if !reflect.DeepEqual([]string{"a", "bb"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	r := g.Report()
+	if r.Running || r.Phase != gc.PhaseDone || r.SnapshotVersion != 123 || r.NumBlobs != 6 || r.NumReferenced != 3 || r.NumUnused != 2 || r.NumSwept != 2 || r.NumRemoved != 2 || r.ReclaimedBytes != 3 {
+		t.Errorf("Unexpected report: %+v", r)
 	}
 }
 
@@ -51,15 +85,332 @@ func TestGC_EmptyRun(t *testing.T) {
 		bs:        []string{"x", "y", "z"},
 		removedbs: []string{},
 	}
-	idb := &MockFscker{
+	idb := &MockSnapshotter{
 		usedbs: []string{"x", "y", "z"},
 	}
 
 	// vvv should not panic.
-	if err := gc.GC(context.TODO(), bs, idb, false); err != nil {
+	if err := newGC(bs, idb).Run(context.TODO(), false); err != nil {
 		t.Errorf("GC err: %v", err)
 	}
 	if len(bs.removedbs) > 0 {
 		t.Errorf("GC removed unexpected blobs: %v", bs.removedbs)
 	}
 }
+
+func TestGC_ExternalRefs(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "b", "x", "y"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{
+		usedbs: []string{"x"},
+	}
+
+	g := newGC(bs, idb)
+	g.SetExternalRefs(func() (map[string]struct{}, error) {
+		return nil, fmt.Errorf("other volume unavailable")
+	})
+	if err := g.Run(context.TODO(), false); err == nil {
+		t.Errorf("GC should fail if external refs are unavailable")
+	}
+	if len(bs.removedbs) > 0 {
+		t.Errorf("GC removed blobs without external refs: %v", bs.removedbs)
+	}
+
+	g.SetExternalRefs(func() (map[string]struct{}, error) {
+		return map[string]struct{}{"b": struct{}{}, "y": struct{}{}}, nil
+	})
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumReferenced != 3 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestGC_ExternalRefsRequeriedBeforeSweep(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "dedup_b", "dedup_c", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{
+		usedbs: []string{"x"},
+	}
+
+	g := newGC(bs, idb)
+	nquery := 0
+	g.SetExternalRefs(func() (map[string]struct{}, error) {
+		nquery++
+		if nquery == 1 {
+			return map[string]struct{}{}, nil
+		}
+		// Another volume started referencing the blob after the trace.
+		return map[string]struct{}{"dedup_b": struct{}{}}, nil
+	})
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a", "dedup_c"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumSkipped != 1 || r.NumRemoved != 2 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestGC_ExternalPins(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "dedup_b", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{
+		usedbs: []string{"x"},
+	}
+
+	g := newGC(bs, idb)
+	g.SetExternalPins(func() ([]string, error) {
+		return nil, fmt.Errorf("writer lock unavailable")
+	})
+	if err := g.Run(context.TODO(), false); err == nil {
+		t.Errorf("GC should fail if external pins are unavailable")
+	}
+	if len(bs.removedbs) > 0 {
+		t.Errorf("GC removed blobs without external pins: %v", bs.removedbs)
+	}
+
+	g.SetExternalPins(func() ([]string, error) {
+		return []string{"dedup_"}, nil
+	})
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumSkipped != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+type MockRefCountingSnapshotter struct {
+	MockSnapshotter
+	refcounts map[string]int
+}
+
+func (idb *MockRefCountingSnapshotter) BlobRefCount(b string) int { return idb.refcounts[b] }
+
+func TestGC_SkipsReferencedBlobs(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "b", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockRefCountingSnapshotter{
+		MockSnapshotter: MockSnapshotter{usedbs: []string{"x"}},
+		refcounts:       map[string]int{"b": 1},
+	}
+
+	g := newGC(bs, idb)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumSkipped != 1 || r.NumRemoved != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestGC_ParallelBatches(t *testing.T) {
+	bs := &MockGCBlobStore{removedbs: []string{}}
+	expected := []string{}
+	for i := 0; i < 200; i++ {
+		b := fmt.Sprintf("b%03d", i)
+		bs.bs = append(bs.bs, b)
+		expected = append(expected, b)
+	}
+	sort.Strings(expected)
+
+	g := newGC(bs, &MockSnapshotter{})
+	g.SetConcurrency(4)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual(expected, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumRemoved != 200 || r.ReclaimedBytes != 800 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestGC_GracePeriod(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{usedbs: []string{"x"}}
+
+	g := gc.New(bs, idb)
+	g.SetGracePeriod(50 * time.Millisecond)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if len(bs.removedbs) > 0 {
+		t.Errorf("GC removed blobs within grace period: %v", bs.removedbs)
+	}
+	if r := g.Report(); r.NumUnused != 1 || r.NumDeferred != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+
+	// "b" shows up later, so it gets its own grace period.
+	bs.bs = append(bs.bs, "b")
+	time.Sleep(60 * time.Millisecond)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumUnused != 2 || r.NumDeferred != 1 || r.NumRemoved != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestGC_PinBlob(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "b", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{usedbs: []string{"x"}}
+
+	g := gc.New(bs, idb)
+	g.SetGracePeriod(50 * time.Millisecond)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	// Pinning restarts the grace period.
+	g.PinBlob("a")()
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"b"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+
+	bs.bs = []string{"a", "x"}
+
+	// Pinned blobs aren't removed even past the grace period.
+	g.SetGracePeriod(0)
+	unpin := g.PinBlob("a")
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"b"}, bs.Removed()) {
+		t.Errorf("GC removed pinned blob: %v", bs.Removed())
+	}
+	if r := g.Report(); r.NumSkipped != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+	unpin()
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a", "b"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+}
+
+type MemCandidateStore struct {
+	firstSeen map[string]time.Time
+}
+
+func (cs *MemCandidateStore) SaveCandidates(firstSeen map[string]time.Time) error {
+	cs.firstSeen = firstSeen
+	return nil
+}
+
+func (cs *MemCandidateStore) LoadCandidates() (map[string]time.Time, error) {
+	return cs.firstSeen, nil
+}
+
+func TestGC_GracePeriodSurvivesRestart(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{usedbs: []string{"x"}}
+	cs := &MemCandidateStore{}
+
+	g := gc.New(bs, idb)
+	g.SetGracePeriod(50 * time.Millisecond)
+	g.SetCandidateStore(cs)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if len(bs.removedbs) > 0 || len(cs.firstSeen) != 1 {
+		t.Errorf("Unexpected state after first run. removed: %v, candidates: %v", bs.removedbs, cs.firstSeen)
+	}
+
+	// A new GC, as after a restart, sweeps "a" on its first run once the grace period passed.
+	time.Sleep(60 * time.Millisecond)
+	g = gc.New(bs, idb)
+	g.SetGracePeriod(50 * time.Millisecond)
+	g.SetCandidateStore(cs)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a"}, bs.Removed()) {
+		t.Errorf("GC removed unexpected blobs: %v", bs.Removed())
+	}
+}
+
+type UnreadableCandidateStore struct {
+	MemCandidateStore
+}
+
+func (cs *UnreadableCandidateStore) LoadCandidates() (map[string]time.Time, error) {
+	return nil, fmt.Errorf("unreadable")
+}
+
+func TestGC_UnreadableCandidateStore(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "x"},
+		removedbs: []string{},
+	}
+	idb := &MockSnapshotter{usedbs: []string{"x"}}
+	cs := &UnreadableCandidateStore{}
+
+	g := gc.New(bs, idb)
+	g.SetGracePeriod(time.Hour)
+	g.SetCandidateStore(cs)
+	if err := g.Run(context.TODO(), false); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if len(bs.removedbs) > 0 || len(cs.firstSeen) != 1 {
+		t.Errorf("GC should start over with the candidates. removed: %v, candidates: %v", bs.removedbs, cs.firstSeen)
+	}
+}
+
+func TestGC_DryRun(t *testing.T) {
+	bs := &MockGCBlobStore{
+		bs:        []string{"a", "x"},
+		removedbs: []string{},
+	}
+	g := newGC(bs, &MockSnapshotter{usedbs: []string{"x"}})
+	if err := g.Run(context.TODO(), true); err != nil {
+		t.Errorf("GC err: %v", err)
+	}
+	if len(bs.removedbs) > 0 {
+		t.Errorf("Dryrun GC removed blobs: %v", bs.removedbs)
+	}
+	if r := g.Report(); !r.DryRun || r.NumRemoved != 1 || r.ReclaimedBytes != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
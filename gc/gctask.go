@@ -3,17 +3,36 @@ package gc
 import (
 	"golang.org/x/net/context"
 
-	"github.com/nyaxt/otaru/inodedb"
 	"github.com/nyaxt/otaru/scheduler"
 )
 
 type GCTask struct {
-	BS     GCableBlobStore
-	IDB    inodedb.DBFscker
+	G      *GC
 	DryRun bool
 }
 
+const (
+	TaskType = "gc"
+	Pool     = "gc"
+)
+
+var _ = scheduler.PersistentTask(&GCTask{})
+var _ = scheduler.JobOptionsProvider(&GCTask{})
+
+func (t *GCTask) TaskType() string { return TaskType }
+
+func (t *GCTask) Params() string {
+	if t.DryRun {
+		return "dryrun"
+	}
+	return ""
+}
+
+func (t *GCTask) JobOptions() scheduler.JobOptions {
+	return scheduler.JobOptions{Priority: scheduler.PriorityLow, Pool: Pool, PoolLimit: 1}
+}
+
 func (t *GCTask) Run(ctx context.Context) scheduler.Result {
-	err := GC(ctx, t.BS, t.IDB, t.DryRun)
+	err := t.G.Run(ctx, t.DryRun)
 	return scheduler.ErrorResult{err}
 }
@@ -106,3 +106,23 @@ type QueryRecentTransactionsProvider interface {
 type DBFscker interface {
 	Fsck() ([]string, []error)
 }
+
+type BlobRefCounter interface {
+	// BlobRefCount returns the number of file chunks, among files reachable from a directory, which reference the blobpath.
+	BlobRefCount(blobpath string) int
+}
+
+type ChunkRefCounter interface {
+	// ChunkRefCount returns the number of file chunks, among all files including the ones removed, which reference the blobpath.
+	ChunkRefCount(blobpath string) int
+}
+
+type SubtreeQuerier interface {
+	// QuerySubtree returns read-only snapshots of id and the nodes reachable from it, all at a single db version.
+	QuerySubtree(id ID) (map[ID]NodeView, error)
+}
+
+type BlobRefsSnapshotter interface {
+	// BlobRefsSnapshot returns a copy of the set of blobpaths referenced by file chunks reachable from a directory, along with the db version it reflects.
+	BlobRefsSnapshot() (map[string]struct{}, TxID)
+}
@@ -0,0 +1,115 @@
+package inodedb
+
+// Blob reference counts are rebuilt from nodes on restore, and aren't serialized into snapshots.
+// A FileChunk references its blob only while its FileNode is linked, whereas chunk reference counts include unlinked FileNodes.
+
+func (s *DBState) rebuildBlobRefs() {
+	s.nlinks = make(map[ID]int)
+	s.blobRefs = make(map[string]int)
+	s.chunkRefs = make(map[string]int)
+
+	for _, n := range s.nodes {
+		dn, ok := n.(*DirNode)
+		if !ok {
+			continue
+		}
+		for _, id := range dn.Entries {
+			s.nlinks[id]++
+		}
+	}
+	for id, n := range s.nodes {
+		fn, ok := n.(*FileNode)
+		if !ok {
+			continue
+		}
+		if s.nlinks[id] > 0 {
+			s.addBlobRefs(fn.Chunks)
+		}
+		addRefs(s.chunkRefs, fn.Chunks)
+	}
+}
+
+func addRefs(refs map[string]int, cs []FileChunk) {
+	for _, fc := range cs {
+		refs[fc.BlobPath]++
+	}
+}
+
+func releaseRefs(refs map[string]int, cs []FileChunk) {
+	for _, fc := range cs {
+		n := refs[fc.BlobPath] - 1
+		if n <= 0 {
+			delete(refs, fc.BlobPath)
+		} else {
+			refs[fc.BlobPath] = n
+		}
+	}
+}
+
+func (s *DBState) addBlobRefs(cs []FileChunk)     { addRefs(s.blobRefs, cs) }
+func (s *DBState) releaseBlobRefs(cs []FileChunk) { releaseRefs(s.blobRefs, cs) }
+
+// updateChunkRefs must be called when the chunks of a FileNode are replaced.
+func (s *DBState) updateChunkRefs(oldcs, newcs []FileChunk) {
+	releaseRefs(s.chunkRefs, oldcs)
+	addRefs(s.chunkRefs, newcs)
+}
+
+// link must be called when a new directory entry pointing to id is added.
+func (s *DBState) link(id ID) {
+	s.nlinks[id]++
+	if s.nlinks[id] != 1 {
+		return
+	}
+	if fn, ok := s.nodes[id].(*FileNode); ok {
+		s.addBlobRefs(fn.Chunks)
+	}
+}
+
+// unlink must be called when a directory entry pointing to id is removed.
+func (s *DBState) unlink(id ID) {
+	n := s.nlinks[id] - 1
+	if n > 0 {
+		s.nlinks[id] = n
+		return
+	}
+	delete(s.nlinks, id)
+	if fn, ok := s.nodes[id].(*FileNode); ok {
+		s.releaseBlobRefs(fn.Chunks)
+	}
+}
+
+func (s *DBState) isLinked(id ID) bool {
+	return s.nlinks[id] > 0
+}
+
+func (s *DBState) BlobRefCount(blobpath string) int {
+	return s.blobRefs[blobpath]
+}
+
+func (s *DBState) ChunkRefCount(blobpath string) int {
+	return s.chunkRefs[blobpath]
+}
+
+var _ = BlobRefCounter(&DB{})
+
+func (db *DB) BlobRefCount(blobpath string) int {
+	return db.state.BlobRefCount(blobpath)
+}
+
+var _ = ChunkRefCounter(&DB{})
+
+func (db *DB) ChunkRefCount(blobpath string) int {
+	return db.state.ChunkRefCount(blobpath)
+}
+
+var _ = BlobRefsSnapshotter(&DB{})
+
+// BlobRefsSnapshot copies the blob reference counts without walking the tree.
+func (db *DB) BlobRefsSnapshot() (map[string]struct{}, TxID) {
+	refs := make(map[string]struct{}, len(db.state.blobRefs))
+	for bp := range db.state.blobRefs {
+		refs[bp] = struct{}{}
+	}
+	return refs, db.state.version
+}
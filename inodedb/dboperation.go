@@ -107,6 +107,7 @@ func (op *HardLinkOp) Apply(s *DBState) error {
 		return EEXIST
 	}
 	dn.Entries[op.Name] = op.TargetID
+	s.link(op.TargetID)
 
 	return nil
 }
@@ -131,6 +132,11 @@ func (op *UpdateChunksOp) Apply(s *DBState) error {
 		return fmt.Errorf("UpdateChunksOp specified node was not file node but was type: %d", n.GetType())
 	}
 
+	if s.isLinked(op.ID) {
+		s.releaseBlobRefs(fn.Chunks)
+		s.addBlobRefs(op.Chunks)
+	}
+	s.updateChunkRefs(fn.Chunks, op.Chunks)
 	fn.Chunks = op.Chunks // FIXME: not sure if need clone?
 	return nil
 }
@@ -211,6 +217,8 @@ type RemoveOp struct {
 	OpMeta   `json:",inline"`
 	NodeLock `json:"nodelock"`
 	Name     string `json:"name"`
+	// SkipEmptyCheck allows removing an entry to a non-empty directory. Used by fsck repair to drop entries forming a cycle, and to move directories to and from the trash.
+	SkipEmptyCheck bool `json:"skipemptycheck,omitempty"`
 }
 
 func (op *RemoveOp) Apply(s *DBState) error {
@@ -231,7 +239,7 @@ func (op *RemoveOp) Apply(s *DBState) error {
 	if !ok {
 		return ENOENT
 	}
-	if tgtnode, ok := s.nodes[tgtid]; ok {
+	if tgtnode, ok := s.nodes[tgtid]; ok && !op.SkipEmptyCheck {
 		if tgtdirnode, ok := tgtnode.(*DirNode); ok {
 			if len(tgtdirnode.Entries) != 0 {
 				return ENOTEMPTY
@@ -240,5 +248,6 @@ func (op *RemoveOp) Apply(s *DBState) error {
 	}
 
 	delete(dn.Entries, op.Name)
+	s.unlink(tgtid)
 	return nil
 }
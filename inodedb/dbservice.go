@@ -3,6 +3,7 @@ package inodedb
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/nyaxt/otaru/util"
 )
@@ -55,6 +56,54 @@ type DBFsckRequest struct {
 	resultC chan fsckResult
 }
 
+type checkResult struct {
+	report *FsckReport
+	err    error
+}
+
+type DBCheckRequest struct {
+	repair  bool
+	resultC chan checkResult
+}
+
+type DBCheckSnapshotRequest struct {
+	resultC chan *DBState
+}
+
+type blobRefsSnapshotResult struct {
+	refs    map[string]struct{}
+	version TxID
+}
+
+type DBBlobRefsSnapshotRequest struct {
+	resultC chan blobRefsSnapshotResult
+}
+
+type querySubtreeResult struct {
+	views map[ID]NodeView
+	err   error
+}
+
+type DBQuerySubtreeRequest struct {
+	id      ID
+	resultC chan querySubtreeResult
+}
+
+type DBBlobRefCountRequest struct {
+	blobpath string
+	resultC  chan int
+}
+
+type DBChunkRefCountRequest struct {
+	blobpath string
+	resultC  chan int
+}
+
+type DBFenceRequest struct {
+	err     error
+	resultC chan struct{}
+}
+
 // DBService serializes requests to DBHandler
 type DBService struct {
 	reqC    chan interface{}
@@ -62,6 +111,9 @@ type DBService struct {
 	exitedC chan struct{}
 
 	h DBHandler
+
+	// fenceErr is returned for transactions and syncs once set. Only accessed from run().
+	fenceErr error
 }
 
 var _ = DBHandler(&DBService{})
@@ -80,17 +132,34 @@ func NewDBService(h DBHandler) *DBService {
 	return s
 }
 
+// enqueue passes req to the service goroutine, counting it in the queue depth while it waits.
+func (srv *DBService) enqueue(req interface{}) {
+	requestQueue.Inc()
+	srv.reqC <- req
+	requestQueue.Dec()
+}
+
 func (srv *DBService) run() {
 	for {
 		select {
 		case req := <-srv.reqC:
+			requestsHandled.Inc()
 			switch req.(type) {
 			case *DBTransactionRequest:
 				req := req.(*DBTransactionRequest)
+				if srv.fenceErr != nil {
+					txErrors.Inc()
+					req.resultC <- srv.fenceErr
+					break
+				}
+				start := time.Now()
 				txid, err := srv.h.ApplyTransaction(req.tx)
+				txDuration.ObserveSince(start)
 				if err != nil {
+					txErrors.Inc()
 					req.resultC <- err
 				} else {
+					txsApplied.Inc()
 					req.resultC <- txid
 				}
 			case *DBQueryNodeRequest:
@@ -111,7 +180,9 @@ func (srv *DBService) run() {
 				req.resultC <- err
 			case *DBSyncRequest:
 				req := req.(*DBSyncRequest)
-				if s, ok := srv.h.(util.Syncer); ok {
+				if srv.fenceErr != nil {
+					req.resultC <- srv.fenceErr
+				} else if s, ok := srv.h.(util.Syncer); ok {
 					req.resultC <- s.Sync()
 				} else {
 					req.resultC <- nil
@@ -143,6 +214,55 @@ func (srv *DBService) run() {
 				} else {
 					req.resultC <- fsckResult{nil, []error{fmt.Errorf("DBHandler doesn't support Fsck")}}
 				}
+			case *DBCheckRequest:
+				req := req.(*DBCheckRequest)
+				if prov, ok := srv.h.(DBChecker); ok {
+					r, err := prov.Check(req.repair)
+					req.resultC <- checkResult{r, err}
+				} else {
+					req.resultC <- checkResult{nil, fmt.Errorf("DBHandler doesn't support Check")}
+				}
+			case *DBCheckSnapshotRequest:
+				req := req.(*DBCheckSnapshotRequest)
+				if prov, ok := srv.h.(checkSnapshotter); ok {
+					req.resultC <- prov.snapshotForCheck()
+				} else {
+					req.resultC <- nil
+				}
+			case *DBBlobRefsSnapshotRequest:
+				req := req.(*DBBlobRefsSnapshotRequest)
+				if prov, ok := srv.h.(BlobRefsSnapshotter); ok {
+					refs, version := prov.BlobRefsSnapshot()
+					req.resultC <- blobRefsSnapshotResult{refs, version}
+				} else {
+					req.resultC <- blobRefsSnapshotResult{nil, 0}
+				}
+			case *DBBlobRefCountRequest:
+				req := req.(*DBBlobRefCountRequest)
+				if prov, ok := srv.h.(BlobRefCounter); ok {
+					req.resultC <- prov.BlobRefCount(req.blobpath)
+				} else {
+					req.resultC <- 0
+				}
+			case *DBChunkRefCountRequest:
+				req := req.(*DBChunkRefCountRequest)
+				if prov, ok := srv.h.(ChunkRefCounter); ok {
+					req.resultC <- prov.ChunkRefCount(req.blobpath)
+				} else {
+					req.resultC <- 0
+				}
+			case *DBQuerySubtreeRequest:
+				req := req.(*DBQuerySubtreeRequest)
+				if prov, ok := srv.h.(SubtreeQuerier); ok {
+					views, err := prov.QuerySubtree(req.id)
+					req.resultC <- querySubtreeResult{views, err}
+				} else {
+					req.resultC <- querySubtreeResult{nil, fmt.Errorf("DBHandler doesn't support QuerySubtree")}
+				}
+			case *DBFenceRequest:
+				req := req.(*DBFenceRequest)
+				srv.fenceErr = req.err
+				req.resultC <- struct{}{}
 			default:
 				log.Printf("unknown request passed to DBService: %v", req)
 			}
@@ -154,6 +274,13 @@ func (srv *DBService) run() {
 	}
 }
 
+// Fence makes the service fail all following transactions and syncs with err.
+func (srv *DBService) Fence(err error) {
+	req := &DBFenceRequest{err: err, resultC: make(chan struct{})}
+	srv.enqueue(req)
+	<-req.resultC
+}
+
 func (srv *DBService) Quit() {
 	srv.quitC <- struct{}{}
 	<-srv.exitedC
@@ -161,7 +288,7 @@ func (srv *DBService) Quit() {
 
 func (srv *DBService) ApplyTransaction(tx DBTransaction) (TxID, error) {
 	req := &DBTransactionRequest{tx: tx, resultC: make(chan interface{})}
-	srv.reqC <- req
+	srv.enqueue(req)
 	res := <-req.resultC
 	if txid, ok := res.(TxID); ok {
 		return txid, nil
@@ -171,14 +298,14 @@ func (srv *DBService) ApplyTransaction(tx DBTransaction) (TxID, error) {
 
 func (srv *DBService) QueryNode(id ID, tryLock bool) (NodeView, NodeLock, error) {
 	req := &DBQueryNodeRequest{id: id, tryLock: tryLock, resultC: make(chan queryNodeResult)}
-	srv.reqC <- req
+	srv.enqueue(req)
 	res := <-req.resultC
 	return res.v, res.nlock, res.err
 }
 
 func (srv *DBService) LockNode(id ID) (NodeLock, error) {
 	req := &DBLockNodeRequest{id: id, resultC: make(chan interface{})}
-	srv.reqC <- req
+	srv.enqueue(req)
 	res := <-req.resultC
 	if nlock, ok := res.(NodeLock); ok {
 		return nlock, nil
@@ -188,25 +315,25 @@ func (srv *DBService) LockNode(id ID) (NodeLock, error) {
 
 func (srv *DBService) UnlockNode(nlock NodeLock) error {
 	req := &DBUnlockNodeRequest{nlock: nlock, resultC: make(chan error)}
-	srv.reqC <- req
+	srv.enqueue(req)
 	return <-req.resultC
 }
 
 func (srv *DBService) Sync() error {
 	req := &DBSyncRequest{resultC: make(chan error)}
-	srv.reqC <- req
+	srv.enqueue(req)
 	return <-req.resultC
 }
 
 func (srv *DBService) GetStats() DBServiceStats {
 	req := &DBStatRequest{resultC: make(chan DBServiceStats)}
-	srv.reqC <- req
+	srv.enqueue(req)
 	return <-req.resultC
 }
 
 func (srv *DBService) QueryRecentTransactions() ([]DBTransaction, error) {
 	req := &DBQueryRecentTransactionsRequest{resultC: make(chan interface{})}
-	srv.reqC <- req
+	srv.enqueue(req)
 	res := <-req.resultC
 	if err, ok := res.(error); ok {
 		return nil, err
@@ -216,7 +343,59 @@ func (srv *DBService) QueryRecentTransactions() ([]DBTransaction, error) {
 
 func (srv *DBService) Fsck() ([]string, []error) {
 	req := &DBFsckRequest{resultC: make(chan fsckResult)}
-	srv.reqC <- req
+	srv.enqueue(req)
 	res := <-req.resultC
 	return res.FoundBlobPaths, res.Errs
 }
+
+var _ = DBChecker(&DBService{})
+
+// Check inspects a copy of the db state outside the service loop, and applies repairs in the loop.
+func (srv *DBService) Check(repair bool) (*FsckReport, error) {
+	if !repair {
+		sreq := &DBCheckSnapshotRequest{resultC: make(chan *DBState)}
+		srv.enqueue(sreq)
+		if s := <-sreq.resultC; s != nil {
+			return s.checkOnly(), nil
+		}
+	}
+
+	req := &DBCheckRequest{repair: repair, resultC: make(chan checkResult)}
+	srv.enqueue(req)
+	res := <-req.resultC
+	return res.report, res.err
+}
+
+var _ = BlobRefsSnapshotter(&DBService{})
+
+func (srv *DBService) BlobRefsSnapshot() (map[string]struct{}, TxID) {
+	req := &DBBlobRefsSnapshotRequest{resultC: make(chan blobRefsSnapshotResult)}
+	srv.enqueue(req)
+	res := <-req.resultC
+	return res.refs, res.version
+}
+
+var _ = BlobRefCounter(&DBService{})
+
+func (srv *DBService) BlobRefCount(blobpath string) int {
+	req := &DBBlobRefCountRequest{blobpath: blobpath, resultC: make(chan int)}
+	srv.enqueue(req)
+	return <-req.resultC
+}
+
+var _ = ChunkRefCounter(&DBService{})
+
+func (srv *DBService) ChunkRefCount(blobpath string) int {
+	req := &DBChunkRefCountRequest{blobpath: blobpath, resultC: make(chan int)}
+	srv.enqueue(req)
+	return <-req.resultC
+}
+
+var _ = SubtreeQuerier(&DBService{})
+
+func (srv *DBService) QuerySubtree(id ID) (map[ID]NodeView, error) {
+	req := &DBQuerySubtreeRequest{id: id, resultC: make(chan querySubtreeResult)}
+	srv.enqueue(req)
+	res := <-req.resultC
+	return res.views, res.err
+}
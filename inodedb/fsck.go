@@ -0,0 +1,460 @@
+package inodedb
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// LostFoundName is the name of the directory under root where fsck repair relinks orphaned subtrees.
+const LostFoundName = "lost+found"
+
+const (
+	FsckDanglingEntry   = "dangling_entry"
+	FsckDirCycle        = "dir_cycle"
+	FsckOrphan          = "orphan"
+	FsckTypeMismatch    = "type_mismatch"
+	FsckChunkOverlap    = "chunk_overlap"
+	FsckChunkGap        = "chunk_gap"
+	FsckChunkBeyondSize = "chunk_beyond_size"
+	FsckStaleLock       = "stale_lock"
+	FsckBlobRefMismatch = "blob_ref_mismatch"
+)
+
+const (
+	FsckError   = "error"
+	FsckWarning = "warning"
+)
+
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	NodeID   ID     `json:"node_id"`
+	// Name is the directory entry name for entry issues.
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description"`
+
+	// Repairable is set if repair mode knows how to fix the issue, and Repaired is set once it did.
+	Repairable bool `json:"repairable"`
+	Repaired   bool `json:"repaired"`
+}
+
+type FsckReport struct {
+	NumNodes     int `json:"num_nodes"`
+	NumReachable int `json:"num_reachable"`
+	// NumUnlinked is the number of nodes no longer linked from any directory, e.g. removed files. They are expected, and aren't reported as issues.
+	NumUnlinked int `json:"num_unlinked"`
+	// NumSharedBlobs is the number of blobs referenced by multiple file chunks, e.g. by clones or deduplicated contents.
+	NumSharedBlobs int `json:"num_shared_blobs"`
+
+	Issues []FsckIssue `json:"issues"`
+
+	// RepairTxID is the transaction which applied the repairs. 0 if no repair was applied.
+	RepairTxID  TxID   `json:"repair_txid"`
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+func (r *FsckReport) NumErrors() int {
+	n := 0
+	for _, i := range r.Issues {
+		if i.Severity == FsckError {
+			n++
+		}
+	}
+	return n
+}
+
+type DBChecker interface {
+	// Check inspects the whole db for inconsistencies. If repair is set, it fixes repairable issues by applying a DBTransaction.
+	Check(repair bool) (*FsckReport, error)
+}
+
+// fsckRepair is a repair action for the issue Issues[issueIdx] of the report.
+type fsckRepair struct {
+	issueIdx int
+	kind     string
+	id       ID
+	name     string
+	size     int64
+}
+
+type fsckWalker struct {
+	s       *DBState
+	r       *FsckReport
+	repairs []fsckRepair
+
+	// state is 1 while the node is on the current path, and 2 once its subtree is done.
+	state map[ID]int
+}
+
+func (w *fsckWalker) addIssue(i FsckIssue) int {
+	w.r.Issues = append(w.r.Issues, i)
+	return len(w.r.Issues) - 1
+}
+
+func (w *fsckWalker) addRepair(i FsckIssue, rep fsckRepair) {
+	i.Repairable = true
+	rep.issueIdx = w.addIssue(i)
+	rep.kind = i.Kind
+	w.repairs = append(w.repairs, rep)
+}
+
+func sortedEntryNames(dn *DirNode) []string {
+	names := make([]string, 0, len(dn.Entries))
+	for name := range dn.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w *fsckWalker) walk(id ID) {
+	w.state[id] = 1
+	defer func() { w.state[id] = 2 }()
+
+	switch n := w.s.nodes[id].(type) {
+	case *FileNode:
+		w.checkChunks(n)
+	case *DirNode:
+		for _, name := range sortedEntryNames(n) {
+			cid := n.Entries[name]
+			if _, ok := w.s.nodes[cid]; !ok {
+				w.addRepair(FsckIssue{
+					Kind: FsckDanglingEntry, Severity: FsckError, NodeID: id, Name: name,
+					Description: fmt.Sprintf("Entry \"%s\" points to missing node %d", name, cid),
+				}, fsckRepair{id: id, name: name})
+				continue
+			}
+			switch w.state[cid] {
+			case 0:
+				w.walk(cid)
+			case 1:
+				w.addRepair(FsckIssue{
+					Kind: FsckDirCycle, Severity: FsckError, NodeID: id, Name: name,
+					Description: fmt.Sprintf("Entry \"%s\" points back to ancestor directory %d", name, cid),
+				}, fsckRepair{id: id, name: name})
+			}
+		}
+	default:
+		w.addIssue(FsckIssue{
+			Kind: FsckTypeMismatch, Severity: FsckError, NodeID: id,
+			Description: fmt.Sprintf("Node has unknown type %v", w.s.nodes[id].GetType()),
+		})
+	}
+}
+
+func (w *fsckWalker) checkChunks(fn *FileNode) {
+	for i := 1; i < len(fn.Chunks); i++ {
+		prev, c := fn.Chunks[i-1], fn.Chunks[i]
+		if c.Left() < prev.Right() {
+			w.addIssue(FsckIssue{
+				Kind: FsckChunkOverlap, Severity: FsckError, NodeID: fn.ID,
+				Description: fmt.Sprintf("Chunk %+v overlaps with the preceding chunk %+v", c, prev),
+			})
+		} else if c.Left() > prev.Right() {
+			// Sparse writes leave gaps, which read as zeros.
+			w.addIssue(FsckIssue{
+				Kind: FsckChunkGap, Severity: FsckWarning, NodeID: fn.ID,
+				Description: fmt.Sprintf("Gap of %d bytes before chunk %+v", c.Left()-prev.Right(), c),
+			})
+		}
+	}
+	if len(fn.Chunks) == 0 {
+		return
+	}
+	if right := fn.Chunks[len(fn.Chunks)-1].Right(); right > fn.Size {
+		// Chunks are written before the size update, so extending the size recovers the data written.
+		w.addRepair(FsckIssue{
+			Kind: FsckChunkBeyondSize, Severity: FsckError, NodeID: fn.ID,
+			Description: fmt.Sprintf("Chunks extend to %d beyond size %d", right, fn.Size),
+		}, fsckRepair{id: fn.ID, size: right})
+	}
+}
+
+// checkBlobRefs compares the blob reference counts with the counts recomputed from the nodes.
+func (w *fsckWalker) checkBlobRefs() {
+	nlinks := make(map[ID]int)
+	for _, n := range w.s.nodes {
+		if dn, ok := n.(*DirNode); ok {
+			for _, id := range dn.Entries {
+				nlinks[id]++
+			}
+		}
+	}
+	expected := make(map[string]int)
+	for id, n := range w.s.nodes {
+		if fn, ok := n.(*FileNode); ok && nlinks[id] > 0 {
+			for _, fc := range fn.Chunks {
+				expected[fc.BlobPath]++
+			}
+		}
+	}
+
+	bps := make([]string, 0, len(expected))
+	for bp, n := range expected {
+		bps = append(bps, bp)
+		if n > 1 {
+			w.r.NumSharedBlobs++
+		}
+	}
+	for bp := range w.s.blobRefs {
+		if _, ok := expected[bp]; !ok {
+			bps = append(bps, bp)
+		}
+	}
+	sort.Strings(bps)
+	for _, bp := range bps {
+		if n := w.s.blobRefs[bp]; n != expected[bp] {
+			w.addRepair(FsckIssue{
+				Kind: FsckBlobRefMismatch, Severity: FsckError,
+				Description: fmt.Sprintf("Blob \"%s\" has ref count %d, but is referenced by %d file chunks", bp, n, expected[bp]),
+			}, fsckRepair{})
+		}
+	}
+}
+
+// findOrphans walks subtrees detached from the root.
+func (w *fsckWalker) findOrphans() {
+	candidates := []ID{}
+	linked := make(map[ID]struct{})
+	for id, n := range w.s.nodes {
+		dn, ok := n.(*DirNode)
+		if !ok || w.state[id] != 0 || len(dn.Entries) == 0 {
+			continue
+		}
+		candidates = append(candidates, id)
+		for _, cid := range dn.Entries {
+			linked[cid] = struct{}{}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	addOrphan := func(id ID) {
+		w.addRepair(FsckIssue{
+			Kind: FsckOrphan, Severity: FsckError, NodeID: id,
+			Description: fmt.Sprintf("Directory %d (orig path \"%s\") is not reachable from root", id, w.s.nodes[id].(*DirNode).OrigPath),
+		}, fsckRepair{id: id})
+		w.walk(id)
+	}
+	for _, id := range candidates {
+		if _, ok := linked[id]; !ok && w.state[id] == 0 {
+			addOrphan(id)
+		}
+	}
+	for _, id := range candidates {
+		if w.state[id] == 0 {
+			addOrphan(id)
+		}
+	}
+}
+
+// check inspects s, and returns the report along with the repairs to apply.
+func (s *DBState) check() (*FsckReport, []fsckRepair) {
+	w := &fsckWalker{s: s, r: &FsckReport{Issues: []FsckIssue{}}, state: make(map[ID]int)}
+	w.r.NumNodes = len(s.nodes)
+
+	if _, ok := s.nodes[RootDirID].(*DirNode); !ok {
+		w.addIssue(FsckIssue{Kind: FsckTypeMismatch, Severity: FsckError, NodeID: RootDirID, Description: "Root directory not found"})
+		return w.r, nil
+	}
+	w.walk(RootDirID)
+	w.r.NumReachable = len(w.state)
+	w.findOrphans()
+	w.r.NumUnlinked = len(s.nodes) - len(w.state)
+	w.checkBlobRefs()
+
+	ids := make([]ID, 0, len(s.nodeLocks))
+	for id := range s.nodeLocks {
+		if _, ok := s.nodes[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		w.addRepair(FsckIssue{
+			Kind: FsckStaleLock, Severity: FsckWarning, NodeID: id,
+			Description: fmt.Sprintf("Lock %+v is held for a node which doesn't exist", s.nodeLocks[id]),
+		}, fsckRepair{id: id})
+	}
+
+	return w.r, w.repairs
+}
+
+// checkSnapshotter is implemented by DBHandlers which can copy their state for check.
+type checkSnapshotter interface {
+	snapshotForCheck() *DBState
+}
+
+// snapshotForCheck returns a copy of s, which shares nothing modified by DBOperations with s.
+func (s *DBState) snapshotForCheck() *DBState {
+	c := &DBState{
+		nodes:     make(map[ID]INode, len(s.nodes)),
+		lastID:    s.lastID,
+		version:   s.version,
+		nodeLocks: make(map[ID]NodeLock, len(s.nodeLocks)),
+		blobRefs:  make(map[string]int, len(s.blobRefs)),
+		chunkRefs: make(map[string]int, len(s.chunkRefs)),
+	}
+	for id, n := range s.nodes {
+		switch n := n.(type) {
+		case *FileNode:
+			fn := *n
+			fn.Chunks = append([]FileChunk{}, n.Chunks...)
+			c.nodes[id] = &fn
+		case *DirNode:
+			dn := *n
+			dn.Entries = make(map[string]ID, len(n.Entries))
+			for name, cid := range n.Entries {
+				dn.Entries[name] = cid
+			}
+			c.nodes[id] = &dn
+		default:
+			c.nodes[id] = n
+		}
+	}
+	for id, nlock := range s.nodeLocks {
+		c.nodeLocks[id] = nlock
+	}
+	for bp, n := range s.blobRefs {
+		c.blobRefs[bp] = n
+	}
+	for bp, n := range s.chunkRefs {
+		c.chunkRefs[bp] = n
+	}
+	return c
+}
+
+func (db *DB) snapshotForCheck() *DBState { return db.state.snapshotForCheck() }
+
+// checkOnly inspects s without repairing.
+func (s *DBState) checkOnly() *FsckReport {
+	r, _ := s.check()
+	log.Printf("Fsck found %d issues (%d errors).", len(r.Issues), r.NumErrors())
+	return r
+}
+
+var _ = DBChecker(&DB{})
+
+func (db *DB) Check(repair bool) (*FsckReport, error) {
+	if !repair {
+		return db.state.checkOnly(), nil
+	}
+
+	r, repairs := db.state.check()
+	log.Printf("Fsck found %d issues (%d errors).", len(r.Issues), r.NumErrors())
+	if len(repairs) == 0 {
+		return r, nil
+	}
+
+	if err := db.repair(r, repairs); err != nil {
+		r.RepairError = err.Error()
+		return r, err
+	}
+	return r, nil
+}
+
+func (db *DB) lostFoundDir(ops []DBOperation, locks []NodeLock) (NodeLock, []DBOperation, []NodeLock, error) {
+	root := db.state.nodes[RootDirID].(*DirNode)
+	if id, ok := root.Entries[LostFoundName]; ok {
+		if _, ok := db.state.nodes[id].(*DirNode); !ok {
+			return NodeLock{}, ops, locks, fmt.Errorf("/%s exists but is not a directory", LostFoundName)
+		}
+		return NodeLock{ID: id, Ticket: NoTicket}, ops, locks, nil
+	}
+
+	nlock, err := db.LockNode(AllocateNewNodeID)
+	if err != nil {
+		return NodeLock{}, ops, locks, err
+	}
+	ops = append(ops,
+		&CreateNodeOp{NodeLock: nlock, OrigPath: "/" + LostFoundName, Type: DirNodeT},
+		&HardLinkOp{NodeLock: NodeLock{RootDirID, NoTicket}, Name: LostFoundName, TargetID: nlock.ID},
+	)
+	return nlock, ops, append(locks, nlock), nil
+}
+
+func (db *DB) repair(r *FsckReport, repairs []fsckRepair) error {
+	ops := []DBOperation{}
+	locks := []NodeLock{}
+	defer func() {
+		for _, nlock := range locks {
+			if err := db.UnlockNode(nlock); err != nil {
+				log.Printf("Failed to unlock node %d after fsck repair: %v", nlock.ID, err)
+			}
+		}
+	}()
+
+	var lflock NodeLock
+	lfnames := make(map[string]struct{})
+	applied := []int{}
+	staleLocks := []fsckRepair{}
+	refMismatches := []fsckRepair{}
+	for _, rep := range repairs {
+		switch rep.kind {
+		case FsckDanglingEntry, FsckDirCycle:
+			ops = append(ops, &RemoveOp{NodeLock: NodeLock{rep.id, NoTicket}, Name: rep.name, SkipEmptyCheck: true})
+		case FsckOrphan:
+			if lflock.ID == 0 {
+				var err error
+				if lflock, ops, locks, err = db.lostFoundDir(ops, locks); err != nil {
+					return err
+				}
+				if lf, ok := db.state.nodes[lflock.ID].(*DirNode); ok {
+					for name := range lf.Entries {
+						lfnames[name] = struct{}{}
+					}
+				}
+			}
+			name := fmt.Sprintf("#%d", rep.id)
+			for j := 1; ; j++ {
+				if _, ok := lfnames[name]; !ok {
+					break
+				}
+				name = fmt.Sprintf("#%d.%d", rep.id, j)
+			}
+			lfnames[name] = struct{}{}
+			ops = append(ops, &HardLinkOp{NodeLock: lflock, Name: name, TargetID: rep.id})
+		case FsckChunkBeyondSize:
+			nlock, err := db.LockNode(rep.id)
+			if err != nil {
+				log.Printf("Fsck: Skipping size fix of node %d: %v", rep.id, err)
+				continue
+			}
+			locks = append(locks, nlock)
+			ops = append(ops, &UpdateSizeOp{NodeLock: nlock, Size: rep.size})
+		case FsckStaleLock:
+			staleLocks = append(staleLocks, rep)
+			continue
+		case FsckBlobRefMismatch:
+			refMismatches = append(refMismatches, rep)
+			continue
+		}
+		applied = append(applied, rep.issueIdx)
+	}
+
+	if len(ops) > 0 {
+		txid, err := db.ApplyTransaction(DBTransaction{Ops: ops})
+		if err != nil {
+			return fmt.Errorf("Failed to apply fsck repair tx: %v", err)
+		}
+		r.RepairTxID = txid
+		log.Printf("Fsck repair applied as tx %d.", txid)
+	}
+	for _, i := range applied {
+		r.Issues[i].Repaired = true
+	}
+
+	// Node locks are in-memory state, so they are released directly.
+	for _, rep := range staleLocks {
+		delete(db.state.nodeLocks, rep.id)
+		r.Issues[rep.issueIdx].Repaired = true
+	}
+	// So are blob ref counts, which are rebuilt from the nodes.
+	if len(refMismatches) > 0 {
+		db.state.rebuildBlobRefs()
+		for _, rep := range refMismatches {
+			r.Issues[rep.issueIdx].Repaired = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package inodedb_test
+
+import (
+	"fmt"
+	"testing"
+
+	i "github.com/nyaxt/otaru/inodedb"
+)
+
+// createNode creates a node with chunks cs and size, and links it under dirID unless dirID is 0.
+func createNode(t *testing.T, db *i.DB, dirID i.ID, name string, typ i.Type, cs []i.FileChunk, size int64) i.ID {
+	nlock, err := db.LockNode(i.AllocateNewNodeID)
+	if err != nil {
+		t.Fatalf("Failed to LockNode: %v", err)
+	}
+	tx := i.DBTransaction{Ops: []i.DBOperation{
+		&i.CreateNodeOp{NodeLock: nlock, OrigPath: "/" + name, Type: typ},
+	}}
+	if typ == i.FileNodeT {
+		tx.Ops = append(tx.Ops,
+			&i.UpdateChunksOp{NodeLock: nlock, Chunks: cs},
+			&i.UpdateSizeOp{NodeLock: nlock, Size: size},
+		)
+	}
+	if dirID != 0 {
+		tx.Ops = append(tx.Ops, &i.HardLinkOp{NodeLock: i.NodeLock{dirID, i.NoTicket}, Name: name, TargetID: nlock.ID})
+	}
+	if _, err := db.ApplyTransaction(tx); err != nil {
+		t.Fatalf("Failed to apply tx: %v", err)
+	}
+	if err := db.UnlockNode(nlock); err != nil {
+		t.Fatalf("Failed to UnlockNode: %v", err)
+	}
+	return nlock.ID
+}
+
+func applyOps(t *testing.T, db *i.DB, ops ...i.DBOperation) {
+	if _, err := db.ApplyTransaction(i.DBTransaction{Ops: ops}); err != nil {
+		t.Fatalf("Failed to apply tx: %v", err)
+	}
+}
+
+func issueKinds(r *i.FsckReport) map[string]int {
+	kinds := make(map[string]int)
+	for _, is := range r.Issues {
+		kinds[is.Kind]++
+	}
+	return kinds
+}
+
+func TestCheck_Clean(t *testing.T) {
+	db, err := i.NewEmptyDB(i.NewSimpleDBStateSnapshotIO(), i.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("Failed to NewEmptyDB: %v", err)
+	}
+	dirID := createNode(t, db, i.RootDirID, "dir", i.DirNodeT, nil, 0)
+	createNode(t, db, dirID, "a.txt", i.FileNodeT, []i.FileChunk{{Offset: 0, Length: 10, BlobPath: "a"}}, 10)
+	createNode(t, db, dirID, "b.txt", i.FileNodeT, nil, 0)
+	applyOps(t, db, &i.RemoveOp{NodeLock: i.NodeLock{dirID, i.NoTicket}, Name: "b.txt"})
+	// A clone shares the blob of a.txt.
+	createNode(t, db, i.RootDirID, "a-clone.txt", i.FileNodeT, []i.FileChunk{{Offset: 0, Length: 10, BlobPath: "a"}}, 10)
+
+	r, err := db.Check(false)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if len(r.Issues) != 0 {
+		t.Errorf("Unexpected issues: %+v", r.Issues)
+	}
+	if r.NumNodes != 5 || r.NumReachable != 4 || r.NumUnlinked != 1 || r.NumSharedBlobs != 1 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestCheck_Repair(t *testing.T) {
+	sio := i.NewSimpleDBStateSnapshotIO()
+	txio := i.NewSimpleDBTransactionLogIO()
+	db, err := i.NewEmptyDB(sio, txio)
+	if err != nil {
+		t.Fatalf("Failed to NewEmptyDB: %v", err)
+	}
+
+	// dir/up -> root forms a cycle.
+	dirID := createNode(t, db, i.RootDirID, "dir", i.DirNodeT, nil, 0)
+	applyOps(t, db, &i.HardLinkOp{NodeLock: i.NodeLock{dirID, i.NoTicket}, Name: "up", TargetID: i.RootDirID})
+
+	// An unlinked directory still holding a file is an orphan.
+	orphanID := createNode(t, db, 0, "orphan", i.DirNodeT, nil, 0)
+	createNode(t, db, orphanID, "o.txt", i.FileNodeT, nil, 0)
+
+	// Chunks written, but size not updated.
+	bigID := createNode(t, db, i.RootDirID, "big.txt", i.FileNodeT, []i.FileChunk{{Offset: 0, Length: 10, BlobPath: "b"}}, 0)
+
+	// Overlapping chunks are reported, but not repaired.
+	createNode(t, db, i.RootDirID, "overlap.txt", i.FileNodeT, []i.FileChunk{
+		{Offset: 0, Length: 10, BlobPath: "c1"},
+		{Offset: 5, Length: 10, BlobPath: "c2"},
+	}, 15)
+
+	// A lock for a node which never got created.
+	if _, err := db.LockNode(i.AllocateNewNodeID); err != nil {
+		t.Fatalf("Failed to LockNode: %v", err)
+	}
+
+	r, err := db.Check(false)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	kinds := issueKinds(r)
+	if kinds[i.FsckDirCycle] != 1 || kinds[i.FsckOrphan] != 1 || kinds[i.FsckChunkBeyondSize] != 1 || kinds[i.FsckChunkOverlap] != 1 || kinds[i.FsckStaleLock] != 1 {
+		t.Errorf("Unexpected issues: %+v", r.Issues)
+	}
+
+	r, err = db.Check(true)
+	if err != nil {
+		t.Fatalf("Check with repair failed: %v", err)
+	}
+	if r.RepairTxID == 0 {
+		t.Errorf("Repair tx not applied: %+v", r)
+	}
+	for _, is := range r.Issues {
+		if is.Repaired != is.Repairable {
+			t.Errorf("Unexpected repair state: %+v", is)
+		}
+	}
+
+	check := func(db *i.DB) {
+		r, err := db.Check(false)
+		if err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		if kinds := issueKinds(r); len(kinds) != 1 || kinds[i.FsckChunkOverlap] != 1 {
+			t.Errorf("Unexpected issues after repair: %+v", r.Issues)
+		}
+
+		v, _, err := db.QueryNode(i.RootDirID, false)
+		if err != nil {
+			t.Fatalf("QueryNode failed: %v", err)
+		}
+		lfID, ok := v.(*i.DirNodeView).Entries[i.LostFoundName]
+		if !ok {
+			t.Fatalf("lost+found not created")
+		}
+		v, _, err = db.QueryNode(lfID, false)
+		if err != nil {
+			t.Fatalf("QueryNode failed: %v", err)
+		}
+		if es := v.(*i.DirNodeView).Entries; len(es) != 1 || es[fmt.Sprintf("#%d", orphanID)] != orphanID {
+			t.Errorf("Unexpected lost+found entries: %+v", es)
+		}
+		v, _, err = db.QueryNode(bigID, false)
+		if err != nil {
+			t.Fatalf("QueryNode failed: %v", err)
+		}
+		if size := v.(*i.FileNodeView).Size; size != 10 {
+			t.Errorf("Unexpected size after repair: %d", size)
+		}
+	}
+	check(db)
+
+	// Repairs are ordinary transactions, so they are replayed on restore.
+	db2, err := i.NewDB(sio, txio)
+	if err != nil {
+		t.Fatalf("Failed to NewDB: %v", err)
+	}
+	check(db2)
+}
+
+func TestCheck_DBService(t *testing.T) {
+	db, err := i.NewEmptyDB(i.NewSimpleDBStateSnapshotIO(), i.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("Failed to NewEmptyDB: %v", err)
+	}
+	createNode(t, db, i.RootDirID, "big.txt", i.FileNodeT, []i.FileChunk{{Offset: 0, Length: 10, BlobPath: "b"}}, 0)
+
+	srv := i.NewDBService(db)
+	defer srv.Quit()
+
+	r, err := srv.Check(false)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if kinds := issueKinds(r); len(r.Issues) != 1 || kinds[i.FsckChunkBeyondSize] != 1 || r.RepairTxID != 0 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+
+	r, err = srv.Check(true)
+	if err != nil {
+		t.Fatalf("Check with repair failed: %v", err)
+	}
+	if r.RepairTxID == 0 {
+		t.Errorf("Repair tx not applied: %+v", r)
+	}
+	if r, err := srv.Check(false); err != nil || len(r.Issues) != 0 {
+		t.Errorf("Unexpected issues after repair: %v, %+v", err, r)
+	}
+}
@@ -46,6 +46,17 @@ const (
 	// SymlinkNode
 )
 
+func (t Type) String() string {
+	switch t {
+	case FileNodeT:
+		return "file"
+	case DirNodeT:
+		return "dir"
+	default:
+		return "unknown"
+	}
+}
+
 type INode interface {
 	GetID() ID
 	GetType() Type
@@ -69,6 +80,11 @@ type DBState struct {
 
 	lastTicket Ticket
 	nodeLocks  map[ID]NodeLock
+
+	// nlinks, blobRefs and chunkRefs are derived from nodes. See blobrefs.go
+	nlinks    map[ID]int
+	blobRefs  map[string]int
+	chunkRefs map[string]int
 }
 
 func NewDBState() *DBState {
@@ -79,6 +95,10 @@ func NewDBState() *DBState {
 
 		lastTicket: 1,
 		nodeLocks:  make(map[ID]NodeLock),
+
+		nlinks:    make(map[ID]int),
+		blobRefs:  make(map[string]int),
+		chunkRefs: make(map[string]int),
 	}
 }
 
@@ -89,12 +109,15 @@ func (s *DBState) addNewNode(node INode) error {
 	if _, ok := s.nodes[id]; ok {
 		return fmt.Errorf("Node already exists")
 	}
-	if id < s.lastID {
+	// IDs below lastID are fine only if allocated by LockNode and yet to be created, which happens when a transaction creates multiple nodes.
+	if _, allocated := s.nodeLocks[id]; id < s.lastID && !allocated {
 		return fmt.Errorf("ID may be being reused")
 	}
 
 	s.nodes[id] = node
-	s.lastID = id
+	if id > s.lastID {
+		s.lastID = id
+	}
 	return nil
 }
 
@@ -379,6 +402,35 @@ func (db *DB) Fsck() ([]string, []error) {
 	return db.fsckRecursive(RootDirID, foundblobpaths, errs)
 }
 
+var _ = SubtreeQuerier(&DB{})
+
+func (db *DB) QuerySubtree(id ID) (map[ID]NodeView, error) {
+	if _, ok := db.state.nodes[id]; !ok {
+		return nil, ENOENT
+	}
+
+	views := make(map[ID]NodeView)
+	stack := []ID{id}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := views[id]; ok {
+			continue
+		}
+		n, ok := db.state.nodes[id]
+		if !ok {
+			return nil, fmt.Errorf("Node ID %d in the subtree not found. Run fsck.", id)
+		}
+		views[id] = n.View()
+		if dn, ok := n.(*DirNode); ok {
+			for _, cid := range dn.Entries {
+				stack = append(stack, cid)
+			}
+		}
+	}
+	return views, nil
+}
+
 var _ = DBServiceStatsProvider(&DB{})
 
 func (db *DB) GetStats() DBServiceStats {
@@ -105,3 +105,133 @@ func TestCreateFile(t *testing.T) {
 		t.Errorf("Fsck returned err on db: %v", errs)
 	}
 }
+
+func TestBlobRefCount(t *testing.T) {
+	sio := i.NewSimpleDBStateSnapshotIO()
+	txio := i.NewSimpleDBTransactionLogIO()
+	db, err := i.NewEmptyDB(sio, txio)
+	if err != nil {
+		t.Errorf("Failed to NewEmptyDB: %v", err)
+		return
+	}
+
+	shared := []i.FileChunk{{Offset: 0, Length: 10, BlobPath: "shared"}}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		nlock, err := db.LockNode(i.AllocateNewNodeID)
+		if err != nil {
+			t.Errorf("Failed to LockNode: %v", err)
+			return
+		}
+		tx := i.DBTransaction{Ops: []i.DBOperation{
+			&i.CreateNodeOp{NodeLock: nlock, OrigPath: "/" + name, Type: i.FileNodeT},
+			&i.UpdateChunksOp{NodeLock: nlock, Chunks: shared},
+			&i.HardLinkOp{NodeLock: i.NodeLock{1, i.NoTicket}, Name: name, TargetID: nlock.ID},
+		}}
+		if _, err := db.ApplyTransaction(tx); err != nil {
+			t.Errorf("Failed to apply tx: %v", err)
+			return
+		}
+		if err := db.UnlockNode(nlock); err != nil {
+			t.Errorf("Failed to UnlockNode: %v", err)
+		}
+	}
+	if n := db.BlobRefCount("shared"); n != 2 {
+		t.Errorf("Unexpected refcount: %d", n)
+	}
+	refs, ver := db.BlobRefsSnapshot()
+	if _, ok := refs["shared"]; !ok || len(refs) != 1 {
+		t.Errorf("Unexpected refs snapshot: %v", refs)
+	}
+
+	tx := i.DBTransaction{Ops: []i.DBOperation{
+		&i.RemoveOp{NodeLock: i.NodeLock{1, i.NoTicket}, Name: "a.txt"},
+	}}
+	if _, err := db.ApplyTransaction(tx); err != nil {
+		t.Errorf("Failed to apply tx: %v", err)
+		return
+	}
+	if n := db.BlobRefCount("shared"); n != 1 {
+		t.Errorf("Unexpected refcount after remove: %d", n)
+	}
+	// The removed file still has the chunk.
+	if n := db.ChunkRefCount("shared"); n != 2 {
+		t.Errorf("Unexpected chunk refcount after remove: %d", n)
+	}
+	if _, ok := refs["shared"]; !ok || ver >= db.GetStats().Version {
+		t.Errorf("Refs snapshot should not be affected by later txs: %v at ver %d", refs, ver)
+	}
+
+	// refcounts should be rebuilt on restore
+	if err := db.Sync(); err != nil {
+		t.Errorf("Failed to Sync DB: %v", err)
+		return
+	}
+	db2, err := i.NewDB(sio, txio)
+	if err != nil {
+		t.Errorf("Failed to NewDB: %v", err)
+		return
+	}
+	if n := db2.BlobRefCount("shared"); n != 1 {
+		t.Errorf("Unexpected refcount after restore: %d", n)
+	}
+	if n := db2.ChunkRefCount("shared"); n != 2 {
+		t.Errorf("Unexpected chunk refcount after restore: %d", n)
+	}
+
+	tx = i.DBTransaction{Ops: []i.DBOperation{
+		&i.RemoveOp{NodeLock: i.NodeLock{1, i.NoTicket}, Name: "b.txt"},
+	}}
+	if _, err := db2.ApplyTransaction(tx); err != nil {
+		t.Errorf("Failed to apply tx: %v", err)
+		return
+	}
+	if n := db2.BlobRefCount("shared"); n != 0 {
+		t.Errorf("Unexpected refcount after removing all links: %d", n)
+	}
+	if refs, ver := db2.BlobRefsSnapshot(); len(refs) != 0 || ver != db2.GetStats().Version {
+		t.Errorf("Unexpected refs snapshot after removing all links: %v at ver %d", refs, ver)
+	}
+}
+
+func TestApplyTransaction_RollbackTwice(t *testing.T) {
+	db, err := i.NewEmptyDB(i.NewSimpleDBStateSnapshotIO(), i.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Errorf("Failed to NewEmptyDB: %v", err)
+		return
+	}
+
+	createFile := func(name string) error {
+		nlock, err := db.LockNode(i.AllocateNewNodeID)
+		if err != nil {
+			return err
+		}
+		defer db.UnlockNode(nlock)
+		tx := i.DBTransaction{Ops: []i.DBOperation{
+			&i.CreateNodeOp{NodeLock: nlock, OrigPath: "/" + name, Type: i.FileNodeT},
+			&i.HardLinkOp{NodeLock: i.NodeLock{1, i.NoTicket}, Name: name, TargetID: nlock.ID},
+		}}
+		_, err = db.ApplyTransaction(tx)
+		return err
+	}
+
+	if err := createFile("a.txt"); err != nil {
+		t.Errorf("Failed to create file: %v", err)
+	}
+	for j := 0; j < 2; j++ {
+		if err := createFile("a.txt"); err != i.EEXIST {
+			t.Errorf("Creating existing file should fail with EEXIST: %v", err)
+		}
+		if err := createFile("b.txt"); err != nil {
+			t.Errorf("Failed to create file after rollback: %v", err)
+		}
+		tx := i.DBTransaction{Ops: []i.DBOperation{
+			&i.RemoveOp{NodeLock: i.NodeLock{1, i.NoTicket}, Name: "b.txt"},
+		}}
+		if _, err := db.ApplyTransaction(tx); err != nil {
+			t.Errorf("Failed to apply tx: %v", err)
+		}
+	}
+	if _, errs := db.Fsck(); len(errs) != 0 {
+		t.Errorf("Fsck returned err on db: %v", errs)
+	}
+}
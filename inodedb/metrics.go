@@ -0,0 +1,17 @@
+package inodedb
+
+import (
+	"github.com/nyaxt/otaru/metrics"
+)
+
+var (
+	txsApplied      = metrics.NewCounter("otaru_inodedb_transactions_total", "Number of transactions applied to inodedb.")
+	txErrors        = metrics.NewCounter("otaru_inodedb_transaction_errors_total", "Number of transactions which failed to apply.")
+	txDuration      = metrics.NewHistogram("otaru_inodedb_transaction_duration_seconds", "Latency of applying a transaction, excluding the time queued.", nil)
+	requestQueue    = metrics.NewGauge("otaru_inodedb_queue_depth", "Number of requests waiting for DBService.")
+	requestsHandled = metrics.NewCounter("otaru_inodedb_requests_total", "Number of requests handled by DBService.")
+)
+
+func init() {
+	metrics.Register(txsApplied, txErrors, txDuration, requestQueue, requestsHandled)
+}
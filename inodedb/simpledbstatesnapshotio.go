@@ -29,6 +29,7 @@ func (io *SimpleDBStateSnapshotIO) SaveSnapshot(s *DBState) error {
 }
 
 func (io *SimpleDBStateSnapshotIO) RestoreSnapshot() (*DBState, error) {
-	dec := gob.NewDecoder(&io.Buf)
+	// Decode from a copy of the reader, so that the snapshot can be restored more than once, e.g. on rollbacks.
+	dec := gob.NewDecoder(bytes.NewReader(io.Buf.Bytes()))
 	return DecodeDBStateFromGob(dec)
 }
@@ -13,6 +13,13 @@ func NewSimpleDBTransactionLogIO() *SimpleDBTransactionLogIO {
 }
 
 func (io *SimpleDBTransactionLogIO) AppendTransaction(tx DBTransaction) error {
+	// Transactions replayed on rollbacks are appended again. Replace them, as the datastore txlog keyed by TxID does.
+	for i := len(io.txs) - 1; i >= 0 && io.txs[i].TxID >= tx.TxID; i-- {
+		if io.txs[i].TxID == tx.TxID {
+			io.txs[i] = tx
+			return nil
+		}
+	}
 	io.txs = append(io.txs, tx)
 	return nil
 }
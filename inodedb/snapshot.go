@@ -52,6 +52,7 @@ func DecodeDBStateFromGob(dec *gob.Decoder) (*DBState, error) {
 	if err := dec.Decode(&s.version); err != nil {
 		return nil, fmt.Errorf("Failed to decode version: %v", err)
 	}
+	s.rebuildBlobRefs()
 
 	return s, nil
 }
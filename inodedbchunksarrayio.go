@@ -45,3 +45,14 @@ func (caio *INodeDBChunksArrayIO) Write(cs []inodedb.FileChunk) error {
 	}
 	return nil
 }
+
+var _ = chunkstore.SharedChunkQuerier(&INodeDBChunksArrayIO{})
+
+// IsSharedChunk tells if the blob of the chunk is referenced from other files than this one, including the ones removed while open.
+func (caio *INodeDBChunksArrayIO) IsSharedChunk(c inodedb.FileChunk) bool {
+	rc, ok := caio.db.(inodedb.ChunkRefCounter)
+	if !ok {
+		return false
+	}
+	return rc.ChunkRefCount(c.BlobPath) > 1
+}
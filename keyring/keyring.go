@@ -0,0 +1,609 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/metadata"
+	"github.com/nyaxt/otaru/util"
+)
+
+// Data keys are wrapped by a key encryption key (KEK), which is sealed to the public key of each user.
+
+// LegacyKeyID is the ID of the data key of filesystems created before keyring was introduced. The key is derived from the original password.
+const LegacyKeyID uint32 = 0
+
+// DefaultUser is the name of the password user created along with the keyring.
+const DefaultUser = "default"
+
+const (
+	// formatVersion 1 wrapped the keys directly with a KEK derived from the single password.
+	formatVersion1 = 1
+	formatVersion  = 2
+)
+
+var (
+	ErrWrongPassword = errors.New("Failed to unwrap keys. Wrong password?")
+	ErrUnknownKey    = errors.New("No user of the keyring matches the private key.")
+)
+
+type wrappedKey struct {
+	ID        uint32
+	Wrapped   []byte
+	CreatedAt time.Time
+}
+
+type userEntry struct {
+	Name    string
+	AddedAt time.Time
+
+	PublicKey []byte
+	// SealedKEK is the KEK sealed to PublicKey.
+	SealedKEK []byte
+
+	// KDF and WrappedPrivateKey are set for password users. The private key is wrapped by the key derived from the password with KDF.
+	KDF               *btncrypt.KDFParams `json:",omitempty"`
+	WrappedPrivateKey []byte              `json:",omitempty"`
+}
+
+type keyringFile struct {
+	Version int
+	// KDF is the parameters to derive KEK from the password in formatVersion1. nil stands for btncrypt.LegacyKDFParams.
+	KDF       *btncrypt.KDFParams `json:",omitempty"`
+	PrimaryID uint32
+	// NamingKey is the wrapped secret for content-addressed blobpaths. Kept separate from the data keys, so that rotating data keys doesn't change blobpaths of deduplicated chunks.
+	NamingKey []byte
+	Keys      []wrappedKey
+	Users     []userEntry `json:",omitempty"`
+}
+
+// Credential identifies the user unlocking a keyring.
+type Credential struct {
+	// User is the name of the user to unlock as. All users are tried if empty.
+	User string
+
+	Password string
+	// PrivateKey unlocks the keyring as a public key user. Password is ignored if PrivateKey is set.
+	PrivateKey *[32]byte
+}
+
+// UserInfo describes a user of the keyring.
+type UserInfo struct {
+	Name      string
+	AddedAt   time.Time
+	PublicKey string
+	// KDF is nil for public key users.
+	KDF *btncrypt.KDFParams
+}
+
+type Keyring struct {
+	kek    btncrypt.Cipher
+	kekRaw []byte
+
+	users map[string]*userEntry
+	// user is the name of the user who unlocked the keyring, and privateKey is their private key.
+	user       string
+	privateKey *[32]byte
+
+	primaryID uint32
+	keys      map[uint32][]byte
+	createdAt map[uint32]time.Time
+	namingKey []byte
+
+	// upgraded is set if the keyring was decoded from an older format.
+	upgraded bool
+}
+
+func newKeyring() *Keyring {
+	return &Keyring{
+		users:     make(map[string]*userEntry),
+		keys:      make(map[uint32][]byte),
+		createdAt: make(map[uint32]time.Time),
+	}
+}
+
+func (kr *Keyring) setKEK(key []byte) error {
+	kek, err := btncrypt.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("Failed to init KEK cipher: %v", err)
+	}
+	kr.kek = kek
+	kr.kekRaw = key
+	return nil
+}
+
+// replaceKEK generates a new KEK, and seals it for all users.
+func (kr *Keyring) replaceKEK() error {
+	if err := kr.setKEK(util.RandomBytes(btncrypt.KeyLength)); err != nil {
+		return err
+	}
+	for _, u := range kr.users {
+		if err := kr.sealKEK(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kr *Keyring) sealKEK(u *userEntry) error {
+	pub, err := toKey(u.PublicKey)
+	if err != nil {
+		return fmt.Errorf("Invalid public key of user \"%s\": %v", u.Name, err)
+	}
+	u.SealedKEK, err = box.SealAnonymous(nil, kr.kekRaw, pub, rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to seal KEK for user \"%s\": %v", u.Name, err)
+	}
+	return nil
+}
+
+func passwordCipher(password string, kdf btncrypt.KDFParams) (btncrypt.Cipher, error) {
+	key, err := kdf.DeriveKey(password)
+	if err != nil {
+		return btncrypt.Cipher{}, fmt.Errorf("Failed to derive key from password: %v", err)
+	}
+	return btncrypt.NewCipher(btncrypt.DeriveKey(key, "keyring-user"))
+}
+
+func (kr *Keyring) setUserPassword(u *userEntry, priv *[32]byte, password string, kdf btncrypt.KDFParams) error {
+	c, err := passwordCipher(password, kdf)
+	if err != nil {
+		return err
+	}
+	wrapped, err := btncrypt.Encrypt(c, priv[:])
+	if err != nil {
+		return fmt.Errorf("Failed to wrap private key: %v", err)
+	}
+	u.KDF = &kdf
+	u.WrappedPrivateKey = wrapped
+	return nil
+}
+
+func (kr *Keyring) addUser(name string, pub *[32]byte) (*userEntry, error) {
+	if name == "" {
+		return nil, fmt.Errorf("User name must not be empty")
+	}
+	if _, ok := kr.users[name]; ok {
+		return nil, fmt.Errorf("User \"%s\" already exists", name)
+	}
+	u := &userEntry{Name: name, AddedAt: time.Now(), PublicKey: append([]byte{}, pub[:]...)}
+	if err := kr.sealKEK(u); err != nil {
+		return nil, err
+	}
+	kr.users[name] = u
+	return u, nil
+}
+
+func (kr *Keyring) addPasswordUser(name, password string, kdf btncrypt.KDFParams) (*[32]byte, error) {
+	pub, priv, err := GenerateUserKey()
+	if err != nil {
+		return nil, err
+	}
+	u, err := kr.addUser(name, pub)
+	if err != nil {
+		return nil, err
+	}
+	if err := kr.setUserPassword(u, priv, password, kdf); err != nil {
+		delete(kr.users, name)
+		return nil, err
+	}
+	return priv, nil
+}
+
+func newWithDefaultUser(password string, kdf btncrypt.KDFParams) (*Keyring, error) {
+	kr := newKeyring()
+	if err := kr.setKEK(util.RandomBytes(btncrypt.KeyLength)); err != nil {
+		return nil, err
+	}
+	priv, err := kr.addPasswordUser(DefaultUser, password, kdf)
+	if err != nil {
+		return nil, err
+	}
+	kr.user = DefaultUser
+	kr.privateKey = priv
+	return kr, nil
+}
+
+// New creates a keyring with a random data key, and a single user DefaultUser.
+func New(password string, kdf btncrypt.KDFParams) (*Keyring, error) {
+	kr, err := newWithDefaultUser(password, kdf)
+	if err != nil {
+		return nil, err
+	}
+	kr.namingKey = util.RandomBytes(btncrypt.KeyLength)
+	kr.addKey(LegacyKeyID + 1)
+	return kr, nil
+}
+
+// NewLegacy creates a keyring for a filesystem encrypted with the password-derived key.
+func NewLegacy(password string) *Keyring {
+	kr, err := newWithDefaultUser(password, btncrypt.LegacyKDFParams())
+	if err != nil {
+		log.Fatalf("Failed to init legacy keyring: %v", err)
+	}
+	key := btncrypt.KeyFromPassword(password)
+	kr.namingKey = key
+	kr.primaryID = LegacyKeyID
+	kr.keys[LegacyKeyID] = key
+	kr.createdAt[LegacyKeyID] = time.Now()
+	return kr
+}
+
+// GenerateUserKey generates a key pair for a public key user.
+func GenerateUserKey() (pub, priv *[32]byte, err error) {
+	pub, priv, err = box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate key pair: %v", err)
+	}
+	return pub, priv, nil
+}
+
+// EncodeUserKey returns the textual form of a public or private key.
+func EncodeUserKey(k *[32]byte) string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParseUserKey parses the textual form of a public or private key.
+func ParseUserKey(s string) (*[32]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode key: %v", err)
+	}
+	return toKey(b)
+}
+
+func toKey(b []byte) (*[32]byte, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("Invalid key length %d", len(b))
+	}
+	var k [32]byte
+	copy(k[:], b)
+	return &k, nil
+}
+
+func (kr *Keyring) addKey(id uint32) {
+	kr.keys[id] = util.RandomBytes(btncrypt.KeyLength)
+	kr.createdAt[id] = time.Now()
+	kr.primaryID = id
+}
+
+func (kr *Keyring) wrap(key []byte) ([]byte, error) {
+	return btncrypt.Encrypt(kr.kek, key)
+}
+
+func (kr *Keyring) unwrap(wrapped []byte) ([]byte, error) {
+	key, err := btncrypt.Decrypt(kr.kek, wrapped, btncrypt.KeyLength)
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+	return key, nil
+}
+
+// unlockUser recovers the private key of u with cred, and opens the KEK sealed for u. It returns nil if cred doesn't match u.
+func unlockUser(u *userEntry, cred Credential) (*[32]byte, []byte) {
+	pub, err := toKey(u.PublicKey)
+	if err != nil {
+		log.Printf("Invalid public key of user \"%s\": %v", u.Name, err)
+		return nil, nil
+	}
+
+	priv := cred.PrivateKey
+	if priv == nil {
+		if u.KDF == nil {
+			return nil, nil
+		}
+		c, err := passwordCipher(cred.Password, *u.KDF)
+		if err != nil {
+			log.Printf("User \"%s\": %v", u.Name, err)
+			return nil, nil
+		}
+		b, err := btncrypt.Decrypt(c, u.WrappedPrivateKey, 32)
+		if err != nil {
+			return nil, nil
+		}
+		if priv, err = toKey(b); err != nil {
+			return nil, nil
+		}
+	}
+
+	kek, ok := box.OpenAnonymous(nil, u.SealedKEK, pub, priv)
+	if !ok {
+		return nil, nil
+	}
+	return priv, kek
+}
+
+func (kr *Keyring) unlock(cred Credential) error {
+	names := kr.userNames()
+	if cred.User != "" {
+		if _, ok := kr.users[cred.User]; !ok {
+			return fmt.Errorf("User \"%s\" not found in keyring", cred.User)
+		}
+		names = []string{cred.User}
+	}
+	for _, name := range names {
+		priv, kek := unlockUser(kr.users[name], cred)
+		if kek == nil {
+			continue
+		}
+		kr.user = name
+		kr.privateKey = priv
+		return kr.setKEK(kek)
+	}
+	if cred.PrivateKey != nil {
+		return ErrUnknownKey
+	}
+	return ErrWrongPassword
+}
+
+// decodeV1 reads the keyring of formatVersion1, and converts it to have DefaultUser with the password.
+func decodeV1(f *keyringFile, password string) (*Keyring, error) {
+	kdf := btncrypt.LegacyKDFParams()
+	if f.KDF != nil {
+		kdf = *f.KDF
+	}
+	key, err := kdf.DeriveKey(password)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive KEK: %v", err)
+	}
+	kr := newKeyring()
+	if err := kr.setKEK(btncrypt.DeriveKey(key, "keyring-kek")); err != nil {
+		return nil, err
+	}
+	if err := kr.decodeKeys(f); err != nil {
+		return nil, err
+	}
+
+	// The KEK derived from the password is replaced by a random one on the next Save.
+	if err := kr.setKEK(util.RandomBytes(btncrypt.KeyLength)); err != nil {
+		return nil, err
+	}
+	if kr.privateKey, err = kr.addPasswordUser(DefaultUser, password, kdf); err != nil {
+		return nil, err
+	}
+	kr.user = DefaultUser
+	kr.upgraded = true
+	return kr, nil
+}
+
+func (kr *Keyring) decodeKeys(f *keyringFile) error {
+	var err error
+	if kr.namingKey, err = kr.unwrap(f.NamingKey); err != nil {
+		return err
+	}
+	for _, wk := range f.Keys {
+		key, err := kr.unwrap(wk.Wrapped)
+		if err != nil {
+			return err
+		}
+		kr.keys[wk.ID] = key
+		kr.createdAt[wk.ID] = wk.CreatedAt
+	}
+	if _, ok := kr.keys[f.PrimaryID]; !ok {
+		return fmt.Errorf("Primary key %d not found in keyring", f.PrimaryID)
+	}
+	kr.primaryID = f.PrimaryID
+	return nil
+}
+
+// Decode reads a keyring, and unlocks it with the password.
+func Decode(r io.Reader, password string) (*Keyring, error) {
+	return DecodeWithCredential(r, Credential{Password: password})
+}
+
+// DecodeWithCredential reads a keyring, and unlocks it as the user cred matches.
+func DecodeWithCredential(r io.Reader, cred Credential) (*Keyring, error) {
+	var f keyringFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("Failed to decode keyring: %v", err)
+	}
+	switch f.Version {
+	case formatVersion1:
+		if cred.PrivateKey != nil {
+			return nil, fmt.Errorf("Keyring version %d can only be unlocked with the password", f.Version)
+		}
+		return decodeV1(&f, cred.Password)
+	case formatVersion:
+		break
+	default:
+		return nil, fmt.Errorf("Unknown keyring version %d", f.Version)
+	}
+
+	kr := newKeyring()
+	for i := range f.Users {
+		u := f.Users[i]
+		kr.users[u.Name] = &u
+	}
+	if err := kr.unlock(cred); err != nil {
+		return nil, err
+	}
+	if err := kr.decodeKeys(&f); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) Encode(w io.Writer) error {
+	f := keyringFile{Version: formatVersion, PrimaryID: kr.primaryID}
+	var err error
+	if f.NamingKey, err = kr.wrap(kr.namingKey); err != nil {
+		return fmt.Errorf("Failed to wrap naming key: %v", err)
+	}
+	for _, id := range kr.KeyIDs() {
+		wrapped, err := kr.wrap(kr.keys[id])
+		if err != nil {
+			return fmt.Errorf("Failed to wrap key %d: %v", id, err)
+		}
+		f.Keys = append(f.Keys, wrappedKey{ID: id, Wrapped: wrapped, CreatedAt: kr.createdAt[id]})
+	}
+	for _, name := range kr.userNames() {
+		f.Users = append(f.Users, *kr.users[name])
+	}
+	return json.NewEncoder(w).Encode(f)
+}
+
+// Load reads the keyring stored in bs, and unlocks it with the password. Returns blobstore.ENOENT if bs has no keyring.
+func Load(bs blobstore.BlobStore, password string) (*Keyring, error) {
+	return LoadWithCredential(bs, Credential{Password: password})
+}
+
+// LoadWithCredential reads the keyring stored in bs, and unlocks it as the user cred matches. Returns blobstore.ENOENT if bs has no keyring.
+func LoadWithCredential(bs blobstore.BlobStore, cred Credential) (*Keyring, error) {
+	r, err := bs.OpenReader(metadata.KeyringBlobpath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return DecodeWithCredential(r, cred)
+}
+
+func (kr *Keyring) Save(bs blobstore.BlobStore) error {
+	w, err := bs.OpenWriter(metadata.KeyringBlobpath)
+	if err != nil {
+		return fmt.Errorf("Failed to open keyring blob for writing: %v", err)
+	}
+	if err := kr.Encode(w); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("Failed to close keyring blob: %v", err)
+	}
+	return nil
+}
+
+// Cipher returns a Cipher which encrypts with the primary key, and is able to decrypt data encrypted with any key in the keyring.
+func (kr *Keyring) Cipher() (btncrypt.Cipher, error) {
+	others := [][]byte{}
+	for _, id := range kr.KeyIDs() {
+		if id != kr.primaryID {
+			others = append(others, kr.keys[id])
+		}
+	}
+	return btncrypt.NewCipherWithKeyID(kr.keys[kr.primaryID], kr.primaryID, others)
+}
+
+// NamingKey returns the secret to derive content-addressed blobpaths from.
+func (kr *Keyring) NamingKey() []byte { return kr.namingKey }
+
+func (kr *Keyring) PrimaryID() uint32 { return kr.primaryID }
+
+// KeyIDs returns IDs of all keys in the keyring in ascending order.
+func (kr *Keyring) KeyIDs() []uint32 {
+	ids := make([]uint32, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (kr *Keyring) CreatedAt(id uint32) time.Time { return kr.createdAt[id] }
+
+// Upgraded reports whether the keyring was decoded from an older format, and should be saved to persist the upgrade.
+func (kr *Keyring) Upgraded() bool { return kr.upgraded }
+
+// User returns the name of the user who unlocked the keyring.
+func (kr *Keyring) User() string { return kr.user }
+
+func (kr *Keyring) userNames() []string {
+	names := make([]string, 0, len(kr.users))
+	for name := range kr.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Users returns all users of the keyring in name order.
+func (kr *Keyring) Users() []UserInfo {
+	us := []UserInfo{}
+	for _, name := range kr.userNames() {
+		u := kr.users[name]
+		info := UserInfo{Name: u.Name, AddedAt: u.AddedAt, KDF: u.KDF}
+		if pub, err := toKey(u.PublicKey); err == nil {
+			info.PublicKey = EncodeUserKey(pub)
+		}
+		us = append(us, info)
+	}
+	return us
+}
+
+// KDFParams returns the KDF parameters of the password of the user who unlocked the keyring. Zero value is returned for public key users.
+func (kr *Keyring) KDFParams() btncrypt.KDFParams {
+	u := kr.users[kr.user]
+	if u == nil || u.KDF == nil {
+		return btncrypt.KDFParams{}
+	}
+	return *u.KDF
+}
+
+// ChangePassword rewraps the private key of the user who unlocked the keyring.
+// Pass the current password with new kdf to migrate to a different KDF.
+func (kr *Keyring) ChangePassword(newpassword string, kdf btncrypt.KDFParams) error {
+	u := kr.users[kr.user]
+	if u == nil || u.KDF == nil {
+		return fmt.Errorf("User \"%s\" is not a password user", kr.user)
+	}
+	return kr.setUserPassword(u, kr.privateKey, newpassword, kdf)
+}
+
+// AddPasswordUser adds a user who unlocks the keyring with password. The user's password key is derived with kdf.
+func (kr *Keyring) AddPasswordUser(name, password string, kdf btncrypt.KDFParams) error {
+	_, err := kr.addPasswordUser(name, password, kdf)
+	return err
+}
+
+// AddPublicKeyUser adds a user who unlocks the keyring with the private key of pub.
+func (kr *Keyring) AddPublicKeyUser(name string, pub *[32]byte) error {
+	_, err := kr.addUser(name, pub)
+	return err
+}
+
+// RemoveUser removes the user, and replaces the KEK so that the user can't unwrap keys added afterwards.
+func (kr *Keyring) RemoveUser(name string) error {
+	if _, ok := kr.users[name]; !ok {
+		return fmt.Errorf("User \"%s\" not found", name)
+	}
+	if name == kr.user {
+		return fmt.Errorf("Can't remove user \"%s\" who unlocked the keyring", name)
+	}
+	delete(kr.users, name)
+	return kr.replaceKEK()
+}
+
+// Rotate generates a new data key, and makes it the primary key. Returns the new key ID.
+func (kr *Keyring) Rotate() uint32 {
+	ids := kr.KeyIDs()
+	newid := ids[len(ids)-1] + 1
+	kr.addKey(newid)
+	return newid
+}
+
+// Retire removes key id from the keyring. Keys from oldestInUse onwards may still be in use, and are refused.
+func (kr *Keyring) Retire(id, oldestInUse uint32) error {
+	if id == kr.primaryID {
+		return fmt.Errorf("Can't retire the primary key %d", id)
+	}
+	if id >= oldestInUse {
+		return fmt.Errorf("Key %d may still be in use. Complete re-encryption of all volumes first.", id)
+	}
+	if _, ok := kr.keys[id]; !ok {
+		return fmt.Errorf("Key %d not found", id)
+	}
+	delete(kr.keys, id)
+	delete(kr.createdAt, id)
+	return nil
+}
@@ -0,0 +1,285 @@
+package keyring_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/keyring"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func testKDFParams(t *testing.T) btncrypt.KDFParams {
+	p, err := btncrypt.NewKDFParams(btncrypt.KDFScrypt)
+	if err != nil {
+		t.Fatalf("NewKDFParams failed: %v", err)
+	}
+	p.N = 1024 // keep the test fast
+	return p
+}
+
+func TestKeyring_SaveLoad(t *testing.T) {
+	bs := TestFileBlobStore()
+
+	if _, err := keyring.Load(bs, "pw"); err != blobstore.ENOENT {
+		t.Errorf("Load on empty blobstore should return ENOENT, got: %v", err)
+	}
+
+	kr, err := keyring.New("pw", testKDFParams(t))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := kr.Save(bs); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	c, err := kr.Cipher()
+	if err != nil {
+		t.Fatalf("Cipher failed: %v", err)
+	}
+	envelope, err := btncrypt.Encrypt(c, HelloWorld)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if _, err := keyring.Load(bs, "wrong"); err != keyring.ErrWrongPassword {
+		t.Errorf("Load with wrong password should fail, got: %v", err)
+	}
+
+	kr2, err := keyring.Load(bs, "pw")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if kr2.PrimaryID() != kr.PrimaryID() || !bytes.Equal(kr2.NamingKey(), kr.NamingKey()) {
+		t.Errorf("Loaded keyring differs")
+	}
+	c2, err := kr2.Cipher()
+	if err != nil {
+		t.Fatalf("Cipher failed: %v", err)
+	}
+	plain, err := btncrypt.Decrypt(c2, envelope, len(HelloWorld))
+	if err != nil || !bytes.Equal(plain, HelloWorld) {
+		t.Errorf("Failed to decrypt with loaded keyring: %v", err)
+	}
+}
+
+func TestKeyring_ChangePasswordAndRotate(t *testing.T) {
+	bs := TestFileBlobStore()
+
+	kr := keyring.NewLegacy("oldpw")
+	legacyc, err := btncrypt.NewCipher(btncrypt.KeyFromPassword("oldpw"))
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+	envelope, err := btncrypt.Encrypt(legacyc, HelloWorld)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if err := kr.ChangePassword("newpw", testKDFParams(t)); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	newid := kr.Rotate()
+	if newid != keyring.LegacyKeyID+1 || kr.PrimaryID() != newid {
+		t.Errorf("Unexpected primary key after rotation: %d", kr.PrimaryID())
+	}
+	if err := kr.Retire(newid, newid+1); err == nil {
+		t.Errorf("Retiring the primary key should fail")
+	}
+	if err := kr.Save(bs); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if _, err := keyring.Load(bs, "oldpw"); err != keyring.ErrWrongPassword {
+		t.Errorf("Load with old password should fail, got: %v", err)
+	}
+	kr2, err := keyring.Load(bs, "newpw")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	c, err := kr2.Cipher()
+	if err != nil {
+		t.Fatalf("Cipher failed: %v", err)
+	}
+	if c.KeyID() != newid {
+		t.Errorf("Unexpected cipher key ID: %d", c.KeyID())
+	}
+	plain, err := btncrypt.Decrypt(c, envelope, len(HelloWorld))
+	if err != nil || !bytes.Equal(plain, HelloWorld) {
+		t.Errorf("Data encrypted with the legacy key should stay readable: %v", err)
+	}
+
+	if err := kr2.Retire(keyring.LegacyKeyID, keyring.LegacyKeyID); err == nil {
+		t.Errorf("Retiring a key still in use should fail")
+	}
+	if err := kr2.Retire(keyring.LegacyKeyID, newid); err != nil {
+		t.Errorf("Retire failed: %v", err)
+	}
+	c, err = kr2.Cipher()
+	if err != nil {
+		t.Fatalf("Cipher failed: %v", err)
+	}
+	if _, err := btncrypt.Decrypt(c, envelope, len(HelloWorld)); err == nil {
+		t.Errorf("Data encrypted with a retired key should be unreadable")
+	}
+}
+
+func TestKeyring_LegacyKDFMigration(t *testing.T) {
+	bs := TestFileBlobStore()
+
+	kr := keyring.NewLegacy("pw")
+	if !kr.KDFParams().IsLegacy() {
+		t.Errorf("Legacy keyring should use legacy KDF: %v", kr.KDFParams())
+	}
+	if err := kr.Save(bs); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	kr, err := keyring.Load(bs, "pw")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	kdf := testKDFParams(t)
+	if err := kr.ChangePassword("pw", kdf); err != nil {
+		t.Fatalf("ChangePassword failed: %v", err)
+	}
+	if err := kr.Save(bs); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	kr2, err := keyring.Load(bs, "pw")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if p := kr2.KDFParams(); p.Algorithm != btncrypt.KDFScrypt || !bytes.Equal(p.Salt, kdf.Salt) {
+		t.Errorf("Unexpected KDF params after migration: %v", p)
+	}
+	if kr2.PrimaryID() != keyring.LegacyKeyID {
+		t.Errorf("KDF migration shouldn't change data keys")
+	}
+}
+
+func TestKeyring_MultiUser(t *testing.T) {
+	bs := TestFileBlobStore()
+
+	kr, err := keyring.New("adminpw", testKDFParams(t))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := kr.AddPasswordUser("alice", "alicepw", testKDFParams(t)); err != nil {
+		t.Fatalf("AddPasswordUser failed: %v", err)
+	}
+	if err := kr.AddPasswordUser("alice", "alicepw2", testKDFParams(t)); err == nil {
+		t.Errorf("Adding a duplicate user should fail")
+	}
+	pub, priv, err := keyring.GenerateUserKey()
+	if err != nil {
+		t.Fatalf("GenerateUserKey failed: %v", err)
+	}
+	if err := kr.AddPublicKeyUser("bob", pub); err != nil {
+		t.Fatalf("AddPublicKeyUser failed: %v", err)
+	}
+	if err := kr.Save(bs); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	alice, err := keyring.Load(bs, "alicepw")
+	if err != nil {
+		t.Fatalf("Load as alice failed: %v", err)
+	}
+	if alice.User() != "alice" || !bytes.Equal(alice.NamingKey(), kr.NamingKey()) {
+		t.Errorf("Unexpected keyring loaded as alice: %s", alice.User())
+	}
+	if _, err := keyring.LoadWithCredential(bs, keyring.Credential{User: "alice", Password: "adminpw"}); err != keyring.ErrWrongPassword {
+		t.Errorf("Load as alice with admin password should fail, got: %v", err)
+	}
+	bob, err := keyring.LoadWithCredential(bs, keyring.Credential{PrivateKey: priv})
+	if err != nil {
+		t.Fatalf("Load as bob failed: %v", err)
+	}
+	if bob.User() != "bob" || bob.PrimaryID() != kr.PrimaryID() {
+		t.Errorf("Unexpected keyring loaded as bob: %s", bob.User())
+	}
+	if us := bob.Users(); len(us) != 3 || us[1].Name != "bob" || us[1].KDF != nil || us[1].PublicKey != keyring.EncodeUserKey(pub) {
+		t.Errorf("Unexpected users: %+v", us)
+	}
+
+	if err := alice.RemoveUser("alice"); err == nil {
+		t.Errorf("Removing the user who unlocked the keyring should fail")
+	}
+	if err := alice.RemoveUser("bob"); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	newid := alice.Rotate()
+	if err := alice.Save(bs); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if _, err := keyring.LoadWithCredential(bs, keyring.Credential{PrivateKey: priv}); err != keyring.ErrUnknownKey {
+		t.Errorf("Load as removed user should fail, got: %v", err)
+	}
+	admin, err := keyring.Load(bs, "adminpw")
+	if err != nil {
+		t.Fatalf("Load as admin failed: %v", err)
+	}
+	if admin.User() != keyring.DefaultUser || admin.PrimaryID() != newid {
+		t.Errorf("Unexpected keyring loaded as admin: %s, %d", admin.User(), admin.PrimaryID())
+	}
+}
+
+func TestKeyring_DecodeVersion1(t *testing.T) {
+	kdf := testKDFParams(t)
+	key, err := kdf.DeriveKey("pw")
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	kek, err := btncrypt.NewCipher(btncrypt.DeriveKey(key, "keyring-kek"))
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+	wrap := func(k []byte) []byte {
+		w, err := btncrypt.Encrypt(kek, k)
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		return w
+	}
+	v1, err := json.Marshal(map[string]interface{}{
+		"Version":   1,
+		"KDF":       kdf,
+		"PrimaryID": 1,
+		"NamingKey": wrap(Key),
+		"Keys":      []interface{}{map[string]interface{}{"ID": 1, "Wrapped": wrap(Key), "CreatedAt": time.Now()}},
+	})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	if _, err := keyring.Decode(bytes.NewReader(v1), "wrong"); err != keyring.ErrWrongPassword {
+		t.Errorf("Decode with wrong password should fail, got: %v", err)
+	}
+	kr, err := keyring.Decode(bytes.NewReader(v1), "pw")
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !kr.Upgraded() || kr.User() != keyring.DefaultUser || kr.PrimaryID() != 1 || !bytes.Equal(kr.NamingKey(), Key) {
+		t.Errorf("Unexpected keyring decoded from version 1")
+	}
+
+	var b bytes.Buffer
+	if err := kr.Encode(&b); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	kr2, err := keyring.Decode(&b, "pw")
+	if err != nil {
+		t.Fatalf("Decode of upgraded keyring failed: %v", err)
+	}
+	if kr2.Upgraded() {
+		t.Errorf("Keyring encoded in the current format should not be marked as upgraded")
+	}
+	if p := kr2.KDFParams(); !bytes.Equal(p.Salt, kdf.Salt) {
+		t.Errorf("Upgraded keyring should keep the KDF: %v", p)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/facade"
+	"github.com/nyaxt/otaru/keyring"
+	"github.com/nyaxt/otaru/util"
+)
+
+var Usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s list\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      List data keys in the keyring.\n")
+	fmt.Fprintf(os.Stderr, "  %s passwd NEW_PASSWORD_FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Change the password of the current user to the one in NEW_PASSWORD_FILE. Update PasswordFile of the config afterwards.\n")
+	fmt.Fprintf(os.Stderr, "  %s kdf\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Rewrap the current user's key with the current password, using the KDF specified by -kdf and a new salt.\n")
+	fmt.Fprintf(os.Stderr, "  %s users\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      List users of the keyring.\n")
+	fmt.Fprintf(os.Stderr, "  %s adduser NAME PASSWORD_FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Add a user who unlocks the keyring with the password in PASSWORD_FILE.\n")
+	fmt.Fprintf(os.Stderr, "  %s addkeyuser NAME PUBLIC_KEY_FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Add a user who unlocks the keyring with the private key of the public key in PUBLIC_KEY_FILE.\n")
+	fmt.Fprintf(os.Stderr, "  %s revoke NAME\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Remove a user, and rotate the data key. Trigger /api/migrate/reencrypt afterwards to re-encrypt existing data.\n")
+	fmt.Fprintf(os.Stderr, "  %s genkey PRIVATE_KEY_FILE\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Generate a key pair for addkeyuser. Writes the private key to PRIVATE_KEY_FILE, and prints the public key.\n")
+	fmt.Fprintf(os.Stderr, "  %s rotate\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Generate a new data key for data written after remount. Trigger /api/migrate/reencrypt to re-encrypt existing data.\n")
+	fmt.Fprintf(os.Stderr, "  %s retire KEYID\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "      Remove a data key. Refused until /api/migrate/reencrypt has completed on every volume after the key was rotated.\n")
+	flag.PrintDefaults()
+}
+
+var (
+	flagConfigFile = flag.String("config", path.Join(os.Getenv("HOME"), ".otaru", "config.toml"), "Config filepath")
+	flagKDF        = flag.String("kdf", "", "KDF algorithm for passwd and kdf commands. Defaults to KDF of the config")
+)
+
+func newKDFParams(alg string) btncrypt.KDFParams {
+	kdf, err := btncrypt.NewKDFParams(alg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return kdf
+}
+
+func oldestKeyIDInUse(cfg *facade.Config) (uint32, error) {
+	o, err := facade.NewOtaru(cfg, &facade.OneshotConfig{ReadOnly: true, NoServices: true, VolumesOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open volumes: %v", err)
+	}
+	defer o.Close()
+	return o.OldestKeyIDInUse()
+}
+
+func genKey(privpath string) {
+	pub, priv, err := keyring.GenerateUserKey()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(privpath, []byte(keyring.EncodeUserKey(priv)+"\n"), 0400); err != nil {
+		log.Fatalf("Failed to write private key: %v", err)
+	}
+	fmt.Println(keyring.EncodeUserKey(pub))
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	flag.Usage = Usage
+	flag.Parse()
+
+	cfg, err := facade.NewConfigFromTomlFile(*flagConfigFile)
+	if err != nil {
+		log.Printf("%v", err)
+		Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() < 1 {
+		Usage()
+		os.Exit(2)
+	}
+
+	if flag.Arg(0) == "genkey" {
+		if flag.NArg() != 2 {
+			Usage()
+			os.Exit(2)
+		}
+		genKey(flag.Arg(1))
+		return
+	}
+
+	bs, err := facade.NewKeyringBlobStore(cfg)
+	if err != nil {
+		log.Fatalf("Failed to init keyring blobstore: %v", err)
+	}
+	cred, err := facade.KeyringCredential(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	kr, err := keyring.LoadWithCredential(bs, cred)
+	if err == blobstore.ENOENT {
+		// The password can't be verified here, so let the filesystem mount create the keyring.
+		log.Fatalf("Keyring not found. Mount the filesystem once to create one.")
+	} else if err != nil {
+		log.Fatalf("Failed to load keyring: %v", err)
+	}
+
+	kdfalg := *flagKDF
+	if kdfalg == "" {
+		kdfalg = cfg.KDF
+	}
+
+	log.Printf("Unlocked keyring as user \"%s\".", kr.User())
+
+	switch flag.Arg(0) {
+	case "list":
+		if kdf := kr.KDFParams(); kdf.Algorithm != "" {
+			fmt.Printf("KDF: %v\n", kdf)
+		}
+		for _, id := range kr.KeyIDs() {
+			primary := ""
+			if id == kr.PrimaryID() {
+				primary = " (primary)"
+			}
+			fmt.Printf("%d\t%v%s\n", id, kr.CreatedAt(id), primary)
+		}
+		return
+	case "passwd":
+		if flag.NArg() != 2 {
+			Usage()
+			os.Exit(2)
+		}
+		if err := kr.ChangePassword(util.StringFromFileOrDie(flag.Arg(1), "new password"), newKDFParams(kdfalg)); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "kdf":
+		if err := kr.ChangePassword(cfg.Password, newKDFParams(kdfalg)); err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("KDF migrated to %v", kr.KDFParams())
+	case "users":
+		for _, u := range kr.Users() {
+			cred := "publickey " + u.PublicKey
+			if u.KDF != nil {
+				cred = fmt.Sprintf("password %v", *u.KDF)
+			}
+			fmt.Printf("%s\t%v\t%s\n", u.Name, u.AddedAt, cred)
+		}
+		return
+	case "adduser":
+		if flag.NArg() != 3 {
+			Usage()
+			os.Exit(2)
+		}
+		if err := kr.AddPasswordUser(flag.Arg(1), util.StringFromFileOrDie(flag.Arg(2), "password"), newKDFParams(kdfalg)); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "addkeyuser":
+		if flag.NArg() != 3 {
+			Usage()
+			os.Exit(2)
+		}
+		pub, err := keyring.ParseUserKey(util.StringFromFileOrDie(flag.Arg(2), "public key"))
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := kr.AddPublicKeyUser(flag.Arg(1), pub); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "revoke":
+		if flag.NArg() != 2 {
+			Usage()
+			os.Exit(2)
+		}
+		if err := kr.RemoveUser(flag.Arg(1)); err != nil {
+			log.Fatalf("%v", err)
+		}
+		id := kr.Rotate()
+		log.Printf("User \"%s\" removed. New primary key: %d", flag.Arg(1), id)
+	case "rotate":
+		id := kr.Rotate()
+		log.Printf("New primary key: %d", id)
+	case "retire":
+		if flag.NArg() != 2 {
+			Usage()
+			os.Exit(2)
+		}
+		id, err := strconv.ParseUint(flag.Arg(1), 10, 32)
+		if err != nil {
+			log.Fatalf("Invalid key ID \"%s\": %v", flag.Arg(1), err)
+		}
+		oldest, err := oldestKeyIDInUse(cfg)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := kr.Retire(uint32(id), oldest); err != nil {
+			log.Fatalf("%v", err)
+		}
+	default:
+		Usage()
+		os.Exit(2)
+	}
+
+	if err := kr.Save(bs); err != nil {
+		log.Fatalf("Failed to save keyring: %v", err)
+	}
+	log.Printf("Keyring saved.")
+}
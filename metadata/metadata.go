@@ -6,6 +6,10 @@ import (
 
 const INodeDBSnapshotBlobpath = "META_INODEDB_SNAPSHOT"
 const VersionCacheBlobpath = "META_VERSION_CACHE"
+const KeyringBlobpath = "META_KEYRING"
+const JobHistoryBlobpath = "META_JOB_HISTORY"
+const GCCandidatesBlobpath = "META_GC_CANDIDATES"
+const WriterLockBlobpath = "META_WRITER_LOCK"
 
 func IsMetadataBlobpath(blobpath string) bool {
 	return strings.HasPrefix(blobpath, "META_")
@@ -0,0 +1,66 @@
+package metadata
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultVolume is the volume of filesystems created before volume support. Its metadata blobs keep the names without the volume.
+const DefaultVolume = "default"
+
+// VolumesBlobpath is the registry of the volumes in the bucket.
+const VolumesBlobpath = "META_VOLUMES"
+
+var volumeNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+func ValidateVolumeName(name string) error {
+	if !volumeNameRE.MatchString(name) {
+		return fmt.Errorf("Invalid volume name \"%s\": must be 1-64 letters, digits, '_' or '-', starting with a letter or a digit", name)
+	}
+	return nil
+}
+
+func volumeBlobpath(volume, blobpath string) string {
+	if volume == DefaultVolume || volume == "" {
+		return blobpath
+	}
+	return fmt.Sprintf("META_VOLUME_%s_%s", volume, blobpath[len("META_"):])
+}
+
+// INodeDBSnapshotBlobpathOf returns the inodedb snapshot blobpath of the volume.
+func INodeDBSnapshotBlobpathOf(volume string) string {
+	return volumeBlobpath(volume, INodeDBSnapshotBlobpath)
+}
+
+// JobHistoryBlobpathOf returns the scheduler job history blobpath of the volume.
+func JobHistoryBlobpathOf(volume string) string {
+	return volumeBlobpath(volume, JobHistoryBlobpath)
+}
+
+// GCCandidatesBlobpathOf returns the blobpath of the GC candidates of the volume.
+func GCCandidatesBlobpathOf(volume string) string {
+	return volumeBlobpath(volume, GCCandidatesBlobpath)
+}
+
+// WriterLockBlobpathOf returns the blobpath of the writer lock of the volume.
+func WriterLockBlobpathOf(volume string) string {
+	return volumeBlobpath(volume, WriterLockBlobpath)
+}
+
+// BlobpathsOfVolume returns all the metadata blobpaths kept per volume.
+func BlobpathsOfVolume(volume string) []string {
+	return []string{
+		INodeDBSnapshotBlobpathOf(volume),
+		JobHistoryBlobpathOf(volume),
+		GCCandidatesBlobpathOf(volume),
+		WriterLockBlobpathOf(volume),
+	}
+}
+
+// TxLogRootKeyOf returns the root key of the inodedb transaction log of the volume in the bucket.
+func TxLogRootKeyOf(bucketName, volume string) string {
+	if volume == DefaultVolume || volume == "" {
+		return bucketName
+	}
+	return bucketName + "/" + volume
+}
@@ -0,0 +1,316 @@
+// Package metrics implements counters, gauges and histograms exported in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric is a named metric family which writes its samples in the Prometheus text exposition format.
+type Metric interface {
+	Name() string
+	writeTo(b *bytes.Buffer)
+}
+
+type desc struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (d *desc) Name() string { return d.name }
+
+func (d *desc) writeHeader(b *bytes.Buffer, typ string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", d.name, typ)
+}
+
+// labelKey joins label values into a map key. The values are checked against the label names.
+func (d *desc) labelKey(lvs []string) string {
+	if len(lvs) != len(d.labelNames) {
+		panic(fmt.Sprintf("Metric %s expects %d label values, but got %d", d.name, len(d.labelNames), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+// formatLabels formats the labels of the key, followed by extra label pairs, in "{a="x",b="y"}" form.
+func (d *desc) formatLabels(key string, extra ...string) string {
+	pairs := []string{}
+	if len(d.labelNames) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", d.labelNames[i], escapeLabelValue(v)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func sortedKeys(m map[string]*float64) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// valueVec is a set of float values keyed by label values, shared by counters and gauges.
+type valueVec struct {
+	desc
+	typ string
+
+	mu     sync.Mutex
+	values map[string]*float64
+}
+
+func (vv *valueVec) add(delta float64, lvs []string) {
+	k := vv.labelKey(lvs)
+
+	vv.mu.Lock()
+	defer vv.mu.Unlock()
+	v, ok := vv.values[k]
+	if !ok {
+		v = new(float64)
+		vv.values[k] = v
+	}
+	*v += delta
+}
+
+func (vv *valueVec) set(val float64, lvs []string) {
+	k := vv.labelKey(lvs)
+
+	vv.mu.Lock()
+	defer vv.mu.Unlock()
+	v, ok := vv.values[k]
+	if !ok {
+		v = new(float64)
+		vv.values[k] = v
+	}
+	*v = val
+}
+
+func (vv *valueVec) writeTo(b *bytes.Buffer) {
+	vv.writeHeader(b, vv.typ)
+
+	vv.mu.Lock()
+	defer vv.mu.Unlock()
+	if len(vv.labelNames) == 0 && len(vv.values) == 0 {
+		// Metrics without labels are exported from the start.
+		fmt.Fprintf(b, "%s 0\n", vv.name)
+		return
+	}
+	for _, k := range sortedKeys(vv.values) {
+		fmt.Fprintf(b, "%s%s %s\n", vv.name, vv.formatLabels(k), formatFloat(*vv.values[k]))
+	}
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by labels.
+type Counter struct{ valueVec }
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{valueVec{desc: desc{name, help, labelNames}, typ: "counter", values: make(map[string]*float64)}}
+}
+
+func (c *Counter) Inc(lvs ...string) { c.add(1, lvs) }
+
+// Add increases the counter by delta. delta must not be negative.
+func (c *Counter) Add(delta float64, lvs ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("Counter %s can't decrease", c.name))
+	}
+	c.add(delta, lvs)
+}
+
+// Gauge is a value which may go up and down, optionally partitioned by labels.
+type Gauge struct{ valueVec }
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{valueVec{desc: desc{name, help, labelNames}, typ: "gauge", values: make(map[string]*float64)}}
+}
+
+func (g *Gauge) Set(v float64, lvs ...string)     { g.set(v, lvs) }
+func (g *Gauge) Add(delta float64, lvs ...string) { g.add(delta, lvs) }
+func (g *Gauge) Inc(lvs ...string)                { g.add(1, lvs) }
+func (g *Gauge) Dec(lvs ...string)                { g.add(-1, lvs) }
+
+// GaugeFunc is a gauge whose value is queried on every scrape.
+type GaugeFunc struct {
+	desc
+	f func() float64
+}
+
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help}, f: f}
+}
+
+func (g *GaugeFunc) writeTo(b *bytes.Buffer) {
+	g.writeHeader(b, "gauge")
+	fmt.Fprintf(b, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// DefBuckets are the default histogram buckets, which suit latencies in seconds from 5ms to 10s.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations in cumulative buckets, optionally partitioned by labels.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+// NewHistogram creates a histogram with the upper bounds of buckets, which must be sorted. nil buckets means DefBuckets.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("Buckets of histogram %s aren't sorted", name))
+	}
+	return &Histogram{
+		desc:    desc{name, help, labelNames},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+func (h *Histogram) Observe(v float64, lvs ...string) {
+	k := h.labelKey(lvs)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, ub := range h.buckets {
+		if v <= ub {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// ObserveSince observes the time elapsed since start in seconds.
+func (h *Histogram) ObserveSince(start time.Time, lvs ...string) {
+	h.Observe(time.Since(start).Seconds(), lvs...)
+}
+
+func (h *Histogram) writeTo(b *bytes.Buffer) {
+	h.writeHeader(b, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ks := make([]string, 0, len(h.values))
+	for k := range h.values {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		hv := h.values[k]
+		for i, ub := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.formatLabels(k, "le", formatFloat(ub)), hv.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.formatLabels(k, "le", "+Inf"), hv.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, h.formatLabels(k), formatFloat(hv.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, h.formatLabels(k), hv.count)
+	}
+}
+
+// Registry is a set of metrics exported together.
+type Registry struct {
+	mu sync.Mutex
+	ms map[string]Metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{ms: make(map[string]Metric)}
+}
+
+// DefaultRegistry is the registry exported by Handler.
+var DefaultRegistry = NewRegistry()
+
+// Register adds the metrics to the registry, replacing the ones registered with the same names.
+func (r *Registry) Register(ms ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range ms {
+		r.ms[m.Name()] = m
+	}
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.ms))
+	for name := range r.ms {
+		names = append(names, name)
+	}
+	ms := make([]Metric, 0, len(r.ms))
+	sort.Strings(names)
+	for _, name := range names {
+		ms = append(ms, r.ms[name])
+	}
+	r.mu.Unlock()
+
+	var b bytes.Buffer
+	for _, m := range ms {
+		m.writeTo(&b)
+	}
+	return b.WriteTo(w)
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteTo(w)
+	})
+}
+
+// Register adds the metrics to DefaultRegistry.
+func Register(ms ...Metric) { DefaultRegistry.Register(ms...) }
+
+// Handler serves the metrics of DefaultRegistry.
+func Handler() http.Handler { return DefaultRegistry.Handler() }
@@ -0,0 +1,83 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nyaxt/otaru/metrics"
+)
+
+func export(t *testing.T, r *metrics.Registry) string {
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	return b.String()
+}
+
+func TestRegistry_Exposition(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	c := metrics.NewCounter("test_requests_total", "Number of requests.", "impl", "op")
+	c.Inc("gcs", "read")
+	c.Add(2, "gcs", "read")
+	c.Inc("file", "write \"x\"")
+	g := metrics.NewGauge("test_queue_depth", "Depth of\nthe queue.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	gf := metrics.NewGaugeFunc("test_temperature", "Current temperature.", func() float64 { return 36.5 })
+	h := metrics.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	h.Observe(0.05, "read")
+	h.Observe(0.5, "read")
+	h.Observe(5, "read")
+	r.Register(c, g, gf, h)
+
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="read",le="0.1"} 1
+test_latency_seconds_bucket{op="read",le="1"} 2
+test_latency_seconds_bucket{op="read",le="+Inf"} 3
+test_latency_seconds_sum{op="read"} 5.55
+test_latency_seconds_count{op="read"} 3
+# HELP test_queue_depth Depth of\nthe queue.
+# TYPE test_queue_depth gauge
+test_queue_depth 1
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{impl="file",op="write \"x\""} 1
+test_requests_total{impl="gcs",op="read"} 3
+# HELP test_temperature Current temperature.
+# TYPE test_temperature gauge
+test_temperature 36.5
+`
+	if got := export(t, r); got != expected {
+		t.Errorf("Unexpected exposition:\n%s", got)
+	}
+}
+
+func TestRegistry_ReplacesSameName(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Register(metrics.NewGaugeFunc("test_value", "Value.", func() float64 { return 1 }))
+	r.Register(metrics.NewGaugeFunc("test_value", "Value.", func() float64 { return 2 }))
+
+	if got := export(t, r); !strings.Contains(got, "test_value 2\n") || strings.Contains(got, "test_value 1\n") {
+		t.Errorf("Unexpected exposition:\n%s", got)
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Register(metrics.NewCounter("test_total", "Total."))
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected content type: %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "test_total 0\n") {
+		t.Errorf("Unexpected body:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,136 @@
+package mgmt
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleReadOnly may only issue requests which don't modify anything, such as polling stats.
+	RoleReadOnly
+	// RoleReader may also read the file content, such as downloads, archives and WebDAV.
+	RoleReader
+	// RoleAdmin may also trigger jobs and modify the filesystem.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleNone:
+		return "none"
+	case RoleReadOnly:
+		return "readonly"
+	case RoleReader:
+		return "reader"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "readonly":
+		return RoleReadOnly, nil
+	case "reader":
+		return RoleReader, nil
+	case "", "admin":
+		return RoleAdmin, nil
+	default:
+		return RoleNone, fmt.Errorf("Unknown role: \"%s\"", s)
+	}
+}
+
+// Credential grants Role to the requests with either the bearer Token, or HTTP basic auth of User and Password.
+type Credential struct {
+	Token    string
+	User     string
+	Password string
+	Role
+}
+
+// readOnlyMethods are the methods allowed to RoleReadOnly and RoleReader. The handlers never modify anything on these methods.
+var readOnlyMethods = map[string]struct{}{
+	"GET":      struct{}{},
+	"HEAD":     struct{}{},
+	"OPTIONS":  struct{}{},
+	"PROPFIND": struct{}{},
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Authenticator authorizes requests against the credentials. It lets every request pass as RoleAdmin if no credential is given.
+type Authenticator struct {
+	creds []Credential
+}
+
+func NewAuthenticator(creds []Credential) *Authenticator {
+	return &Authenticator{creds: creds}
+}
+
+func (a *Authenticator) Enabled() bool { return len(a.creds) > 0 }
+
+// Authenticate returns the role granted to the request. It returns RoleNone if the request has no valid credential.
+func (a *Authenticator) Authenticate(req *http.Request) Role {
+	if !a.Enabled() {
+		return RoleAdmin
+	}
+
+	role := RoleNone
+	authz := req.Header.Get("Authorization")
+	if strings.HasPrefix(authz, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(authz, "Bearer "))
+		for _, c := range a.creds {
+			if c.Token != "" && secureEqual(c.Token, token) && c.Role > role {
+				role = c.Role
+			}
+		}
+		return role
+	}
+	if user, password, ok := req.BasicAuth(); ok {
+		for _, c := range a.creds {
+			if c.User != "" && secureEqual(c.User, user) && secureEqual(c.Password, password) && c.Role > role {
+				role = c.Role
+			}
+		}
+	}
+	return role
+}
+
+// Wrap returns a handler which serves h only to the requests authorized for their method.
+func (a *Authenticator) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch role := a.Authenticate(req); role {
+		case RoleNone:
+			w.Header().Set("WWW-Authenticate", `Basic realm="otaru"`)
+			http.Error(w, "Authentication required.", http.StatusUnauthorized)
+		case RoleReadOnly, RoleReader:
+			if _, ok := readOnlyMethods[req.Method]; !ok {
+				http.Error(w, fmt.Sprintf("%s requests require admin role.", req.Method), http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, req)
+		default:
+			h.ServeHTTP(w, req)
+		}
+	})
+}
+
+// Require returns a handler which serves h only to the requests granted role or higher. Use it under Wrap, which checks the methods.
+func (a *Authenticator) Require(role Role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.Authenticate(req) < role {
+			http.Error(w, fmt.Sprintf("%s requires %v role.", req.URL.Path, role), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
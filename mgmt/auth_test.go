@@ -0,0 +1,119 @@
+package mgmt_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/nyaxt/otaru/mgmt"
+)
+
+func newTestServer(t *testing.T, opts mgmt.Options) *mgmt.Server {
+	srv, err := mgmt.NewServer(opts)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.APIRouter().HandleFunc("/stats", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return map[string]int{"n": 1}
+	}))
+	srv.APIRouter().HandleFunc("/trigger", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return "triggered"
+	}))
+	srv.APIRouter().Handle("/content", srv.Authenticator().Require(mgmt.RoleReader, mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return "content"
+	})))
+	return srv
+}
+
+type authReq struct {
+	method string
+	path   string
+	setup  func(req *http.Request)
+	status int
+}
+
+func TestServer_Auth(t *testing.T) {
+	srv := newTestServer(t, mgmt.Options{
+		Credentials: []mgmt.Credential{
+			{Token: "admintoken", Role: mgmt.RoleAdmin},
+			{User: "dashboard", Password: "pw", Role: mgmt.RoleReadOnly},
+			{Token: "readertoken", Role: mgmt.RoleReader},
+		},
+	})
+
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user, password string) func(req *http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+	for _, r := range []authReq{
+		{"GET", "/healthz", nil, http.StatusOK},
+		{"GET", "/api/stats", nil, http.StatusUnauthorized},
+		{"GET", "/metrics", nil, http.StatusUnauthorized},
+		{"GET", "/api/stats", bearer("wrong"), http.StatusUnauthorized},
+		{"GET", "/api/stats", bearer("admintoken"), http.StatusOK},
+		{"POST", "/api/trigger", bearer("admintoken"), http.StatusOK},
+		{"GET", "/api/stats", basic("dashboard", "wrong"), http.StatusUnauthorized},
+		{"GET", "/api/stats", basic("dashboard", "pw"), http.StatusOK},
+		{"GET", "/metrics", basic("dashboard", "pw"), http.StatusOK},
+		{"POST", "/api/trigger", basic("dashboard", "pw"), http.StatusForbidden},
+		{"GET", "/api/content", basic("dashboard", "pw"), http.StatusForbidden},
+		{"GET", "/api/content", bearer("readertoken"), http.StatusOK},
+		{"GET", "/api/content", bearer("admintoken"), http.StatusOK},
+		{"GET", "/api/stats", bearer("readertoken"), http.StatusOK},
+		{"POST", "/api/trigger", bearer("readertoken"), http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(r.method, r.path, nil)
+		if r.setup != nil {
+			r.setup(req)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != r.status {
+			t.Errorf("%s %s (%s): expected status %d, got %d", r.method, r.path, req.Header.Get("Authorization"), r.status, w.Code)
+		}
+	}
+}
+
+func TestServer_NoAuth(t *testing.T) {
+	srv := newTestServer(t, mgmt.Options{})
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/api/trigger", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 without credentials configured, got %d", w.Code)
+	}
+}
+
+func TestServer_SelfSignedTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmttlstest")
+	if err != nil {
+		t.Fatalf("Failed to create tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := mgmt.Options{
+		TLSSelfSigned: true,
+		TLSCertFile:   path.Join(dir, "cert.pem"),
+		TLSKeyFile:    path.Join(dir, "key.pem"),
+	}
+	newTestServer(t, opts)
+
+	// The certificate generated on first start is reused.
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load generated cert: %v", err)
+	}
+	newTestServer(t, opts)
+	cert2, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load cert: %v", err)
+	}
+	if string(cert.Certificate[0]) != string(cert2.Certificate[0]) {
+		t.Errorf("Self-signed cert was regenerated")
+	}
+}
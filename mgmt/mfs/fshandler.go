@@ -0,0 +1,355 @@
+package mfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/archive"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/mgmt"
+)
+
+type Stat struct {
+	Name string     `json:"name"`
+	Path string     `json:"path"`
+	ID   inodedb.ID `json:"id"`
+	Type string     `json:"type"`
+	Size int64      `json:"size"`
+}
+
+// TrashEntry is an entry in the trash, with the attributes of the node removed.
+type TrashEntry struct {
+	Name      string     `json:"name"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	OrigPath  string     `json:"orig_path"`
+	ID        inodedb.ID `json:"id"`
+	Type      string     `json:"type"`
+	Size      int64      `json:"size"`
+}
+
+func stat(fs *otaru.FileSystem, fullpath string, id inodedb.ID) (Stat, error) {
+	a, err := fs.Attr(id)
+	if err != nil {
+		return Stat{}, err
+	}
+	return Stat{
+		Name: path.Base(fullpath),
+		Path: fullpath,
+		ID:   a.ID,
+		Type: a.Type.String(),
+		Size: a.Size,
+	}, nil
+}
+
+// statusOf maps errors from otaru.FileSystem to HTTP status codes.
+func statusOf(err error) int {
+	var errno syscall.Errno
+	switch e := err.(type) {
+	case syscall.Errno:
+		errno = e
+	case inodedb.Errno:
+		errno = syscall.Errno(e)
+	default:
+		return http.StatusInternalServerError
+	}
+	switch errno {
+	case syscall.ENOENT:
+		return http.StatusNotFound
+	case syscall.EEXIST, syscall.ENOTDIR, syscall.EISDIR, syscall.ENOTEMPTY:
+		return http.StatusConflict
+	case syscall.EACCES, syscall.EPERM:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), statusOf(err))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// pathParam returns the cleaned "path" query parameter, which must be absolute.
+func pathParam(req *http.Request, key string) (string, error) {
+	p := req.URL.Query().Get(key)
+	if len(p) < 1 || p[0] != '/' {
+		return "", fmt.Errorf("Query parameter \"%s\" must be an absolute path, but given: \"%s\"", key, p)
+	}
+	return path.Clean(p), nil
+}
+
+// handler adapts a handler func which takes the "path" query parameter and returns a JSON result.
+func handler(method string, f func(fullpath string, req *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			http.Error(w, fmt.Sprintf("%s should be requested with %s method.", req.URL.Path, method), http.StatusMethodNotAllowed)
+			return
+		}
+		fullpath, err := pathParam(req, "path")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := f(fullpath, req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, res)
+	}
+}
+
+func serveDownload(fs *otaru.FileSystem, w http.ResponseWriter, req *http.Request, fullpath string) {
+	id, err := fs.FindNodeFullPath(fullpath)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fh, err := fs.OpenFile(id, fl.O_RDONLY)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer fh.Close()
+
+	// ServeContent handles Range and HEAD. Otaru doesn't keep mtime, so conditional requests aren't supported.
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(fullpath)}))
+	http.ServeContent(w, req, path.Base(fullpath), time.Time{}, otaru.NewFileHandleIO(fh))
+}
+
+func Install(srv *mgmt.Server, fs *otaru.FileSystem) {
+	rtr := srv.APIRouter().PathPrefix("/fs").Subrouter()
+
+	rtr.HandleFunc("/ls", handler("GET", func(fullpath string, req *http.Request) (interface{}, error) {
+		id, err := fs.FindDirFullPath(fullpath)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := fs.DirEntries(id)
+		if err != nil {
+			return nil, err
+		}
+
+		ss := make([]Stat, 0, len(entries))
+		for name, id := range entries {
+			s, err := stat(fs, path.Join(fullpath, name), id)
+			if err != nil {
+				return nil, err
+			}
+			ss = append(ss, s)
+		}
+		sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+		return ss, nil
+	}))
+	rtr.HandleFunc("/stat", handler("GET", func(fullpath string, req *http.Request) (interface{}, error) {
+		id, err := fs.FindNodeFullPath(fullpath)
+		if err != nil {
+			return nil, err
+		}
+		return stat(fs, fullpath, id)
+	}))
+	auth := srv.Authenticator()
+	rtr.Handle("/content", auth.Require(mgmt.RoleReader, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD":
+			fullpath, err := pathParam(req, "path")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			serveDownload(fs, w, req, fullpath)
+		case "PUT":
+			handler("PUT", func(fullpath string, req *http.Request) (interface{}, error) {
+				if _, err := fs.WriteFileFullPath(fullpath, req.Body); err != nil {
+					return nil, err
+				}
+				id, err := fs.FindNodeFullPath(fullpath)
+				if err != nil {
+					return nil, err
+				}
+				return stat(fs, fullpath, id)
+			})(w, req)
+		default:
+			http.Error(w, "/content should be requested with GET, HEAD or PUT method.", http.StatusMethodNotAllowed)
+		}
+	})))
+	rtr.HandleFunc("/mkdir", handler("POST", func(fullpath string, req *http.Request) (interface{}, error) {
+		id, err := fs.CreateDirFullPath(fullpath)
+		if err != nil {
+			return nil, err
+		}
+		return stat(fs, fullpath, id)
+	}))
+	rtr.HandleFunc("/rename", handler("POST", func(fullpath string, req *http.Request) (interface{}, error) {
+		dstpath, err := pathParam(req, "dst")
+		if err != nil {
+			return nil, err
+		}
+		if err := fs.RenameFullPath(fullpath, dstpath); err != nil {
+			return nil, err
+		}
+		id, err := fs.FindNodeFullPath(dstpath)
+		if err != nil {
+			return nil, err
+		}
+		return stat(fs, dstpath, id)
+	}))
+	rtr.HandleFunc("/clone", handler("POST", func(fullpath string, req *http.Request) (interface{}, error) {
+		dstpath, err := pathParam(req, "dst")
+		if err != nil {
+			return nil, err
+		}
+		id, err := fs.CloneTreeFullPath(fullpath, dstpath)
+		if err != nil {
+			return nil, err
+		}
+		return stat(fs, dstpath, id)
+	}))
+	rtr.HandleFunc("/remove", handler("POST", func(fullpath string, req *http.Request) (interface{}, error) {
+		if err := fs.RemoveFullPath(fullpath); err != nil {
+			return nil, err
+		}
+		return struct{}{}, nil
+	}))
+	rtr.HandleFunc("/trash", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "/trash should be requested with GET method.", http.StatusMethodNotAllowed)
+			return
+		}
+		tes, err := fs.ListTrash()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res := make([]TrashEntry, 0, len(tes))
+		for _, te := range tes {
+			res = append(res, TrashEntry{
+				Name:      te.Name,
+				DeletedAt: te.DeletedAt,
+				OrigPath:  te.OrigPath,
+				ID:        te.ID,
+				Type:      te.Type.String(),
+				Size:      te.Size,
+			})
+		}
+		writeJSON(w, res)
+	})
+	rtr.HandleFunc("/trash/restore", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "/trash/restore should be requested with POST method.", http.StatusMethodNotAllowed)
+			return
+		}
+		name := req.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "Query parameter \"name\" must be given.", http.StatusBadRequest)
+			return
+		}
+		// The entry is restored to the path it was removed from unless "dst" is given.
+		var dstpath string
+		if req.URL.Query().Get("dst") != "" {
+			var err error
+			if dstpath, err = pathParam(req, "dst"); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		dstpath, err := fs.RestoreTrash(name, dstpath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		id, err := fs.FindNodeFullPath(dstpath)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		s, err := stat(fs, dstpath, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, s)
+	})
+	rtr.HandleFunc("/trash/purge", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "/trash/purge should be requested with POST method.", http.StatusMethodNotAllowed)
+			return
+		}
+		// Only the entries older than the retention are purged unless "all" is given.
+		var n int
+		var err error
+		if req.URL.Query().Get("all") != "" {
+			n, err = fs.PurgeTrash(context.Background(), time.Now())
+		} else {
+			n, err = fs.PurgeExpiredTrash(context.Background())
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, struct {
+			NumPurged int `json:"num_purged"`
+		}{n})
+	})
+	rtr.Handle("/tar", auth.Require(mgmt.RoleReader, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			http.Error(w, "/tar should be requested with GET method.", http.StatusMethodNotAllowed)
+			return
+		}
+		fullpath, err := pathParam(req, "path")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveTar(fs, w, req, fullpath)
+	})))
+	rtr.HandleFunc("/untar", handler("POST", func(fullpath string, req *http.Request) (interface{}, error) {
+		comp, err := archive.ParseCompression(req.URL.Query().Get("compression"))
+		if err != nil {
+			return nil, err
+		}
+		return archive.ExtractTar(fs, fullpath, req.Body, comp)
+	}))
+}
+
+func serveTar(fs *otaru.FileSystem, w http.ResponseWriter, req *http.Request, fullpath string) {
+	comp, err := archive.ParseCompression(req.URL.Query().Get("compression"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := fs.FindNodeFullPath(fullpath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	name := path.Base(fullpath)
+	if fullpath == "/" {
+		name = "root"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + comp.Ext()}))
+	// The status is already sent once the archive starts streaming, so errors can only be logged.
+	if err := archive.WriteTar(fs, fullpath, w, comp); err != nil {
+		log.Printf("Failed to stream tar of \"%s\": %v", fullpath, err)
+	}
+}
@@ -0,0 +1,214 @@
+package mfs_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/mgmt"
+	"github.com/nyaxt/otaru/mgmt/mfs"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	return newTestServerForFS(t, TestFileSystem())
+}
+
+func newTestServerForFS(t *testing.T, fs *otaru.FileSystem) *httptest.Server {
+	srv, err := mgmt.NewServer(mgmt.Options{})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	mfs.Install(srv, fs)
+	return httptest.NewServer(srv.Handler())
+}
+
+func do(t *testing.T, method, url, body string, hdr map[string]string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestFSHandler(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	api := ts.URL + "/api/fs"
+
+	if code, _ := do(t, "POST", api+"/mkdir?path=/dir", "", nil); code != http.StatusOK {
+		t.Errorf("mkdir: %d", code)
+	}
+	if code, _ := do(t, "POST", api+"/mkdir?path=/dir", "", nil); code != http.StatusConflict {
+		t.Errorf("mkdir existing dir: %d, expected 409", code)
+	}
+	if code, _ := do(t, "PUT", api+"/content?path=/dir/hello.txt", "hello world!", nil); code != http.StatusOK {
+		t.Errorf("upload: %d", code)
+	}
+	// Replace with a shorter content.
+	if code, _ := do(t, "PUT", api+"/content?path=/dir/hello.txt", "hello otaru", nil); code != http.StatusOK {
+		t.Errorf("upload replace: %d", code)
+	}
+
+	code, body := do(t, "GET", api+"/content?path=/dir/hello.txt", "", nil)
+	if code != http.StatusOK || body != "hello otaru" {
+		t.Errorf("download: %d %q", code, body)
+	}
+	code, body = do(t, "GET", api+"/content?path=/dir/hello.txt", "", map[string]string{"Range": "bytes=6-"})
+	if code != http.StatusPartialContent || body != "otaru" {
+		t.Errorf("ranged download: %d %q", code, body)
+	}
+
+	code, body = do(t, "GET", api+"/ls?path=/dir", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("ls: %d", code)
+	}
+	if resp, err := http.Get(api + "/ls?path=/dir"); err != nil {
+		t.Errorf("ls failed: %v", err)
+	} else {
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Unexpected Content-Type: %s", ct)
+		}
+	}
+	var ss []mfs.Stat
+	if err := json.Unmarshal([]byte(body), &ss); err != nil {
+		t.Fatalf("Failed to unmarshal ls result: %v", err)
+	}
+	if len(ss) != 1 || ss[0].Name != "hello.txt" || ss[0].Type != "file" || ss[0].Size != 11 {
+		t.Errorf("unexpected ls result: %+v", ss)
+	}
+
+	if code, _ := do(t, "POST", api+"/clone?path=/dir/hello.txt&dst=/dir/clone.txt", "", nil); code != http.StatusOK {
+		t.Errorf("clone: %d", code)
+	}
+	code, body = do(t, "GET", api+"/content?path=/dir/clone.txt", "", nil)
+	if code != http.StatusOK || body != "hello otaru" {
+		t.Errorf("download clone: %d %q", code, body)
+	}
+	if code, _ := do(t, "POST", api+"/clone?path=/dir/hello.txt&dst=/dir/clone.txt", "", nil); code != http.StatusConflict {
+		t.Errorf("clone to existing: %d, expected 409", code)
+	}
+	if code, _ := do(t, "POST", api+"/remove?path=/dir/clone.txt", "", nil); code != http.StatusOK {
+		t.Errorf("remove clone: %d", code)
+	}
+	if code, _ := do(t, "POST", api+"/clone?path=/dir&dst=/dir-clone", "", nil); code != http.StatusOK {
+		t.Errorf("clone dir: %d", code)
+	}
+	code, body = do(t, "GET", api+"/content?path=/dir-clone/hello.txt", "", nil)
+	if code != http.StatusOK || body != "hello otaru" {
+		t.Errorf("download from cloned dir: %d %q", code, body)
+	}
+
+	if code, _ := do(t, "POST", api+"/rename?path=/dir/hello.txt&dst=/hello.txt", "", nil); code != http.StatusOK {
+		t.Errorf("rename: %d", code)
+	}
+	if code, _ := do(t, "GET", api+"/stat?path=/dir/hello.txt", "", nil); code != http.StatusNotFound {
+		t.Errorf("stat renamed src: %d, expected 404", code)
+	}
+	if code, _ := do(t, "POST", api+"/remove?path=/", "", nil); code != http.StatusForbidden {
+		t.Errorf("remove root: %d, expected 403", code)
+	}
+	if code, _ := do(t, "POST", api+"/remove?path=/hello.txt", "", nil); code != http.StatusOK {
+		t.Errorf("remove: %d", code)
+	}
+	if code, _ := do(t, "GET", api+"/content?path=/hello.txt", "", nil); code != http.StatusNotFound {
+		t.Errorf("download removed: %d, expected 404", code)
+	}
+	if code, _ := do(t, "GET", api+"/mkdir?path=/foo", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("mkdir with GET: %d, expected 405", code)
+	}
+}
+
+func TestFSHandler_Trash(t *testing.T) {
+	fs := TestFileSystem()
+	fs.EnableTrash(time.Hour)
+	ts := newTestServerForFS(t, fs)
+	defer ts.Close()
+	api := ts.URL + "/api/fs"
+
+	if code, _ := do(t, "PUT", api+"/content?path=/hello.txt", "hello otaru", nil); code != http.StatusOK {
+		t.Errorf("upload: %d", code)
+	}
+	if code, _ := do(t, "POST", api+"/remove?path=/hello.txt", "", nil); code != http.StatusOK {
+		t.Errorf("remove: %d", code)
+	}
+
+	code, body := do(t, "GET", api+"/trash", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("trash: %d", code)
+	}
+	var tes []mfs.TrashEntry
+	if err := json.Unmarshal([]byte(body), &tes); err != nil {
+		t.Fatalf("Failed to unmarshal trash result: %v", err)
+	}
+	if len(tes) != 1 || tes[0].OrigPath != "/hello.txt" || tes[0].Type != "file" || tes[0].Size != 11 {
+		t.Fatalf("unexpected trash result: %+v", tes)
+	}
+
+	if code, _ := do(t, "POST", api+"/trash/restore", "", nil); code != http.StatusBadRequest {
+		t.Errorf("restore without name: %d, expected 400", code)
+	}
+	if code, _ := do(t, "POST", api+"/trash/restore?name=nonexistent", "", nil); code != http.StatusNotFound {
+		t.Errorf("restore nonexistent: %d, expected 404", code)
+	}
+	if code, _ := do(t, "POST", api+"/trash/restore?name="+tes[0].Name+"&dst=/restored/hello.txt", "", nil); code != http.StatusOK {
+		t.Errorf("restore: %d", code)
+	}
+	code, body = do(t, "GET", api+"/content?path=/restored/hello.txt", "", nil)
+	if code != http.StatusOK || body != "hello otaru" {
+		t.Errorf("download restored: %d %q", code, body)
+	}
+
+	if code, _ := do(t, "POST", api+"/remove?path=/restored/hello.txt", "", nil); code != http.StatusOK {
+		t.Errorf("remove: %d", code)
+	}
+	if code, body := do(t, "POST", api+"/trash/purge", "", nil); code != http.StatusOK || body != `{"num_purged":0}` {
+		t.Errorf("purge: %d %q", code, body)
+	}
+	if code, body := do(t, "POST", api+"/trash/purge?all=1", "", nil); code != http.StatusOK || body != `{"num_purged":1}` {
+		t.Errorf("purge all: %d %q", code, body)
+	}
+	if code, body := do(t, "GET", api+"/trash", "", nil); code != http.StatusOK || body != "[]" {
+		t.Errorf("trash after purge: %d %q", code, body)
+	}
+}
+
+func TestFSHandler_ContentDisposition(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+	api := ts.URL + "/api/fs"
+
+	if code, _ := do(t, "PUT", api+`/content?path=/a%22b.txt`, "hello", nil); code != http.StatusOK {
+		t.Fatalf("put: %d", code)
+	}
+	for _, url := range []string{api + `/content?path=/a%22b.txt`, api + "/tar?path=/a%22b.txt"} {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", url, err)
+		}
+		resp.Body.Close()
+		_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		if err != nil || !strings.HasPrefix(params["filename"], `a"b.txt`) {
+			t.Errorf("Unexpected Content-Disposition of %s: %q, %v", url, resp.Header.Get("Content-Disposition"), err)
+		}
+	}
+}
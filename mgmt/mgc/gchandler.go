@@ -4,14 +4,20 @@ import (
 	"net/http"
 
 	"github.com/nyaxt/otaru/gc"
-	"github.com/nyaxt/otaru/inodedb"
 	"github.com/nyaxt/otaru/mgmt"
 	"github.com/nyaxt/otaru/scheduler"
 )
 
-func Install(srv *mgmt.Server, s *scheduler.Scheduler, bs gc.GCableBlobStore, idb inodedb.DBFscker) {
+type triggerResult struct {
+	JobID scheduler.ID `json:"job_id"`
+}
+
+func Install(srv *mgmt.Server, s *scheduler.Scheduler, g *gc.GC) {
 	rtr := srv.APIRouter().PathPrefix("/gc").Subrouter()
 
+	rtr.HandleFunc("/report", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return g.Report()
+	}))
 	rtr.HandleFunc("/trigger", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != "POST" {
 			http.Error(w, "GC should be triggered with POST method.", http.StatusMethodNotAllowed)
@@ -20,8 +26,19 @@ func Install(srv *mgmt.Server, s *scheduler.Scheduler, bs gc.GCableBlobStore, id
 
 		dryrunp := req.URL.Query().Get("dryrun")
 		dryrun := len(dryrunp) > 0
+		async := len(req.URL.Query().Get("async")) > 0
+
+		task := &gc.GCTask{g, dryrun}
+		if async {
+			// Respond with the job_id right away. The result can be polled at /api/scheduler/job/{id} or /api/gc/report.
+			id := s.RunImmediately(task, nil)
+			mgmt.JSONHandler(func(*http.Request) interface{} {
+				return triggerResult{JobID: id}
+			})(w, req)
+			return
+		}
 
-		jv := s.RunImmediatelyBlock(&gc.GCTask{bs, idb, dryrun})
+		jv := s.RunImmediatelyBlock(task)
 		if err := jv.Result.Err(); err != nil {
 			http.Error(w, "GC task failed with error", http.StatusInternalServerError)
 			return
@@ -39,6 +39,26 @@ func Install(srv *mgmt.Server, h inodedb.DBHandler) {
 
 		return txs
 	}))
+	rtr.HandleFunc("/fsck", func(w http.ResponseWriter, req *http.Request) {
+		prov, ok := h.(inodedb.DBChecker)
+		if !ok {
+			http.Error(w, "Active inodedb doesn't support /fsck", http.StatusNotImplemented)
+			return
+		}
+		repair := len(req.URL.Query().Get("repair")) > 0
+		if repair && req.Method != "POST" {
+			http.Error(w, "Fsck repair should be triggered with POST method.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mgmt.JSONHandler(func(*http.Request) interface{} {
+			r, err := prov.Check(repair)
+			if r == nil {
+				return err
+			}
+			return r
+		})(w, req)
+	})
 	rtr.HandleFunc("/inode/{id:[0-9]+}", mgmt.JSONHandler(func(req *http.Request) interface{} {
 		vars := mux.Vars(req)
 		nid, err := strconv.ParseUint(vars["id"], 10, 32)
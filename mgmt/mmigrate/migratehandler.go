@@ -0,0 +1,40 @@
+package mmigrate
+
+import (
+	"net/http"
+
+	"github.com/nyaxt/otaru/mgmt"
+	"github.com/nyaxt/otaru/migrate"
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+type triggerResult struct {
+	JobID scheduler.ID `json:"job_id"`
+}
+
+// Install exposes the migrator under /api/migrate/{name}.
+func Install(srv *mgmt.Server, s *scheduler.Scheduler, name string, m *migrate.Migrator) {
+	rtr := srv.APIRouter().PathPrefix("/migrate/" + name).Subrouter()
+
+	rtr.HandleFunc("/progress", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return m.Progress()
+	}))
+	rtr.HandleFunc("/trigger", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Migration should be triggered with POST method.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if len(req.URL.Query().Get("restart")) > 0 {
+			if err := m.Reset(); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+
+		id := s.RunImmediately(&migrate.Task{m, name}, nil)
+		mgmt.JSONHandler(func(*http.Request) interface{} {
+			return triggerResult{JobID: id}
+		})(w, req)
+	})
+}
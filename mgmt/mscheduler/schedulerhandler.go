@@ -11,6 +11,15 @@ import (
 	"github.com/nyaxt/otaru/scheduler"
 )
 
+func parseID(req *http.Request) (scheduler.ID, error) {
+	vars := mux.Vars(req)
+	nid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return scheduler.ID(nid), nil
+}
+
 func Install(srv *mgmt.Server, s *scheduler.Scheduler) {
 	rtr := srv.APIRouter().PathPrefix("/scheduler").Subrouter()
 
@@ -21,11 +30,43 @@ func Install(srv *mgmt.Server, s *scheduler.Scheduler) {
 		return s.QueryAll()
 	}))
 	rtr.HandleFunc("/job/{id:[0-9]+}", mgmt.JSONHandler(func(req *http.Request) interface{} {
-		vars := mux.Vars(req)
-		nid, err := strconv.ParseUint(vars["id"], 10, 32)
+		id, err := parseID(req)
+		if err != nil {
+			return err
+		}
+		return s.Query(id)
+	}))
+	rtr.HandleFunc("/history", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return s.QueryHistory()
+	}))
+	rtr.HandleFunc("/recurring/all", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return s.QueryAllRecurring()
+	}))
+	rtr.HandleFunc("/recurring/{id:[0-9]+}", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		id, err := parseID(req)
 		if err != nil {
 			return err
 		}
-		return s.Query(scheduler.ID(nid))
+		return s.QueryRecurring(id)
 	}))
+	installRecurringControl := func(action string, f func(scheduler.ID) error) {
+		rtr.HandleFunc("/recurring/{id:[0-9]+}/"+action, func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "POST" {
+				http.Error(w, "Recurring job "+action+" should be requested with POST method.", http.StatusMethodNotAllowed)
+				return
+			}
+			mgmt.JSONHandler(func(req *http.Request) interface{} {
+				id, err := parseID(req)
+				if err != nil {
+					return err
+				}
+				if err := f(id); err != nil {
+					return err
+				}
+				return s.QueryRecurring(id)
+			})(w, req)
+		})
+	}
+	installRecurringControl("pause", s.PauseRecurring)
+	installRecurringControl("resume", s.ResumeRecurring)
 }
@@ -0,0 +1,39 @@
+package mscrubber
+
+import (
+	"net/http"
+
+	"github.com/nyaxt/otaru/mgmt"
+	"github.com/nyaxt/otaru/scheduler"
+	"github.com/nyaxt/otaru/scrubber"
+)
+
+type triggerResult struct {
+	JobID scheduler.ID `json:"job_id"`
+}
+
+func Install(srv *mgmt.Server, s *scheduler.Scheduler, sc *scrubber.Scrubber) {
+	rtr := srv.APIRouter().PathPrefix("/scrubber").Subrouter()
+
+	rtr.HandleFunc("/report", mgmt.JSONHandler(func(req *http.Request) interface{} {
+		return sc.Report()
+	}))
+	rtr.HandleFunc("/trigger", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Scrub should be triggered with POST method.", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if len(req.URL.Query().Get("restart")) > 0 {
+			if err := sc.Reset(); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+
+		id := s.RunImmediately(&scrubber.Task{sc}, nil)
+		mgmt.JSONHandler(func(*http.Request) interface{} {
+			return triggerResult{JobID: id}
+		})(w, req)
+	})
+}
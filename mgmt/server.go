@@ -1,19 +1,60 @@
 package mgmt
 
 import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
+
+	"github.com/nyaxt/otaru/metrics"
 )
 
+const DefaultListenAddr = "127.0.0.1:10246"
+
+type Options struct {
+	// ListenAddr is the address to listen on. DefaultListenAddr if empty.
+	ListenAddr string
+
+	// TLSCertFile and TLSKeyFile enable TLS with the certificate.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSSelfSigned enables TLS with a self-signed certificate. It is generated into TLSCertFile and TLSKeyFile if they are given but don't exist yet.
+	TLSSelfSigned bool
+
+	// Credentials are required to access /api and /metrics. Everything is open if none is given.
+	Credentials []Credential
+}
+
+func (opts Options) tlsEnabled() bool {
+	return opts.TLSSelfSigned || opts.TLSCertFile != ""
+}
+
 type Server struct {
 	rtr     *mux.Router
 	apirtr  *mux.Router
+	auth    *Authenticator
 	httpsrv *http.Server
+	useTLS  bool
 }
 
-func NewServer() *Server {
+func NewServer(opts Options) (*Server, error) {
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = DefaultListenAddr
+	}
+
+	auth := NewAuthenticator(opts.Credentials)
+	if !auth.Enabled() {
+		if h, _, err := net.SplitHostPort(opts.ListenAddr); err == nil {
+			if ip := net.ParseIP(h); h != "localhost" && (ip == nil || !ip.IsLoopback()) {
+				log.Printf("Warning: mgmt server listens on \"%s\" without authentication.", opts.ListenAddr)
+			}
+		}
+	}
+
 	rtr := mux.NewRouter()
 
 	rtr.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
@@ -21,25 +62,84 @@ func NewServer() *Server {
 		w.Write([]byte("OK"))
 	})
 
-	apirtr := rtr.PathPrefix("/api").Subrouter()
+	rtr.Handle("/metrics", auth.Wrap(metrics.Handler()))
+
+	// The API routes are matched by a separate router, so that all of them are guarded by auth.
+	apiroot := mux.NewRouter()
+	apirtr := apiroot.PathPrefix("/api").Subrouter()
+	rtr.PathPrefix("/api").Handler(auth.Wrap(apiroot))
 
 	// FIXME: Migrate to github.com/elazarl/go-bindata-assetfs
 	rtr.Handle("/", http.FileServer(http.Dir("../www")))
 
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"http://localhost:9000"}, // gulp devsrv
+		AllowedOrigins:   []string{"http://localhost:9000"}, // gulp devsrv
+		AllowedHeaders:   []string{"Authorization"},
+		AllowCredentials: true,
 	})
 
 	httpsrv := &http.Server{
-		Addr:    ":10246",
+		Addr:    opts.ListenAddr,
 		Handler: c.Handler(rtr),
 	}
-	return &Server{rtr: rtr, apirtr: apirtr, httpsrv: httpsrv}
+	if opts.tlsEnabled() {
+		cert, err := loadTLSCert(opts)
+		if err != nil {
+			return nil, err
+		}
+		httpsrv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	return &Server{rtr: rtr, apirtr: apirtr, auth: auth, httpsrv: httpsrv, useTLS: opts.tlsEnabled()}, nil
 }
 
 func (srv *Server) APIRouter() *mux.Router { return srv.apirtr }
 
+// Authenticator returns the authenticator guarding /api, so that handlers served outside /api can share it.
+func (srv *Server) Authenticator() *Authenticator { return srv.auth }
+
+// HandlePrefix serves h for the paths under prefix outside /api, guarded by the same auth as /api.
+func (srv *Server) HandlePrefix(prefix string, h http.Handler) {
+	srv.rtr.PathPrefix(prefix).Handler(srv.auth.Wrap(h))
+}
+
+// RunListener serves h on its own listener at addr, with the same TLS and auth as the mgmt server.
+func (srv *Server) RunListener(addr string, h http.Handler) error {
+	httpsrv := &http.Server{
+		Addr:      addr,
+		Handler:   srv.auth.Wrap(h),
+		TLSConfig: srv.httpsrv.TLSConfig,
+	}
+	if srv.useTLS {
+		log.Printf("Listening on https://%s", addr)
+		if err := httpsrv.ListenAndServeTLS("", ""); err != nil {
+			return fmt.Errorf("Failed to serve: %v", err)
+		}
+		return nil
+	}
+
+	log.Printf("Listening on http://%s", addr)
+	if err := httpsrv.ListenAndServe(); err != nil {
+		return fmt.Errorf("Failed to serve: %v", err)
+	}
+	return nil
+}
+
+// Handler returns the root handler of the server.
+func (srv *Server) Handler() http.Handler { return srv.httpsrv.Handler }
+
 func (srv *Server) Run() error {
+	if srv.useTLS {
+		log.Printf("mgmt server listening on https://%s", srv.httpsrv.Addr)
+		if err := srv.httpsrv.ListenAndServeTLS("", ""); err != nil {
+			return fmt.Errorf("Failed to serve: %v", err)
+		}
+		return nil
+	}
+
+	log.Printf("mgmt server listening on http://%s", srv.httpsrv.Addr)
 	if err := srv.httpsrv.ListenAndServe(); err != nil {
 		return err
 	}
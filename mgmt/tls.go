@@ -0,0 +1,109 @@
+package mgmt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const selfSignedCertValidity = 10 * 365 * 24 * time.Hour
+
+// GenerateSelfSignedCert generates a self-signed certificate and its key in PEM, valid for the hosts.
+func GenerateSelfSignedCert(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to generate serial number: %v", err)
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"otaru"}, CommonName: "otaru mgmt"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create certificate: %v", err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to marshal key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+	return certPEM, keyPEM, nil
+}
+
+// selfSignedHosts returns the hosts the self-signed certificate for the listen address should be valid for.
+func selfSignedHosts(listenAddr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if h, _, err := net.SplitHostPort(listenAddr); err == nil && h != "" {
+		hosts = append(hosts, h)
+	}
+	if h, err := os.Hostname(); err == nil {
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// loadTLSCert loads the certificate for the options, generating a self-signed one if requested.
+func loadTLSCert(opts Options) (tls.Certificate, error) {
+	if opts.TLSSelfSigned && !(opts.TLSCertFile != "" && fileExists(opts.TLSCertFile)) {
+		certPEM, keyPEM, err := GenerateSelfSignedCert(selfSignedHosts(opts.ListenAddr))
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if opts.TLSCertFile != "" && opts.TLSKeyFile != "" {
+			if err := ioutil.WriteFile(opts.TLSKeyFile, keyPEM, 0600); err != nil {
+				return tls.Certificate{}, fmt.Errorf("Failed to write TLS key file: %v", err)
+			}
+			if err := ioutil.WriteFile(opts.TLSCertFile, certPEM, 0644); err != nil {
+				return tls.Certificate{}, fmt.Errorf("Failed to write TLS cert file: %v", err)
+			}
+			log.Printf("Generated self-signed certificate \"%s\".", opts.TLSCertFile)
+		} else {
+			log.Printf("Generated self-signed certificate. It changes on every restart unless TLS cert/key files are given.")
+		}
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to load TLS cert/key: %v", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,532 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+// ChunkPredicate reports whether a chunk with the header needs to be rewritten.
+type ChunkPredicate func(h chunkstore.ChunkHeader) bool
+
+func IsOldFormat(h chunkstore.ChunkHeader) bool {
+	return h.Format() != chunkstore.CurrentFormat
+}
+
+// IsEncryptedWithOtherKey returns a ChunkPredicate matching chunks not encrypted with the data key keyID.
+func IsEncryptedWithOtherKey(keyID uint32) ChunkPredicate {
+	return func(h chunkstore.ChunkHeader) bool {
+		return h.KeyID != keyID
+	}
+}
+
+// HasUnscrubbedOrigFilename returns a ChunkPredicate matching chunks whose OrigFilename isn't recorded as s specifies.
+func HasUnscrubbedOrigFilename(s *chunkstore.PathScrubber) ChunkPredicate {
+	return func(h chunkstore.ChunkHeader) bool {
+		return s.Scrub(h.OrigFilename) != h.OrigFilename
+	}
+}
+
+// HeaderTransform modifies the header of rewritten chunks.
+type HeaderTransform func(h *chunkstore.ChunkHeader)
+
+// ScrubOrigFilename returns a HeaderTransform which scrubs OrigFilename with s.
+func ScrubOrigFilename(s *chunkstore.PathScrubber) HeaderTransform {
+	return func(h *chunkstore.ChunkHeader) {
+		h.OrigFilename = s.Scrub(h.OrigFilename)
+	}
+}
+
+type Progress struct {
+	Running     bool      `json:"running"`
+	Completed   bool      `json:"completed"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+
+	// NextID is the cursor. The next run resumes scanning from the node.
+	NextID inodedb.ID `json:"next_id"`
+	LastID inodedb.ID `json:"last_id"`
+
+	NumFilesScanned    int   `json:"num_files_scanned"`
+	NumChunksScanned   int   `json:"num_chunks_scanned"`
+	NumChunksRewritten int   `json:"num_chunks_rewritten"`
+	NumBytesRewritten  int64 `json:"num_bytes_rewritten"`
+
+	// SkippedIDs lists files which were locked by a writer, or were modified while their chunks were being rewritten. They will be revisited on the next pass.
+	SkippedIDs []inodedb.ID `json:"skipped_ids"`
+
+	LastError string `json:"last_error"`
+}
+
+// Migrator rewrites chunks matching a predicate into the current chunk format, with the current cipher.
+type Migrator struct {
+	bs           blobstore.RandomAccessBlobStore
+	c            btncrypt.Cipher
+	idb          inodedb.DBHandler
+	needsRewrite ChunkPredicate
+	transform    HeaderTransform
+	pinner       chunkstore.BlobPinner
+	onCompleted  func() error
+
+	mu       sync.Mutex
+	progress Progress
+	// dedupCopies maps the dedup chunks rewritten to their copies, so that the other files sharing them are repointed to the same copies.
+	dedupCopies map[string]string
+}
+
+func New(bs blobstore.RandomAccessBlobStore, c btncrypt.Cipher, idb inodedb.DBHandler, needsRewrite ChunkPredicate) *Migrator {
+	return &Migrator{
+		bs:           bs,
+		c:            c,
+		idb:          idb,
+		needsRewrite: needsRewrite,
+		progress:     Progress{NextID: inodedb.RootDirID},
+		dedupCopies:  make(map[string]string),
+	}
+}
+
+// SetHeaderTransform makes the migrator apply f to the headers of rewritten chunks.
+func (m *Migrator) SetHeaderTransform(f HeaderTransform) { m.transform = f }
+
+// SetBlobPinner makes the copies of dedup chunks reused pinned by p until the files are repointed to them.
+func (m *Migrator) SetBlobPinner(p chunkstore.BlobPinner) { m.pinner = p }
+
+// SetOnCompleted sets f called when a pass completes without skipping any file.
+func (m *Migrator) SetOnCompleted(f func() error) { m.onCompleted = f }
+
+func (m *Migrator) Progress() Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.progress
+	p.SkippedIDs = append([]inodedb.ID{}, m.progress.SkippedIDs...)
+	return p
+}
+
+// Reset discards the cursor, so that the next run starts a new pass from the beginning.
+func (m *Migrator) Reset() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.progress.Running {
+		return fmt.Errorf("Can't reset a running migration.")
+	}
+	m.progress = Progress{NextID: inodedb.RootDirID}
+	return nil
+}
+
+func (m *Migrator) updateProgress(f func(p *Progress)) {
+	m.mu.Lock()
+	f(&m.progress)
+	m.mu.Unlock()
+}
+
+func (m *Migrator) Run(ctx context.Context) error {
+	prov, ok := m.idb.(inodedb.DBServiceStatsProvider)
+	if !ok {
+		return fmt.Errorf("Migration requires DBHandler to support GetStats()")
+	}
+
+	m.mu.Lock()
+	if m.progress.Running {
+		m.mu.Unlock()
+		return fmt.Errorf("Migration is already running.")
+	}
+	if m.progress.Completed {
+		m.progress = Progress{NextID: inodedb.RootDirID}
+	}
+	m.progress.Running = true
+	if m.progress.StartedAt.IsZero() {
+		m.progress.StartedAt = time.Now()
+	}
+	m.progress.LastID = prov.GetStats().LastID
+	id := m.progress.NextID
+	lastID := m.progress.LastID
+	m.mu.Unlock()
+
+	defer m.updateProgress(func(p *Progress) { p.Running = false })
+
+	log.Printf("Migration start from node %d to %d.", id, lastID)
+	for ; id <= lastID; id++ {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Detected cancel. Bailing out. The next run will resume from node %d.", id)
+			return err
+		}
+
+		if err := m.migrateNode(id); err != nil {
+			err = fmt.Errorf("Failed to migrate node %d: %v", id, err)
+			m.updateProgress(func(p *Progress) { p.LastError = err.Error() })
+			return err
+		}
+		m.updateProgress(func(p *Progress) { p.NextID = id + 1 })
+		m.reportProgress(ctx)
+	}
+
+	if m.onCompleted != nil && len(m.Progress().SkippedIDs) == 0 {
+		if err := m.onCompleted(); err != nil {
+			err = fmt.Errorf("Failed to complete migration: %v", err)
+			m.updateProgress(func(p *Progress) { p.LastError = err.Error() })
+			return err
+		}
+	}
+
+	m.updateProgress(func(p *Progress) {
+		p.Completed = true
+		p.CompletedAt = time.Now()
+	})
+	log.Printf("Migration done: %+v", m.Progress())
+	return nil
+}
+
+// reportProgress reports the progress of the pass to the scheduler job running it, if any.
+func (m *Migrator) reportProgress(ctx context.Context) {
+	p := m.Progress()
+	fraction := 1.0
+	if p.LastID > 0 {
+		fraction = float64(p.NextID-1) / float64(p.LastID)
+	}
+	scheduler.ReportProgress(ctx, scheduler.Progress{
+		Fraction:       fraction,
+		Message:        fmt.Sprintf("node %d/%d, %d chunks rewritten", p.NextID-1, p.LastID, p.NumChunksRewritten),
+		BytesProcessed: p.NumBytesRewritten,
+	})
+}
+
+type rewrittenChunk struct {
+	orig    inodedb.FileChunk
+	origVer int64
+	newBP   string
+	// unpin releases newBP pinned until the swap, if it was reused.
+	unpin func()
+}
+
+func (m *Migrator) migrateNode(id inodedb.ID) error {
+	v, _, err := m.idb.QueryNode(id, false)
+	if err != nil {
+		if inodedb.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	fv, ok := v.(*inodedb.FileNodeView)
+	if !ok {
+		return nil
+	}
+	m.updateProgress(func(p *Progress) { p.NumFilesScanned++ })
+
+	rcs := []rewrittenChunk{}
+	defer func() {
+		for _, rc := range rcs {
+			if rc.unpin != nil {
+				rc.unpin()
+			}
+		}
+	}()
+	for _, fc := range fv.Chunks {
+		rc, err := m.rewriteChunk(fc)
+		if err != nil {
+			return err
+		}
+		if rc != nil {
+			rcs = append(rcs, *rc)
+		}
+	}
+	if len(rcs) == 0 {
+		return nil
+	}
+
+	// Swap FileChunks to the rewritten blobs.
+	nlock, err := m.idb.LockNode(id)
+	if err != nil {
+		if err == inodedb.ErrLockTaken {
+			log.Printf("Node %d is locked. Skipping for now.", id)
+			m.updateProgress(func(p *Progress) { p.SkippedIDs = append(p.SkippedIDs, id) })
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		if err := m.idb.UnlockNode(nlock); err != nil {
+			log.Printf("Failed to unlock node %d: %v", id, err)
+		}
+	}()
+
+	v, _, err = m.idb.QueryNode(id, false)
+	if err != nil {
+		return err
+	}
+	fv, ok = v.(*inodedb.FileNodeView)
+	if !ok {
+		return nil
+	}
+
+	cs := append([]inodedb.FileChunk{}, fv.Chunks...)
+	swapped := []rewrittenChunk{}
+	for _, rc := range rcs {
+		for i := range cs {
+			if cs[i] != rc.orig {
+				continue
+			}
+			ver, err := m.payloadVersion(rc.orig.BlobPath)
+			if err != nil {
+				return err
+			}
+			if ver != rc.origVer {
+				log.Printf("Chunk %+v was modified while being rewritten. Skipping.", rc.orig)
+				break
+			}
+			cs[i].BlobPath = rc.newBP
+			swapped = append(swapped, rc)
+			break
+		}
+	}
+	if len(swapped) != len(rcs) {
+		m.updateProgress(func(p *Progress) { p.SkippedIDs = append(p.SkippedIDs, id) })
+	}
+	if len(swapped) == 0 {
+		return nil
+	}
+
+	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
+		&inodedb.UpdateChunksOp{NodeLock: nlock, Chunks: cs},
+	}}
+	if _, err := m.idb.ApplyTransaction(tx); err != nil {
+		return fmt.Errorf("Failed to apply tx for updating cs: %v", err)
+	}
+
+	m.mu.Lock()
+	for _, rc := range swapped {
+		if chunkstore.IsDedupBlobPath(rc.orig.BlobPath) {
+			m.dedupCopies[rc.orig.BlobPath] = rc.newBP
+		}
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// reuseDedupCopy returns the copy of the dedup chunk made for another file, if it is still intact. The copy is pinned until the swap.
+func (m *Migrator) reuseDedupCopy(fc inodedb.FileChunk, origVer int64) *rewrittenChunk {
+	m.mu.Lock()
+	copybp, ok := m.dedupCopies[fc.BlobPath]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	unpin := func() {}
+	if m.pinner != nil {
+		unpin = m.pinner.PinBlob(copybp)
+	}
+	if err := m.verifyChunk(copybp); err != nil {
+		log.Printf("Copy \"%s\" of dedup chunk \"%s\" can't be reused: %v", copybp, fc.BlobPath, err)
+		unpin()
+		m.mu.Lock()
+		delete(m.dedupCopies, fc.BlobPath)
+		m.mu.Unlock()
+		return nil
+	}
+	m.updateProgress(func(p *Progress) { p.NumChunksRewritten++ })
+	return &rewrittenChunk{orig: fc, origVer: origVer, newBP: copybp, unpin: unpin}
+}
+
+// verifyChunk reads the whole chunk to make sure that it is intact and doesn't need a rewrite.
+func (m *Migrator) verifyChunk(blobpath string) error {
+	bh, err := m.bs.Open(blobpath, fl.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer bh.Close()
+
+	cr, err := chunkstore.NewChunkReader(&blobstore.OffsetReader{bh, 0}, m.c)
+	if err != nil {
+		return err
+	}
+	if err := cr.Header().VerifyBlobPath(blobpath); err != nil {
+		return err
+	}
+	if m.needsRewrite(cr.Header()) {
+		return fmt.Errorf("Chunk needs to be rewritten")
+	}
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Migrator) readHeader(bh blobstore.BlobHandle) (chunkstore.ChunkHeader, error) {
+	var h chunkstore.ChunkHeader
+	if err := h.ReadFrom(&blobstore.OffsetReader{bh, 0}, m.c); err != nil {
+		return h, fmt.Errorf("Failed to read header: %v", err)
+	}
+	return h, nil
+}
+
+func (m *Migrator) payloadVersion(blobpath string) (int64, error) {
+	bh, err := m.bs.Open(blobpath, fl.O_RDONLY)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open blob \"%s\": %v", blobpath, err)
+	}
+	defer bh.Close()
+
+	h, err := m.readHeader(bh)
+	if err != nil {
+		return 0, err
+	}
+	return h.PayloadVersion, nil
+}
+
+// rewriteChunk rewrites the chunk if it needs to be. It returns nil if no FileChunk update is needed.
+func (m *Migrator) rewriteChunk(fc inodedb.FileChunk) (*rewrittenChunk, error) {
+	bh, err := m.bs.Open(fc.BlobPath, fl.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open blob \"%s\": %v", fc.BlobPath, err)
+	}
+	defer bh.Close()
+
+	h, err := m.readHeader(bh)
+	if err != nil {
+		return nil, fmt.Errorf("Blob \"%s\": %v", fc.BlobPath, err)
+	}
+	if err := h.VerifyBlobPath(fc.BlobPath); err != nil {
+		return nil, err
+	}
+	m.updateProgress(func(p *Progress) { p.NumChunksScanned++ })
+	if !m.needsRewrite(h) {
+		return nil, nil
+	}
+	log.Printf("Rewriting chunk %+v. Format: %x", fc, h.Format())
+
+	cr, err := chunkstore.NewChunkReader(&blobstore.OffsetReader{bh, 0}, m.c)
+	if err != nil {
+		return nil, err
+	}
+	newh := chunkstore.ChunkHeader{
+		PayloadLen:     h.PayloadLen,
+		PayloadVersion: 1,
+		OrigFilename:   h.OrigFilename,
+		OrigOffset:     h.OrigOffset,
+		Compression:    h.Compression,
+	}
+	if m.transform != nil {
+		m.transform(&newh)
+	}
+
+	var newbp string
+	if chunkstore.IsDedupBlobPath(fc.BlobPath) {
+		// Dedup chunks may be shared by other files, so they are copied to a new dedup blob, and the files are repointed to the copy one by one.
+		if rc := m.reuseDedupCopy(fc, h.PayloadVersion); rc != nil {
+			return rc, nil
+		}
+		if newbp, err = chunkstore.GenerateNewDedupBlobPath(m.bs); err != nil {
+			return nil, fmt.Errorf("Failed to generate new blobpath: %v", err)
+		}
+	} else if newbp, err = blobstore.GenerateNewBlobPath(m.bs); err != nil {
+		return nil, fmt.Errorf("Failed to generate new blobpath: %v", err)
+	}
+	nbh, err := m.bs.Open(newbp, fl.O_RDWR|fl.O_CREATE|fl.O_EXCL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open blob \"%s\" for writing: %v", newbp, err)
+	}
+	defer nbh.Close()
+
+	newh.BlobPath = newbp
+	w := &blobstore.OffsetWriter{nbh, 0}
+	if h.Compression != chunkstore.CompressionNone {
+		p, err := ioutil.ReadAll(cr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read chunk \"%s\": %v", fc.BlobPath, err)
+		}
+		if err := chunkstore.WriteChunk(w, m.c, newh, p); err != nil {
+			return nil, err
+		}
+	} else {
+		cw, err := chunkstore.NewChunkWriter(w, m.c, newh)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(cw, cr); err != nil {
+			return nil, fmt.Errorf("Failed to copy chunk \"%s\": %v", fc.BlobPath, err)
+		}
+		if err := cw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	m.updateProgress(func(p *Progress) {
+		p.NumChunksRewritten++
+		p.NumBytesRewritten += w.Offset
+	})
+	return &rewrittenChunk{orig: fc, origVer: h.PayloadVersion, newBP: newbp}, nil
+}
+
+// RestoreProgress restores the progress checkpointed by Task, so that the next run resumes from its cursor.
+func (m *Migrator) RestoreProgress(p Progress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.progress.Running {
+		return fmt.Errorf("Can't restore progress of a running migration.")
+	}
+	p.Running = false
+	m.progress = p
+	return nil
+}
+
+type Task struct {
+	M *Migrator
+	// Name is the name the migrator is installed as. It identifies the migrator to resume on restart.
+	Name string
+}
+
+var _ = scheduler.PersistentTask(&Task{})
+var _ = scheduler.Checkpointer(&Task{})
+var _ = scheduler.JobOptionsProvider(&Task{})
+
+func (t *Task) TaskType() string { return TaskTypePrefix + t.Name }
+func (t *Task) Params() string   { return "" }
+
+func (t *Task) JobOptions() scheduler.JobOptions {
+	return scheduler.JobOptions{Priority: scheduler.PriorityLow, Pool: Pool, PoolLimit: 1}
+}
+
+func (t *Task) Checkpoint() ([]byte, error) {
+	return json.Marshal(t.M.Progress())
+}
+
+func (t *Task) Run(ctx context.Context) scheduler.Result {
+	err := t.M.Run(ctx)
+	return scheduler.ErrorResult{err}
+}
+
+const TaskTypePrefix = "migrate/"
+
+const Pool = "migrate"
+
+// Resumer returns a scheduler.TaskResumer which restores the checkpointed progress to m, and resumes the migration.
+func Resumer(m *Migrator, name string) scheduler.TaskResumer {
+	return func(params string, checkpoint []byte) (scheduler.Task, error) {
+		if checkpoint != nil {
+			var p Progress
+			if err := json.Unmarshal(checkpoint, &p); err != nil {
+				return nil, fmt.Errorf("Failed to decode checkpoint: %v", err)
+			}
+			if err := m.RestoreProgress(p); err != nil {
+				return nil, err
+			}
+		}
+		return &Task{M: m, Name: name}, nil
+	}
+}
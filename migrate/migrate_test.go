@@ -0,0 +1,404 @@
+package migrate_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/migrate"
+	. "github.com/nyaxt/otaru/testutils"
+	"github.com/nyaxt/otaru/util"
+)
+
+func writeLegacyChunk(t *testing.T, bs blobstore.RandomAccessBlobStore, blobpath string, p []byte) {
+	var b bytes.Buffer
+	cw, err := chunkstore.NewChunkWriterOfFormatForTesting(&b, TestCipher(), chunkstore.ChunkHeader{PayloadLen: uint32(len(p)), PayloadVersion: 1}, chunkstore.LegacyFormat)
+	if err != nil {
+		t.Fatalf("NewChunkWriter failed: %v", err)
+	}
+	if _, err := cw.Write(p); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	buf := b.Bytes()
+
+	bh, err := bs.Open(blobpath, fl.O_RDWRCREATE)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bh.Close()
+	if err := bh.PWrite(0, buf); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+}
+
+func createFile(t *testing.T, db *inodedb.DB, name string, cs []inodedb.FileChunk) inodedb.ID {
+	nlock, err := db.LockNode(inodedb.AllocateNewNodeID)
+	if err != nil {
+		t.Fatalf("LockNode failed: %v", err)
+	}
+	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
+		&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: "/" + name, Type: inodedb.FileNodeT},
+		&inodedb.UpdateChunksOp{NodeLock: nlock, Chunks: cs},
+		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{inodedb.RootDirID, inodedb.NoTicket}, Name: name, TargetID: nlock.ID},
+	}}
+	if _, err := db.ApplyTransaction(tx); err != nil {
+		t.Fatalf("ApplyTransaction failed: %v", err)
+	}
+	if err := db.UnlockNode(nlock); err != nil {
+		t.Fatalf("UnlockNode failed: %v", err)
+	}
+	return nlock.ID
+}
+
+func TestMigrator_RewritesOldFormat(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+
+	writeLegacyChunk(t, bs, "legacy", HelloWorld)
+	id := createFile(t, db, "hello.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "legacy"}})
+
+	m := migrate.New(bs, TestCipher(), db, migrate.IsOldFormat)
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+
+	p := m.Progress()
+	if !p.Completed || p.NumChunksRewritten != 1 || len(p.SkippedIDs) != 0 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	v, _, err := db.QueryNode(id, false)
+	if err != nil {
+		t.Fatalf("QueryNode failed: %v", err)
+	}
+	cs := v.(*inodedb.FileNodeView).Chunks
+	if len(cs) != 1 || cs[0].BlobPath == "legacy" {
+		t.Errorf("Chunk not migrated: %+v", cs)
+		return
+	}
+
+	bh, err := bs.Open(cs[0].BlobPath, fl.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bh.Close()
+	cio := chunkstore.NewChunkIO(bh, TestCipher())
+	if f := cio.Header().Format(); f != chunkstore.CurrentFormat {
+		t.Errorf("Unexpected format: %x", f)
+	}
+	readtgt := make([]byte, len(HelloWorld))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(HelloWorld, readtgt) {
+		t.Errorf("Migrated content mismatch")
+	}
+
+	// The second pass should find nothing to rewrite.
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+	if p := m.Progress(); p.NumChunksRewritten != 0 || p.NumChunksScanned != 1 {
+		t.Errorf("Unexpected progress on second pass: %+v", p)
+	}
+}
+
+func TestMigrator_SkipsLockedNode(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+
+	writeLegacyChunk(t, bs, "legacy", HelloWorld)
+	id := createFile(t, db, "hello.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "legacy"}})
+	nlock, err := db.LockNode(id)
+	if err != nil {
+		t.Fatalf("LockNode failed: %v", err)
+	}
+
+	m := migrate.New(bs, TestCipher(), db, migrate.IsOldFormat)
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+	if p := m.Progress(); len(p.SkippedIDs) != 1 || p.SkippedIDs[0] != id {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+	v, _, _ := db.QueryNode(id, false)
+	if cs := v.(*inodedb.FileNodeView).Chunks; cs[0].BlobPath != "legacy" {
+		t.Errorf("Locked node was modified: %+v", cs)
+	}
+
+	if err := db.UnlockNode(nlock); err != nil {
+		t.Fatalf("UnlockNode failed: %v", err)
+	}
+}
+
+func TestMigrator_OnCompleted(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	writeLegacyChunk(t, bs, "legacy", HelloWorld)
+	id := createFile(t, db, "hello.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "legacy"}})
+	nlock, err := db.LockNode(id)
+	if err != nil {
+		t.Fatalf("LockNode failed: %v", err)
+	}
+
+	m := migrate.New(bs, TestCipher(), db, migrate.IsOldFormat)
+	ncalls := 0
+	var hookErr error
+	m.SetOnCompleted(func() error {
+		ncalls++
+		return hookErr
+	})
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+	if ncalls != 0 {
+		t.Errorf("OnCompleted shouldn't be called when a file was skipped")
+	}
+	if err := db.UnlockNode(nlock); err != nil {
+		t.Fatalf("UnlockNode failed: %v", err)
+	}
+
+	hookErr = fmt.Errorf("injected")
+	if err := m.Run(context.TODO()); err == nil {
+		t.Errorf("Run should fail when OnCompleted fails")
+	}
+	if p := m.Progress(); ncalls != 1 || p.Completed {
+		t.Errorf("Unexpected progress after failed OnCompleted: %d calls, %+v", ncalls, p)
+	}
+
+	hookErr = nil
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+	if p := m.Progress(); ncalls != 2 || !p.Completed {
+		t.Errorf("Unexpected progress after retry: %d calls, %+v", ncalls, p)
+	}
+}
+
+func TestMigrator_ResumesAfterCancel(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	writeLegacyChunk(t, bs, "legacy", HelloWorld)
+	createFile(t, db, "hello.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "legacy"}})
+
+	m := migrate.New(bs, TestCipher(), db, migrate.IsOldFormat)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Run(ctx); err == nil {
+		t.Errorf("Run should fail on cancelled ctx")
+	}
+	if p := m.Progress(); p.Completed || p.NextID != inodedb.RootDirID {
+		t.Errorf("Unexpected progress after cancel: %+v", p)
+	}
+
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+	if p := m.Progress(); !p.Completed || p.NumChunksRewritten != 1 {
+		t.Errorf("Unexpected progress after resume: %+v", p)
+	}
+}
+
+func TestMigrator_Reencrypt(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	writeLegacyChunk(t, bs, "oldkey", HelloWorld)
+	id := createFile(t, db, "hello.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "oldkey"}})
+
+	newkey := util.RandomBytes(btncrypt.KeyLength)
+	c, err := btncrypt.NewCipherWithKeyID(newkey, 1, [][]byte{Key})
+	if err != nil {
+		t.Fatalf("NewCipherWithKeyID failed: %v", err)
+	}
+	m := migrate.New(bs, c, db, migrate.IsEncryptedWithOtherKey(c.KeyID()))
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+	if p := m.Progress(); p.NumChunksRewritten != 1 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	v, _, err := db.QueryNode(id, false)
+	if err != nil {
+		t.Fatalf("QueryNode failed: %v", err)
+	}
+	cs := v.(*inodedb.FileNodeView).Chunks
+
+	// The old key is no longer needed.
+	newonly, err := btncrypt.NewCipherWithKeyID(newkey, 1, nil)
+	if err != nil {
+		t.Fatalf("NewCipherWithKeyID failed: %v", err)
+	}
+	bh, err := bs.Open(cs[0].BlobPath, fl.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bh.Close()
+	cio := chunkstore.NewChunkIO(bh, newonly)
+	if kid := cio.Header().KeyID; kid != 1 {
+		t.Errorf("Unexpected KeyID: %d", kid)
+	}
+	readtgt := make([]byte, len(HelloWorld))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(HelloWorld, readtgt) {
+		t.Errorf("Re-encrypted content mismatch")
+	}
+}
+
+func TestMigrator_ScrubOrigFilename(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+
+	var b bytes.Buffer
+	cw, err := chunkstore.NewChunkWriter(&b, TestCipher(), chunkstore.ChunkHeader{PayloadLen: uint32(len(HelloWorld)), PayloadVersion: 1, OrigFilename: "/hello.txt", BlobPath: "plainpath"})
+	if err != nil {
+		t.Fatalf("NewChunkWriter failed: %v", err)
+	}
+	if _, err := cw.Write(HelloWorld); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	bh, err := bs.Open("plainpath", fl.O_RDWRCREATE)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := bh.PWrite(0, b.Bytes()); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	bh.Close()
+	id := createFile(t, db, "hello.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "plainpath"}})
+
+	s := chunkstore.NewPathScrubber(chunkstore.PathPrivacyHMAC, []byte("namingkey"))
+	m := migrate.New(bs, TestCipher(), db, migrate.HasUnscrubbedOrigFilename(s))
+	m.SetHeaderTransform(migrate.ScrubOrigFilename(s))
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+	if p := m.Progress(); p.NumChunksRewritten != 1 {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+
+	v, _, err := db.QueryNode(id, false)
+	if err != nil {
+		t.Fatalf("QueryNode failed: %v", err)
+	}
+	cs := v.(*inodedb.FileNodeView).Chunks
+	bh, err = bs.Open(cs[0].BlobPath, fl.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bh.Close()
+	cio := chunkstore.NewChunkIO(bh, TestCipher())
+	if fn := cio.Header().OrigFilename; fn != s.HashPath("/hello.txt") {
+		t.Errorf("Unexpected OrigFilename: %s", fn)
+	}
+	readtgt := make([]byte, len(HelloWorld))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Errorf("PRead failed: %v", err)
+		return
+	}
+	if !bytes.Equal(HelloWorld, readtgt) {
+		t.Errorf("Scrubbed chunk content mismatch")
+	}
+
+	// Scrubbed chunks are left untouched on the next pass.
+	if err := m.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+	if p := m.Progress(); p.NumChunksRewritten != 0 {
+		t.Errorf("Unexpected progress on the 2nd pass: %+v", p)
+	}
+}
+
+func TestMigrator_CopiesSharedDedupChunk(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	const shared = chunkstore.DedupBlobPathPrefix + "shared"
+	writeLegacyChunk(t, bs, shared, HelloWorld)
+	fc := inodedb.FileChunk{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: shared}
+	idA := createFile(t, db, "a.txt", []inodedb.FileChunk{fc})
+	idB := createFile(t, db, "b.txt", []inodedb.FileChunk{fc})
+	origSize, err := bs.BlobSize(shared)
+	if err != nil {
+		t.Fatalf("BlobSize failed: %v", err)
+	}
+
+	m := migrate.New(bs, TestCipher(), db, migrate.IsOldFormat)
+	if err := m.Run(context.TODO()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	chunksOf := func(id inodedb.ID) []inodedb.FileChunk {
+		v, _, err := db.QueryNode(id, false)
+		if err != nil {
+			t.Fatalf("QueryNode failed: %v", err)
+		}
+		return v.(*inodedb.FileNodeView).Chunks
+	}
+	csA, csB := chunksOf(idA), chunksOf(idB)
+	if csA[0].BlobPath == shared || !chunkstore.IsDedupBlobPath(csA[0].BlobPath) {
+		t.Errorf("Shared dedup chunk should be repointed to a dedup copy: %+v", csA)
+	}
+	if csB[0].BlobPath != csA[0].BlobPath {
+		t.Errorf("Files sharing the chunk should share its copy: %+v, %+v", csA, csB)
+	}
+	if size, err := bs.BlobSize(shared); err != nil || size != origSize {
+		t.Errorf("Shared dedup chunk shouldn't be modified in place: %d, %v", size, err)
+	}
+
+	bh, err := bs.Open(csA[0].BlobPath, fl.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bh.Close()
+	cio := chunkstore.NewChunkIO(bh, TestCipher())
+	readtgt := make([]byte, len(HelloWorld))
+	if err := cio.PRead(0, readtgt); err != nil {
+		t.Fatalf("PRead failed: %v", err)
+	}
+	if !bytes.Equal(HelloWorld, readtgt) {
+		t.Errorf("Migrated content mismatch")
+	}
+}
@@ -0,0 +1,311 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// JobRecord is the persisted record of a job.
+type JobRecord struct {
+	ID       `json:"id"`
+	TaskType string `json:"task_type"`
+	Params   string `json:"params"`
+	State    `json:"state,string"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+
+	Error string `json:"error"`
+
+	// Interrupted is set if the job was aborted by a scheduler shutdown, or was lost by a crash, instead of being aborted explicitly.
+	Interrupted bool `json:"interrupted"`
+	// PendingResume is set on interrupted jobs until ResumeInterruptedJobs visits them.
+	PendingResume bool `json:"pending_resume"`
+	// ResumedAs is the ID of the job which resumed the interrupted job.
+	ResumedAs ID `json:"resumed_as,omitempty"`
+
+	// Checkpoint is the last checkpoint taken from the task, if it is a Checkpointer.
+	Checkpoint []byte `json:"-"`
+}
+
+// JobStore persists job records across restarts.
+type JobStore interface {
+	// LoadJobRecords returns all job records stored. It returns an empty slice if nothing is stored yet.
+	LoadJobRecords() ([]JobRecord, error)
+	SaveJobRecords(rs []JobRecord) error
+}
+
+// PersistentTask is a Task which describes itself in its job record.
+type PersistentTask interface {
+	Task
+
+	// TaskType names the kind of the task. It is used to look up the TaskResumer of an interrupted job.
+	TaskType() string
+	// Params encodes the task parameters, so that the TaskResumer is able to recreate the task.
+	Params() string
+}
+
+// Checkpointer is implemented by tasks which are able to resume from the middle of a run.
+type Checkpointer interface {
+	// Checkpoint returns an opaque snapshot of the task progress. It is called periodically while the task is running, and once after the task returns.
+	Checkpoint() ([]byte, error)
+}
+
+// TaskResumer recreates the task of an interrupted job from its params and the last checkpoint. checkpoint is nil if none was taken.
+type TaskResumer func(params string, checkpoint []byte) (Task, error)
+
+const (
+	maxJobRecords             = 256
+	defaultCheckpointInterval = 30 * time.Second
+)
+
+func describeTask(task Task) (string, string) {
+	if pt, ok := task.(PersistentTask); ok {
+		return pt.TaskType(), pt.Params()
+	}
+	return fmt.Sprintf("%T", task), ""
+}
+
+// SetJobStore loads the job records from js, and persists job records to it afterwards. It must be called before running jobs.
+func (s *Scheduler) SetJobStore(js JobStore) {
+	rs, err := js.LoadJobRecords()
+	if err != nil {
+		log.Printf("Failed to load job records. Starting with empty history: %v", err)
+		rs = nil
+	}
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	for _, r := range rs {
+		r := r
+		if r.State == JobScheduled || r.State == JobStarted {
+			r.State = JobAborted
+			r.Interrupted = true
+			r.PendingResume = true
+			if r.Error == "" {
+				r.Error = "Interrupted by restart."
+			}
+		}
+		s.records[r.ID] = &r
+
+		// Don't reuse IDs of recorded jobs.
+		for {
+			lastID := atomic.LoadUint32((*uint32)(&s.idGen.lastID))
+			if ID(lastID) >= r.ID || atomic.CompareAndSwapUint32((*uint32)(&s.idGen.lastID), lastID, uint32(r.ID)) {
+				break
+			}
+		}
+	}
+	s.jobStore = js
+	log.Printf("Loaded %d job records.", len(rs))
+}
+
+// SetCheckpointInterval sets the interval to take checkpoints of running Checkpointer tasks.
+func (s *Scheduler) SetCheckpointInterval(d time.Duration) { s.checkpointInterval = d }
+
+// RegisterResumer registers f to resume interrupted jobs of taskType.
+func (s *Scheduler) RegisterResumer(taskType string, f TaskResumer) {
+	s.historyMu.Lock()
+	s.resumers[taskType] = f
+	s.historyMu.Unlock()
+}
+
+// ResumeInterruptedJobs reschedules interrupted jobs whose task type has a TaskResumer registered.
+func (s *Scheduler) ResumeInterruptedJobs() []ID {
+	type resumeReq struct {
+		rec     JobRecord
+		resumer TaskResumer
+	}
+
+	s.historyMu.Lock()
+	reqs := []resumeReq{}
+	for _, r := range s.records {
+		if !r.PendingResume {
+			continue
+		}
+		r.PendingResume = false
+		if f, ok := s.resumers[r.TaskType]; ok {
+			reqs = append(reqs, resumeReq{*r, f})
+		}
+	}
+	s.historyMu.Unlock()
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].rec.ID < reqs[j].rec.ID })
+
+	ids := []ID{}
+	for _, req := range reqs {
+		task, err := req.resumer(req.rec.Params, req.rec.Checkpoint)
+		if err != nil {
+			log.Printf("Failed to resume job %d of task type \"%s\": %v", req.rec.ID, req.rec.TaskType, err)
+			continue
+		}
+		id := s.RunAt(task, req.rec.ScheduledAt, nil)
+		log.Printf("Resumed interrupted job %d of task type \"%s\" as job %d.", req.rec.ID, req.rec.TaskType, id)
+
+		s.historyMu.Lock()
+		if r, ok := s.records[req.rec.ID]; ok {
+			r.ResumedAs = id
+		}
+		s.historyMu.Unlock()
+		ids = append(ids, id)
+	}
+	s.markHistoryDirty()
+	return ids
+}
+
+// QueryHistory returns the job records, oldest first.
+func (s *Scheduler) QueryHistory() []JobRecord {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	return s.sortedRecordsWithLock()
+}
+
+func (s *Scheduler) sortedRecordsWithLock() []JobRecord {
+	rs := make([]JobRecord, 0, len(s.records))
+	for _, r := range s.records {
+		rs = append(rs, *r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].ID < rs[j].ID })
+	return rs
+}
+
+// lastStartedAt returns when the last recorded job of the task started, or zero time if none did.
+func (s *Scheduler) lastStartedAt(task Task) time.Time {
+	taskType, params := describeTask(task)
+
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	var last time.Time
+	for _, r := range s.records {
+		if r.TaskType == taskType && r.Params == params && r.StartedAt.After(last) {
+			last = r.StartedAt
+		}
+	}
+	return last
+}
+
+// recordJob updates the job record to the current state of j. It must not be called with j.mu held.
+func (s *Scheduler) recordJob(j *job) {
+	v := j.View()
+	interrupted := v.State == JobAborted && atomic.LoadInt32(&s.stopping) != 0
+
+	s.historyMu.Lock()
+	r, ok := s.records[v.ID]
+	if !ok {
+		r = &JobRecord{ID: v.ID, TaskType: j.taskType, Params: j.params}
+		s.records[v.ID] = r
+	}
+	r.State = v.State
+	r.CreatedAt = v.CreatedAt
+	r.ScheduledAt = v.ScheduledAt
+	r.StartedAt = v.StartedAt
+	r.FinishedAt = v.FinishedAt
+	if v.Result != nil {
+		if err := v.Result.Err(); err != nil {
+			r.Error = err.Error()
+		}
+	}
+	if interrupted {
+		r.Interrupted = true
+		r.PendingResume = true
+	}
+	s.trimRecordsWithLock()
+	s.historyMu.Unlock()
+
+	s.markHistoryDirty()
+}
+
+func (s *Scheduler) recordCheckpoint(id ID, cp Checkpointer) {
+	bs, err := cp.Checkpoint()
+	if err != nil {
+		log.Printf("Failed to take checkpoint of job %d: %v", id, err)
+		return
+	}
+
+	s.historyMu.Lock()
+	if r, ok := s.records[id]; ok {
+		r.Checkpoint = bs
+	}
+	s.historyMu.Unlock()
+
+	s.markHistoryDirty()
+}
+
+// checkpointLoop takes checkpoints of the running job until stopC is closed.
+func (s *Scheduler) checkpointLoop(id ID, cp Checkpointer, stopC <-chan struct{}, doneC chan<- struct{}) {
+	defer close(doneC)
+
+	ticker := time.NewTicker(s.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.recordCheckpoint(id, cp)
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// trimRecordsWithLock drops the oldest records exceeding maxJobRecords. Records pending resume are kept.
+func (s *Scheduler) trimRecordsWithLock() {
+	if len(s.records) <= maxJobRecords {
+		return
+	}
+	ids := make([]ID, 0, len(s.records))
+	for id := range s.records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if len(s.records) <= maxJobRecords {
+			break
+		}
+		if r := s.records[id]; r.PendingResume || r.State == JobScheduled || r.State == JobStarted {
+			continue
+		}
+		delete(s.records, id)
+	}
+}
+
+func (s *Scheduler) markHistoryDirty() {
+	select {
+	case s.historySaveC <- struct{}{}:
+	default:
+		// A save is already pending.
+	}
+}
+
+// SaveHistory persists the job records to the JobStore now, if set.
+func (s *Scheduler) SaveHistory() error {
+	s.historyMu.Lock()
+	js := s.jobStore
+	rs := s.sortedRecordsWithLock()
+	s.historyMu.Unlock()
+
+	if js == nil {
+		return nil
+	}
+	return js.SaveJobRecords(rs)
+}
+
+func (s *Scheduler) saveHistory() {
+	if err := s.SaveHistory(); err != nil {
+		log.Printf("Failed to save job records: %v", err)
+	}
+}
+
+// historySaverMain saves job records in background, coalescing updates made while saving.
+func (s *Scheduler) historySaverMain() {
+	for range s.historySaveC {
+		s.saveHistory()
+	}
+	s.saveHistory()
+	s.joinHistorySaverC <- struct{}{}
+}
@@ -0,0 +1,193 @@
+package scheduler_test
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+type MemJobStore struct {
+	mu sync.Mutex
+	rs []scheduler.JobRecord
+}
+
+func (js *MemJobStore) LoadJobRecords() ([]scheduler.JobRecord, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return append([]scheduler.JobRecord{}, js.rs...), nil
+}
+
+func (js *MemJobStore) SaveJobRecords(rs []scheduler.JobRecord) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.rs = append([]scheduler.JobRecord{}, rs...)
+	return nil
+}
+
+// StepTask counts up to Goal, one step per 10ms, and checkpoints its count.
+type StepTask struct {
+	Goal int
+
+	mu sync.Mutex
+	n  int
+}
+
+func (st *StepTask) TaskType() string { return "step" }
+func (st *StepTask) Params() string   { return strconv.Itoa(st.Goal) }
+
+func (st *StepTask) Checkpoint() ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return []byte(strconv.Itoa(st.n)), nil
+}
+
+func (st *StepTask) Count() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.n
+}
+
+func (st *StepTask) Run(ctx context.Context) scheduler.Result {
+	for st.Count() < st.Goal {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return scheduler.ErrorResult{ctx.Err()}
+		}
+		st.mu.Lock()
+		st.n++
+		st.mu.Unlock()
+	}
+	return scheduler.ErrorResult{nil}
+}
+
+func TestScheduler_History(t *testing.T) {
+	js := &MemJobStore{}
+
+	s := scheduler.NewScheduler()
+	s.SetJobStore(js)
+	s.SetCheckpointInterval(20 * time.Millisecond)
+	doneID := s.RunImmediately(HogeTask{}, nil)
+	st := &StepTask{Goal: 50}
+	stepID := s.RunImmediately(st, nil)
+	time.Sleep(200 * time.Millisecond)
+	s.AbortAllAndStop()
+
+	rs, _ := js.LoadJobRecords()
+	if len(rs) != 2 {
+		t.Fatalf("Unexpected records: %+v", rs)
+	}
+	if r := rs[0]; r.ID != doneID || r.State != scheduler.JobFinished || r.Interrupted || r.FinishedAt.IsZero() {
+		t.Errorf("Unexpected record of finished job: %+v", r)
+	}
+	r := rs[1]
+	if r.ID != stepID || r.TaskType != "step" || r.Params != "50" || r.State != scheduler.JobAborted || !r.Interrupted || !r.PendingResume || r.Error == "" {
+		t.Errorf("Unexpected record of interrupted job: %+v", r)
+	}
+	if cp, _ := strconv.Atoi(string(r.Checkpoint)); cp != st.Count() {
+		t.Errorf("Unexpected checkpoint %q, expected %d", r.Checkpoint, st.Count())
+	}
+
+	// Restart.
+	s = scheduler.NewScheduler()
+	s.SetJobStore(js)
+	var resumed *StepTask
+	s.RegisterResumer("step", func(params string, checkpoint []byte) (scheduler.Task, error) {
+		goal, err := strconv.Atoi(params)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(string(checkpoint))
+		if err != nil {
+			return nil, err
+		}
+		resumed = &StepTask{Goal: goal, n: n}
+		return resumed, nil
+	})
+	ids := s.ResumeInterruptedJobs()
+	if len(ids) != 1 || ids[0] <= stepID {
+		t.Fatalf("Unexpected resumed job IDs: %v", ids)
+	}
+	if resumed == nil || resumed.Count() < st.Count() {
+		t.Fatalf("Task wasn't resumed from checkpoint")
+	}
+	if ids := s.ResumeInterruptedJobs(); len(ids) != 0 {
+		t.Errorf("Jobs resumed twice: %v", ids)
+	}
+	s.RunAllAndStop()
+
+	if n := resumed.Count(); n != 50 {
+		t.Errorf("Resumed task didn't complete: %d", n)
+	}
+	rs, _ = js.LoadJobRecords()
+	if len(rs) != 3 || rs[1].ResumedAs != ids[0] || rs[1].PendingResume || rs[2].State != scheduler.JobFinished {
+		t.Errorf("Unexpected records after resume: %+v", rs)
+	}
+}
+
+func TestScheduler_RecurringAfterRestart(t *testing.T) {
+	lastRun := time.Now().Add(-time.Hour)
+	rec := scheduler.JobRecord{ID: 1, TaskType: "step", Params: "1", State: scheduler.JobFinished, StartedAt: lastRun, FinishedAt: lastRun}
+
+	// The run due 30 minutes after the last recorded run was missed while the scheduler was down.
+	s := scheduler.NewScheduler()
+	s.SetJobStore(&MemJobStore{rs: []scheduler.JobRecord{rec}})
+	st := &StepTask{Goal: 1}
+	s.RunRecurring("step", st, scheduler.Every(30*time.Minute), scheduler.MissedRunOnce)
+	for i := 0; i < 100 && st.Count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.Count() != 1 {
+		t.Errorf("MissedRunOnce didn't catch up the run missed before restart")
+	}
+	s.AbortAllAndStop()
+
+	s = scheduler.NewScheduler()
+	s.SetJobStore(&MemJobStore{rs: []scheduler.JobRecord{rec}})
+	st = &StepTask{Goal: 1}
+	id := s.RunRecurring("step", st, scheduler.Every(30*time.Minute), scheduler.MissedRunSkip)
+	for i := 0; i < 100 && s.QueryRecurring(id).NumMissed == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := s.QueryRecurring(id); st.Count() != 0 || v.NumMissed != 1 {
+		t.Errorf("MissedRunSkip didn't skip the run missed before restart: %+v", v)
+	}
+	s.AbortAllAndStop()
+
+	// Without a recorded run, the first run is an interval away.
+	s = scheduler.NewScheduler()
+	s.SetJobStore(&MemJobStore{})
+	id = s.RunRecurring("step", &StepTask{Goal: 1}, scheduler.Every(30*time.Minute), scheduler.MissedRunOnce)
+	if v := s.QueryRecurring(id); v.NextRunAt.Before(time.Now().Add(29 * time.Minute)) {
+		t.Errorf("Unexpected first run: %+v", v)
+	}
+	s.AbortAllAndStop()
+}
+
+type UnreadableJobStore struct {
+	MemJobStore
+}
+
+func (js *UnreadableJobStore) LoadJobRecords() ([]scheduler.JobRecord, error) {
+	return nil, fmt.Errorf("unreadable")
+}
+
+func TestScheduler_UnreadableJobStore(t *testing.T) {
+	js := &UnreadableJobStore{}
+
+	s := scheduler.NewScheduler()
+	s.SetJobStore(js)
+	id := s.RunImmediately(HogeTask{}, nil)
+	s.RunAllAndStop()
+
+	rs, _ := js.MemJobStore.LoadJobRecords()
+	if len(rs) != 1 || rs[0].ID != id || rs[0].State != scheduler.JobFinished {
+		t.Errorf("Job records should be saved over unreadable ones: %+v", rs)
+	}
+}
@@ -0,0 +1,23 @@
+package scheduler
+
+import (
+	"github.com/nyaxt/otaru/metrics"
+)
+
+var (
+	jobsDone    = metrics.NewCounter("otaru_scheduler_jobs_total", "Number of jobs which finished or were aborted.", "task_type", "state")
+	jobDuration = metrics.NewHistogram("otaru_scheduler_job_duration_seconds", "Run time of jobs.", []float64{.1, 1, 10, 60, 600, 3600, 6 * 3600}, "task_type")
+)
+
+func init() {
+	metrics.Register(jobsDone, jobDuration)
+}
+
+// Metrics returns gauges of the scheduler queues, to be registered by the owner of the scheduler.
+func (s *Scheduler) Metrics() []metrics.Metric {
+	return []metrics.Metric{
+		metrics.NewGaugeFunc("otaru_scheduler_wait_jobs", "Number of jobs waiting for their scheduled time.", func() float64 { return float64(s.GetStats().NumWaitJobs) }),
+		metrics.NewGaugeFunc("otaru_scheduler_ready_jobs", "Number of jobs waiting for a runner or a pool slot.", func() float64 { return float64(s.GetStats().NumReadyJobs) }),
+		metrics.NewGaugeFunc("otaru_scheduler_running_jobs", "Number of jobs running.", func() float64 { return float64(s.GetStats().NumRunningJobs) }),
+	}
+}
@@ -0,0 +1,158 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+// DefaultPool is the pool of jobs which don't specify one. It has no limit other than the number of runners.
+const DefaultPool = ""
+
+// JobOptions control how a job is dispatched to the runners.
+type JobOptions struct {
+	// Priority orders the jobs ready to run. Jobs with higher priority start first. Jobs of the same priority start in the scheduled order.
+	Priority int
+	// Pool is the concurrency pool the job belongs to. The number of jobs running at once in a pool is capped by its limit.
+	Pool string
+	// PoolLimit, if positive, is the limit of the pool unless one is set via SetPoolLimit.
+	PoolLimit int
+}
+
+// JobOptionsProvider is implemented by tasks which specify their own JobOptions.
+type JobOptionsProvider interface {
+	JobOptions() JobOptions
+}
+
+func defaultJobOptions(task Task) JobOptions {
+	if p, ok := task.(JobOptionsProvider); ok {
+		return p.JobOptions()
+	}
+	return JobOptions{Priority: PriorityNormal, Pool: DefaultPool}
+}
+
+type pool struct {
+	// limit is the max number of jobs running at once. 0 means unlimited.
+	limit int
+	// limitSet is true once the limit is set via SetPoolLimit, which takes precedence over JobOptions.PoolLimit.
+	limitSet bool
+	running  int
+}
+
+type PoolStats struct {
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+}
+
+type pools struct {
+	mu sync.Mutex
+	m  map[string]*pool
+}
+
+func (ps *pools) getWithLock(name string) *pool {
+	p, ok := ps.m[name]
+	if !ok {
+		p = &pool{}
+		ps.m[name] = p
+	}
+	return p
+}
+
+func (ps *pools) setJobLimit(name string, n int) {
+	if n <= 0 {
+		return
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p := ps.getWithLock(name)
+	if !p.limitSet {
+		p.limit = n
+	}
+}
+
+func (ps *pools) tryAcquire(name string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p := ps.getWithLock(name)
+	if p.limit > 0 && p.running >= p.limit {
+		return false
+	}
+	p.running++
+	return true
+}
+
+func (ps *pools) release(name string) {
+	ps.mu.Lock()
+	ps.getWithLock(name).running--
+	ps.mu.Unlock()
+}
+
+func (ps *pools) stats() map[string]PoolStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	m := make(map[string]PoolStats, len(ps.m))
+	for name, p := range ps.m {
+		m[name] = PoolStats{Limit: p.limit, Running: p.running}
+	}
+	return m
+}
+
+// SetPoolLimit caps the number of jobs running at once in the pool. n <= 0 removes the limit. Jobs already running aren't affected.
+func (s *Scheduler) SetPoolLimit(name string, n int) {
+	if n < 0 {
+		n = 0
+	}
+	s.pools.mu.Lock()
+	p := s.pools.getWithLock(name)
+	p.limit = n
+	p.limitSet = true
+	s.pools.mu.Unlock()
+}
+
+// sortReadyJobs orders the jobs by the priority, and then by the scheduled time.
+func sortReadyJobs(js []*job) {
+	sort.SliceStable(js, func(a, b int) bool {
+		ja, jb := js[a], js[b]
+		if ja.priority != jb.priority {
+			return ja.priority > jb.priority
+		}
+		if !ja.ScheduledAt.Equal(jb.ScheduledAt) {
+			return ja.ScheduledAt.Before(jb.ScheduledAt)
+		}
+		return ja.ID < jb.ID
+	})
+}
+
+// dispatch sends the ready jobs to idle runners as the pool limits allow, and returns the jobs left.
+func (s *Scheduler) dispatch(readyJobs []*job) []*job {
+	sortReadyJobs(readyJobs)
+
+	left := readyJobs[:0]
+	for _, j := range readyJobs {
+		j.mu.Lock()
+		aborted := j.State == JobAborted
+		j.mu.Unlock()
+		if aborted {
+			continue
+		}
+
+		if s.numIdleRunners == 0 || !s.pools.tryAcquire(j.pool) {
+			left = append(left, j)
+			continue
+		}
+		s.numIdleRunners--
+		s.runC <- j
+	}
+	for i := len(left); i < len(readyJobs); i++ {
+		readyJobs[i] = nil
+	}
+	return left
+}
@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Progress is the progress of a running job, as reported by its task.
+type Progress struct {
+	// Fraction is the fraction of the work done, in [0, 1]. It is negative if the task can't tell.
+	Fraction       float64   `json:"fraction"`
+	Message        string    `json:"message"`
+	BytesProcessed int64     `json:"bytes_processed"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// UnknownFraction is the Progress.Fraction of tasks which don't know how much work is left.
+const UnknownFraction = -1
+
+type jobCtxKey struct{}
+
+func withJob(ctx context.Context, j *job) context.Context {
+	return context.WithValue(ctx, jobCtxKey{}, j)
+}
+
+// ReportProgress updates the progress of the job running with ctx, if any.
+func ReportProgress(ctx context.Context, p Progress) {
+	j, ok := ctx.Value(jobCtxKey{}).(*job)
+	if !ok {
+		return
+	}
+	if p.Fraction > 1 {
+		p.Fraction = 1
+	} else if p.Fraction < 0 {
+		p.Fraction = UnknownFraction
+	}
+	p.UpdatedAt = time.Now()
+
+	j.mu.Lock()
+	j.progress = p
+	j.mu.Unlock()
+}
@@ -0,0 +1,236 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MissedRunPolicy specifies what to do with a run of a recurring job which couldn't start on time.
+type MissedRunPolicy int
+
+const (
+	// MissedRunSkip skips the missed run, and waits for the next scheduled time.
+	MissedRunSkip MissedRunPolicy = iota
+	// MissedRunOnce runs the job once as soon as possible, no matter how many runs were missed.
+	MissedRunOnce
+)
+
+func (p MissedRunPolicy) String() string {
+	switch p {
+	case MissedRunSkip:
+		return "skip"
+	case MissedRunOnce:
+		return "once"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseMissedRunPolicy(s string) (MissedRunPolicy, error) {
+	switch s {
+	case "", "skip":
+		return MissedRunSkip, nil
+	case "once":
+		return MissedRunOnce, nil
+	default:
+		return MissedRunSkip, fmt.Errorf("Unknown missed run policy: \"%s\"", s)
+	}
+}
+
+// missedRunTolerance is how late a run may start before it is considered missed.
+const missedRunTolerance = time.Minute
+
+type recurringJob struct {
+	ID
+	Name string
+	Spec
+	MissedRunPolicy
+	Task
+
+	mu        sync.Mutex
+	paused    bool
+	running   bool
+	nextRunAt time.Time
+	numRuns   int
+	numMissed int
+	lastJob   *JobView
+}
+
+type RecurringJobView struct {
+	ID              `json:"id"`
+	Name            string `json:"name"`
+	Spec            string `json:"spec"`
+	MissedRunPolicy string `json:"missed_run_policy"`
+
+	Paused    bool      `json:"paused"`
+	Running   bool      `json:"running"`
+	NextRunAt time.Time `json:"next_run_at"`
+	NumRuns   int       `json:"num_runs"`
+	NumMissed int       `json:"num_missed"`
+
+	// LastRun is the view of the job of the last run. nil if the job has never run.
+	LastRun *JobView `json:"last_run"`
+}
+
+func (rj *recurringJob) View() *RecurringJobView {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+
+	return &RecurringJobView{
+		ID:              rj.ID,
+		Name:            rj.Name,
+		Spec:            rj.Spec.String(),
+		MissedRunPolicy: rj.MissedRunPolicy.String(),
+		Paused:          rj.paused,
+		Running:         rj.running,
+		NextRunAt:       rj.nextRunAt,
+		NumRuns:         rj.numRuns,
+		NumMissed:       rj.numMissed,
+		LastRun:         rj.lastJob,
+	}
+}
+
+// minMissedRunTolerance accounts for the granularity of the scheduler tick.
+const minMissedRunTolerance = 2 * schedulerTickDuration
+
+// tolerance returns how late the run at nextRunAt may start. It is capped at the half of the interval for frequent jobs.
+func (rj *recurringJob) tolerance() time.Duration {
+	d := missedRunTolerance
+	if next := rj.Spec.Next(rj.nextRunAt); !next.IsZero() {
+		if half := next.Sub(rj.nextRunAt) / 2; half < d {
+			d = half
+		}
+	}
+	if d < minMissedRunTolerance {
+		d = minMissedRunTolerance
+	}
+	return d
+}
+
+// checkDue returns true if a new run of the job should start now. It must be called from schedulerMain.
+func (rj *recurringJob) checkDue(now time.Time) bool {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+
+	if rj.paused || rj.nextRunAt.IsZero() || now.Before(rj.nextRunAt) {
+		return false
+	}
+
+	// Never run the job concurrently with its previous run.
+	if rj.running {
+		if rj.MissedRunPolicy == MissedRunSkip {
+			rj.numMissed++
+			rj.nextRunAt = rj.Spec.Next(now)
+		}
+		// MissedRunOnce keeps nextRunAt, so the job runs as soon as the current run finishes.
+		return false
+	}
+
+	late := now.Sub(rj.nextRunAt) > rj.tolerance()
+	rj.nextRunAt = rj.Spec.Next(now)
+	if late && rj.MissedRunPolicy == MissedRunSkip {
+		rj.numMissed++
+		return false
+	}
+
+	rj.running = true
+	rj.numRuns++
+	return true
+}
+
+func (rj *recurringJob) onDone(v *JobView) {
+	rj.mu.Lock()
+	rj.running = false
+	rj.lastJob = v
+	rj.mu.Unlock()
+}
+
+func (rj *recurringJob) setPaused(paused bool) {
+	rj.mu.Lock()
+	rj.paused = paused
+	rj.mu.Unlock()
+}
+
+// RunRecurring registers task to run repeatedly on spec. The first run is scheduled after the last run in the job history, if any.
+func (s *Scheduler) RunRecurring(name string, task Task, spec Spec, policy MissedRunPolicy) ID {
+	nextRunAt := spec.Next(time.Now())
+	if last := s.lastStartedAt(task); !last.IsZero() {
+		if next := spec.Next(last); !next.IsZero() && next.Before(nextRunAt) {
+			nextRunAt = next
+		}
+	}
+
+	rj := &recurringJob{
+		ID:              s.idGen.genID(),
+		Name:            name,
+		Spec:            spec,
+		MissedRunPolicy: policy,
+		Task:            task,
+		nextRunAt:       nextRunAt,
+	}
+
+	s.recurringMu.Lock()
+	s.recurringJobs[rj.ID] = rj
+	s.recurringMu.Unlock()
+
+	return rj.ID
+}
+
+func (s *Scheduler) findRecurring(id ID) *recurringJob {
+	s.recurringMu.Lock()
+	defer s.recurringMu.Unlock()
+	return s.recurringJobs[id]
+}
+
+func (s *Scheduler) QueryRecurring(id ID) *RecurringJobView {
+	rj := s.findRecurring(id)
+	if rj == nil {
+		return nil
+	}
+	return rj.View()
+}
+
+func (s *Scheduler) QueryAllRecurring() []*RecurringJobView {
+	s.recurringMu.Lock()
+	defer s.recurringMu.Unlock()
+
+	rjvs := make([]*RecurringJobView, 0, len(s.recurringJobs))
+	for _, rj := range s.recurringJobs {
+		rjvs = append(rjvs, rj.View())
+	}
+	return rjvs
+}
+
+// PauseRecurring stops the recurring job from starting new runs. The run in progress isn't aborted.
+func (s *Scheduler) PauseRecurring(id ID) error {
+	rj := s.findRecurring(id)
+	if rj == nil {
+		return fmt.Errorf("Recurring job ID %d doesn't exist.", id)
+	}
+	rj.setPaused(true)
+	return nil
+}
+
+// ResumeRecurring resumes the paused recurring job. Runs scheduled while paused are treated per its MissedRunPolicy.
+func (s *Scheduler) ResumeRecurring(id ID) error {
+	rj := s.findRecurring(id)
+	if rj == nil {
+		return fmt.Errorf("Recurring job ID %d doesn't exist.", id)
+	}
+	rj.setPaused(false)
+	return nil
+}
+
+func (s *Scheduler) dueRecurringJobs(now time.Time) []*recurringJob {
+	s.recurringMu.Lock()
+	defer s.recurringMu.Unlock()
+
+	var due []*recurringJob
+	for _, rj := range s.recurringJobs {
+		if rj.checkDue(now) {
+			due = append(due, rj)
+		}
+	}
+	return due
+}
@@ -3,6 +3,7 @@ package scheduler
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
@@ -62,14 +63,23 @@ type job struct {
 	Result
 	DoneCallback
 
+	taskType string
+	params   string
+	priority int
+	pool     string
+
 	mu         sync.Mutex
 	cancelfn   context.CancelFunc
+	progress   Progress
 	scheduledC chan struct{}
 }
 
 type JobView struct {
-	ID    `json:"id"`
-	State `json:"state,string"`
+	ID       `json:"id"`
+	State    `json:"state,string"`
+	TaskType string `json:"task_type"`
+	Priority int    `json:"priority"`
+	Pool     string `json:"pool"`
 	// Issuer string
 
 	CreatedAt   time.Time `json:"created_at"`
@@ -77,6 +87,8 @@ type JobView struct {
 	StartedAt   time.Time `json:"started_at"`
 	FinishedAt  time.Time `json:"finishd_at"`
 
+	Progress Progress `json:"progress"`
+
 	Result `json:"result"`
 }
 
@@ -86,10 +98,14 @@ func (j *job) ViewWithLock() *JobView {
 	return &JobView{
 		ID:          j.ID,
 		State:       j.State,
+		TaskType:    j.taskType,
+		Priority:    j.priority,
+		Pool:        j.pool,
 		CreatedAt:   j.CreatedAt,
 		ScheduledAt: j.ScheduledAt,
 		StartedAt:   j.StartedAt,
 		FinishedAt:  j.FinishedAt,
+		Progress:    j.progress,
 		Result:      j.Result,
 	}
 }
@@ -114,32 +130,71 @@ type Scheduler struct {
 	numRunners  int
 	numWaitJobs int
 
+	// numIdleRunners is only accessed from schedulerMain.
+	numIdleRunners  int
+	numReadyJobs    int32
+	numRunningJobs  int32
+	pools           pools
+	rootCtx         context.Context
+	cancelAllJobsFn context.CancelFunc
+
 	idGen
 
 	scheduleC     chan *job
 	queryC        chan *jobQuery
 	abortC        chan *abortReq
 	runC          chan *job
+	runnerDoneC   chan *job
 	joinScheduleC chan struct{}
 	joinRunnerC   chan struct{}
+
+	recurringMu   sync.Mutex
+	recurringJobs map[ID]*recurringJob
+
+	historyMu          sync.Mutex
+	jobStore           JobStore
+	records            map[ID]*JobRecord
+	resumers           map[string]TaskResumer
+	checkpointInterval time.Duration
+	historySaveC       chan struct{}
+	joinHistorySaverC  chan struct{}
+
+	// stopping is set to non-zero once AbortAllAndStop is called, so that the jobs aborted are recorded as interrupted.
+	stopping int32
 }
 
 const schedulerTickDuration = 300 * time.Millisecond
 
 func NewScheduler() *Scheduler {
+	const numRunners = 4 // FIXME
+	rootCtx, cancelAllJobsFn := context.WithCancel(context.Background())
 	s := &Scheduler{
-		numRunners:    4, // FIXME
-		numWaitJobs:   0,
-		idGen:         idGen{0},
-		scheduleC:     make(chan *job, 1),
-		queryC:        make(chan *jobQuery, 1),
-		abortC:        make(chan *abortReq, 1),
-		runC:          make(chan *job, 8),
+		numRunners:      numRunners,
+		numWaitJobs:     0,
+		numIdleRunners:  numRunners,
+		pools:           pools{m: make(map[string]*pool)},
+		rootCtx:         rootCtx,
+		cancelAllJobsFn: cancelAllJobsFn,
+		idGen:           idGen{0},
+		scheduleC:       make(chan *job, 1),
+		queryC:          make(chan *jobQuery, 1),
+		abortC:          make(chan *abortReq, 1),
+		// The runners never receive more jobs than idle, so neither of them blocks.
+		runC:          make(chan *job, numRunners),
+		runnerDoneC:   make(chan *job, numRunners),
 		joinScheduleC: make(chan struct{}),
 		joinRunnerC:   make(chan struct{}),
+		recurringJobs: make(map[ID]*recurringJob),
+
+		records:            make(map[ID]*JobRecord),
+		resumers:           make(map[string]TaskResumer),
+		checkpointInterval: defaultCheckpointInterval,
+		historySaveC:       make(chan struct{}, 1),
+		joinHistorySaverC:  make(chan struct{}),
 	}
 
 	go s.schedulerMain()
+	go s.historySaverMain()
 	for i := 0; i < s.numRunners; i++ {
 		go s.runnerMain()
 	}
@@ -148,32 +203,52 @@ func NewScheduler() *Scheduler {
 }
 
 type Stats struct {
-	NumRunners  int `json:"num_runners"`
-	NumWaitJobs int `json:"num_wait_jobs"`
+	NumRunners     int                  `json:"num_runners"`
+	NumWaitJobs    int                  `json:"num_wait_jobs"`
+	NumReadyJobs   int                  `json:"num_ready_jobs"`
+	NumRunningJobs int                  `json:"num_running_jobs"`
+	Pools          map[string]PoolStats `json:"pools"`
 }
 
 func (s *Scheduler) GetStats() *Stats {
 	return &Stats{
-		NumRunners:  s.numRunners,
-		NumWaitJobs: s.numWaitJobs,
+		NumRunners:     s.numRunners,
+		NumWaitJobs:    s.numWaitJobs,
+		NumReadyJobs:   int(atomic.LoadInt32(&s.numReadyJobs)),
+		NumRunningJobs: int(atomic.LoadInt32(&s.numRunningJobs)),
+		Pools:          s.pools.stats(),
 	}
 }
 
-func (s *Scheduler) RunAt(task Task, at time.Time, cb DoneCallback) ID {
-	id := s.idGen.genID()
-	j := &job{
-		ID:           id,
+func (s *Scheduler) newJob(task Task, at time.Time, opts JobOptions, cb DoneCallback) *job {
+	taskType, params := describeTask(task)
+	s.pools.setJobLimit(opts.Pool, opts.PoolLimit)
+	return &job{
+		ID:           s.idGen.genID(),
 		CreatedAt:    time.Now(),
 		ScheduledAt:  at,
 		Task:         task,
 		DoneCallback: cb,
+		taskType:     taskType,
+		params:       params,
+		priority:     opts.Priority,
+		pool:         opts.Pool,
 		scheduledC:   make(chan struct{}),
 	}
+}
+
+func (s *Scheduler) RunAt(task Task, at time.Time, cb DoneCallback) ID {
+	return s.RunWithOptions(task, at, defaultJobOptions(task), cb)
+}
+
+// RunWithOptions schedules task at the time with opts, overriding the JobOptions the task may provide.
+func (s *Scheduler) RunWithOptions(task Task, at time.Time, opts JobOptions, cb DoneCallback) ID {
+	j := s.newJob(task, at, opts, cb)
 
 	s.scheduleC <- j
 	<-j.scheduledC
 
-	return id
+	return j.ID
 }
 
 func (s *Scheduler) RunImmediately(task Task, cb DoneCallback) ID {
@@ -236,21 +311,30 @@ func (s *Scheduler) stop() {
 	for i := 0; i < s.numRunners; i++ {
 		<-s.joinRunnerC
 	}
+	s.cancelAllJobsFn()
+	close(s.historySaveC)
+	<-s.joinHistorySaverC
 	log.Printf("scheduler stop done")
 }
 
 func (s *Scheduler) RunAllAndStop() { s.stop() }
 
 func (s *Scheduler) AbortAllAndStop() {
+	atomic.StoreInt32(&s.stopping, 1)
 	s.abortInternal(allJobs)
+	s.cancelAllJobsFn()
 	s.stop()
 }
 
-func abortJob(j *job) {
+func (s *Scheduler) abortJob(j *job) {
+	defer s.recordJob(j)
+
 	j.mu.Lock()
+	defer j.mu.Unlock()
 	switch j.State {
 	case JobScheduled:
 		j.State = JobAborted
+		jobsDone.Inc(j.taskType, j.State.String())
 		if j.DoneCallback != nil {
 			go j.DoneCallback(j.ViewWithLock())
 		}
@@ -261,12 +345,12 @@ func abortJob(j *job) {
 	case JobAborted:
 		// Job is already aborted. Nothing to do.
 	}
-	j.mu.Unlock()
 }
 
 func (s *Scheduler) schedulerMain() {
 	tick := time.NewTicker(schedulerTickDuration) // FIXME: This should actually wait until next scheduled task instead of using fixed duration ticker.
 	waitJobs := make([]*job, 0)
+	readyJobs := make([]*job, 0)
 	jobs := make(map[ID]*job)
 
 	defer func() {
@@ -275,8 +359,12 @@ func (s *Scheduler) schedulerMain() {
 	}()
 
 	scheduleC := s.scheduleC
+	queryC := s.queryC
+	abortC := s.abortC
 	for {
-		if scheduleC == nil && s.numWaitJobs == 0 {
+		readyJobs = s.dispatch(readyJobs)
+		atomic.StoreInt32(&s.numReadyJobs, int32(len(readyJobs)))
+		if scheduleC == nil && s.numWaitJobs == 0 && len(readyJobs) == 0 {
 			return
 		}
 
@@ -296,9 +384,10 @@ func (s *Scheduler) schedulerMain() {
 				continue
 			}
 			jobs[j.ID] = j
+			s.recordJob(j)
 
 			if j.ScheduledAt.Before(time.Now()) {
-				s.runC <- j
+				readyJobs = append(readyJobs, j)
 			} else {
 				waitJobs = append(waitJobs, j)
 				s.numWaitJobs = len(waitJobs)
@@ -307,8 +396,13 @@ func (s *Scheduler) schedulerMain() {
 				close(j.scheduledC)
 			}
 
-		case q := <-s.queryC:
-			if q == nil {
+		case j := <-s.runnerDoneC:
+			s.numIdleRunners++
+			s.pools.release(j.pool)
+
+		case q, more := <-queryC:
+			if !more {
+				queryC = nil
 				continue
 			}
 			if q.ID == allJobs {
@@ -328,14 +422,15 @@ func (s *Scheduler) schedulerMain() {
 				q.resultC <- []*JobView{j.View()}
 			}
 
-		case req := <-s.abortC:
-			if req == nil {
+		case req, more := <-abortC:
+			if !more {
+				abortC = nil
 				continue
 			}
 
 			if req.ID == allJobs {
 				for _, j := range jobs {
-					abortJob(j)
+					s.abortJob(j)
 				}
 
 				req.doneC <- struct{}{}
@@ -348,7 +443,7 @@ func (s *Scheduler) schedulerMain() {
 				req.doneC <- struct{}{}
 				continue
 			}
-			abortJob(j)
+			s.abortJob(j)
 			req.doneC <- struct{}{}
 
 		case <-tick.C:
@@ -356,53 +451,89 @@ func (s *Scheduler) schedulerMain() {
 			now := time.Now()
 			for _, j := range waitJobs {
 				if j.ScheduledAt.Before(now) {
-					s.runC <- j
+					readyJobs = append(readyJobs, j)
 				} else {
 					stillWaitJobs = append(stillWaitJobs, j)
 				}
 			}
 			waitJobs = stillWaitJobs
 			s.numWaitJobs = len(waitJobs)
+
+			// Recurring jobs don't start new runs once the scheduler is stopping.
+			if scheduleC != nil {
+				for _, rj := range s.dueRecurringJobs(now) {
+					j := s.newJob(rj.Task, now, defaultJobOptions(rj.Task), rj.onDone)
+					jobs[j.ID] = j
+					s.recordJob(j)
+					readyJobs = append(readyJobs, j)
+				}
+			}
 		}
 	}
 }
 
 func (s *Scheduler) runnerMain() {
 	for j := range s.runC {
-		j.mu.Lock()
-		if j.State == JobAborted {
-			j.mu.Unlock()
-			continue
-		}
-		if j.State != JobScheduled {
-			log.Printf("Skipping job not in scheduled state: %v", j)
-
-			j.mu.Unlock()
-			continue
-		}
-
-		task := j.Task
-		ctx, cancelfn := context.WithCancel(context.Background())
-		j.cancelfn = cancelfn
-		j.StartedAt = time.Now()
-		j.State = JobStarted
+		s.runJob(j)
+		s.runnerDoneC <- j
+	}
+	s.joinRunnerC <- struct{}{}
+}
 
+func (s *Scheduler) runJob(j *job) {
+	j.mu.Lock()
+	if j.State == JobAborted {
 		j.mu.Unlock()
-		result := task.Run(ctx)
-		finishedAt := time.Now()
-		j.mu.Lock()
-
-		j.Result = result
-		j.FinishedAt = finishedAt
-		if ctx.Err() != nil {
-			j.State = JobAborted
-		} else {
-			j.State = JobFinished
-		}
-		if j.DoneCallback != nil {
-			go j.DoneCallback(j.ViewWithLock())
-		}
+		return
+	}
+	if j.State != JobScheduled {
+		log.Printf("Skipping job not in scheduled state: %v", j)
+
 		j.mu.Unlock()
+		return
 	}
-	s.joinRunnerC <- struct{}{}
+
+	task := j.Task
+	// The task ctx is cancelled on abort of the job, or of all jobs on AbortAllAndStop.
+	ctx, cancelfn := context.WithCancel(withJob(s.rootCtx, j))
+	defer cancelfn()
+	j.cancelfn = cancelfn
+	j.StartedAt = time.Now()
+	j.State = JobStarted
+
+	j.mu.Unlock()
+	atomic.AddInt32(&s.numRunningJobs, 1)
+	defer atomic.AddInt32(&s.numRunningJobs, -1)
+	s.recordJob(j)
+
+	var stopCheckpointC, checkpointDoneC chan struct{}
+	cp, isCheckpointer := task.(Checkpointer)
+	if isCheckpointer {
+		stopCheckpointC = make(chan struct{})
+		checkpointDoneC = make(chan struct{})
+		go s.checkpointLoop(j.ID, cp, stopCheckpointC, checkpointDoneC)
+	}
+	result := task.Run(ctx)
+	finishedAt := time.Now()
+	if isCheckpointer {
+		close(stopCheckpointC)
+		<-checkpointDoneC
+		s.recordCheckpoint(j.ID, cp)
+	}
+	j.mu.Lock()
+
+	j.Result = result
+	j.FinishedAt = finishedAt
+	if ctx.Err() != nil {
+		j.State = JobAborted
+	} else {
+		j.State = JobFinished
+	}
+	jobsDone.Inc(j.taskType, j.State.String())
+	jobDuration.Observe(finishedAt.Sub(j.StartedAt).Seconds(), j.taskType)
+	if j.DoneCallback != nil {
+		go j.DoneCallback(j.ViewWithLock())
+	}
+	j.mu.Unlock()
+	s.recordJob(j)
 }
@@ -1,6 +1,8 @@
 package scheduler_test
 
 import (
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -203,3 +205,251 @@ func TestScheduler_QueryAll(t *testing.T) {
 
 	s.AbortAllAndStop()
 }
+
+type CountTask struct {
+	mu    sync.Mutex
+	n     int
+	sleep time.Duration
+}
+
+func (ct *CountTask) Run(ctx context.Context) scheduler.Result {
+	ct.mu.Lock()
+	ct.n++
+	ct.mu.Unlock()
+	select {
+	case <-time.After(ct.sleep):
+	case <-ctx.Done():
+	}
+	return scheduler.ErrorResult{nil}
+}
+
+func (ct *CountTask) Count() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.n
+}
+
+func TestScheduler_RunRecurring(t *testing.T) {
+	s := scheduler.NewScheduler()
+
+	ct := &CountTask{}
+	id := s.RunRecurring("count", ct, scheduler.Every(200*time.Millisecond), scheduler.MissedRunSkip)
+	time.Sleep(1100 * time.Millisecond)
+	if n := ct.Count(); n < 2 || n > 5 {
+		t.Errorf("Unexpected number of runs: %d", n)
+	}
+
+	v := s.QueryRecurring(id)
+	if v == nil || v.Name != "count" || v.LastRun == nil || v.LastRun.State != scheduler.JobFinished || !v.NextRunAt.After(v.LastRun.StartedAt) {
+		t.Errorf("Unexpected recurring job view: %+v", v)
+	}
+	if vs := s.QueryAllRecurring(); len(vs) != 1 {
+		t.Errorf("Unexpected recurring job views: %+v", vs)
+	}
+
+	if err := s.PauseRecurring(id); err != nil {
+		t.Errorf("PauseRecurring failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	n := ct.Count()
+	time.Sleep(1500 * time.Millisecond)
+	if ct.Count() != n {
+		t.Errorf("Paused job ran")
+	}
+
+	// The runs missed while paused are skipped.
+	if err := s.ResumeRecurring(id); err != nil {
+		t.Errorf("ResumeRecurring failed: %v", err)
+	}
+	for i := 0; i < 100 && s.QueryRecurring(id).NumMissed == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ct.Count() != n {
+		t.Errorf("Missed run wasn't skipped")
+	}
+	if v := s.QueryRecurring(id); v.Paused || v.NumMissed == 0 {
+		t.Errorf("Unexpected recurring job view after resume: %+v", v)
+	}
+
+	s.AbortAllAndStop()
+}
+
+func TestScheduler_RecurringNoOverlap(t *testing.T) {
+	s := scheduler.NewScheduler()
+
+	ct := &CountTask{sleep: 800 * time.Millisecond}
+	id := s.RunRecurring("slow", ct, scheduler.Every(100*time.Millisecond), scheduler.MissedRunOnce)
+	time.Sleep(700 * time.Millisecond)
+	if n := ct.Count(); n != 1 {
+		t.Errorf("Recurring job overlapped: %d runs", n)
+	}
+	if v := s.QueryRecurring(id); !v.Running {
+		t.Errorf("Unexpected recurring job view: %+v", v)
+	}
+
+	// MissedRunOnce runs the job once right after the slow run finishes.
+	time.Sleep(700 * time.Millisecond)
+	if n := ct.Count(); n != 2 {
+		t.Errorf("Unexpected number of runs: %d", n)
+	}
+
+	s.AbortAllAndStop()
+}
+
+type OrderTask struct {
+	name  string
+	mu    *sync.Mutex
+	order *[]string
+	sleep time.Duration
+}
+
+func (ot OrderTask) Run(ctx context.Context) scheduler.Result {
+	ot.mu.Lock()
+	*ot.order = append(*ot.order, ot.name)
+	ot.mu.Unlock()
+	select {
+	case <-time.After(ot.sleep):
+	case <-ctx.Done():
+	}
+	return scheduler.ErrorResult{nil}
+}
+
+func TestScheduler_Priority(t *testing.T) {
+	s := scheduler.NewScheduler()
+	s.SetPoolLimit("p", 1)
+
+	var mu sync.Mutex
+	order := []string{}
+	task := func(name string) OrderTask {
+		return OrderTask{name: name, mu: &mu, order: &order, sleep: 50 * time.Millisecond}
+	}
+
+	// The first job occupies the pool, so that the rest are queued.
+	s.RunWithOptions(task("first"), scheduler.ZeroTime, scheduler.JobOptions{Pool: "p"}, nil)
+	time.Sleep(20 * time.Millisecond)
+	s.RunWithOptions(task("low"), scheduler.ZeroTime, scheduler.JobOptions{Priority: scheduler.PriorityLow, Pool: "p"}, nil)
+	s.RunWithOptions(task("normal"), scheduler.ZeroTime, scheduler.JobOptions{Pool: "p"}, nil)
+	s.RunWithOptions(task("high"), scheduler.ZeroTime, scheduler.JobOptions{Priority: scheduler.PriorityHigh, Pool: "p"}, nil)
+	s.RunAllAndStop()
+
+	expected := []string{"first", "high", "normal", "low"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("Unexpected run order: %v", order)
+	}
+}
+
+type ConcurrencyTask struct {
+	mu      *sync.Mutex
+	running *int
+	max     *int
+}
+
+func (ct ConcurrencyTask) Run(ctx context.Context) scheduler.Result {
+	ct.mu.Lock()
+	*ct.running++
+	if *ct.running > *ct.max {
+		*ct.max = *ct.running
+	}
+	ct.mu.Unlock()
+
+	time.Sleep(30 * time.Millisecond)
+
+	ct.mu.Lock()
+	*ct.running--
+	ct.mu.Unlock()
+	return scheduler.ErrorResult{nil}
+}
+
+func (ConcurrencyTask) JobOptions() scheduler.JobOptions {
+	return scheduler.JobOptions{Pool: "limited"}
+}
+
+func TestScheduler_PoolLimit(t *testing.T) {
+	s := scheduler.NewScheduler()
+	s.SetPoolLimit("limited", 2)
+
+	var mu sync.Mutex
+	running, max := 0, 0
+	ids := []scheduler.ID{}
+	for i := 0; i < 6; i++ {
+		ids = append(ids, s.RunImmediately(ConcurrencyTask{&mu, &running, &max}, nil))
+	}
+	if v := s.Query(ids[0]); v.Pool != "limited" {
+		t.Errorf("Task JobOptions not applied: %+v", v)
+	}
+	if st := s.GetStats(); st.Pools["limited"].Limit != 2 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+	s.RunAllAndStop()
+
+	if max != 2 {
+		t.Errorf("Expected 2 jobs to run concurrently, but saw %d", max)
+	}
+}
+
+func TestScheduler_JobPoolLimit(t *testing.T) {
+	s := scheduler.NewScheduler()
+
+	var mu sync.Mutex
+	running, max := 0, 0
+	opts := scheduler.JobOptions{Pool: "declared", PoolLimit: 1}
+	for i := 0; i < 4; i++ {
+		s.RunWithOptions(ConcurrencyTask{&mu, &running, &max}, scheduler.ZeroTime, opts, nil)
+	}
+	if st := s.GetStats(); st.Pools["declared"].Limit != 1 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+	s.RunAllAndStop()
+	if max != 1 {
+		t.Errorf("Expected 1 job to run at once, but saw %d", max)
+	}
+
+	// SetPoolLimit overrides the limit the jobs declare.
+	s = scheduler.NewScheduler()
+	s.SetPoolLimit("declared", 3)
+	running, max = 0, 0
+	for i := 0; i < 6; i++ {
+		s.RunWithOptions(ConcurrencyTask{&mu, &running, &max}, scheduler.ZeroTime, opts, nil)
+	}
+	s.RunAllAndStop()
+	if max != 3 {
+		t.Errorf("Expected 3 jobs to run concurrently, but saw %d", max)
+	}
+}
+
+type ProgressTask struct {
+	reportedC chan struct{}
+}
+
+func (pt ProgressTask) Run(ctx context.Context) scheduler.Result {
+	scheduler.ReportProgress(ctx, scheduler.Progress{Fraction: 0.5, Message: "halfway", BytesProcessed: 123})
+	close(pt.reportedC)
+	<-ctx.Done()
+	return scheduler.ErrorResult{ctx.Err()}
+}
+
+func TestScheduler_Progress(t *testing.T) {
+	s := scheduler.NewScheduler()
+
+	pt := ProgressTask{make(chan struct{})}
+	cbjoin := make(chan *scheduler.JobView)
+	id := s.RunImmediately(pt, func(v *scheduler.JobView) { cbjoin <- v })
+	<-pt.reportedC
+
+	v := s.Query(id)
+	if v.State != scheduler.JobStarted || v.Progress.Fraction != 0.5 || v.Progress.Message != "halfway" || v.Progress.BytesProcessed != 123 || v.Progress.UpdatedAt.IsZero() {
+		t.Errorf("Unexpected job view: %+v", v)
+	}
+
+	// Abort is propagated to the task via ctx.
+	s.Abort(id)
+	v = <-cbjoin
+	if v.State != scheduler.JobAborted || v.Result.Err() != context.Canceled {
+		t.Errorf("Unexpected job view after abort: %+v", v)
+	}
+
+	// Reporting progress outside a job is a no-op.
+	scheduler.ReportProgress(context.Background(), scheduler.Progress{Fraction: 1})
+
+	s.RunAllAndStop()
+}
@@ -0,0 +1,203 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec specifies when a recurring job runs.
+type Spec interface {
+	// Next returns the first scheduled time after t. It returns ZeroTime if there is none.
+	Next(t time.Time) time.Time
+	String() string
+}
+
+type intervalSpec time.Duration
+
+func (s intervalSpec) Next(t time.Time) time.Time { return t.Add(time.Duration(s)) }
+func (s intervalSpec) String() string             { return "@every " + time.Duration(s).String() }
+
+// Every returns a Spec which runs the job in the fixed interval d.
+func Every(d time.Duration) Spec { return intervalSpec(d) }
+
+// cronSpec is a cron-like spec of 5 fields: minute, hour, day of month, month, and day of week. Times are evaluated in the local timezone.
+type cronSpec struct {
+	src string
+
+	minute, hour, dom, month, dow uint64
+	// If both day of month and day of week are restricted, a day matching either of them matches. This follows cron.
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = cronField{0, 59, nil}
+	hourField   = cronField{0, 23, nil}
+	domField    = cronField{1, 31, nil}
+	monthField  = cronField{1, 12, []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	dowField    = cronField{0, 6, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+func (f cronField) parseValue(s string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse \"%s\": %v", s, err)
+	}
+	// Accept 7 as Sunday, as cron does.
+	if f.max == 6 && n == 7 {
+		n = 0
+	}
+	if n < f.min || n > f.max {
+		return 0, fmt.Errorf("Value %d out of range [%d, %d]", n, f.min, f.max)
+	}
+	return n, nil
+}
+
+// parse parses a field of comma separated "*", "N", "N-M", each optionally followed by "/STEP".
+func (f cronField) parse(s string) (bits uint64, star bool, err error) {
+	for _, term := range strings.Split(s, ",") {
+		rng, step := term, 1
+		if i := strings.IndexByte(term, '/'); i >= 0 {
+			rng = term[:i]
+			if step, err = strconv.Atoi(term[i+1:]); err != nil || step <= 0 {
+				return 0, false, fmt.Errorf("Invalid step in \"%s\"", term)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if rng == "*" {
+			star = star || step == 1
+		} else if i := strings.IndexByte(rng, '-'); i > 0 {
+			if lo, err = f.parseValue(rng[:i]); err != nil {
+				return 0, false, err
+			}
+			if hi, err = f.parseValue(rng[i+1:]); err != nil {
+				return 0, false, err
+			}
+			if hi < lo {
+				return 0, false, fmt.Errorf("Invalid range \"%s\"", rng)
+			}
+		} else {
+			if lo, err = f.parseValue(rng); err != nil {
+				return 0, false, err
+			}
+			hi = lo
+			if step != 1 {
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, star, nil
+}
+
+func parseCronSpec(src string) (*cronSpec, error) {
+	expr := src
+	if s, ok := cronShorthands[expr]; ok {
+		expr = s
+	}
+	fs := strings.Fields(expr)
+	if len(fs) != 5 {
+		return nil, fmt.Errorf("Cron spec \"%s\" should have 5 fields, but has %d", src, len(fs))
+	}
+
+	cs := &cronSpec{src: src}
+	var err error
+	if cs.minute, _, err = minuteField.parse(fs[0]); err != nil {
+		return nil, fmt.Errorf("Invalid minute field: %v", err)
+	}
+	if cs.hour, _, err = hourField.parse(fs[1]); err != nil {
+		return nil, fmt.Errorf("Invalid hour field: %v", err)
+	}
+	if cs.dom, cs.domStar, err = domField.parse(fs[2]); err != nil {
+		return nil, fmt.Errorf("Invalid day of month field: %v", err)
+	}
+	if cs.month, _, err = monthField.parse(fs[3]); err != nil {
+		return nil, fmt.Errorf("Invalid month field: %v", err)
+	}
+	if cs.dow, cs.dowStar, err = dowField.parse(fs[4]); err != nil {
+		return nil, fmt.Errorf("Invalid day of week field: %v", err)
+	}
+	return cs, nil
+}
+
+func (cs *cronSpec) String() string { return cs.src }
+
+func (cs *cronSpec) dayMatches(t time.Time) bool {
+	domMatch := cs.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// cronSearchLimit bounds the search for specs which never match, e.g. "0 0 30 2 *".
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+func (cs *cronSpec) Next(t time.Time) time.Time {
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	loc := t.Location()
+
+	for t.Before(limit) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return ZeroTime
+}
+
+// ParseSpec parses an interval ("@every 1h", "1h") or a cron-like spec ("30 3 * * *", "@daily").
+func ParseSpec(s string) (Spec, error) {
+	s = strings.TrimSpace(s)
+	durstr := s
+	if strings.HasPrefix(s, "@every ") {
+		durstr = strings.TrimSpace(strings.TrimPrefix(s, "@every "))
+	}
+	if d, err := time.ParseDuration(durstr); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("Interval must be positive: %v", d)
+		}
+		return Every(d), nil
+	} else if durstr != s {
+		return nil, fmt.Errorf("Failed to parse interval \"%s\": %v", durstr, err)
+	}
+
+	return parseCronSpec(s)
+}
@@ -0,0 +1,61 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+func TestParseSpec_Interval(t *testing.T) {
+	for _, s := range []string{"@every 90m", "1h30m"} {
+		spec, err := scheduler.ParseSpec(s)
+		if err != nil {
+			t.Errorf("ParseSpec(%q) failed: %v", s, err)
+			continue
+		}
+		now := time.Now()
+		if next := spec.Next(now); next.Sub(now) != 90*time.Minute {
+			t.Errorf("Unexpected next for %q: %v", s, next)
+		}
+	}
+	for _, s := range []string{"@every -1h", "@every xyz", "0s"} {
+		if _, err := scheduler.ParseSpec(s); err == nil {
+			t.Errorf("ParseSpec(%q) should fail", s)
+		}
+	}
+}
+
+func TestParseSpec_Cron(t *testing.T) {
+	base := time.Date(2016, 2, 27, 10, 15, 30, 0, time.Local) // Saturday
+
+	testcases := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2016, 2, 27, 10, 16, 0, 0, time.Local)},
+		{"*/20 * * * *", time.Date(2016, 2, 27, 10, 20, 0, 0, time.Local)},
+		{"30 3 * * *", time.Date(2016, 2, 28, 3, 30, 0, 0, time.Local)},
+		{"@daily", time.Date(2016, 2, 28, 0, 0, 0, 0, time.Local)},
+		{"0 12 29 feb *", time.Date(2016, 2, 29, 12, 0, 0, 0, time.Local)},
+		{"0 0 * * mon-fri", time.Date(2016, 2, 29, 0, 0, 0, 0, time.Local)},
+		{"0 0 1,15 * 0", time.Date(2016, 2, 28, 0, 0, 0, 0, time.Local)},
+		{"0 0 30 2 *", scheduler.ZeroTime},
+	}
+	for _, tc := range testcases {
+		spec, err := scheduler.ParseSpec(tc.spec)
+		if err != nil {
+			t.Errorf("ParseSpec(%q) failed: %v", tc.spec, err)
+			continue
+		}
+		if next := spec.Next(base); !next.Equal(tc.next) {
+			t.Errorf("Unexpected next for %q: %v, expected %v", tc.spec, next, tc.next)
+		}
+	}
+
+	for _, s := range []string{"* * * *", "60 * * * *", "* * * * 8", "5-1 * * * *", "*/0 * * * *"} {
+		if _, err := scheduler.ParseSpec(s); err == nil {
+			t.Errorf("ParseSpec(%q) should fail", s)
+		}
+	}
+}
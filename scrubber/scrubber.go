@@ -0,0 +1,308 @@
+package scrubber
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/btncrypt"
+	"github.com/nyaxt/otaru/chunkstore"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+const readBufSize = 64 * 1024
+
+// BadChunk describes a chunk which failed verification.
+type BadChunk struct {
+	NodeID   inodedb.ID        `json:"node_id"`
+	OrigPath string            `json:"orig_path"`
+	Chunk    inodedb.FileChunk `json:"chunk"`
+	Reason   string            `json:"reason"`
+	FoundAt  time.Time         `json:"found_at"`
+}
+
+type Report struct {
+	Running     bool      `json:"running"`
+	Completed   bool      `json:"completed"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+
+	// NextID is the cursor. The next run resumes scanning from the node.
+	NextID inodedb.ID `json:"next_id"`
+	LastID inodedb.ID `json:"last_id"`
+
+	NumFilesScanned   int   `json:"num_files_scanned"`
+	NumChunksVerified int   `json:"num_chunks_verified"`
+	NumBytesVerified  int64 `json:"num_bytes_verified"`
+
+	BadChunks []BadChunk `json:"bad_chunks"`
+
+	LastError string `json:"last_error"`
+}
+
+// Scrubber reads every chunk reachable from inodedb from the backend blobstore to verify it.
+type Scrubber struct {
+	bs       blobstore.BlobStore
+	c        btncrypt.Cipher
+	idb      inodedb.DBHandler
+	syncBlob func(blobpath string) error
+
+	// bytesPerSec limits the read rate. 0 means unlimited.
+	bytesPerSec int64
+
+	mu     sync.Mutex
+	report Report
+}
+
+func New(bs blobstore.BlobStore, c btncrypt.Cipher, idb inodedb.DBHandler) *Scrubber {
+	return &Scrubber{
+		bs:     bs,
+		c:      c,
+		idb:    idb,
+		report: Report{NextID: inodedb.RootDirID},
+	}
+}
+
+// SetSyncBlob sets f called before verifying a chunk, to write back its pending changes to bs.
+func (s *Scrubber) SetSyncBlob(f func(blobpath string) error) { s.syncBlob = f }
+
+// SetRateLimit limits the chunk read rate to bytesPerSec. 0 means unlimited.
+func (s *Scrubber) SetRateLimit(bytesPerSec int64) { s.bytesPerSec = bytesPerSec }
+
+func (s *Scrubber) Report() Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.report
+	r.BadChunks = append([]BadChunk{}, s.report.BadChunks...)
+	return r
+}
+
+// Reset discards the cursor and the bad chunks found, so that the next run starts a new pass from the beginning.
+func (s *Scrubber) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.report.Running {
+		return fmt.Errorf("Can't reset a running scrub.")
+	}
+	s.report = Report{NextID: inodedb.RootDirID}
+	return nil
+}
+
+func (s *Scrubber) updateReport(f func(r *Report)) {
+	s.mu.Lock()
+	f(&s.report)
+	s.mu.Unlock()
+}
+
+func (s *Scrubber) Run(ctx context.Context) error {
+	prov, ok := s.idb.(inodedb.DBServiceStatsProvider)
+	if !ok {
+		return fmt.Errorf("Scrub requires DBHandler to support GetStats()")
+	}
+
+	s.mu.Lock()
+	if s.report.Running {
+		s.mu.Unlock()
+		return fmt.Errorf("Scrub is already running.")
+	}
+	if s.report.Completed {
+		s.report = Report{NextID: inodedb.RootDirID}
+	}
+	s.report.Running = true
+	if s.report.StartedAt.IsZero() {
+		s.report.StartedAt = time.Now()
+	}
+	s.report.LastID = prov.GetStats().LastID
+	id := s.report.NextID
+	lastID := s.report.LastID
+	s.mu.Unlock()
+
+	defer s.updateReport(func(r *Report) { r.Running = false })
+
+	t := newThrottle(s.bytesPerSec)
+	log.Printf("Scrub start from node %d to %d.", id, lastID)
+	for ; id <= lastID; id++ {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Detected cancel. Bailing out. The next run will resume from node %d.", id)
+			return err
+		}
+
+		if err := s.scrubNode(ctx, t, id); err != nil {
+			if err == ctx.Err() {
+				log.Printf("Detected cancel. Bailing out. The next run will resume from node %d.", id)
+				return err
+			}
+			err = fmt.Errorf("Failed to scrub node %d: %v", id, err)
+			s.updateReport(func(r *Report) { r.LastError = err.Error() })
+			return err
+		}
+		s.updateReport(func(r *Report) { r.NextID = id + 1 })
+		s.reportProgress(ctx)
+	}
+
+	s.updateReport(func(r *Report) {
+		r.Completed = true
+		r.CompletedAt = time.Now()
+	})
+	rep := s.Report()
+	log.Printf("Scrub done. %d chunks verified, %d bad chunks found.", rep.NumChunksVerified, len(rep.BadChunks))
+	return nil
+}
+
+// reportProgress reports the progress of the pass to the scheduler job running it, if any.
+func (s *Scrubber) reportProgress(ctx context.Context) {
+	r := s.Report()
+	fraction := 1.0
+	if r.LastID > 0 {
+		fraction = float64(r.NextID-1) / float64(r.LastID)
+	}
+	scheduler.ReportProgress(ctx, scheduler.Progress{
+		Fraction:       fraction,
+		Message:        fmt.Sprintf("node %d/%d, %d bad chunks", r.NextID-1, r.LastID, len(r.BadChunks)),
+		BytesProcessed: r.NumBytesVerified,
+	})
+}
+
+func (s *Scrubber) scrubNode(ctx context.Context, t *throttle, id inodedb.ID) error {
+	v, _, err := s.idb.QueryNode(id, false)
+	if err != nil {
+		if inodedb.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	fv, ok := v.(*inodedb.FileNodeView)
+	if !ok {
+		return nil
+	}
+	s.updateReport(func(r *Report) { r.NumFilesScanned++ })
+
+	for _, fc := range fv.Chunks {
+		reason, err := s.verifyChunk(ctx, t, fc)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			log.Printf("Scrub found bad chunk %+v of node %d (\"%s\"): %s", fc, id, fv.OrigPath, reason)
+			bc := BadChunk{NodeID: id, OrigPath: fv.OrigPath, Chunk: fc, Reason: reason, FoundAt: time.Now()}
+			s.updateReport(func(r *Report) { r.BadChunks = append(r.BadChunks, bc) })
+		}
+		s.updateReport(func(r *Report) { r.NumChunksVerified++ })
+	}
+	return nil
+}
+
+// verifyChunk reads through the chunk. It returns the reason if the chunk is bad, and an error only if the scrub itself can't proceed.
+func (s *Scrubber) verifyChunk(ctx context.Context, t *throttle, fc inodedb.FileChunk) (string, error) {
+	if s.syncBlob != nil {
+		if err := s.syncBlob(fc.BlobPath); err != nil {
+			return "", fmt.Errorf("Failed to sync blob \"%s\": %v", fc.BlobPath, err)
+		}
+	}
+
+	r, err := s.bs.OpenReader(fc.BlobPath)
+	if err != nil {
+		return fmt.Sprintf("Failed to open blob: %v", err), nil
+	}
+	defer r.Close()
+
+	cr, err := chunkstore.NewChunkReader(r, s.c)
+	if err != nil {
+		return err.Error(), nil
+	}
+	h := cr.Header()
+	if err := h.VerifyBlobPath(fc.BlobPath); err != nil {
+		return err.Error(), nil
+	}
+	if int64(h.PayloadLen) != fc.Length {
+		return fmt.Sprintf("PayloadLen %d doesn't match chunk length %d", h.PayloadLen, fc.Length), nil
+	}
+
+	buf := make([]byte, readBufSize)
+	var nread int64
+	for {
+		n, err := cr.Read(buf)
+		nread += int64(n)
+		s.updateReport(func(r *Report) { r.NumBytesVerified += int64(n) })
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Sprintf("Failed to read content at offset %d: %v", nread, err), nil
+		}
+		if err := t.wait(ctx, n); err != nil {
+			return "", err
+		}
+	}
+	if nread != fc.Length {
+		return fmt.Sprintf("Read %d bytes, but expected %d bytes", nread, fc.Length), nil
+	}
+	return "", nil
+}
+
+// RestoreReport restores the report checkpointed by Task, so that the next run resumes from its cursor.
+func (s *Scrubber) RestoreReport(r Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.report.Running {
+		return fmt.Errorf("Can't restore report of a running scrub.")
+	}
+	r.Running = false
+	s.report = r
+	return nil
+}
+
+const (
+	TaskType = "scrub"
+	Pool     = "scrub"
+)
+
+type Task struct {
+	S *Scrubber
+}
+
+var _ = scheduler.PersistentTask(&Task{})
+var _ = scheduler.Checkpointer(&Task{})
+var _ = scheduler.JobOptionsProvider(&Task{})
+
+func (t *Task) TaskType() string { return TaskType }
+func (t *Task) Params() string   { return "" }
+
+func (t *Task) JobOptions() scheduler.JobOptions {
+	return scheduler.JobOptions{Priority: scheduler.PriorityLow, Pool: Pool, PoolLimit: 1}
+}
+
+func (t *Task) Checkpoint() ([]byte, error) {
+	return json.Marshal(t.S.Report())
+}
+
+func (t *Task) Run(ctx context.Context) scheduler.Result {
+	err := t.S.Run(ctx)
+	return scheduler.ErrorResult{err}
+}
+
+// Resumer returns a scheduler.TaskResumer which restores the checkpointed report to s, and resumes the scrub.
+func Resumer(s *Scrubber) scheduler.TaskResumer {
+	return func(params string, checkpoint []byte) (scheduler.Task, error) {
+		if checkpoint != nil {
+			var r Report
+			if err := json.Unmarshal(checkpoint, &r); err != nil {
+				return nil, fmt.Errorf("Failed to decode checkpoint: %v", err)
+			}
+			if err := s.RestoreReport(r); err != nil {
+				return nil, err
+			}
+		}
+		return &Task{s}, nil
+	}
+}
@@ -0,0 +1,224 @@
+package scrubber_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru/blobstore"
+	"github.com/nyaxt/otaru/blobstore/cachedblobstore"
+	"github.com/nyaxt/otaru/chunkstore"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/scrubber"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func writeChunk(t *testing.T, bs blobstore.RandomAccessBlobStore, blobpath string, p []byte) []byte {
+	var b bytes.Buffer
+	cw, err := chunkstore.NewChunkWriter(&b, TestCipher(), chunkstore.ChunkHeader{PayloadLen: uint32(len(p)), PayloadVersion: 1, BlobPath: blobpath})
+	if err != nil {
+		t.Fatalf("NewChunkWriter failed: %v", err)
+	}
+	if _, err := cw.Write(p); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	buf := b.Bytes()
+	putBlob(t, bs, blobpath, buf)
+	return buf
+}
+
+func putBlob(t *testing.T, bs blobstore.RandomAccessBlobStore, blobpath string, buf []byte) {
+	bh, err := bs.Open(blobpath, fl.O_RDWRCREATE)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer bh.Close()
+	if err := bh.PWrite(0, buf); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+}
+
+func createFile(t *testing.T, db *inodedb.DB, name string, cs []inodedb.FileChunk) inodedb.ID {
+	nlock, err := db.LockNode(inodedb.AllocateNewNodeID)
+	if err != nil {
+		t.Fatalf("LockNode failed: %v", err)
+	}
+	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
+		&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: "/" + name, Type: inodedb.FileNodeT},
+		&inodedb.UpdateChunksOp{NodeLock: nlock, Chunks: cs},
+		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{inodedb.RootDirID, inodedb.NoTicket}, Name: name, TargetID: nlock.ID},
+	}}
+	if _, err := db.ApplyTransaction(tx); err != nil {
+		t.Fatalf("ApplyTransaction failed: %v", err)
+	}
+	if err := db.UnlockNode(nlock); err != nil {
+		t.Fatalf("UnlockNode failed: %v", err)
+	}
+	return nlock.ID
+}
+
+func TestScrubber_FindsBadChunks(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	hwlen := int64(len(HelloWorld))
+
+	writeChunk(t, bs, "good", HelloWorld)
+	createFile(t, db, "good.txt", []inodedb.FileChunk{{Offset: 0, Length: hwlen, BlobPath: "good"}})
+
+	buf := writeChunk(t, bs, "rotten", HelloWorld)
+	buf[len(buf)-1] ^= 0xff
+	putBlob(t, bs, "rotten", buf)
+	rottenID := createFile(t, db, "rotten.txt", []inodedb.FileChunk{{Offset: 0, Length: hwlen, BlobPath: "rotten"}})
+
+	writeChunk(t, bs, "short", HelloWorld)
+	createFile(t, db, "short.txt", []inodedb.FileChunk{{Offset: 0, Length: hwlen + 1, BlobPath: "short"}})
+
+	createFile(t, db, "missing.txt", []inodedb.FileChunk{{Offset: 0, Length: hwlen, BlobPath: "missing"}})
+
+	s := scrubber.New(bs, TestCipher(), db)
+	if err := s.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+	r := s.Report()
+	if !r.Completed || r.NumFilesScanned != 4 || r.NumChunksVerified != 4 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+	if len(r.BadChunks) != 3 {
+		t.Fatalf("Unexpected bad chunks: %+v", r.BadChunks)
+	}
+	if bc := r.BadChunks[0]; bc.NodeID != rottenID || bc.OrigPath != "/rotten.txt" || bc.Chunk.BlobPath != "rotten" {
+		t.Errorf("Unexpected bad chunk: %+v", bc)
+	}
+	for i, bp := range []string{"rotten", "short", "missing"} {
+		if bc := r.BadChunks[i]; bc.Chunk.BlobPath != bp || bc.Reason == "" {
+			t.Errorf("Unexpected bad chunk: %+v", bc)
+		}
+	}
+	if !strings.Contains(r.BadChunks[1].Reason, "PayloadLen") {
+		t.Errorf("Unexpected reason for length mismatch: %s", r.BadChunks[1].Reason)
+	}
+}
+
+func TestScrubber_VerifiesBackend(t *testing.T) {
+	backendbs := TestFileBlobStore()
+	cbs, err := cachedblobstore.New(backendbs, TestFileBlobStore(), fl.O_RDWRCREATE, chunkstore.NewQueryChunkVersion(TestCipher()))
+	if err != nil {
+		t.Fatalf("Failed to create CachedBlobStore: %v", err)
+	}
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	hwlen := int64(len(HelloWorld))
+
+	buf := writeChunk(t, cbs, "rotten", HelloWorld)
+	createFile(t, db, "rotten.txt", []inodedb.FileChunk{{Offset: 0, Length: hwlen, BlobPath: "rotten"}})
+	if err := cbs.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	// Only the backend copy rots. The cache still serves the good one.
+	buf[len(buf)-1] ^= 0xff
+	w, err := backendbs.OpenWriter("rotten")
+	if err != nil {
+		t.Fatalf("OpenWriter failed: %v", err)
+	}
+	if _, err := w.Write(buf); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Not written back yet.
+	writeChunk(t, cbs, "pending", HelloWorld)
+	createFile(t, db, "pending.txt", []inodedb.FileChunk{{Offset: 0, Length: hwlen, BlobPath: "pending"}})
+
+	s := scrubber.New(backendbs, TestCipher(), db)
+	s.SetSyncBlob(cbs.SyncBlob)
+	if err := s.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+		return
+	}
+	r := s.Report()
+	if !r.Completed || r.NumChunksVerified != 2 || len(r.BadChunks) != 1 || r.BadChunks[0].Chunk.BlobPath != "rotten" {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+}
+
+func TestScrubber_ResumesAfterCancel(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	writeChunk(t, bs, "good", HelloWorld)
+	createFile(t, db, "good.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "good"}})
+
+	s := scrubber.New(bs, TestCipher(), db)
+	s.SetRateLimit(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Run(ctx); err == nil {
+		t.Errorf("Run should fail on cancelled ctx")
+	}
+	if r := s.Report(); r.Completed || r.NextID != inodedb.RootDirID {
+		t.Errorf("Unexpected report after cancel: %+v", r)
+	}
+
+	if err := s.Run(context.TODO()); err != nil {
+		t.Errorf("Run failed: %v", err)
+	}
+	if r := s.Report(); !r.Completed || r.NumChunksVerified != 1 || len(r.BadChunks) != 0 {
+		t.Errorf("Unexpected report after resume: %+v", r)
+	}
+}
+
+func TestScrubber_ResumesFromCheckpoint(t *testing.T) {
+	bs := TestFileBlobStore()
+	db, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	writeChunk(t, bs, "good", HelloWorld)
+	createFile(t, db, "good.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "good"}})
+	createFile(t, db, "missing.txt", []inodedb.FileChunk{{Offset: 0, Length: int64(len(HelloWorld)), BlobPath: "missing"}})
+
+	s := scrubber.New(bs, TestCipher(), db)
+	if err := s.Run(context.TODO()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	r := s.Report()
+	r.Completed = false
+	r.NextID = r.LastID
+	if err := s.RestoreReport(r); err != nil {
+		t.Fatalf("RestoreReport failed: %v", err)
+	}
+	cp, err := (&scrubber.Task{s}).Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	// Pretend restart.
+	s2 := scrubber.New(bs, TestCipher(), db)
+	task, err := scrubber.Resumer(s2)("", cp)
+	if err != nil {
+		t.Fatalf("Resumer failed: %v", err)
+	}
+	if res := task.Run(context.TODO()); res.Err() != nil {
+		t.Fatalf("Resumed run failed: %v", res.Err())
+	}
+	r2 := s2.Report()
+	if !r2.Completed || r2.NumFilesScanned != 3 || len(r2.BadChunks) != 2 {
+		t.Errorf("Unexpected report after resume: %+v", r2)
+	}
+}
@@ -0,0 +1,38 @@
+package scrubber
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// throttle paces reads so that the average rate since its creation stays under bytesPerSec.
+type throttle struct {
+	bytesPerSec int64
+	start       time.Time
+	total       int64
+}
+
+func newThrottle(bytesPerSec int64) *throttle {
+	return &throttle{bytesPerSec: bytesPerSec, start: time.Now()}
+}
+
+// wait blocks until n more bytes can be read without exceeding the rate, or ctx is cancelled.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.bytesPerSec <= 0 {
+		return nil
+	}
+	t.total += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.total) / float64(t.bytesPerSec) * float64(time.Second)))
+	d := due.Sub(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
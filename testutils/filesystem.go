@@ -0,0 +1,17 @@
+package otaru_test
+
+import (
+	"log"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+// TestFileSystem returns an empty FileSystem on a new TestFileBlobStore.
+func TestFileSystem() *otaru.FileSystem {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		log.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	return otaru.NewFileSystem(inodedb.NewDBService(idb), TestFileBlobStore(), TestCipher())
+}
@@ -0,0 +1,445 @@
+package otaru
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru/chunkstore"
+	"github.com/nyaxt/otaru/inodedb"
+	"github.com/nyaxt/otaru/scheduler"
+)
+
+// TrashDirName is the hidden directory at the root which keeps the removed entries as TrashDirName/<trash entry name>/<base name>.
+const TrashDirName = ".otaru-trash"
+
+const trashPath = "/" + TrashDirName
+
+// trashTimeLayout formats the deletion time in the trash entry names, so that they sort in the order removed.
+const trashTimeLayout = "20060102T150405.000000000Z"
+
+type TrashEntry struct {
+	// Name identifies the entry in the trash.
+	Name      string
+	DeletedAt time.Time
+	// OrigPath is the path the entry was removed from. It is recorded as PathPrivacy specifies, so it may be hashed or omitted.
+	OrigPath string
+	// Attr is of the node removed.
+	Attr
+}
+
+func trashEntryName(deletedAt time.Time, id inodedb.ID) string {
+	return fmt.Sprintf("%s-%d", deletedAt.UTC().Format(trashTimeLayout), id)
+}
+
+func parseTrashEntryName(name string) (time.Time, inodedb.ID, error) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return time.Time{}, 0, fmt.Errorf("Invalid trash entry name: \"%s\"", name)
+	}
+	deletedAt, err := time.Parse(trashTimeLayout, name[:i])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("Invalid trash entry name \"%s\": %v", name, err)
+	}
+	id, err := strconv.ParseUint(name[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("Invalid trash entry name \"%s\": %v", name, err)
+	}
+	return deletedAt, inodedb.ID(id), nil
+}
+
+// EnableTrash makes Remove and RemoveAll move the entries to the trash. 0 retention keeps them until purged explicitly.
+func (fs *FileSystem) EnableTrash(retention time.Duration) {
+	fs.trashEnabled = true
+	fs.trashRetention = retention
+}
+
+// trashDirID returns the ID of the trash directory. If it doesn't exist, it is created if create, or ENOENT is returned.
+func (fs *FileSystem) trashDirID(create bool) (inodedb.ID, error) {
+	fs.muTrash.Lock()
+	defer fs.muTrash.Unlock()
+
+	entries, err := fs.DirEntries(inodedb.RootDirID)
+	if err != nil {
+		return 0, err
+	}
+	if id, ok := entries[TrashDirName]; ok {
+		return id, nil
+	}
+	if !create {
+		return 0, ENOENT
+	}
+	return fs.CreateDir(inodedb.RootDirID, TrashDirName)
+}
+
+// bypassesTrash tells if the entry is to be removed for good even if the trash is enabled, i.e. the trash directory itself and anything in it.
+func (fs *FileSystem) bypassesTrash(dirID inodedb.ID, name string) (bool, error) {
+	if !fs.trashEnabled {
+		return true, nil
+	}
+	if dirID == inodedb.RootDirID {
+		return name == TrashDirName, nil
+	}
+	return fs.isInTrash(dirID)
+}
+
+// isInTrash tells if the directory is the trash directory or in it.
+func (fs *FileSystem) isInTrash(dirID inodedb.ID) (bool, error) {
+	trashID, err := fs.trashDirID(false)
+	if err == ENOENT {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fs.muTrashIDs.Lock()
+	defer fs.muTrashIDs.Unlock()
+
+	if fs.trashIDs == nil || fs.trashIDsRoot != trashID {
+		ids := make(map[inodedb.ID]struct{})
+		if err := fs.collectDirIDs(trashID, ids); err != nil {
+			return false, fmt.Errorf("Failed to list directories in trash: %v", err)
+		}
+		fs.trashIDs = ids
+		fs.trashIDsRoot = trashID
+	}
+	_, ok := fs.trashIDs[dirID]
+	return ok, nil
+}
+
+// collectDirIDs adds the ID of the directory and the directories under it to ids. Nothing is added if id isn't a directory.
+func (fs *FileSystem) collectDirIDs(id inodedb.ID, ids map[inodedb.ID]struct{}) error {
+	v, _, err := fs.idb.QueryNode(id, false)
+	if err != nil {
+		return err
+	}
+	dv, ok := v.(*inodedb.DirNodeView)
+	if !ok {
+		return nil
+	}
+	ids[id] = struct{}{}
+	for _, cid := range dv.Entries {
+		if err := fs.collectDirIDs(cid, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trackTrashDirs adds the directory linked to parentID, and the directories under it, to the cached trash IDs if parentID is in the trash.
+func (fs *FileSystem) trackTrashDirs(parentID, id inodedb.ID) {
+	fs.muTrashIDs.Lock()
+	defer fs.muTrashIDs.Unlock()
+
+	if fs.trashIDs == nil {
+		return
+	}
+	if _, ok := fs.trashIDs[parentID]; !ok {
+		return
+	}
+	if err := fs.collectDirIDs(id, fs.trashIDs); err != nil {
+		log.Printf("Failed to track directories moved to trash. Will list them again: %v", err)
+		fs.trashIDs = nil
+	}
+}
+
+// untrackTrashDirsIfIn drops the cached trash IDs if any of the directories is in the trash.
+func (fs *FileSystem) untrackTrashDirsIfIn(dirIDs ...inodedb.ID) {
+	fs.muTrashIDs.Lock()
+	defer fs.muTrashIDs.Unlock()
+
+	if fs.trashIDs == nil {
+		return
+	}
+	for _, id := range dirIDs {
+		if _, ok := fs.trashIDs[id]; ok {
+			fs.trashIDs = nil
+			return
+		}
+	}
+}
+
+// moveToTrash moves the entry to a new trash entry in a single DBTransaction. A non-empty directory is moved only if recursive.
+func (fs *FileSystem) moveToTrash(dirID inodedb.ID, name string, recursive bool) error {
+	entries, err := fs.DirEntries(dirID)
+	if err != nil {
+		return err
+	}
+	id, ok := entries[name]
+	if !ok {
+		return ENOENT
+	}
+
+	trashID, err := fs.trashDirID(true)
+	if err != nil {
+		return fmt.Errorf("Failed to create trash directory: %v", err)
+	}
+
+	nlock, err := fs.idb.LockNode(inodedb.AllocateNewNodeID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fs.idb.UnlockNode(nlock); err != nil {
+			log.Printf("Failed to unlock node when moving to trash: %v", err)
+		}
+	}()
+
+	tname := trashEntryName(time.Now(), id)
+	origpath := path.Clean(fmt.Sprintf("%s/%s", fs.tryGetOrigPath(dirID), name))
+	// The entry is linked to the trash before unlinked from the directory, so that the blobs of the files stay referenced.
+	tx := inodedb.DBTransaction{Ops: []inodedb.DBOperation{
+		&inodedb.CreateNodeOp{NodeLock: nlock, OrigPath: fs.pathScrubber.Scrub(origpath), Type: inodedb.DirNodeT},
+		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{trashID, inodedb.NoTicket}, Name: tname, TargetID: nlock.ID},
+		&inodedb.HardLinkOp{NodeLock: nlock, Name: name, TargetID: id},
+		&inodedb.RemoveOp{NodeLock: inodedb.NodeLock{dirID, inodedb.NoTicket}, Name: name, SkipEmptyCheck: recursive},
+	}}
+	if _, err := fs.idb.ApplyTransaction(tx); err != nil {
+		return err
+	}
+	log.Printf("Moved \"%s\" (%d) to trash \"%s\"", origpath, id, tname)
+	fs.trackTrashDirs(trashID, nlock.ID)
+
+	fs.setOrigPathForId(nlock.ID, path.Join(trashPath, tname))
+	fs.setOrigPathForId(id, path.Join(trashPath, tname, name))
+	return nil
+}
+
+// trashEntry returns the ID of the trash entry directory, and the base name and the ID of the entry removed.
+func (fs *FileSystem) trashEntry(trashID inodedb.ID, name string) (inodedb.ID, string, inodedb.ID, error) {
+	entries, err := fs.DirEntries(trashID)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	tid, ok := entries[name]
+	if !ok {
+		return 0, "", 0, ENOENT
+	}
+	tentries, err := fs.DirEntries(tid)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if len(tentries) != 1 {
+		return 0, "", 0, fmt.Errorf("Trash entry \"%s\" should contain exactly 1 entry, but has %d", name, len(tentries))
+	}
+	var basename string
+	var id inodedb.ID
+	for basename, id = range tentries {
+	}
+	return tid, basename, id, nil
+}
+
+// ListTrash returns the entries in the trash, in the order removed.
+func (fs *FileSystem) ListTrash() ([]TrashEntry, error) {
+	trashID, err := fs.trashDirID(false)
+	if err == ENOENT {
+		return []TrashEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.DirEntries(trashID)
+	if err != nil {
+		return nil, err
+	}
+
+	tes := make([]TrashEntry, 0, len(entries))
+	for name, tid := range entries {
+		deletedAt, _, err := parseTrashEntryName(name)
+		if err != nil {
+			log.Printf("Skipping unknown entry in trash: %v", err)
+			continue
+		}
+		v, _, err := fs.idb.QueryNode(tid, false)
+		if err != nil {
+			return nil, err
+		}
+		dv, ok := v.(*inodedb.DirNodeView)
+		if !ok || len(dv.Entries) != 1 {
+			log.Printf("Skipping broken trash entry \"%s\"", name)
+			continue
+		}
+		te := TrashEntry{Name: name, DeletedAt: deletedAt, OrigPath: dv.OrigPath}
+		for _, id := range dv.Entries {
+			if te.Attr, err = fs.Attr(id); err != nil {
+				return nil, err
+			}
+		}
+		tes = append(tes, te)
+	}
+	sort.Slice(tes, func(i, j int) bool { return tes[i].Name < tes[j].Name })
+	return tes, nil
+}
+
+// createDirAll creates the directory fullpath along with its missing parents, and returns its ID.
+func (fs *FileSystem) createDirAll(fullpath string) (inodedb.ID, error) {
+	id, err := fs.FindNodeFullPath(fullpath)
+	if err == nil {
+		if isdir, err := fs.IsDir(id); err != nil {
+			return 0, err
+		} else if !isdir {
+			return 0, ENOTDIR
+		}
+		return id, nil
+	}
+	if err != ENOENT {
+		return 0, err
+	}
+	if _, err := fs.createDirAll(path.Dir(fullpath)); err != nil {
+		return 0, err
+	}
+	return fs.CreateDirFullPath(fullpath)
+}
+
+func (fs *FileSystem) isEmptyDir(id inodedb.ID) (bool, error) {
+	v, _, err := fs.idb.QueryNode(id, false)
+	if err != nil {
+		return false, err
+	}
+	dv, ok := v.(*inodedb.DirNodeView)
+	return ok && len(dv.Entries) == 0, nil
+}
+
+// RestoreTrash moves the entry in the trash back to dstpath, or to its original path if dstpath is empty.
+func (fs *FileSystem) RestoreTrash(name, dstpath string) (string, error) {
+	trashID, err := fs.trashDirID(false)
+	if err != nil {
+		return "", err
+	}
+	tid, basename, id, err := fs.trashEntry(trashID, name)
+	if err != nil {
+		return "", err
+	}
+
+	if dstpath == "" {
+		v, _, err := fs.idb.QueryNode(tid, false)
+		if err != nil {
+			return "", err
+		}
+		dstpath = v.(*inodedb.DirNodeView).OrigPath
+		if chunkstore.IsScrubbedPath(dstpath) || checkFullPath(dstpath) != nil {
+			return "", fmt.Errorf("The path trash entry \"%s\" was removed from isn't recorded. Specify the path to restore to.", name)
+		}
+	}
+	if err := checkFullPath(dstpath); err != nil {
+		return "", err
+	}
+	dstpath = path.Clean(dstpath)
+	if dstpath == "/" || dstpath == trashPath || strings.HasPrefix(dstpath, trashPath+"/") {
+		return "", EPERM
+	}
+
+	dstDirID, err := fs.createDirAll(path.Dir(dstpath))
+	if err != nil {
+		return "", err
+	}
+	dstName := path.Base(dstpath)
+
+	ops := []inodedb.DBOperation{
+		&inodedb.HardLinkOp{NodeLock: inodedb.NodeLock{dstDirID, inodedb.NoTicket}, Name: dstName, TargetID: id},
+	}
+	if entries, err := fs.DirEntries(dstDirID); err != nil {
+		return "", err
+	} else if existingID, ok := entries[dstName]; ok {
+		empty, err := fs.isEmptyDir(id)
+		if err != nil {
+			return "", err
+		}
+		isdir, err := fs.IsDir(existingID)
+		if err != nil {
+			return "", err
+		}
+		if !empty || !isdir {
+			return "", EEXIST
+		}
+		ops = nil
+	}
+	ops = append(ops,
+		&inodedb.RemoveOp{NodeLock: inodedb.NodeLock{tid, inodedb.NoTicket}, Name: basename, SkipEmptyCheck: true},
+		&inodedb.RemoveOp{NodeLock: inodedb.NodeLock{trashID, inodedb.NoTicket}, Name: name},
+	)
+	if _, err := fs.idb.ApplyTransaction(inodedb.DBTransaction{Ops: ops}); err != nil {
+		return "", err
+	}
+	log.Printf("Restored trash \"%s\" (%d) to \"%s\"", name, id, dstpath)
+	fs.untrackTrashDirsIfIn(tid)
+
+	fs.setOrigPathForId(id, dstpath)
+	return dstpath, nil
+}
+
+// PurgeTrash removes the entries moved to the trash before t for good, and returns the number of entries purged.
+func (fs *FileSystem) PurgeTrash(ctx context.Context, t time.Time) (int, error) {
+	trashID, err := fs.trashDirID(false)
+	if err == ENOENT {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	entries, err := fs.DirEntries(trashID)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for name := range entries {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		deletedAt, _, err := parseTrashEntryName(name)
+		if err != nil {
+			log.Printf("Skipping unknown entry in trash: %v", err)
+			continue
+		}
+		if !deletedAt.Before(t) {
+			continue
+		}
+		if err := fs.RemoveAllNow(trashID, name); err != nil {
+			return n, fmt.Errorf("Failed to purge trash \"%s\": %v", name, err)
+		}
+		n++
+	}
+	log.Printf("Purged %d entries from trash", n)
+	return n, nil
+}
+
+// PurgeExpiredTrash purges the entries in the trash older than the retention. Nothing is purged with 0 retention.
+func (fs *FileSystem) PurgeExpiredTrash(ctx context.Context) (int, error) {
+	if fs.trashRetention == 0 {
+		return 0, nil
+	}
+	return fs.PurgeTrash(ctx, time.Now().Add(-fs.trashRetention))
+}
+
+const (
+	TrashPurgeTaskType = "trash-purge"
+	TrashPurgePool     = "trash-purge"
+)
+
+// TrashPurgeTask purges the entries in the trash older than the retention.
+type TrashPurgeTask struct {
+	FS *FileSystem
+}
+
+var _ = scheduler.PersistentTask(&TrashPurgeTask{})
+var _ = scheduler.JobOptionsProvider(&TrashPurgeTask{})
+
+func (t *TrashPurgeTask) TaskType() string { return TrashPurgeTaskType }
+func (t *TrashPurgeTask) Params() string   { return "" }
+
+func (t *TrashPurgeTask) JobOptions() scheduler.JobOptions {
+	return scheduler.JobOptions{Priority: scheduler.PriorityLow, Pool: TrashPurgePool, PoolLimit: 1}
+}
+
+func (t *TrashPurgeTask) Run(ctx context.Context) scheduler.Result {
+	_, err := t.FS.PurgeExpiredTrash(ctx)
+	return scheduler.ErrorResult{err}
+}
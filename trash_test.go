@@ -0,0 +1,265 @@
+package otaru_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru"
+	"github.com/nyaxt/otaru/chunkstore"
+	"github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	. "github.com/nyaxt/otaru/testutils"
+)
+
+func createFile(t *testing.T, fs *otaru.FileSystem, fullpath string, p []byte) {
+	h, err := fs.OpenFileFullPath(fullpath, flags.O_CREATE|flags.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath(%s) failed: %v", fullpath, err)
+	}
+	h.Close()
+	writeAt(t, fs, fullpath, 0, p)
+}
+
+func TestTrash(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+	fs.EnableTrash(time.Hour)
+
+	if _, err := fs.CreateDirFullPath("/docs"); err != nil {
+		t.Fatalf("CreateDirFullPath failed: %v", err)
+	}
+	if _, err := fs.CreateDirFullPath("/docs/sub"); err != nil {
+		t.Fatalf("CreateDirFullPath failed: %v", err)
+	}
+	createFile(t, fs, "/docs/a.txt", []byte("hello"))
+	createFile(t, fs, "/docs/sub/b.txt", []byte("world"))
+	aID, err := fs.FindNodeFullPath("/docs/a.txt")
+	if err != nil {
+		t.Fatalf("FindNodeFullPath failed: %v", err)
+	}
+	blobpath := chunksOf(t, idb, aID)[0].BlobPath
+
+	if err := fs.RemoveFullPath("/docs"); err != otaru.ENOTEMPTY && err != inodedb.ENOTEMPTY {
+		t.Errorf("Remove of non-empty dir should fail with ENOTEMPTY: %v", err)
+	}
+	if err := fs.RemoveFullPath("/docs/a.txt"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	if err := fs.RemoveAllFullPath("/docs/sub"); err != nil {
+		t.Fatalf("RemoveAllFullPath failed: %v", err)
+	}
+	if _, err := fs.FindNodeFullPath("/docs/a.txt"); err != otaru.ENOENT {
+		t.Errorf("Removed file should be gone: %v", err)
+	}
+	if n := idb.BlobRefCount(blobpath); n != 1 {
+		t.Errorf("Blob of file in trash should stay referenced, but refcount %d", n)
+	}
+
+	tes, err := fs.ListTrash()
+	if err != nil {
+		t.Fatalf("ListTrash failed: %v", err)
+	}
+	if len(tes) != 2 {
+		t.Fatalf("Expected 2 trash entries, got %+v", tes)
+	}
+	if tes[0].OrigPath != "/docs/a.txt" || tes[0].Type != inodedb.FileNodeT || tes[0].Size != 5 {
+		t.Errorf("Unexpected trash entry: %+v", tes[0])
+	}
+	if tes[1].OrigPath != "/docs/sub" || tes[1].Type != inodedb.DirNodeT {
+		t.Errorf("Unexpected trash entry: %+v", tes[1])
+	}
+	if d := time.Since(tes[0].DeletedAt); d < 0 || d > time.Minute {
+		t.Errorf("Unexpected deletion time: %v", tes[0].DeletedAt)
+	}
+	if _, err := fs.FindNodeFullPath("/" + otaru.TrashDirName + "/" + tes[1].Name + "/sub/b.txt"); err != nil {
+		t.Errorf("Removed subtree should be kept in the trash dir: %v", err)
+	}
+
+	// Restore to the original path, recreating the removed parent.
+	if err := fs.RemoveFullPath("/docs"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	p, err := fs.RestoreTrash(tes[1].Name, "")
+	if err != nil {
+		t.Fatalf("RestoreTrash failed: %v", err)
+	}
+	if p != "/docs/sub" {
+		t.Errorf("Unexpected restored path: %s", p)
+	}
+	if !bytes.Equal(readAll(t, fs, "/docs/sub/b.txt"), []byte("world")) {
+		t.Errorf("Restored subtree content mismatch")
+	}
+
+	// The empty dir "/docs" restores onto the recreated one.
+	tes, err = fs.ListTrash()
+	if err != nil {
+		t.Fatalf("ListTrash failed: %v", err)
+	}
+	if len(tes) != 2 || tes[1].OrigPath != "/docs" {
+		t.Fatalf("Unexpected trash entries: %+v", tes)
+	}
+	if _, err := fs.RestoreTrash(tes[1].Name, ""); err != nil {
+		t.Errorf("RestoreTrash of empty dir onto existing dir failed: %v", err)
+	}
+
+	createFile(t, fs, "/docs/a.txt", []byte("new"))
+	if _, err := fs.RestoreTrash(tes[0].Name, ""); err != otaru.EEXIST && err != inodedb.EEXIST {
+		t.Errorf("Restore onto existing file should fail with EEXIST: %v", err)
+	}
+	if _, err := fs.RestoreTrash(tes[0].Name, "/"+otaru.TrashDirName+"/a.txt"); err != otaru.EPERM {
+		t.Errorf("Restore into the trash should fail with EPERM: %v", err)
+	}
+	if p, err := fs.RestoreTrash(tes[0].Name, "/docs/a.old.txt"); err != nil || p != "/docs/a.old.txt" {
+		t.Errorf("RestoreTrash to dst failed: %v, %s", err, p)
+	}
+	if !bytes.Equal(readAll(t, fs, "/docs/a.old.txt"), []byte("hello")) {
+		t.Errorf("Restored file content mismatch")
+	}
+	if _, err := fs.RestoreTrash(tes[0].Name, ""); err != otaru.ENOENT {
+		t.Errorf("Restore of restored entry should fail with ENOENT: %v", err)
+	}
+
+	// Nothing is purged until the entries get older than the retention.
+	if err := fs.RemoveFullPath("/docs/a.old.txt"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	if n, err := fs.PurgeExpiredTrash(context.Background()); err != nil || n != 0 {
+		t.Errorf("PurgeExpiredTrash should purge nothing: %v, %d", err, n)
+	}
+	if n, err := fs.PurgeTrash(context.Background(), time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Errorf("PurgeTrash failed: %v, %d", err, n)
+	}
+	if tes, err := fs.ListTrash(); err != nil || len(tes) != 0 {
+		t.Errorf("Trash should be empty after purge: %v, %+v", err, tes)
+	}
+	if n := idb.BlobRefCount(blobpath); n != 0 {
+		t.Errorf("Blob of purged file should be unreferenced, but refcount %d", n)
+	}
+
+	// Entries in the trash are removed for good.
+	if err := fs.RemoveAllFullPath("/" + otaru.TrashDirName); err != nil {
+		t.Errorf("RemoveAllFullPath of trash dir failed: %v", err)
+	}
+	if tes, err := fs.ListTrash(); err != nil || len(tes) != 0 {
+		t.Errorf("ListTrash without trash dir failed: %v, %+v", err, tes)
+	}
+
+	if report, err := idb.Check(false); err != nil {
+		t.Errorf("Check failed: %v", err)
+	} else if len(report.Issues) != 0 {
+		t.Errorf("Unexpected fsck issues: %+v", report.Issues)
+	}
+}
+
+func TestTrash_PathPrivacy(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	fs := otaru.NewFileSystem(idb, TestFileBlobStore(), TestCipher())
+	fs.SetPathScrubber(chunkstore.NewPathScrubber(chunkstore.PathPrivacyHMAC, []byte("testkey")))
+	fs.EnableTrash(0)
+
+	createFile(t, fs, "/secret.txt", []byte("hello"))
+	if err := fs.RemoveFullPath("/secret.txt"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	tes, err := fs.ListTrash()
+	if err != nil || len(tes) != 1 {
+		t.Fatalf("ListTrash failed: %v, %+v", err, tes)
+	}
+	if strings.Contains(tes[0].OrigPath, "secret") {
+		t.Errorf("OrigPath should be scrubbed: %s", tes[0].OrigPath)
+	}
+	if _, err := fs.RestoreTrash(tes[0].Name, ""); err == nil {
+		t.Errorf("Restore without dst should fail if the path isn't recorded")
+	}
+	if _, err := fs.RestoreTrash(tes[0].Name, "/restored.txt"); err != nil {
+		t.Errorf("RestoreTrash to dst failed: %v", err)
+	}
+	if n, err := fs.PurgeExpiredTrash(context.Background()); err != nil || n != 0 {
+		t.Errorf("PurgeExpiredTrash with 0 retention should purge nothing: %v, %d", err, n)
+	}
+}
+
+func TestTrash_EntriesInTrashFoundByID(t *testing.T) {
+	idb, err := inodedb.NewEmptyDB(inodedb.NewSimpleDBStateSnapshotIO(), inodedb.NewSimpleDBTransactionLogIO())
+	if err != nil {
+		t.Fatalf("NewEmptyDB failed: %v", err)
+	}
+	bs := TestFileBlobStore()
+	fs := otaru.NewFileSystem(idb, bs, TestCipher())
+	fs.EnableTrash(time.Hour)
+
+	if _, err := fs.CreateDirFullPath("/docs"); err != nil {
+		t.Fatalf("CreateDirFullPath failed: %v", err)
+	}
+	if _, err := fs.CreateDirFullPath("/docs/sub"); err != nil {
+		t.Fatalf("CreateDirFullPath failed: %v", err)
+	}
+	createFile(t, fs, "/docs/sub/b.txt", []byte("world"))
+	createFile(t, fs, "/docs/sub/c.txt", []byte("again"))
+	subID, err := fs.FindNodeFullPath("/docs/sub")
+	if err != nil {
+		t.Fatalf("FindNodeFullPath failed: %v", err)
+	}
+	if err := fs.RemoveAllFullPath("/docs"); err != nil {
+		t.Fatalf("RemoveAllFullPath failed: %v", err)
+	}
+
+	// A new FileSystem doesn't know the paths of the nodes until looked up.
+	fs2 := otaru.NewFileSystem(idb, bs, TestCipher())
+	fs2.EnableTrash(time.Hour)
+	if err := fs2.Remove(subID, "b.txt"); err != nil {
+		t.Fatalf("Remove in trash failed: %v", err)
+	}
+	if tes, err := fs2.ListTrash(); err != nil || len(tes) != 1 {
+		t.Errorf("Remove in trash shouldn't add a trash entry: %v, %+v", err, tes)
+	}
+
+	if err := fs2.Rename(inodedb.RootDirID, otaru.TrashDirName, inodedb.RootDirID, "trash"); err != otaru.EPERM {
+		t.Errorf("Rename of trash dir should fail with EPERM: %v", err)
+	}
+	if _, err := fs2.CreateDirFullPath("/fake"); err != nil {
+		t.Fatalf("CreateDirFullPath failed: %v", err)
+	}
+	if err := fs2.Rename(inodedb.RootDirID, "fake", inodedb.RootDirID, otaru.TrashDirName); err != otaru.EPERM {
+		t.Errorf("Rename onto trash dir should fail with EPERM: %v", err)
+	}
+
+	// A dir moved out of the trash is no longer in it.
+	if err := fs2.Rename(subID, "c.txt", inodedb.RootDirID, "c.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := fs2.Rename(inodedb.RootDirID, "fake", subID, "fake"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := fs2.RemoveFullPath("/c.txt"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	if tes, err := fs2.ListTrash(); err != nil || len(tes) != 2 {
+		t.Errorf("Removed file should be moved to trash: %v, %+v", err, tes)
+	}
+	if err := fs2.Rename(subID, "fake", inodedb.RootDirID, "fake"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := fs2.RemoveFullPath("/fake"); err != nil {
+		t.Fatalf("RemoveFullPath failed: %v", err)
+	}
+	if tes, err := fs2.ListTrash(); err != nil || len(tes) != 3 {
+		t.Errorf("Dir moved out of the trash should be moved to trash again: %v, %+v", err, tes)
+	}
+
+	if report, err := idb.Check(false); err != nil {
+		t.Errorf("Check failed: %v", err)
+	} else if len(report.Issues) != 0 {
+		t.Errorf("Unexpected fsck issues: %+v", report.Issues)
+	}
+}
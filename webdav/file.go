@@ -0,0 +1,189 @@
+package webdav
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	xwebdav "golang.org/x/net/webdav"
+
+	"github.com/nyaxt/otaru"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+// FileInfo implements os.FileInfo of an otaru node.
+type FileInfo struct {
+	ofs  *otaru.FileSystem
+	name string
+	attr otaru.Attr
+}
+
+var _ = xwebdav.ETager(FileInfo{})
+
+func stat(ofs *otaru.FileSystem, fullpath string, id inodedb.ID) (FileInfo, error) {
+	a, err := ofs.Attr(id)
+	if err != nil {
+		return FileInfo{}, osError(err)
+	}
+	return FileInfo{ofs: ofs, name: path.Base(fullpath), attr: a}, nil
+}
+
+func (fi FileInfo) Name() string { return fi.name }
+func (fi FileInfo) Size() int64  { return fi.attr.Size }
+
+func (fi FileInfo) Mode() os.FileMode {
+	if fi.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi FileInfo) ModTime() time.Time { return time.Time{} }
+func (fi FileInfo) IsDir() bool        { return fi.attr.Type == inodedb.DirNodeT }
+func (fi FileInfo) Sys() interface{}   { return fi.attr }
+
+func (fi FileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.IsDir() {
+		return "", xwebdav.ErrNotImplemented
+	}
+	ver, err := fi.ofs.ContentVersion(fi.attr.ID)
+	if err != nil {
+		return "", osError(err)
+	}
+	return fmt.Sprintf("\"%x-%x\"", uint64(fi.attr.ID), ver), nil
+}
+
+// File is an open regular file.
+type File struct {
+	*otaru.FileHandleIO
+	ofs  *otaru.FileSystem
+	fh   *otaru.FileHandle
+	name string
+	flag int
+
+	// rep is set for files opened with O_TRUNC, which replace the file on Close. failed is set if the content couldn't be fully written.
+	rep    *otaru.FileReplacement
+	failed bool
+}
+
+func newFile(ofs *otaru.FileSystem, fh *otaru.FileHandle, name string, flag int) *File {
+	return &File{FileHandleIO: otaru.NewFileHandleIO(fh), ofs: ofs, fh: fh, name: name, flag: flag}
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.FileHandleIO.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+// ReadFrom lets io.Copy of a PUT body tell the body was cut short, so that the file isn't replaced with the partial content.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(f.FileHandleIO, r)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, syscall.ENOTDIR
+}
+
+// Stat syncs the content written first, so that the ETag reflects it.
+func (f *File) Stat() (os.FileInfo, error) {
+	if fl.IsWriteAllowed(f.flag) {
+		if err := f.fh.Sync(); err != nil {
+			f.failed = true
+			return nil, fmt.Errorf("Failed to sync \"%s\": %v", f.name, err)
+		}
+	}
+	return FileInfo{
+		ofs:  f.ofs,
+		name: path.Base(f.name),
+		attr: otaru.Attr{ID: f.fh.ID(), Type: inodedb.FileNodeT, Size: f.fh.Size()},
+	}, nil
+}
+
+// Close syncs the content written, as WebDAV clients can't request fsync.
+func (f *File) Close() error {
+	defer f.fh.Close()
+	if fl.IsWriteAllowed(f.flag) {
+		if err := f.fh.Sync(); err != nil {
+			f.failed = true
+			if f.rep != nil {
+				f.rep.Abort()
+			}
+			return fmt.Errorf("Failed to sync \"%s\": %v", f.name, err)
+		}
+	}
+	if f.rep == nil {
+		return nil
+	}
+	if f.failed {
+		f.rep.Abort()
+		return fmt.Errorf("Content of \"%s\" wasn't fully written. Keeping the file as is.", f.name)
+	}
+	return osError(f.rep.Commit())
+}
+
+// DirFile is an open directory. It can only be listed.
+type DirFile struct {
+	fs   *otaru.FileSystem
+	name string
+	id   inodedb.ID
+
+	// fis are the entries left to be returned by Readdir. They are queried on the first Readdir.
+	fis  []os.FileInfo
+	read bool
+}
+
+func (d *DirFile) Close() error                   { return nil }
+func (d *DirFile) Read(p []byte) (int, error)     { return 0, syscall.EISDIR }
+func (d *DirFile) Write(p []byte) (int, error)    { return 0, syscall.EISDIR }
+func (d *DirFile) Seek(int64, int) (int64, error) { return 0, nil }
+func (d *DirFile) Stat() (os.FileInfo, error)     { return stat(d.fs, d.name, d.id) }
+
+func (d *DirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := d.fs.DirEntries(d.id)
+		if err != nil {
+			return nil, osError(err)
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fi, err := stat(d.fs, path.Join(d.name, name), entries[name])
+			if err != nil {
+				return nil, err
+			}
+			d.fis = append(d.fis, fi)
+		}
+		d.read = true
+	}
+
+	if count <= 0 {
+		fis := d.fis
+		d.fis = nil
+		return fis, nil
+	}
+	if len(d.fis) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.fis) {
+		count = len(d.fis)
+	}
+	fis := d.fis[:count]
+	d.fis = d.fis[count:]
+	return fis, nil
+}
@@ -0,0 +1,122 @@
+// Package webdav serves otaru.FileSystem over WebDAV, for clients which can't mount FUSE.
+package webdav
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"golang.org/x/net/context"
+	xwebdav "golang.org/x/net/webdav"
+
+	"github.com/nyaxt/otaru"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+)
+
+// FileSystem implements golang.org/x/net/webdav.FileSystem on top of otaru.FileSystem.
+type FileSystem struct {
+	ofs *otaru.FileSystem
+}
+
+var _ = xwebdav.FileSystem(FileSystem{})
+
+func NewFileSystem(ofs *otaru.FileSystem) FileSystem {
+	return FileSystem{ofs}
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// osError converts errors of inodedb to syscall.Errno, so that webdav.Handler can tell them with os.IsNotExist and os.IsExist.
+func osError(err error) error {
+	if errno, ok := err.(inodedb.Errno); ok {
+		return syscall.Errno(errno)
+	}
+	return err
+}
+
+func (fs FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	_, err := fs.ofs.CreateDirFullPath(cleanPath(name))
+	return osError(err)
+}
+
+func (fs FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (xwebdav.File, error) {
+	name = cleanPath(name)
+
+	id, err := fs.ofs.FindNodeFullPath(name)
+	if err == nil {
+		if isdir, err := fs.ofs.IsDir(id); err != nil {
+			return nil, osError(err)
+		} else if isdir {
+			if fl.IsWriteAllowed(flag) {
+				return nil, syscall.EISDIR
+			}
+			if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+				return nil, syscall.EEXIST
+			}
+			return &DirFile{fs: fs.ofs, name: name, id: id}, nil
+		}
+	} else if osError(err) != syscall.ENOENT {
+		return nil, osError(err)
+	}
+
+	if flag&os.O_TRUNC != 0 && fl.IsWriteAllowed(flag) {
+		if err != nil && flag&os.O_CREATE == 0 {
+			return nil, osError(err)
+		}
+		if err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, syscall.EEXIST
+		}
+		return fs.openReplacement(name, flag)
+	}
+
+	fh, err := fs.ofs.OpenFileFullPath(name, flag&fl.O_VALIDMASK, perm)
+	if err != nil {
+		return nil, osError(err)
+	}
+	return newFile(fs.ofs, fh, name, flag), nil
+}
+
+// openReplacement opens a temporary file for a truncating open, which replaces the file on Close.
+func (fs FileSystem) openReplacement(name string, flag int) (xwebdav.File, error) {
+	rep, err := fs.ofs.BeginReplaceFullPath(name)
+	if err != nil {
+		return nil, osError(err)
+	}
+	fh, err := fs.ofs.OpenFile(rep.ID(), fl.O_RDWR)
+	if err != nil {
+		rep.Abort()
+		return nil, osError(err)
+	}
+	f := newFile(fs.ofs, fh, name, flag)
+	f.rep = rep
+	return f, nil
+}
+
+// RemoveAll removes the file, or the directory with everything it contains.
+func (fs FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = cleanPath(name)
+	if name == "/" {
+		return syscall.EPERM
+	}
+	err := osError(fs.ofs.RemoveAllFullPath(name))
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+func (fs FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return osError(fs.ofs.RenameFullPath(cleanPath(oldName), cleanPath(newName)))
+}
+
+func (fs FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = cleanPath(name)
+	id, err := fs.ofs.FindNodeFullPath(name)
+	if err != nil {
+		return nil, osError(err)
+	}
+	return stat(fs.ofs, name, id)
+}
@@ -0,0 +1,212 @@
+package webdav_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/nyaxt/otaru"
+	fl "github.com/nyaxt/otaru/flags"
+	"github.com/nyaxt/otaru/inodedb"
+	. "github.com/nyaxt/otaru/testutils"
+	"github.com/nyaxt/otaru/webdav"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *otaru.FileSystem) {
+	fs := TestFileSystem()
+	return httptest.NewServer(webdav.NewHandler(fs, "/dav")), fs
+}
+
+func do(t *testing.T, method, url, body string, hdr map[string]string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestWebDAV(t *testing.T) {
+	ts, fs := newTestServer(t)
+	defer ts.Close()
+	dav := ts.URL + "/dav"
+
+	if code, _ := do(t, "MKCOL", dav+"/dir", "", nil); code != http.StatusCreated {
+		t.Errorf("MKCOL: %d", code)
+	}
+	if code, _ := do(t, "MKCOL", dav+"/nonexistent/dir", "", nil); code != http.StatusConflict {
+		t.Errorf("MKCOL without parent: %d, expected 409", code)
+	}
+	if code, _ := do(t, "PUT", dav+"/dir/hello.txt", "hello world!", nil); code != http.StatusCreated {
+		t.Errorf("PUT: %d", code)
+	}
+	if code, _ := do(t, "PUT", dav+"/dir/hello.txt", "hello otaru", nil); code != http.StatusCreated {
+		t.Errorf("PUT replace: %d", code)
+	}
+
+	code, body := do(t, "GET", dav+"/dir/hello.txt", "", nil)
+	if code != http.StatusOK || body != "hello otaru" {
+		t.Errorf("GET: %d %q", code, body)
+	}
+	code, body = do(t, "GET", dav+"/dir/hello.txt", "", map[string]string{"Range": "bytes=0-4"})
+	if code != http.StatusPartialContent || body != "hello" {
+		t.Errorf("ranged GET: %d %q", code, body)
+	}
+
+	code, body = do(t, "PROPFIND", dav+"/dir/", "", map[string]string{"Depth": "1"})
+	if code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND: %d", code)
+	}
+	if !strings.Contains(body, "/dav/dir/hello.txt") || !strings.Contains(body, "<D:getcontentlength>11</D:getcontentlength>") {
+		t.Errorf("PROPFIND result doesn't list hello.txt: %s", body)
+	}
+
+	lockbody := `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	if code, _ := do(t, "LOCK", dav+"/dir/hello.txt", lockbody, nil); code != http.StatusOK {
+		t.Errorf("LOCK: %d", code)
+	}
+	if code, _ := do(t, "PUT", dav+"/dir/hello.txt", "overwrite", nil); code != http.StatusLocked {
+		t.Errorf("PUT to locked file: %d, expected 423", code)
+	}
+
+	if code, _ := do(t, "MOVE", dav+"/dir", "", map[string]string{"Destination": dav + "/moved"}); code != http.StatusCreated {
+		t.Errorf("MOVE: %d", code)
+	}
+	if _, err := fs.FindNodeFullPath("/moved/hello.txt"); err != nil {
+		t.Errorf("Moved file not found: %v", err)
+	}
+
+	if code, _ := do(t, "DELETE", dav+"/moved", "", nil); code != http.StatusNoContent {
+		t.Errorf("DELETE: %d", code)
+	}
+	if code, _ := do(t, "GET", dav+"/moved/hello.txt", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET deleted: %d, expected 404", code)
+	}
+	entries, err := fs.DirEntries(inodedb.RootDirID)
+	if err != nil {
+		t.Fatalf("DirEntries failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Unexpected entries left: %v", entries)
+	}
+}
+
+func etag(t *testing.T, url string) string {
+	resp, err := http.Head(url)
+	if err != nil {
+		t.Fatalf("HEAD %s failed: %v", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD %s: %d", url, resp.StatusCode)
+	}
+	return resp.Header.Get("ETag")
+}
+
+func TestWebDAV_ETag(t *testing.T) {
+	ts, fs := newTestServer(t)
+	defer ts.Close()
+	url := ts.URL + "/dav/hello.txt"
+
+	if code, _ := do(t, "PUT", url, "hello world!", nil); code != http.StatusCreated {
+		t.Fatalf("PUT: %d", code)
+	}
+	etag1 := etag(t, url)
+	if etag1 == "" {
+		t.Fatalf("No ETag returned")
+	}
+	if etag(t, url) != etag1 {
+		t.Errorf("ETag changed without writes")
+	}
+
+	// Overwrite in place with the same length, which doesn't change the chunks array.
+	fh, err := fs.OpenFileFullPath("/hello.txt", fl.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath failed: %v", err)
+	}
+	if err := fh.PWrite(0, []byte("HELLO")); err != nil {
+		t.Fatalf("PWrite failed: %v", err)
+	}
+	if err := fh.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	fh.Close()
+	etag2 := etag(t, url)
+	if etag2 == etag1 {
+		t.Errorf("ETag unchanged after in-place write: %s", etag2)
+	}
+
+	if code, _ := do(t, "PUT", url, "hello otaru!", nil); code != http.StatusCreated {
+		t.Fatalf("PUT replace: %d", code)
+	}
+	if etag3 := etag(t, url); etag3 == etag2 {
+		t.Errorf("ETag unchanged after PUT: %s", etag3)
+	}
+}
+
+type failingReader struct{ r io.Reader }
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestFileSystem_InterruptedPutKeepsOldContent(t *testing.T) {
+	ts, fs := newTestServer(t)
+	defer ts.Close()
+	if _, err := fs.WriteFileFullPath("/hello.txt", strings.NewReader("hello world!")); err != nil {
+		t.Fatalf("WriteFileFullPath failed: %v", err)
+	}
+
+	dfs := webdav.NewFileSystem(fs)
+	ctx := context.Background()
+	f, err := dfs.OpenFile(ctx, "/hello.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := io.Copy(f, failingReader{strings.NewReader("partial")}); err == nil {
+		t.Fatalf("Copy unexpectedly succeeded")
+	}
+	if err := f.Close(); err == nil {
+		t.Errorf("Close of interrupted write succeeded")
+	}
+
+	h, err := fs.OpenFileFullPath("/hello.txt", fl.O_RDONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFileFullPath failed: %v", err)
+	}
+	b, err := ioutil.ReadAll(otaru.NewFileHandleIO(h))
+	h.Close()
+	if err != nil || string(b) != "hello world!" {
+		t.Errorf("Unexpected content after interrupted write: %q, %v", b, err)
+	}
+	entries, err := fs.DirEntries(inodedb.RootDirID)
+	if err != nil {
+		t.Fatalf("DirEntries failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Unexpected entries left: %v", entries)
+	}
+}
@@ -0,0 +1,27 @@
+package webdav
+
+import (
+	"log"
+	"net/http"
+
+	xwebdav "golang.org/x/net/webdav"
+
+	"github.com/nyaxt/otaru"
+)
+
+// DefaultPrefix is the path the WebDAV handler is mounted at on the mgmt server.
+const DefaultPrefix = "/webdav"
+
+// NewHandler returns a WebDAV handler serving ofs under the URL path prefix. Locks are kept in memory, and are lost on restart.
+func NewHandler(ofs *otaru.FileSystem, prefix string) http.Handler {
+	return &xwebdav.Handler{
+		Prefix:     prefix,
+		FileSystem: NewFileSystem(ofs),
+		LockSystem: xwebdav.NewMemLS(),
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				log.Printf("webdav %s %s: %v", req.Method, req.URL.Path, err)
+			}
+		},
+	}
+}
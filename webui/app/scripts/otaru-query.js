@@ -39,7 +39,8 @@ class OtaruQuery {
       this.timer = null;
     }
     if (this.shouldFetch) {
-      let f = fetch(this.endpointURL).catch(this._onError.bind(this))
+      // Send basic auth credentials the browser has for the mgmt server.
+      let f = fetch(this.endpointURL, {credentials: 'include'}).catch(this._onError.bind(this))
       if (this.text) {
         f = f.then((res) => {
           if (res === undefined) return;